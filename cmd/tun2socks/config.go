@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Flags not configurable in a config file.
+var nonConfigFlags = map[string]bool{
+	"config":     true,
+	"dumpConfig": true,
+	"version":    true,
+}
+
+// Flags holding credentials, their values are redacted by dumpConfig.
+var credentialFlags = map[string]bool{
+	"proxyPassword": true,
+}
+
+// Flags holding comma separated addresses which may be URLs carrying
+// credentials, passwords in them are redacted by dumpConfig.
+var urlFlags = map[string]bool{
+	"proxyServer": true,
+	"dnsUpstream": true,
+}
+
+// redacted replaces credentials in dumped configurations.
+const redacted = "xxxxx"
+
+// Flags given on the command line, recorded when the config file is first
+// loaded as flags set from the file are indistinguishable afterwards.
+var setOnCmdline map[string]bool
+
+// configValidators check values of flags with a fixed set of valid values,
+// so that mistakes are reported with the key in the config file.
+var configValidators = map[string]func(string) error{
+	"proxyType": func(v string) error {
+		if !isProxyType(v) {
+			return fmt.Errorf("unsupported proxy type %q", v)
+		}
+		return nil
+	},
+	"icmpMode":       oneOf("local", "drop", "forward"),
+	"udpSessionMode": oneOf("fullcone", "symmetric"),
+	"loglevel":       oneOf("debug", "info", "warn", "error", "none"),
+	"groupPolicy":    oneOf("priority", "round-robin", "least-latency", "consistent-hash"),
+}
+
+func oneOf(values ...string) func(string) error {
+	return func(v string) error {
+		for _, value := range values {
+			if strings.ToLower(v) == value {
+				return nil
+			}
+		}
+		return fmt.Errorf("%q is not one of %s", v, strings.Join(values, ", "))
+	}
+}
+
+// loadConfig sets flags not given on the command line from the config file
+// at path, the format is detected from the extension (.yaml, .yml, .json or
+// .toml).
+//
+// Keys are flag names. A key whose value is a table is a section, keys in
+// a section are prefixed with the section name, for example
+//
+//	tun:
+//	  name: tun1
+//	  routes: [0.0.0.0/1, 128.0.0.0/1]
+//
+// sets -tunName and -tunRoutes, keys which are full flag names are also
+// accepted in a section. Lists are joined with commas.
+//
+// Flags not given on the command line are reset to their defaults first, so
+// that keys removed from the file take no effect when it is loaded again.
+func loadConfig(path string) error {
+	values, err := readConfig(path)
+	if err != nil {
+		return err
+	}
+
+	if setOnCmdline == nil {
+		setOnCmdline = make(map[string]bool)
+		flag.Visit(func(f *flag.Flag) {
+			setOnCmdline[f.Name] = true
+		})
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		if !setOnCmdline[f.Name] && !nonConfigFlags[f.Name] {
+			flag.Set(f.Name, f.DefValue)
+		}
+	})
+
+	err = applyConfig(values, "", "", func(key, name, value string) error {
+		if setOnCmdline[name] {
+			return nil
+		}
+		if validate, ok := configValidators[name]; ok {
+			if err := validate(value); err != nil {
+				return fmt.Errorf("%s: %v", key, err)
+			}
+		}
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("%s: invalid value %q: %v", key, value, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+func readConfig(path string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]interface{})
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &values)
+	case ".json":
+		err = json.Unmarshal(data, &values)
+	case ".toml":
+		err = toml.Unmarshal(data, &values)
+	default:
+		return nil, fmt.Errorf("%s: unsupported config file format, use .yaml, .json or .toml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return values, nil
+}
+
+// applyConfig calls set with the dotted key, the flag name and the string
+// value of each value in values, section is the name of the section values
+// are in and prefix its dotted key.
+func applyConfig(values map[string]interface{}, section, prefix string, set func(key, name, value string) error) error {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		key := prefix + k
+		v := values[k]
+		if sub, ok := v.(map[string]interface{}); ok {
+			if section != "" {
+				return fmt.Errorf("%s: sections can not be nested", key)
+			}
+			if err := applyConfig(sub, k, key+".", set); err != nil {
+				return err
+			}
+			continue
+		}
+
+		name := configFlagName(section, k)
+		if name == "" {
+			return fmt.Errorf("%s: unknown key", key)
+		}
+		value, err := configValue(v)
+		if err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+		if err := set(key, name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// configFlagName returns the name of the flag set by key in section, or an
+// empty string if there is no such flag.
+func configFlagName(section, key string) string {
+	var names []string
+	if section != "" && key != "" {
+		names = append(names, section+strings.ToUpper(key[:1])+key[1:])
+	}
+	names = append(names, key)
+	for _, name := range names {
+		if !nonConfigFlags[name] && flag.Lookup(name) != nil {
+			return name
+		}
+	}
+	return ""
+}
+
+func configValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case uint64:
+		return strconv.FormatUint(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			s, err := configValue(item)
+			if err != nil {
+				return "", err
+			}
+			if strings.Contains(s, ",") {
+				return "", errors.New("list items can not contain commas")
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, ","), nil
+	case nil:
+		return "", nil
+	default:
+		return "", fmt.Errorf("unsupported value type %T", v)
+	}
+}
+
+// dumpConfig writes the effective configuration as YAML, it can be used as
+// a config file once redacted credentials are filled in.
+func dumpConfig(w io.Writer) error {
+	values := make(map[string]interface{})
+	flag.VisitAll(func(f *flag.Flag) {
+		if nonConfigFlags[f.Name] {
+			return
+		}
+		v := f.Value.(flag.Getter).Get()
+		if d, ok := v.(time.Duration); ok {
+			v = d.String()
+		}
+		if s, ok := v.(string); ok {
+			v = redactCredentials(f.Name, s)
+		}
+		values[f.Name] = v
+	})
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(values); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// redactCredentials returns the value of flag name with credentials
+// replaced.
+func redactCredentials(name, value string) string {
+	if credentialFlags[name] && value != "" {
+		return redacted
+	}
+	if !urlFlags[name] {
+		return value
+	}
+	items := strings.Split(value, ",")
+	for i, item := range items {
+		if !strings.Contains(item, "://") {
+			continue
+		}
+		u, err := url.Parse(item)
+		if err != nil {
+			// The URL may be mangled anywhere, keep only its scheme.
+			items[i] = item[:strings.Index(item, "://")+3] + redacted
+			continue
+		}
+		if u.User != nil {
+			// User names are redacted too, some schemes carry keys in them.
+			u.User = url.User(redacted)
+			items[i] = u.String()
+		}
+	}
+	return strings.Join(items, ",")
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+// startControlServer serves the control API on addr, which is either a Unix
+// socket path prefixed with "unix:" or a loopback TCP address.
+//
+//	GET /conns           lists sessions of the stack
+//	DELETE /conns/{id}   aborts a TCP session or closes a UDP session
+//	POST /reload         reloads the config file and handlers like SIGHUP
+//
+// The API is not authenticated, the Unix socket is only accessible by its
+// owner and should be preferred, any local user can reach a TCP address.
+func startControlServer(addr string) {
+	l, err := controlListener(addr)
+	if err != nil {
+		log.Fatalf("failed to listen for the control API: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /conns", func(w http.ResponseWriter, req *http.Request) {
+		conns := core.Conns()
+		if conns == nil {
+			conns = []core.ConnInfo{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(conns)
+	})
+	mux.HandleFunc("DELETE /conns/{id}", func(w http.ResponseWriter, req *http.Request) {
+		if err := core.CloseConn(req.PathValue("id")); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("POST /reload", func(w http.ResponseWriter, req *http.Request) {
+		if err := reload(); err != nil {
+			log.Errorf("failed to reload: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Infof("reloaded")
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			log.Fatalf("failed to serve the control API: %v", err)
+		}
+	}()
+}
+
+func controlListener(addr string) (net.Listener, error) {
+	if strings.HasPrefix(addr, "unix:") {
+		path := strings.TrimPrefix(addr, "unix:")
+		os.Remove(path) // Remove the socket left by a previous run.
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Chmod(path, 0600); err != nil {
+			l.Close()
+			return nil, err
+		}
+		return l, nil
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("control API address %v is not a loopback address", addr)
+	}
+	return net.Listen("tcp", addr)
+}
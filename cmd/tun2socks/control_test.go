@@ -0,0 +1,34 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestControlListener(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:0", "[::1]:0", "localhost:0"} {
+		l, err := controlListener(addr)
+		if err != nil {
+			t.Errorf("%v: %v", addr, err)
+			continue
+		}
+		l.Close()
+	}
+	for _, addr := range []string{":0", "0.0.0.0:0", "[::]:0", "192.0.2.1:0", "example.com:0", "127.0.0.1"} {
+		if l, err := controlListener(addr); err == nil {
+			l.Close()
+			t.Errorf("%v: no error", addr)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "control.sock")
+	l, err := controlListener("unix:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("unexpected socket mode %v, %v", fi.Mode(), err)
+	}
+}
@@ -0,0 +1,22 @@
+// +build direct
+
+package main
+
+import (
+	"github.com/eycorsican/go-tun2socks/proxy/direct"
+)
+
+func init() {
+	args.addFlag(fUdpTimeout)
+	args.addFlag(fDirect)
+
+	registerHandlerCreater("direct", func(h *handlers) error {
+		opts, err := args.directOptions()
+		if err != nil {
+			return err
+		}
+		h.tcp = direct.NewTCPHandler(opts)
+		h.udp = direct.NewUDPHandler(opts, *args.UdpTimeout)
+		return nil
+	})
+}
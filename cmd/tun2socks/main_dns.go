@@ -0,0 +1,84 @@
+// +build dns
+
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/eycorsican/go-tun2socks/core"
+	"github.com/eycorsican/go-tun2socks/proxy/direct"
+	"github.com/eycorsican/go-tun2socks/proxy/dns"
+)
+
+func init() {
+	args.addFlag(fDirect)
+	args.DnsUpstream = flag.String("dnsUpstream", "", "Answer DNS queries with a cache and forward cache misses to this server (udp://ip:port sent directly from sockets set up like direct connections, tcp://host:port, tls://host:port or an https:// URL through the proxy handler)")
+	args.DnsCacheSize = flag.Int("dnsCacheSize", 1024, "Number of DNS responses cached, 0 disables the cache")
+
+	registerHandlerCreater("dns", func(h *handlers) error {
+		opts, err := args.directOptions()
+		if err != nil {
+			return err
+		}
+		upstream, err := dnsUpstream(*args.DnsUpstream, h.tcp, opts)
+		if err != nil {
+			return err
+		}
+		h.udp = dns.NewUDPHandler(h.udp, upstream, *args.DnsCacheSize)
+		return nil
+	})
+}
+
+// dnsUpstream creates the upstream of a -dnsUpstream value, upstreams over
+// TCP connect through h. A bare host:port stands for a UDP server.
+//
+// UDP queries and the lookups of upstream host names are sent from sockets
+// set up by opts: with the default route on TUN they would otherwise be
+// routed back into the stack and wait for the very upstream being resolved.
+func dnsUpstream(server string, h core.TCPConnHandler, opts *direct.Options) (dns.Upstream, error) {
+	if !strings.Contains(server, "://") {
+		server = "udp://" + server
+	}
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DNS upstream URL: %v", err)
+	}
+	host := u.Host
+	if u.Port() == "" {
+		port := "53"
+		switch u.Scheme {
+		case "tls":
+			port = "853"
+		case "https":
+			port = "443"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	if u.Scheme != "udp" && h == nil {
+		return nil, fmt.Errorf("DNS upstream %v requires a TCP handler", server)
+	}
+	// The system resolver is kept unless sockets need to be set up, the
+	// pure Go one replacing it doesn't know all platform settings.
+	var resolver *net.Resolver
+	if opts.Interface != "" || opts.SourceAddr != nil || opts.Mark != 0 {
+		resolver = &net.Resolver{PreferGo: true, Dial: opts.DialContext}
+	}
+	switch u.Scheme {
+	case "udp":
+		return dns.NewUDPUpstream(host, opts.DialContext), nil
+	case "tcp":
+		return dns.NewTCPUpstream(host, dns.HandlerDialer(h, resolver)), nil
+	case "tls":
+		return dns.NewTLSUpstream(host, dns.HandlerDialer(h, resolver), &tls.Config{ServerName: u.Hostname()}), nil
+	case "https":
+		return dns.NewHTTPSUpstream(u.String(), dns.HandlerDialer(h, resolver), &tls.Config{ServerName: u.Hostname()}), nil
+	default:
+		return nil, fmt.Errorf("unsupported DNS upstream URL scheme: %v", u.Scheme)
+	}
+}
@@ -3,7 +3,8 @@
 package main
 
 import (
-	"github.com/eycorsican/go-tun2socks/core"
+	"strings"
+
 	"github.com/eycorsican/go-tun2socks/proxy/redirect"
 )
 
@@ -11,8 +12,13 @@ func init() {
 	args.addFlag(fProxyServer)
 	args.addFlag(fUdpTimeout)
 
-	registerHandlerCreater("redirect", func() {
-		core.RegisterTCPConnHandler(redirect.NewTCPHandler(*args.ProxyServer))
-		core.RegisterUDPConnHandler(redirect.NewUDPHandler(*args.ProxyServer, *args.UdpTimeout))
+	registerHandlerCreater("redirect", func(h *handlers) error {
+		h.tcp = redirect.NewTCPHandler(*args.ProxyServer)
+		if strings.ToLower(*args.UdpSessionMode) == "symmetric" {
+			h.udp = redirect.NewSymmetricUDPHandler(*args.ProxyServer, *args.UdpTimeout)
+		} else {
+			h.udp = redirect.NewUDPHandler(*args.ProxyServer, *args.UdpTimeout)
+		}
+		return nil
 	})
 }
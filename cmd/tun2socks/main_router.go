@@ -0,0 +1,85 @@
+// +build router
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/net/proxy"
+
+	"github.com/eycorsican/go-tun2socks/core"
+	"github.com/eycorsican/go-tun2socks/proxy/direct"
+	"github.com/eycorsican/go-tun2socks/proxy/http"
+	"github.com/eycorsican/go-tun2socks/proxy/redirect"
+	"github.com/eycorsican/go-tun2socks/proxy/router"
+	"github.com/eycorsican/go-tun2socks/proxy/socks"
+)
+
+func init() {
+	args.addFlag(fUdpTimeout)
+	args.addFlag(fDirect)
+	args.RouterRules = flag.String("routerRules", "", "Rules file of the router handler")
+
+	registerHandlerCreater("router", func(h *handlers) error {
+		cfg, err := router.LoadConfig(*args.RouterRules)
+		if err != nil {
+			return fmt.Errorf("failed to load router rules: %v", err)
+		}
+
+		tcpHandlers := make(map[string]core.TCPConnHandler, len(cfg.Upstreams)+1)
+		udpHandlers := make(map[string]core.UDPConnHandler, len(cfg.Upstreams)+1)
+		directOpts, err := args.directOptions()
+		if err != nil {
+			return err
+		}
+		tcpHandlers[router.ActionDirect] = direct.NewTCPHandler(directOpts)
+		udpHandlers[router.ActionDirect] = direct.NewUDPHandler(directOpts, *args.UdpTimeout)
+		for _, u := range cfg.Upstreams {
+			tcpHandlers[u.Name], udpHandlers[u.Name], err = newUpstreamHandlers(u, *args.UdpTimeout)
+			if err != nil {
+				return err
+			}
+		}
+
+		r, err := router.NewRouter(cfg, tcpHandlers, udpHandlers, *args.UdpTimeout)
+		if err != nil {
+			return fmt.Errorf("failed to create router: %v", err)
+		}
+		if fakeDns != nil {
+			r.SetDomainLookup(func(ip net.IP) (string, bool) {
+				domain := fakeDns.QueryDomain(ip)
+				return domain, domain != ""
+			})
+		}
+		h.tcp, h.udp = r, r
+		return nil
+	})
+}
+
+func newUpstreamHandlers(u *router.Upstream, udpTimeout time.Duration) (core.TCPConnHandler, core.UDPConnHandler, error) {
+	var auth *proxy.Auth
+	if u.User != "" {
+		auth = &proxy.Auth{User: u.User, Password: u.Password}
+	}
+
+	switch u.Type {
+	case "socks":
+		proxyAddr, err := net.ResolveTCPAddr("tcp", u.Address)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid address of upstream %v: %v", u.Name, err)
+		}
+		proxyHost := proxyAddr.IP.String()
+		proxyPort := uint16(proxyAddr.Port)
+		return socks.NewTCPHandlerWithFakeDns(proxyHost, proxyPort, auth, fakeDns),
+			socks.NewUDPHandlerWithFakeDns(proxyHost, proxyPort, udpTimeout, auth, fakeDns), nil
+	case "http":
+		return http.NewTCPHandler(u.Address, auth, nil), http.NewUDPHandler(), nil
+	case "redirect":
+		return redirect.NewTCPHandler(u.Address), redirect.NewUDPHandler(u.Address, udpTimeout), nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported type of upstream %v: %v", u.Name, u.Type)
+	}
+}
@@ -0,0 +1,83 @@
+// +build shadowsocks
+
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/eycorsican/go-tun2socks/proxy/shadowsocks"
+)
+
+func init() {
+	args.addFlag(fProxyServer)
+	args.addFlag(fUdpTimeout)
+	args.addFlag(fProxyAuth)
+	args.SSMethod = flag.String("ssMethod", "", "Shadowsocks method (chacha20-ietf-poly1305 by default), the password is given with -proxyPassword, or the base64 encoded key for 2022-blake3 methods")
+
+	registerHandlerCreater("shadowsocks", func(h *handlers) error {
+		// The proxy server can be given as a SIP002 URL carrying the method
+		// and the password, e.g. ss://base64(method:password)@host:port,
+		// explicit flags take precedence.
+		server := *args.ProxyServer
+		method := shadowsocks.MethodChacha20Poly1305
+		var password string
+		if strings.Contains(server, "://") {
+			u, err := url.Parse(server)
+			if err != nil {
+				return fmt.Errorf("invalid proxy server URL: %v", err)
+			}
+			if u.Scheme != "ss" {
+				return fmt.Errorf("unsupported proxy server URL scheme: %v", u.Scheme)
+			}
+			server = u.Host
+			if u.User != nil {
+				m, p, err := parseSSUserInfo(u.User)
+				if err != nil {
+					return err
+				}
+				method, password = m, p
+			}
+		}
+		if *args.SSMethod != "" {
+			method = *args.SSMethod
+		}
+		if *args.ProxyPassword != "" {
+			password = *args.ProxyPassword
+		}
+
+		// Verify proxy server address.
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			return fmt.Errorf("invalid proxy server address: %v", err)
+		}
+		c, err := shadowsocks.NewCipher(method, password)
+		if err != nil {
+			return err
+		}
+
+		h.tcp = shadowsocks.NewTCPHandler(server, c)
+		h.udp = shadowsocks.NewUDPHandler(server, c, *args.UdpTimeout)
+		return nil
+	})
+}
+
+// parseSSUserInfo returns the method and the password of a SIP002 URL, the
+// user info is either method:password or its base64url encoding.
+func parseSSUserInfo(user *url.Userinfo) (string, string, error) {
+	if password, ok := user.Password(); ok {
+		return user.Username(), password, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(user.Username(), "="))
+	if err != nil {
+		return "", "", fmt.Errorf("invalid shadowsocks user info: %v", err)
+	}
+	method, password, ok := strings.Cut(string(b), ":")
+	if !ok {
+		return "", "", fmt.Errorf("invalid shadowsocks user info: missing password")
+	}
+	return method, password, nil
+}
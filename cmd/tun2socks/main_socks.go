@@ -3,27 +3,33 @@
 package main
 
 import (
+	"fmt"
 	"net"
 
-	"github.com/eycorsican/go-tun2socks/common/log"
-	"github.com/eycorsican/go-tun2socks/core"
 	"github.com/eycorsican/go-tun2socks/proxy/socks"
 )
 
 func init() {
 	args.addFlag(fProxyServer)
 	args.addFlag(fUdpTimeout)
+	args.addFlag(fProxyAuth)
+
+	registerHandlerCreater("socks", func(h *handlers) error {
+		server, auth, err := args.socksServer()
+		if err != nil {
+			return err
+		}
 
-	registerHandlerCreater("socks", func() {
 		// Verify proxy server address.
-		proxyAddr, err := net.ResolveTCPAddr("tcp", *args.ProxyServer)
+		proxyAddr, err := net.ResolveTCPAddr("tcp", server)
 		if err != nil {
-			log.Fatalf("invalid proxy server address: %v", err)
+			return fmt.Errorf("invalid proxy server address: %v", err)
 		}
 		proxyHost := proxyAddr.IP.String()
 		proxyPort := uint16(proxyAddr.Port)
 
-		core.RegisterTCPConnHandler(socks.NewTCPHandler(proxyHost, proxyPort))
-		core.RegisterUDPConnHandler(socks.NewUDPHandler(proxyHost, proxyPort, *args.UdpTimeout))
+		h.tcp = socks.NewTCPHandlerWithFakeDns(proxyHost, proxyPort, auth, fakeDns)
+		h.udp = socks.NewUDPHandlerWithFakeDns(proxyHost, proxyPort, *args.UdpTimeout, auth, fakeDns)
+		return nil
 	})
 }
@@ -0,0 +1,25 @@
+// +build uot
+
+package main
+
+import (
+	"flag"
+
+	"github.com/eycorsican/go-tun2socks/proxy/uot"
+)
+
+func init() {
+	args.addFlag(fProxyServer)
+	args.addFlag(fUdpTimeout)
+	args.addFlag(fProxyAuth)
+	args.UdpOverTcp = flag.String("udpOverTcp", "", "Relay UDP in TCP streams to this address through the SOCKS5 proxy server, "+uot.MagicRelay+" for servers supporting UDP-over-TCP (overrides the UDP proxy handler)")
+
+	registerHandlerCreater("uot", func(h *handlers) error {
+		server, auth, err := args.socksServer()
+		if err != nil {
+			return err
+		}
+		h.udp = uot.NewUDPHandler(server, auth, *args.UdpOverTcp, *args.UdpTimeout)
+		return nil
+	})
+}
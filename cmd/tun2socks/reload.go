@@ -0,0 +1,156 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+// Flags applied only at startup, changing them on reload has no effect.
+var restartFlags = []string{
+	"tunName", "tunAddr", "tunGw", "tunMask", "tunDns", "tunPersist", "tunRoutes", "tunIPv6", "tunOffload",
+	"mtu", "tcpWindow",
+	"blockOutsideDns", "icmpMode", "udpSessionMode",
+	"fakeDns", "fakeDnsPool", "fakeDnsIPv6Pool",
+	"metricsAddr", "controlAddr",
+	"pcap", "pcapFilter", "pcapMaxSize", "pcapMaxFiles",
+}
+
+var reloadMu sync.Mutex
+
+// registerHandlers creates the handlers of the proxy type and registers them
+// to the stack, replacing the handlers registered before. Existing
+// connections keep the handlers they were created by. The running handlers
+// are left untouched if any handler fails to be created.
+func registerHandlers() (err error) {
+	if !isProxyType(*args.ProxyType) {
+		return fmt.Errorf("unsupported proxy type %q", *args.ProxyType)
+	}
+	creater := handlerCreater[*args.ProxyType]
+	dnsFallback := args.DnsFallback != nil && *args.DnsFallback
+	fallbackCreater, found := handlerCreater["dnsfallback"]
+	if dnsFallback && !found {
+		return fmt.Errorf("DNS fallback connection handler not found, build with `dnsfallback` tag")
+	}
+	udpOverTcp := args.UdpOverTcp != nil && *args.UdpOverTcp != ""
+	if udpOverTcp && dnsFallback {
+		return fmt.Errorf("-udpOverTcp and -dnsFallback can not be used together")
+	}
+
+	h := &handlers{}
+	defer func() {
+		if err != nil {
+			for _, fn := range h.discarded {
+				fn()
+			}
+		}
+	}()
+	if err := creater(h); err != nil {
+		return err
+	}
+	if dnsFallback {
+		// Override the UDP handler with a DNS-over-TCP (fallback) UDP handler.
+		if err := fallbackCreater(h); err != nil {
+			return err
+		}
+	}
+	if udpOverTcp {
+		// Override the UDP handler with a UDP-over-TCP handler.
+		if err := handlerCreater["uot"](h); err != nil {
+			return err
+		}
+	}
+	if args.DnsUpstream != nil && *args.DnsUpstream != "" {
+		// Answer DNS queries before the UDP handler.
+		dnsCreater, found := handlerCreater["dns"]
+		if !found {
+			return fmt.Errorf("DNS connection handler not found, build with `dns` tag")
+		}
+		if err := dnsCreater(h); err != nil {
+			return err
+		}
+	}
+
+	// The stack requires both handlers once running.
+	if h.tcp == nil || h.udp == nil {
+		return fmt.Errorf("proxy type %q created no TCP or UDP handler", *args.ProxyType)
+	}
+	core.RegisterConnHandlers(h.tcp, h.udp)
+	for _, fn := range h.registered {
+		fn()
+	}
+	return nil
+}
+
+// reload re-reads the config file and recreates the TCP and UDP handlers
+// without touching the TUN device or existing connections, the running
+// handlers and flags are kept if it fails.
+func reload() (err error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	before := flagValues()
+	defer func() {
+		if err != nil {
+			for name, value := range before {
+				flag.Set(name, value)
+			}
+			setLogLevel(*args.LogLevel)
+		}
+	}()
+
+	if *args.Config != "" {
+		if err := loadConfig(*args.Config); err != nil {
+			return err
+		}
+	}
+	for _, fn := range postFlagsInitFn {
+		if fn != nil {
+			fn()
+		}
+	}
+	if err := setLogLevel(*args.LogLevel); err != nil {
+		return err
+	}
+	if err := registerHandlers(); err != nil {
+		return err
+	}
+
+	after := flagValues()
+	for _, name := range restartFlags {
+		if before[name] != after[name] {
+			log.Warnf("%v changed, restart to apply it", name)
+		}
+	}
+	return nil
+}
+
+func flagValues() map[string]string {
+	values := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		values[f.Name] = f.Value.String()
+	})
+	return values
+}
+
+func setLogLevel(level string) error {
+	switch strings.ToLower(level) {
+	case "debug":
+		log.SetLevel(log.DEBUG)
+	case "info":
+		log.SetLevel(log.INFO)
+	case "warn":
+		log.SetLevel(log.WARN)
+	case "error":
+		log.SetLevel(log.ERROR)
+	case "none":
+		log.SetLevel(log.NONE)
+	default:
+		return fmt.Errorf("unsupported logging level %q", level)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+type testTCPHandler string
+
+func (h testTCPHandler) Handle(conn net.Conn, target *net.TCPAddr) error { return nil }
+
+type testUDPHandler string
+
+func (h testUDPHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error { return nil }
+
+func (h testUDPHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr) error {
+	return nil
+}
+
+func TestReload(t *testing.T) {
+	path := writeConfig(t, "config.yaml", "proxyType: test\nproxyServer: a\n")
+	testFlags(t, "-config", path)
+
+	tcp, udp := core.RegisteredTCPConnHandler(), core.RegisteredUDPConnHandler()
+	defer core.RegisterConnHandlers(tcp, udp)
+
+	// The test handlers are named after -proxyServer, the DNS handler wraps
+	// them and fails to be created for a "bad" upstream.
+	for _, name := range []string{"test", "dns"} {
+		if creater, ok := handlerCreater[name]; ok {
+			defer func(name string) { handlerCreater[name] = creater }(name)
+		} else {
+			defer delete(handlerCreater, name)
+		}
+	}
+	// udponly creates no TCP handler.
+	for _, name := range []string{"test", "udponly"} {
+		proxyTypes[name] = true
+		defer delete(proxyTypes, name)
+	}
+	handlerCreater["udponly"] = func(h *handlers) error {
+		h.udp = testUDPHandler("udponly")
+		return nil
+	}
+	defer delete(handlerCreater, "udponly")
+	var registered, discarded []string
+	handlerCreater["test"] = func(h *handlers) error {
+		name := *args.ProxyServer
+		h.tcp, h.udp = testTCPHandler(name), testUDPHandler(name)
+		h.registered = append(h.registered, func() { registered = append(registered, name) })
+		h.discarded = append(h.discarded, func() { discarded = append(discarded, name) })
+		return nil
+	}
+	handlerCreater["dns"] = func(h *handlers) error {
+		if *args.DnsUpstream == "bad" {
+			return errors.New("bad DNS upstream")
+		}
+		h.udp = testUDPHandler("dns+" + string(h.udp.(testUDPHandler)))
+		return nil
+	}
+
+	assertHandlers := func(tcp, udp string) {
+		t.Helper()
+		if h := core.RegisteredTCPConnHandler(); h != testTCPHandler(tcp) {
+			t.Errorf("TCP handler is %v, want %v", h, tcp)
+		}
+		if h := core.RegisteredUDPConnHandler(); h != testUDPHandler(udp) {
+			t.Errorf("UDP handler is %v, want %v", h, udp)
+		}
+	}
+	writeFile := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := reload(); err != nil {
+		t.Fatal(err)
+	}
+	assertHandlers("a", "a")
+
+	writeFile("proxyType: test\nproxyServer: b\ndnsUpstream: 8.8.8.8:53\n")
+	if err := reload(); err != nil {
+		t.Fatal(err)
+	}
+	assertHandlers("b", "dns+b")
+
+	// The DNS handler fails after the test handlers are created, none of
+	// them is registered and the flags are restored.
+	writeFile("proxyType: test\nproxyServer: c\ndnsUpstream: bad\n")
+	if err := reload(); err == nil {
+		t.Fatal("no error reloading a bad DNS upstream")
+	}
+	assertHandlers("b", "dns+b")
+	if server, upstream := flagValue("proxyServer"), flagValue("dnsUpstream"); server != "b" || upstream != "8.8.8.8:53" {
+		t.Errorf("flags not restored: proxyServer %v, dnsUpstream %v", server, upstream)
+	}
+	if len(registered) != 2 || registered[1] != "b" {
+		t.Errorf("registered hooks called for %v", registered)
+	}
+	if len(discarded) != 1 || discarded[0] != "c" {
+		t.Errorf("discarded hooks called for %v", discarded)
+	}
+
+	// Wrappers are not proxy types, proxy types create both handlers.
+	for _, proxyType := range []string{"nonexistent", "dns", "udponly"} {
+		writeFile("proxyType: " + proxyType + "\n")
+		if err := reload(); err == nil {
+			t.Fatalf("no error reloading proxy type %v", proxyType)
+		}
+		assertHandlers("b", "dns+b")
+		if got := flagValue("proxyType"); got != "test" {
+			t.Errorf("proxyType not restored: %v", got)
+		}
+	}
+}
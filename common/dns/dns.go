@@ -1,3 +1,24 @@
 package dns
 
+import (
+	"net"
+)
+
 const COMMON_DNS_PORT = 53
+
+// FakeDns answers DNS queries with fake IP addresses from a reserved pool
+// and maps them back to the queried domains, so that handlers can connect
+// to domains instead of IP addresses.
+type FakeDns interface {
+	// GenerateFakeResponse returns the response to a DNS query, an error
+	// is returned if the query can not be answered with fake addresses
+	// (e.g. it's not an A/AAAA query).
+	GenerateFakeResponse(request []byte) ([]byte, error)
+
+	// QueryDomain returns the domain ip was assigned to, or "" if ip is
+	// not a fake IP or its mapping has been evicted.
+	QueryDomain(ip net.IP) string
+
+	// IsFakeIP reports whether ip belongs to the fake IP pools.
+	IsFakeIP(ip net.IP) bool
+}
@@ -0,0 +1,225 @@
+package fakedns
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/eycorsican/go-tun2socks/common/dns"
+)
+
+// Fake addresses are only valid as long as they are mapped, responses carry
+// a short TTL so that clients do not cache them for long.
+const fakeResponseTTL = 1
+
+// DefaultIPv4Pool is the benchmarking network (RFC 2544), which is unlikely
+// to be used by real hosts.
+var DefaultIPv4Pool = &net.IPNet{IP: net.IP{198, 18, 0, 0}, Mask: net.CIDRMask(15, 32)}
+
+type fakeDns struct {
+	pool4 *ipPool
+	pool6 *ipPool
+}
+
+// NewFakeDns creates a fake DNS answering A queries with addresses from
+// ipv4Pool and AAAA queries with addresses from ipv6Pool, size is the max
+// number of domains mapped per pool. AAAA queries get empty answers if
+// ipv6Pool is nil.
+func NewFakeDns(ipv4Pool, ipv6Pool *net.IPNet, size int) (dns.FakeDns, error) {
+	if ipv4Pool == nil || ipv4Pool.IP.To4() == nil {
+		return nil, errors.New("invalid IPv4 fake IP pool")
+	}
+	d := &fakeDns{}
+	var err error
+	if d.pool4, err = newIPPool(ipv4Pool, size); err != nil {
+		return nil, err
+	}
+	if ipv6Pool != nil {
+		if ipv6Pool.IP.To4() != nil {
+			return nil, errors.New("invalid IPv6 fake IP pool")
+		}
+		if d.pool6, err = newIPPool(ipv6Pool, size); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+func (d *fakeDns) GenerateFakeResponse(request []byte) ([]byte, error) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(request)
+	if err != nil {
+		return nil, err
+	}
+	if header.Response || header.OpCode != 0 {
+		return nil, errors.New("not a DNS query")
+	}
+	questions, err := parser.AllQuestions()
+	if err != nil {
+		return nil, err
+	}
+	if len(questions) != 1 {
+		return nil, errors.New("unsupported number of questions")
+	}
+	q := questions[0]
+	if q.Class != dnsmessage.ClassINET || (q.Type != dnsmessage.TypeA && q.Type != dnsmessage.TypeAAAA) {
+		return nil, fmt.Errorf("unsupported question %v %v", q.Class, q.Type)
+	}
+	domain := strings.ToLower(strings.TrimSuffix(q.Name.String(), "."))
+
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 header.ID,
+		Response:           true,
+		Authoritative:      true,
+		RecursionDesired:   header.RecursionDesired,
+		RecursionAvailable: true,
+	})
+	builder.EnableCompression()
+	if err := builder.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := builder.Question(q); err != nil {
+		return nil, err
+	}
+	if err := builder.StartAnswers(); err != nil {
+		return nil, err
+	}
+	rh := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: fakeResponseTTL}
+	switch q.Type {
+	case dnsmessage.TypeA:
+		var a dnsmessage.AResource
+		copy(a.A[:], d.pool4.assign(domain).To4())
+		err = builder.AResource(rh, a)
+	case dnsmessage.TypeAAAA:
+		if d.pool6 != nil {
+			var aaaa dnsmessage.AAAAResource
+			copy(aaaa.AAAA[:], d.pool6.assign(domain).To16())
+			err = builder.AAAAResource(rh, aaaa)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return builder.Finish()
+}
+
+func (d *fakeDns) QueryDomain(ip net.IP) string {
+	if p := d.poolOf(ip); p != nil {
+		return p.lookup(ip)
+	}
+	return ""
+}
+
+func (d *fakeDns) IsFakeIP(ip net.IP) bool {
+	return d.poolOf(ip) != nil
+}
+
+func (d *fakeDns) poolOf(ip net.IP) *ipPool {
+	if ip.To4() != nil {
+		if d.pool4.network.Contains(ip) {
+			return d.pool4
+		}
+		return nil
+	}
+	if d.pool6 != nil && d.pool6.network.Contains(ip) {
+		return d.pool6
+	}
+	return nil
+}
+
+// ipPool assigns addresses of a network to domains, the least recently used
+// mapping is reassigned once all addresses are in use.
+type ipPool struct {
+	sync.Mutex
+
+	network *net.IPNet
+	next    uint32 // Offset of the next never assigned address.
+	size    uint32 // Number of assignable addresses.
+
+	ips     *lru.Cache[string, string] // Address to domain.
+	domains map[string]net.IP          // Domain to address.
+}
+
+func newIPPool(network *net.IPNet, size int) (*ipPool, error) {
+	if size <= 0 {
+		return nil, errors.New("invalid fake DNS size")
+	}
+	ones, bits := network.Mask.Size()
+	hostBits := bits - ones
+	if hostBits < 2 {
+		return nil, fmt.Errorf("fake IP pool %v is too small", network)
+	}
+	// The first and the last addresses of the network are not assigned.
+	available := uint64(1)<<uint(hostBits) - 2
+	if hostBits >= 32 {
+		available = 1<<32 - 2
+	}
+	if uint64(size) > available {
+		size = int(available)
+	}
+
+	ip := network.IP.Mask(network.Mask)
+	if ip4 := ip.To4(); ip4 != nil && bits == 32 {
+		ip = ip4
+	}
+	p := &ipPool{
+		network: &net.IPNet{IP: ip, Mask: network.Mask},
+		next:    1,
+		size:    uint32(size),
+		domains: make(map[string]net.IP, size),
+	}
+	// Evicted addresses are forgotten by their domains as well.
+	p.ips, _ = lru.NewWithEvict(size, func(ip string, domain string) {
+		delete(p.domains, domain)
+	})
+	return p, nil
+}
+
+// assign returns the address of domain, assigning one if needed.
+func (p *ipPool) assign(domain string) net.IP {
+	p.Lock()
+	defer p.Unlock()
+
+	if ip, ok := p.domains[domain]; ok {
+		p.ips.Get(ip.String()) // Mark as recently used.
+		return ip
+	}
+
+	var ip net.IP
+	if p.next <= p.size {
+		ip = p.offset(p.next)
+		p.next++
+	} else {
+		oldIP, _, _ := p.ips.RemoveOldest()
+		ip = net.ParseIP(oldIP)
+		if ip4 := ip.To4(); ip4 != nil && len(p.network.IP) == net.IPv4len {
+			ip = ip4
+		}
+	}
+	p.domains[domain] = ip
+	p.ips.Add(ip.String(), domain)
+	return ip
+}
+
+func (p *ipPool) lookup(ip net.IP) string {
+	p.Lock()
+	defer p.Unlock()
+
+	domain, _ := p.ips.Get(ip.String())
+	return domain
+}
+
+// offset returns the address at offset n in the network.
+func (p *ipPool) offset(n uint32) net.IP {
+	ip := make(net.IP, len(p.network.IP))
+	copy(ip, p.network.IP)
+	tail := ip[len(ip)-4:]
+	binary.BigEndian.PutUint32(tail, binary.BigEndian.Uint32(tail)+n)
+	return ip
+}
@@ -0,0 +1,136 @@
+package fakedns
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestIPPool(t *testing.T) {
+	_, network, _ := net.ParseCIDR("10.0.0.0/29")
+	p, err := newIPPool(network, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assign := func(domain, want string) {
+		t.Helper()
+		if ip := p.assign(domain); ip.String() != want || len(ip) != net.IPv4len {
+			t.Errorf("%v assigned %v, want %v", domain, ip, want)
+		}
+	}
+	assign("a", "10.0.0.1")
+	assign("b", "10.0.0.2")
+	assign("c", "10.0.0.3")
+	assign("a", "10.0.0.1")
+	// The pool is full, the least recently used address is reassigned.
+	assign("d", "10.0.0.2")
+	if domain := p.lookup(net.ParseIP("10.0.0.2")); domain != "d" {
+		t.Errorf("10.0.0.2 maps to %q", domain)
+	}
+	assign("b", "10.0.0.3")
+	if domain := p.lookup(net.ParseIP("10.0.0.3")); domain != "b" {
+		t.Errorf("10.0.0.3 maps to %q", domain)
+	}
+	if domain := p.lookup(net.ParseIP("10.0.0.4")); domain != "" {
+		t.Errorf("unassigned address maps to %q", domain)
+	}
+}
+
+func TestIPPoolSize(t *testing.T) {
+	// The network and broadcast addresses are never assigned.
+	_, network, _ := net.ParseCIDR("10.0.0.0/30")
+	p, err := newIPPool(network, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.1", "10.0.0.2"} {
+		if ip := p.assign(string(rune('a' + i))); ip.String() != want {
+			t.Errorf("assigned %v, want %v", ip, want)
+		}
+	}
+
+	_, network, _ = net.ParseCIDR("fd00::/120")
+	if p, err = newIPPool(network, 10); err != nil {
+		t.Fatal(err)
+	}
+	if ip := p.assign("a"); ip.String() != "fd00::1" {
+		t.Errorf("assigned %v", ip)
+	}
+
+	_, network, _ = net.ParseCIDR("10.0.0.0/31")
+	if _, err := newIPPool(network, 10); err == nil {
+		t.Error("pool too small accepted")
+	}
+	if _, err := newIPPool(DefaultIPv4Pool, 0); err == nil {
+		t.Error("empty pool accepted")
+	}
+}
+
+func query(t *testing.T, name string, qtype dnsmessage.Type) []byte {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 42, RecursionDesired: true})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET})
+	msg, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestGenerateFakeResponse(t *testing.T) {
+	_, pool6, _ := net.ParseCIDR("fd00::/64")
+	d, err := NewFakeDns(DefaultIPv4Pool, pool6, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		resp, err := d.GenerateFakeResponse(query(t, "WWW.Example.com.", qtype))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var msg dnsmessage.Message
+		if err := msg.Unpack(resp); err != nil {
+			t.Fatal(err)
+		}
+		if msg.ID != 42 || !msg.Response || len(msg.Answers) != 1 || msg.Answers[0].Header.TTL != fakeResponseTTL {
+			t.Fatalf("unexpected response %+v", msg)
+		}
+		var ip net.IP
+		switch r := msg.Answers[0].Body.(type) {
+		case *dnsmessage.AResource:
+			ip = r.A[:]
+		case *dnsmessage.AAAAResource:
+			ip = r.AAAA[:]
+		}
+		if !d.IsFakeIP(ip) || d.QueryDomain(ip) != "www.example.com" {
+			t.Errorf("%v maps to %q", ip, d.QueryDomain(ip))
+		}
+	}
+	if d.IsFakeIP(net.IPv4(8, 8, 8, 8)) || d.IsFakeIP(net.ParseIP("fd01::1")) {
+		t.Error("real address is fake")
+	}
+
+	// AAAA queries get empty answers without an IPv6 pool.
+	d, err = NewFakeDns(DefaultIPv4Pool, nil, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := d.GenerateFakeResponse(query(t, "example.com.", dnsmessage.TypeAAAA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil || len(msg.Answers) != 0 {
+		t.Errorf("unexpected response %+v, %v", msg, err)
+	}
+
+	for _, req := range [][]byte{
+		query(t, "example.com.", dnsmessage.TypeMX),
+		{0, 1, 2},
+	} {
+		if _, err := d.GenerateFakeResponse(req); err == nil {
+			t.Errorf("%x: no error", req)
+		}
+	}
+}
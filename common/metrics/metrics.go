@@ -0,0 +1,191 @@
+// Package metrics implements a few metric types and exposes them in the
+// Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	v uint64
+}
+
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.v, 1)
+}
+
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.v, n)
+}
+
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.v)
+}
+
+// GaugeFunc is a value computed when metrics are collected.
+type GaugeFunc func() float64
+
+// Histogram counts observations in cumulative buckets.
+type Histogram struct {
+	bounds []float64
+	counts []uint64 // One more than bounds for the +Inf bucket.
+	count  uint64
+	sum    uint64 // float64 bits
+}
+
+// NewHistogram creates a histogram with the given upper bounds of buckets,
+// in increasing order.
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.count, 1)
+	for {
+		old := atomic.LoadUint64(&h.sum)
+		sum := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&h.sum, old, sum) {
+			return
+		}
+	}
+}
+
+// ObserveDuration observes the time elapsed since start in seconds.
+func (h *Histogram) ObserveDuration(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+// DefaultDurationBuckets are bucket bounds in seconds suitable for dial
+// latencies.
+var DefaultDurationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Name returns the name of a metric of family with labels given as name and
+// value pairs, e.g. Name("foo_total", "proto", "tcp") is foo_total{proto="tcp"}.
+// Label values are escaped as the text format requires.
+func Name(family string, labels ...string) string {
+	if len(labels) < 2 {
+		return family
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+`="`+labelEscaper.Replace(labels[i+1])+`"`)
+	}
+	return family + "{" + strings.Join(pairs, ",") + "}"
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+type metric struct {
+	name   string // Name with labels, e.g. foo_total{proto="tcp"}.
+	family string
+	help   string
+	typ    string
+	value  interface{}
+}
+
+// Registry holds metrics to be exposed.
+type Registry struct {
+	sync.Mutex
+	metrics []*metric
+}
+
+// DefaultRegistry is the registry served by Handler.
+var DefaultRegistry = &Registry{}
+
+func (r *Registry) register(name, help, typ string, value interface{}) {
+	family := name
+	if i := strings.IndexByte(name, '{'); i >= 0 {
+		family = name[:i]
+	}
+	r.Lock()
+	r.metrics = append(r.metrics, &metric{name: name, family: family, help: help, typ: typ, value: value})
+	r.Unlock()
+}
+
+// RegisterCounter registers c as name, which may carry labels, see Name for
+// labels with arbitrary values. Metrics of the same family (name without
+// labels) share the help text of the first registered one.
+func (r *Registry) RegisterCounter(name, help string, c *Counter) {
+	r.register(name, help, "counter", c)
+}
+
+func (r *Registry) RegisterGauge(name, help string, g GaugeFunc) {
+	r.register(name, help, "gauge", g)
+}
+
+func (r *Registry) RegisterHistogram(name, help string, h *Histogram) {
+	r.register(name, help, "histogram", h)
+}
+
+// Write writes all metrics in the Prometheus text format.
+func (r *Registry) Write(w io.Writer) {
+	r.Lock()
+	metrics := append([]*metric(nil), r.metrics...)
+	r.Unlock()
+
+	// Samples of a family must be grouped together.
+	sort.SliceStable(metrics, func(i, j int) bool {
+		return metrics[i].family < metrics[j].family
+	})
+	family := ""
+	for _, m := range metrics {
+		if m.family != family {
+			family = m.family
+			fmt.Fprintf(w, "# HELP %s %s\n", m.family, helpEscaper.Replace(m.help))
+			fmt.Fprintf(w, "# TYPE %s %s\n", m.family, m.typ)
+		}
+		switch v := m.value.(type) {
+		case *Counter:
+			fmt.Fprintf(w, "%s %d\n", m.name, v.Value())
+		case GaugeFunc:
+			fmt.Fprintf(w, "%s %g\n", m.name, v())
+		case *Histogram:
+			writeHistogram(w, m, v)
+		}
+	}
+}
+
+func writeHistogram(w io.Writer, m *metric, h *Histogram) {
+	labels := ""
+	if i := strings.IndexByte(m.name, '{'); i >= 0 {
+		labels = strings.TrimSuffix(m.name[i+1:], "}") + ","
+	}
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		fmt.Fprintf(w, "%s_bucket{%sle=\"%g\"} %d\n", m.family, labels, bound, cumulative)
+	}
+	cumulative += atomic.LoadUint64(&h.counts[len(h.bounds)])
+	fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", m.family, labels, cumulative)
+	suffix := ""
+	if labels != "" {
+		suffix = "{" + strings.TrimSuffix(labels, ",") + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %g\n", m.family, suffix, math.Float64frombits(atomic.LoadUint64(&h.sum)))
+	fmt.Fprintf(w, "%s_count%s %d\n", m.family, suffix, atomic.LoadUint64(&h.count))
+}
+
+// Handler returns an HTTP handler serving metrics of DefaultRegistry.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		DefaultRegistry.Write(w)
+	})
+}
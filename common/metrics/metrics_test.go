@@ -0,0 +1,106 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func write(r *Registry) string {
+	var buf bytes.Buffer
+	r.Write(&buf)
+	return buf.String()
+}
+
+func TestHistogram(t *testing.T) {
+	r := &Registry{}
+	h := NewHistogram([]float64{1, 2, 5})
+	r.RegisterHistogram(`dial_seconds{proto="tcp"}`, "Dial latency.", h)
+	// Bounds are inclusive.
+	for _, v := range []float64{0.5, 1, 1.5, 5, 7.5} {
+		h.Observe(v)
+	}
+	want := `# HELP dial_seconds Dial latency.
+# TYPE dial_seconds histogram
+dial_seconds_bucket{proto="tcp",le="1"} 2
+dial_seconds_bucket{proto="tcp",le="2"} 3
+dial_seconds_bucket{proto="tcp",le="5"} 4
+dial_seconds_bucket{proto="tcp",le="+Inf"} 5
+dial_seconds_sum{proto="tcp"} 15.5
+dial_seconds_count{proto="tcp"} 5
+`
+	if got := write(r); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	r = &Registry{}
+	r.RegisterHistogram("empty_seconds", "Nothing observed.", NewHistogram([]float64{0.1}))
+	want = `# HELP empty_seconds Nothing observed.
+# TYPE empty_seconds histogram
+empty_seconds_bucket{le="0.1"} 0
+empty_seconds_bucket{le="+Inf"} 0
+empty_seconds_sum 0
+empty_seconds_count 0
+`
+	if got := write(r); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestFamilies(t *testing.T) {
+	r := &Registry{}
+	var tcp, udp, in Counter
+	tcp.Add(3)
+	udp.Inc()
+	in.Add(1500)
+	r.RegisterCounter(`sessions_total{proto="tcp"}`, "Sessions.", &tcp)
+	r.RegisterCounter("bytes_total", "Bytes.", &in)
+	r.RegisterCounter(`sessions_total{proto="udp"}`, "", &udp)
+	want := `# HELP bytes_total Bytes.
+# TYPE bytes_total counter
+bytes_total 1500
+# HELP sessions_total Sessions.
+# TYPE sessions_total counter
+sessions_total{proto="tcp"} 3
+sessions_total{proto="udp"} 1
+`
+	if got := write(r); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestGaugeFunc(t *testing.T) {
+	r := &Registry{}
+	v := 1.0
+	r.RegisterGauge("active", "Active.", func() float64 { return v })
+	if got := write(r); !strings.HasSuffix(got, "\nactive 1\n") {
+		t.Errorf("got:\n%s", got)
+	}
+	v = 2.5
+	if got := write(r); !strings.HasSuffix(got, "\nactive 2.5\n") {
+		t.Errorf("gauge not evaluated again:\n%s", got)
+	}
+}
+
+func TestEscaping(t *testing.T) {
+	tests := []struct {
+		labels []string
+		name   string
+	}{
+		{nil, "rules_total"},
+		{[]string{"rule"}, "rules_total"},
+		{[]string{"rule", "a"}, `rules_total{rule="a"}`},
+		{[]string{"rule", `"a"`, "path", `C:\b` + "\n"}, `rules_total{rule="\"a\"",path="C:\\b\n"}`},
+	}
+	for _, tt := range tests {
+		if name := Name("rules_total", tt.labels...); name != tt.name {
+			t.Errorf("Name(%q) = %v, want %v", tt.labels, name, tt.name)
+		}
+	}
+
+	r := &Registry{}
+	r.RegisterCounter("rules_total", "Rules\nmatched, see C:\\rules.", &Counter{})
+	if got := write(r); !strings.HasPrefix(got, `# HELP rules_total Rules\nmatched, see C:\\rules.`+"\n") {
+		t.Errorf("got:\n%s", got)
+	}
+}
@@ -0,0 +1,19 @@
+package packet
+
+// Direction is the direction of a packet crossing the TUN boundary.
+type Direction int
+
+const (
+	// Inbound packets are read from TUN and written to the stack.
+	Inbound Direction = iota
+
+	// Outbound packets are output by the stack to TUN.
+	Outbound
+)
+
+func (d Direction) String() string {
+	if d == Inbound {
+		return "in"
+	}
+	return "out"
+}
@@ -0,0 +1,69 @@
+// Package packet parses IP packet headers without depending on the stack,
+// so that packet taps and filters can be built without cgo.
+package packet
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// IPv6HeaderLen is the length of the fixed IPv6 header.
+const IPv6HeaderLen = 40
+
+// IPv6 extension headers walked to find the upper-layer protocol, they are
+// the ones lwIP handles (RFC 8200 section 4).
+const (
+	IPv6HopByHop = 0
+	IPv6Routing  = 43
+	IPv6Fragment = 44
+	IPv6DestOpts = 60
+
+	ipv6FragmentLen = 8
+)
+
+// WalkIPv6 walks the extension headers of an IPv6 packet and returns the
+// upper-layer protocol, the offset of its header and the Fragment header,
+// nil if there's none.
+func WalkIPv6(p []byte) (uint8, int, []byte, error) {
+	if len(p) < IPv6HeaderLen {
+		return 0, 0, nil, errors.New("short IPv6 packet")
+	}
+	next := p[6]
+	var frag []byte
+	for off := IPv6HeaderLen; ; {
+		var hdrLen int
+		switch next {
+		case IPv6HopByHop, IPv6Routing, IPv6DestOpts:
+			if len(p) < off+2 {
+				return 0, 0, nil, errors.New("short IPv6 extension header")
+			}
+			hdrLen = (int(p[off+1]) + 1) * 8
+		case IPv6Fragment:
+			hdrLen = ipv6FragmentLen
+		default:
+			return next, off, frag, nil
+		}
+		if len(p) < off+hdrLen {
+			return 0, 0, nil, errors.New("short IPv6 extension header")
+		}
+		if next == IPv6Fragment {
+			frag = p[off : off+hdrLen]
+		}
+		next = p[off]
+		off += hdrLen
+	}
+}
+
+// IPv6UpperLayer walks the extension headers of an IPv6 packet and returns
+// the upper-layer protocol and the packet from its header on, the header is
+// nil in fragments other than the first one.
+func IPv6UpperLayer(pkt []byte) (uint8, []byte, error) {
+	next, off, frag, err := WalkIPv6(pkt)
+	if err != nil {
+		return 0, nil, err
+	}
+	if frag != nil && binary.BigEndian.Uint16(frag[2:4])>>3 > 0 {
+		return next, nil, nil
+	}
+	return next, pkt[off:], nil
+}
@@ -0,0 +1,73 @@
+package packet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// ipv6 returns an IPv6 packet with the extension headers exts, whose first
+// byte is the type of the header until they are chained, followed by a UDP
+// header and payload.
+func ipv6(payload []byte, exts ...[]byte) []byte {
+	pkt := make([]byte, IPv6HeaderLen)
+	pkt[0] = 0x60
+	next := &pkt[6]
+	for _, ext := range exts {
+		*next = ext[0]
+		off := len(pkt)
+		pkt = append(pkt, ext...)
+		next = &pkt[off]
+	}
+	*next = 17
+	udp := make([]byte, 8)
+	binary.BigEndian.PutUint16(udp[0:2], 12345)
+	binary.BigEndian.PutUint16(udp[2:4], 53)
+	pkt = append(pkt, udp...)
+	return append(pkt, payload...)
+}
+
+func fragment(offset int) []byte {
+	h := []byte{IPv6Fragment, 0, 0, 0, 0, 0, 0, 42}
+	binary.BigEndian.PutUint16(h[2:4], uint16(offset))
+	return h
+}
+
+func TestIPv6UpperLayer(t *testing.T) {
+	hopByHop := []byte{IPv6HopByHop, 0, 1, 4, 0, 0, 0, 0}
+	routing := []byte{IPv6Routing, 0, 4, 0, 0, 0, 0, 0}
+	for _, c := range []struct {
+		name  string
+		pkt   []byte
+		upper bool
+	}{
+		{"plain", ipv6([]byte("data")), true},
+		{"options", ipv6([]byte("data"), hopByHop, routing), true},
+		{"first fragment", ipv6([]byte("data"), hopByHop, fragment(0)), true},
+		{"later fragment", ipv6([]byte("data"), fragment(64)), false},
+	} {
+		proto, upper, err := IPv6UpperLayer(c.pkt)
+		if err != nil || proto != 17 {
+			t.Errorf("%v: protocol %v, error %v", c.name, proto, err)
+			continue
+		}
+		if !c.upper {
+			if upper != nil {
+				t.Errorf("%v: upper-layer header in a later fragment", c.name)
+			}
+			continue
+		}
+		if len(upper) < 8 || binary.BigEndian.Uint16(upper[2:4]) != 53 || !bytes.Equal(upper[8:], []byte("data")) {
+			t.Errorf("%v: upper layer %x", c.name, upper)
+		}
+	}
+
+	// Extension headers running past the end of the packet.
+	pkt := ipv6(nil, hopByHop)
+	pkt[IPv6HeaderLen+1] = 8
+	for _, p := range [][]byte{pkt, pkt[:IPv6HeaderLen+1], pkt[:IPv6HeaderLen-1]} {
+		if _, _, err := IPv6UpperLayer(p); err == nil {
+			t.Errorf("truncated packet of %d bytes accepted", len(p))
+		}
+	}
+}
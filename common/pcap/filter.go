@@ -0,0 +1,225 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/eycorsican/go-tun2socks/common/packet"
+)
+
+const (
+	protoICMP   = 1
+	protoTCP    = 6
+	protoUDP    = 17
+	protoICMPv6 = 58
+)
+
+// packetInfo is what a filter matches against.
+type packetInfo struct {
+	proto    uint8
+	src, dst net.IP
+	srcPort  uint16
+	dstPort  uint16
+	hasPorts bool
+}
+
+// parsePacket extracts the protocol, addresses and ports of an IP packet,
+// ports are only extracted from unfragmented or first fragment TCP and UDP
+// packets.
+func parsePacket(pkt []byte) (*packetInfo, bool) {
+	if len(pkt) < 1 {
+		return nil, false
+	}
+	info := &packetInfo{}
+	var payload []byte
+	switch pkt[0] >> 4 {
+	case 4:
+		if len(pkt) < 20 {
+			return nil, false
+		}
+		ihl := int(pkt[0]&0x0f) * 4
+		if ihl < 20 || len(pkt) < ihl {
+			return nil, false
+		}
+		info.proto = pkt[9]
+		info.src = net.IP(pkt[12:16])
+		info.dst = net.IP(pkt[16:20])
+		if binary.BigEndian.Uint16(pkt[6:8])&0x1fff == 0 {
+			payload = pkt[ihl:]
+		}
+	case 6:
+		proto, upper, err := packet.IPv6UpperLayer(pkt)
+		if err != nil {
+			return nil, false
+		}
+		info.proto = proto
+		info.src = net.IP(pkt[8:24])
+		info.dst = net.IP(pkt[24:40])
+		payload = upper
+	default:
+		return nil, false
+	}
+	if (info.proto == protoTCP || info.proto == protoUDP) && len(payload) >= 4 {
+		info.srcPort = binary.BigEndian.Uint16(payload[0:2])
+		info.dstPort = binary.BigEndian.Uint16(payload[2:4])
+		info.hasPorts = true
+	}
+	return info, true
+}
+
+// Filter selects packets to capture.
+type Filter interface {
+	Match(pkt []byte) bool
+}
+
+type matcher func(info *packetInfo) bool
+
+// filter is a disjunction of conjunctions of primitives.
+type filter [][]matcher
+
+func (f filter) Match(pkt []byte) bool {
+	info, ok := parsePacket(pkt)
+	if !ok {
+		return false
+	}
+	for _, and := range f {
+		matched := true
+		for _, m := range and {
+			if !m(info) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseFilter parses a filter expression in a small subset of the BPF
+// syntax, primitives are
+//
+//	tcp, udp, icmp, icmp6, ip, ip6
+//	[src|dst] host <ip>
+//	[src|dst] net <cidr>
+//	[src|dst] port <port>
+//
+// optionally preceded by "not", and combined with "and" and "or", "and"
+// binds tighter than "or". An empty expression matches all packets.
+func ParseFilter(expr string) (Filter, error) {
+	tokens := strings.Fields(strings.ToLower(expr))
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+
+	var f filter
+	var and []matcher
+	for i := 0; i < len(tokens); {
+		m, n, err := parsePrimitive(tokens[i:])
+		if err != nil {
+			return nil, err
+		}
+		and = append(and, m)
+		i += n
+		if i == len(tokens) {
+			break
+		}
+		switch tokens[i] {
+		case "and", "&&":
+		case "or", "||":
+			f = append(f, and)
+			and = nil
+		default:
+			return nil, fmt.Errorf("expected and/or, got %q", tokens[i])
+		}
+		i++
+		if i == len(tokens) {
+			return nil, errors.New("unexpected end of filter")
+		}
+	}
+	return append(f, and), nil
+}
+
+// parsePrimitive parses a primitive at the beginning of tokens and returns
+// the number of tokens consumed.
+func parsePrimitive(tokens []string) (matcher, int, error) {
+	if tokens[0] == "not" || tokens[0] == "!" {
+		if len(tokens) < 2 {
+			return nil, 0, errors.New("unexpected end of filter")
+		}
+		m, n, err := parsePrimitive(tokens[1:])
+		if err != nil {
+			return nil, 0, err
+		}
+		return func(info *packetInfo) bool { return !m(info) }, n + 1, nil
+	}
+
+	switch tokens[0] {
+	case "tcp":
+		return protoMatcher(protoTCP), 1, nil
+	case "udp":
+		return protoMatcher(protoUDP), 1, nil
+	case "icmp":
+		return protoMatcher(protoICMP), 1, nil
+	case "icmp6":
+		return protoMatcher(protoICMPv6), 1, nil
+	case "ip":
+		return func(info *packetInfo) bool { return len(info.src) == net.IPv4len }, 1, nil
+	case "ip6":
+		return func(info *packetInfo) bool { return len(info.src) == net.IPv6len }, 1, nil
+	}
+
+	src, dst, n := true, true, 0
+	switch tokens[0] {
+	case "src":
+		dst, n = false, 1
+	case "dst":
+		src, n = false, 1
+	}
+	if len(tokens) < n+2 {
+		return nil, 0, fmt.Errorf("unexpected end of filter after %q", strings.Join(tokens, " "))
+	}
+	kind, value := tokens[n], tokens[n+1]
+	n += 2
+
+	switch kind {
+	case "host":
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, 0, fmt.Errorf("invalid host %q", value)
+		}
+		return addrMatcher(src, dst, func(addr net.IP) bool { return ip.Equal(addr) }), n, nil
+	case "net":
+		_, ipNet, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid net %q", value)
+		}
+		return addrMatcher(src, dst, ipNet.Contains), n, nil
+	case "port":
+		port, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid port %q", value)
+		}
+		return func(info *packetInfo) bool {
+			return info.hasPorts &&
+				(src && info.srcPort == uint16(port) || dst && info.dstPort == uint16(port))
+		}, n, nil
+	default:
+		return nil, 0, fmt.Errorf("unknown filter primitive %q", kind)
+	}
+}
+
+func protoMatcher(proto uint8) matcher {
+	return func(info *packetInfo) bool { return info.proto == proto }
+}
+
+func addrMatcher(src, dst bool, match func(net.IP) bool) matcher {
+	return func(info *packetInfo) bool {
+		return src && match(info.src) || dst && match(info.dst)
+	}
+}
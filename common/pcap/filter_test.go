@@ -0,0 +1,147 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// ipv4Packet builds an IPv4 packet with a transport header carrying the ports.
+func ipv4Packet(proto uint8, src, dst string, srcPort, dstPort uint16) []byte {
+	pkt := make([]byte, 20+8)
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+	pkt[9] = proto
+	copy(pkt[12:16], net.ParseIP(src).To4())
+	copy(pkt[16:20], net.ParseIP(dst).To4())
+	binary.BigEndian.PutUint16(pkt[20:22], srcPort)
+	binary.BigEndian.PutUint16(pkt[22:24], dstPort)
+	return pkt
+}
+
+// ipv6Packet builds an IPv6 packet, ext holds extension headers whose first
+// byte is overwritten with the next header.
+func ipv6Packet(proto uint8, src, dst string, srcPort, dstPort uint16, ext ...[]byte) []byte {
+	pkt := make([]byte, 40)
+	pkt[0] = 0x60
+	copy(pkt[8:24], net.ParseIP(src).To16())
+	copy(pkt[24:40], net.ParseIP(dst).To16())
+	next := &pkt[6]
+	for _, h := range ext {
+		*next = h[len(h)-1]
+		h = append([]byte(nil), h[:len(h)-1]...)
+		pkt = append(pkt, h...)
+		next = &pkt[len(pkt)-len(h)]
+	}
+	*next = proto
+	ports := make([]byte, 8)
+	binary.BigEndian.PutUint16(ports[0:2], srcPort)
+	binary.BigEndian.PutUint16(ports[2:4], dstPort)
+	pkt = append(pkt, ports...)
+	binary.BigEndian.PutUint16(pkt[4:6], uint16(len(pkt)-40))
+	return pkt
+}
+
+// hopByHop is an empty hop-by-hop options header, the last byte is its
+// header type.
+var hopByHop = []byte{0, 0, 1, 4, 0, 0, 0, 0, 0}
+
+// fragment returns a fragment header with offset off in 8-byte units.
+func fragment(off uint16) []byte {
+	h := make([]byte, 9)
+	binary.BigEndian.PutUint16(h[2:4], off<<3)
+	h[8] = 44
+	return h
+}
+
+func TestFilter(t *testing.T) {
+	tcp4 := ipv4Packet(protoTCP, "10.0.0.1", "1.2.3.4", 1234, 80)
+	udp4 := ipv4Packet(protoUDP, "10.0.0.1", "8.8.8.8", 1234, 53)
+	icmp4 := ipv4Packet(protoICMP, "10.0.0.1", "1.2.3.4", 0, 0)
+	tcp6 := ipv6Packet(protoTCP, "fd00::1", "2001:db8::1", 1234, 80)
+	tcp6Ext := ipv6Packet(protoTCP, "fd00::1", "2001:db8::1", 1234, 80, hopByHop)
+	udp6Frag := ipv6Packet(protoUDP, "fd00::1", "2001:db8::1", 1234, 53, fragment(0))
+	udp6NextFrag := ipv6Packet(protoUDP, "fd00::1", "2001:db8::1", 1234, 53, fragment(1))
+
+	tests := []struct {
+		expr string
+		pkt  []byte
+		want bool
+	}{
+		{"tcp", tcp4, true},
+		{"tcp", udp4, false},
+		{"icmp", icmp4, true},
+		{"ip", tcp4, true},
+		{"ip", tcp6, false},
+		{"ip6", tcp6, true},
+		{"port 80", tcp4, true},
+		{"src port 80", tcp4, false},
+		{"dst port 80", tcp4, true},
+		{"src port 1234", tcp4, true},
+		{"host 1.2.3.4", tcp4, true},
+		{"src host 1.2.3.4", tcp4, false},
+		{"dst host 1.2.3.4", tcp4, true},
+		{"net 10.0.0.0/8", tcp4, true},
+		{"dst net 10.0.0.0/8", tcp4, false},
+		{"host 2001:db8::1", tcp6, true},
+		{"not tcp", tcp4, false},
+		{"! tcp", udp4, true},
+		{"tcp && port 80", tcp4, true},
+		{"udp || icmp", icmp4, true},
+		// "and" binds tighter than "or".
+		{"udp and port 80 or icmp", tcp4, false},
+		{"udp and port 80 or icmp", icmp4, true},
+		{"icmp or udp and port 53", udp4, true},
+		{"icmp or tcp and port 53", tcp4, false},
+		{"tcp and not port 80 or udp", tcp4, false},
+		{"tcp and not port 80 or udp", udp4, true},
+		// Extension headers are skipped to find the upper layer.
+		{"tcp", tcp6Ext, true},
+		{"tcp and port 80", tcp6Ext, true},
+		{"udp and port 53", udp6Frag, true},
+		// Ports are unknown in non-first fragments.
+		{"udp", udp6NextFrag, true},
+		{"port 53", udp6NextFrag, false},
+		{"not port 53", udp6NextFrag, true},
+		{"tcp", []byte{0x45, 0}, false},
+		{"ip6", ipv6Packet(protoTCP, "fd00::1", "2001:db8::1", 1, 2, hopByHop)[:42], false},
+	}
+	for _, tt := range tests {
+		f, err := ParseFilter(tt.expr)
+		if err != nil {
+			t.Errorf("ParseFilter(%q): %v", tt.expr, err)
+			continue
+		}
+		if got := f.Match(tt.pkt); got != tt.want {
+			t.Errorf("%q matched %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestParseFilterEmpty(t *testing.T) {
+	f, err := ParseFilter("  ")
+	if f != nil || err != nil {
+		t.Errorf("got %v, %v", f, err)
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	for _, expr := range []string{
+		"tcp udp",
+		"tcp and",
+		"tcp or",
+		"not",
+		"host",
+		"src port",
+		"host 1.2.3",
+		"net 10.0.0.0",
+		"port 65536",
+		"port http",
+		"src tcp",
+		"foo",
+	} {
+		if f, err := ParseFilter(expr); err == nil {
+			t.Errorf("ParseFilter(%q) = %v, want error", expr, f)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+// Package pcap writes IP packets to pcap files readable by tcpdump and
+// Wireshark.
+package pcap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+	"github.com/eycorsican/go-tun2socks/common/packet"
+)
+
+const (
+	magicMicroseconds = 0xa1b2c3d4
+	versionMajor      = 2
+	versionMinor      = 4
+	snapLen           = 65535
+
+	// LinkTypeRaw is the link type of packets beginning with an IPv4 or
+	// IPv6 header.
+	LinkTypeRaw = 101
+
+	fileHeaderLen   = 24
+	recordHeaderLen = 16
+
+	// queueSize is the number of packets buffered for the writing goroutine,
+	// packets are dropped when the queue is full.
+	queueSize = 1024
+)
+
+// Options configures a Writer.
+type Options struct {
+	// Filter selects packets to write, all packets are written if nil.
+	Filter Filter
+
+	// MaxSize is the size in bytes after which the file is rotated, files
+	// are never rotated if 0.
+	MaxSize int64
+
+	// MaxFiles is the number of rotated files kept besides the current
+	// one, rotated files are named <path>.1 (the newest) to <path>.N.
+	MaxFiles int
+}
+
+type record struct {
+	ts   time.Time
+	data []byte
+}
+
+// Writer is a core.PacketTap writing packets in both directions to a pcap
+// file with LINKTYPE_RAW, packets are written by a separate goroutine so
+// that the stack is never blocked by disk I/O.
+type Writer struct {
+	path string
+	opts Options
+
+	file *os.File
+	w    *bufio.Writer
+	size int64
+
+	queue   chan record
+	done    chan struct{}
+	closeMu sync.Mutex
+	closed  bool
+}
+
+// NewWriter creates the pcap file at path and starts writing packets to it.
+func NewWriter(path string, opts *Options) (*Writer, error) {
+	w := &Writer{
+		path:  path,
+		queue: make(chan record, queueSize),
+		done:  make(chan struct{}),
+	}
+	if opts != nil {
+		w.opts = *opts
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	go w.run()
+	return w, nil
+}
+
+// TapPacket implements core.PacketTap.
+func (w *Writer) TapPacket(pkt []byte, dir packet.Direction) {
+	if w.opts.Filter != nil && !w.opts.Filter.Match(pkt) {
+		return
+	}
+	if len(pkt) > snapLen {
+		pkt = pkt[:snapLen]
+	}
+	data := make([]byte, len(pkt))
+	copy(data, pkt)
+
+	w.closeMu.Lock()
+	defer w.closeMu.Unlock()
+	if w.closed {
+		return
+	}
+	select {
+	case w.queue <- record{ts: time.Now(), data: data}:
+	default:
+		log.Debugf("pcap queue is full, dropping packet")
+	}
+}
+
+// Close writes queued packets and closes the file.
+func (w *Writer) Close() error {
+	w.closeMu.Lock()
+	if w.closed {
+		w.closeMu.Unlock()
+		return nil
+	}
+	w.closed = true
+	close(w.queue)
+	w.closeMu.Unlock()
+
+	<-w.done
+	return w.closeFile()
+}
+
+func (w *Writer) run() {
+	defer close(w.done)
+
+	for p := range w.queue {
+		if err := w.writePacket(p); err != nil {
+			log.Errorf("failed to write pcap file %v: %v", w.path, err)
+			continue
+		}
+		// Flush when the queue is drained so that the file is readable
+		// while capturing.
+		if len(w.queue) == 0 {
+			if err := w.w.Flush(); err != nil {
+				log.Errorf("failed to write pcap file %v: %v", w.path, err)
+			}
+		}
+	}
+}
+
+func (w *Writer) writePacket(p record) error {
+	if w.w == nil {
+		// A previous rotation failed.
+		if err := w.open(); err != nil {
+			return err
+		}
+	}
+	if w.opts.MaxSize > 0 && w.size+int64(recordHeaderLen+len(p.data)) > w.opts.MaxSize && w.size > fileHeaderLen {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+
+	var hdr [recordHeaderLen]byte
+	binary.LittleEndian.PutUint32(hdr[0:4], uint32(p.ts.Unix()))
+	binary.LittleEndian.PutUint32(hdr[4:8], uint32(p.ts.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(hdr[8:12], uint32(len(p.data)))
+	binary.LittleEndian.PutUint32(hdr[12:16], uint32(len(p.data)))
+	if _, err := w.w.Write(hdr[:]); err != nil {
+		return err
+	}
+	if _, err := w.w.Write(p.data); err != nil {
+		return err
+	}
+	w.size += int64(recordHeaderLen + len(p.data))
+	return nil
+}
+
+// open creates the file and writes the pcap file header.
+func (w *Writer) open() error {
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create pcap file: %v", err)
+	}
+
+	var hdr [fileHeaderLen]byte
+	binary.LittleEndian.PutUint32(hdr[0:4], magicMicroseconds)
+	binary.LittleEndian.PutUint16(hdr[4:6], versionMajor)
+	binary.LittleEndian.PutUint16(hdr[6:8], versionMinor)
+	// Timezone offset and timestamp accuracy are always 0.
+	binary.LittleEndian.PutUint32(hdr[16:20], snapLen)
+	binary.LittleEndian.PutUint32(hdr[20:24], LinkTypeRaw)
+	if _, err := f.Write(hdr[:]); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write pcap file header: %v", err)
+	}
+
+	w.file = f
+	w.w = bufio.NewWriter(f)
+	w.size = fileHeaderLen
+	return nil
+}
+
+func (w *Writer) closeFile() error {
+	if w.file == nil {
+		return nil
+	}
+	err := w.w.Flush()
+	if cerr := w.file.Close(); err == nil {
+		err = cerr
+	}
+	w.file = nil
+	w.w = nil
+	return err
+}
+
+// rotate renames the current file to <path>.1, shifting older files, and
+// starts a new one.
+func (w *Writer) rotate() error {
+	if err := w.closeFile(); err != nil {
+		return err
+	}
+	if w.opts.MaxFiles > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", w.path, w.opts.MaxFiles))
+		for i := w.opts.MaxFiles - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", w.path, i), fmt.Sprintf("%s.%d", w.path, i+1))
+		}
+		if err := os.Rename(w.path, w.path+".1"); err != nil {
+			return err
+		}
+	}
+	return w.open()
+}
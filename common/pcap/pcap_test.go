@@ -0,0 +1,114 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/eycorsican/go-tun2socks/common/packet"
+)
+
+// readRecords checks the file header of the pcap file at path and returns
+// the packets it holds.
+func readRecords(t *testing.T, path string) [][]byte {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) < fileHeaderLen {
+		t.Fatalf("%v: short file header", path)
+	}
+	le := binary.LittleEndian
+	if le.Uint32(b[0:4]) != 0xa1b2c3d4 || le.Uint16(b[4:6]) != 2 || le.Uint16(b[6:8]) != 4 ||
+		le.Uint32(b[16:20]) != 65535 || le.Uint32(b[20:24]) != 101 {
+		t.Fatalf("%v: bad file header % x", path, b[:fileHeaderLen])
+	}
+	var pkts [][]byte
+	for b = b[fileHeaderLen:]; len(b) > 0; {
+		if len(b) < recordHeaderLen {
+			t.Fatalf("%v: short record header", path)
+		}
+		caplen, origlen := le.Uint32(b[8:12]), le.Uint32(b[12:16])
+		if caplen != origlen || len(b) < recordHeaderLen+int(caplen) {
+			t.Fatalf("%v: bad record header % x", path, b[:recordHeaderLen])
+		}
+		pkts = append(pkts, b[recordHeaderLen:recordHeaderLen+int(caplen)])
+		b = b[recordHeaderLen+int(caplen):]
+	}
+	return pkts
+}
+
+func TestWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.pcap")
+
+	f, err := ParseFilter("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := NewWriter(path, &Options{Filter: f})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp := ipv4Packet(protoTCP, "10.0.0.1", "1.2.3.4", 1234, 80)
+	udp := ipv4Packet(protoUDP, "10.0.0.1", "1.2.3.4", 1234, 53)
+	w.TapPacket(tcp, packet.Inbound)
+	w.TapPacket(udp, packet.Inbound)
+	w.TapPacket(tcp, packet.Outbound)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Packets tapped after Close are ignored.
+	w.TapPacket(tcp, packet.Inbound)
+
+	pkts := readRecords(t, path)
+	if len(pkts) != 2 {
+		t.Fatalf("got %v packets, want 2", len(pkts))
+	}
+	for _, pkt := range pkts {
+		if string(pkt) != string(tcp) {
+			t.Errorf("got packet % x, want % x", pkt, tcp)
+		}
+	}
+}
+
+func TestWriterRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.pcap")
+
+	pkt := ipv4Packet(protoTCP, "10.0.0.1", "1.2.3.4", 1234, 80)
+	record := recordHeaderLen + len(pkt)
+	// Two records fit in a file.
+	w, err := NewWriter(path, &Options{MaxSize: int64(fileHeaderLen + 2*record), MaxFiles: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 7; i++ {
+		pkt[len(pkt)-1] = byte(i)
+		w.TapPacket(pkt, packet.Inbound)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Packets 0 and 1 have been rotated out.
+	for name, want := range map[string][]byte{
+		path:        {6},
+		path + ".1": {4, 5},
+		path + ".2": {2, 3},
+	} {
+		pkts := readRecords(t, name)
+		if len(pkts) != len(want) {
+			t.Errorf("%v: got %v packets, want %v", name, len(pkts), len(want))
+			continue
+		}
+		for i, p := range pkts {
+			if p[len(p)-1] != want[i] {
+				t.Errorf("%v: got packet %v, want %v", name, p[len(p)-1], want[i])
+			}
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("%v.3 exists", path)
+	}
+}
@@ -0,0 +1,72 @@
+// Package relay copies data between the connections from TUN and the
+// connections to upstream servers.
+package relay
+
+import (
+	"io"
+	"net"
+)
+
+// DuplexConn is a connection whose directions can be closed separately.
+type DuplexConn interface {
+	net.Conn
+	CloseRead() error
+	CloseWrite() error
+}
+
+type direction byte
+
+const (
+	dirUplink direction = iota
+	dirDownlink
+)
+
+// Copy copies data between lhs and rhs in both directions and returns when
+// both are done. A direction reaching EOF is half closed if both conns are
+// DuplexConns, both conns are closed otherwise or on errors.
+func Copy(lhs, rhs net.Conn) {
+	upCh := make(chan struct{})
+
+	cls := func(dir direction, interrupt bool) {
+		lhsDConn, lhsOk := lhs.(DuplexConn)
+		rhsDConn, rhsOk := rhs.(DuplexConn)
+		if !interrupt && lhsOk && rhsOk {
+			switch dir {
+			case dirUplink:
+				lhsDConn.CloseRead()
+				rhsDConn.CloseWrite()
+			case dirDownlink:
+				lhsDConn.CloseWrite()
+				rhsDConn.CloseRead()
+			default:
+				panic("unexpected direction")
+			}
+		} else {
+			lhs.Close()
+			rhs.Close()
+		}
+	}
+
+	// Uplink
+	go func() {
+		var err error
+		_, err = io.Copy(rhs, lhs)
+		if err != nil {
+			cls(dirUplink, true) // interrupt the conn if the error is not nil (not EOF)
+		} else {
+			cls(dirUplink, false) // half close uplink direction of the TCP conn if possible
+		}
+		upCh <- struct{}{}
+	}()
+
+	// Downlink
+	var err error
+	_, err = io.Copy(lhs, rhs)
+	if err != nil {
+		cls(dirDownlink, true)
+	} else {
+		cls(dirDownlink, false)
+	}
+
+	<-upCh // Wait for uplink done.
+}
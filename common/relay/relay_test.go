@@ -0,0 +1,53 @@
+package relay
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, s
+}
+
+// A client closing its write direction still gets the reply of the server.
+func TestCopyHalfClose(t *testing.T) {
+	client, lhs := tcpPair(t)
+	rhs, server := tcpPair(t)
+	done := make(chan struct{})
+	go func() {
+		Copy(lhs, rhs)
+		close(done)
+	}()
+
+	go func() {
+		req, _ := io.ReadAll(server)
+		server.Write(append([]byte("re: "), req...))
+		server.Close()
+	}()
+	client.Write([]byte("ping"))
+	client.(*net.TCPConn).CloseWrite()
+	resp, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp) != "re: ping" {
+		t.Errorf("unexpected reply %q", resp)
+	}
+	client.Close()
+	<-done
+}
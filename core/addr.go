@@ -10,12 +10,16 @@ import (
 	"errors"
 	"net"
 	"strconv"
+	"unsafe"
 )
 
-// ipaddr_ntoa() is using a global static buffer to return result,
-// reentrants are not allowed, caller is required to lock lwipMutex.
-func ipAddrNTOA(ipaddr C.struct_ip_addr) string {
-	return C.GoString(C.ipaddr_ntoa(&ipaddr))
+// ipAddrToIP converts an lwIP address to a net.IP from its bytes, as
+// ipaddr_ntoa() formats some IPv6 addresses in a way net can't parse.
+func ipAddrToIP(ipaddr *C.struct_ip_addr) net.IP {
+	if ipaddr._type == C.uint8_t(6) {
+		return net.IP(C.GoBytes(unsafe.Pointer(&ipaddr.u_addr), 16))
+	}
+	return net.IP(C.GoBytes(unsafe.Pointer(&ipaddr.u_addr), 4))
 }
 
 func ipAddrATON(cp string, addr *C.struct_ip_addr) error {
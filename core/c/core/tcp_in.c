@@ -318,8 +318,14 @@ tcp_input(struct pbuf *p, struct netif *inp)
     for (lpcb = tcp_listen_pcbs.listen_pcbs; lpcb != NULL; lpcb = lpcb->next) {
 #if TUN2SOCKS
       // go-tun2socks logic
-      // use the first one, and it should be set to the loopif
-      break;
+      // use the first one bound to the input netif, every stack binds its
+      // listening pcb to its own netif
+      if ((lpcb->netif_idx == NETIF_NO_INDEX) ||
+          (lpcb->netif_idx == netif_get_index(ip_data.current_input_netif))) {
+        break;
+      }
+      prev = (struct tcp_pcb *)lpcb;
+      continue;
 #endif /* TUN2SOCKS */
 
       /* check if PCB is bound to specific netif */
@@ -719,7 +725,14 @@ tcp_listen_input(struct tcp_pcb_listen *pcb)
     npcb->snd_wnd_max = npcb->snd_wnd;
 
 #if TCP_CALCULATE_EFF_SEND_MSS
+#if TUN2SOCKS
+    // go-tun2socks logic
+    // the SYN came in through the netif of the stack, routing would pick
+    // the default netif
+    npcb->mss = tcp_eff_send_mss_netif(npcb->mss, ip_current_input_netif(), &npcb->remote_ip);
+#else
     npcb->mss = tcp_eff_send_mss(npcb->mss, &npcb->local_ip, &npcb->remote_ip);
+#endif /* TUN2SOCKS */
 #endif /* TCP_CALCULATE_EFF_SEND_MSS */
 
     MIB2_STATS_INC(mib2.tcppassiveopens);
@@ -81,9 +81,20 @@
 #define LWIP_TCP_TIMESTAMPS 1
 */
 
-#define TCP_MSS 1460
-#define TCP_WND 32 * 1024
-#define TCP_SND_BUF (TCP_WND)
+// maximum values, the MSS, the receive window and the send buffer of
+// connections are set per stack at runtime, see core/options.go
+#define TCP_MSS 8960
+#define LWIP_WND_SCALE 1
+#define TCP_RCV_SCALE 7
+#define TCP_WND (4 * 1024 * 1024)
+#define TCP_SND_BUF (4 * 1024 * 1024)
+#define TCP_SND_QUEUELEN (4 * (TCP_SND_BUF) / 536)
+#define TCP_SNDLOWAT (2 * TCP_MSS + 1)
+#define LWIP_TCP_PCB_NUM_EXT_ARGS 1
+
+// send window updates relative to the window of the pcb rather than the
+// maximum window
+#define TCP_WND_UPDATE_THRESHOLD LWIP_MIN((TCP_WND_MAX(pcb) / 4), (pcb->mss * 4))
 
 #define MEM_LIBC_MALLOC 1
 #define MEMP_MEM_MALLOC 1
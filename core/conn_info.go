@@ -0,0 +1,234 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ConnInfo describes a TCP or UDP session tracked by a stack.
+type ConnInfo struct {
+	// ID identifies the session in the stack, e.g. "tcp-12" or
+	// "udp-10.0.0.1:5353".
+	ID      string `json:"id"`
+	Network string `json:"network"`
+
+	// LocalAddr is the address of the local client, RemoteAddr is the
+	// destination, it's the first destination of full cone UDP sessions.
+	LocalAddr  string `json:"local_addr"`
+	RemoteAddr string `json:"remote_addr"`
+
+	State string `json:"state"`
+
+	// UplinkBytes counts bytes received from TUN, DownlinkBytes counts
+	// bytes written to TUN.
+	UplinkBytes   uint64 `json:"uplink_bytes"`
+	DownlinkBytes uint64 `json:"downlink_bytes"`
+
+	Created time.Time     `json:"created"`
+	Age     time.Duration `json:"age"`
+
+	// Handler is the type name of the handler of the session.
+	Handler string `json:"handler"`
+}
+
+// connStats holds counters and the creation time of a session.
+type connStats struct {
+	created  time.Time
+	uplink   atomic.Uint64
+	downlink atomic.Uint64
+}
+
+func newConnStats() connStats {
+	return connStats{created: time.Now()}
+}
+
+func (s *connStats) fill(info *ConnInfo) {
+	info.UplinkBytes = s.uplink.Load()
+	info.DownlinkBytes = s.downlink.Load()
+	info.Created = s.created
+	info.Age = time.Since(s.created)
+}
+
+// connInfoer is implemented by all TCP and UDP conns of the package.
+type connInfoer interface {
+	info() ConnInfo
+}
+
+func (s tcpConnState) String() string {
+	switch s {
+	case tcpNewConn:
+		return "new"
+	case tcpConnecting:
+		return "connecting"
+	case tcpConnected:
+		return "connected"
+	case tcpWriteClosed:
+		return "write_closed"
+	case tcpReceiveClosed:
+		return "receive_closed"
+	case tcpClosing:
+		return "closing"
+	case tcpAborting:
+		return "aborting"
+	case tcpClosed:
+		return "closed"
+	case tcpErrored:
+		return "errored"
+	default:
+		return "unknown"
+	}
+}
+
+func (s udpConnState) String() string {
+	switch s {
+	case udpConnecting:
+		return "connecting"
+	case udpConnected:
+		return "connected"
+	case udpClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+func tcpConnID(key uint32) string {
+	return "tcp-" + strconv.FormatUint(uint64(key), 10)
+}
+
+func udpConnID(connId string) string {
+	return "udp-" + connId
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+// Conns returns the sessions of the stack, TCP sessions first.
+func (s *lwipStack) Conns() []ConnInfo {
+	var conns []ConnInfo
+	for _, c := range s.tcpConns.Values() {
+		if i, ok := c.(connInfoer); ok {
+			conns = append(conns, i.info())
+		}
+	}
+	var udpConns []ConnInfo
+	for _, c := range s.udpConns.Values() {
+		if i, ok := c.(connInfoer); ok {
+			udpConns = append(udpConns, i.info())
+		}
+	}
+	sort.Slice(conns, func(i, j int) bool { return conns[i].Created.Before(conns[j].Created) })
+	sort.Slice(udpConns, func(i, j int) bool { return udpConns[i].Created.Before(udpConns[j].Created) })
+	return append(conns, udpConns...)
+}
+
+// CloseConn aborts the TCP session or closes the UDP session with the
+// given ID.
+func (s *lwipStack) CloseConn(id string) error {
+	switch {
+	case strings.HasPrefix(id, "tcp-"):
+		key, err := strconv.ParseUint(strings.TrimPrefix(id, "tcp-"), 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid connection ID %v", id)
+		}
+		conn, ok := s.tcpConns.Peek(uint32(key))
+		if !ok {
+			return fmt.Errorf("connection %v not found", id)
+		}
+		conn.Abort()
+		return nil
+	case strings.HasPrefix(id, "udp-"):
+		conn, ok := s.udpConns.Peek(strings.TrimPrefix(id, "udp-"))
+		if !ok {
+			return fmt.Errorf("connection %v not found", id)
+		}
+		return conn.Close()
+	default:
+		return errors.New("invalid connection ID")
+	}
+}
+
+// Conns returns the sessions of the default stack.
+func Conns() []ConnInfo {
+	return defaultStack.Conns()
+}
+
+// CloseConn closes a session of the default stack, see LWIPStack.CloseConn.
+func CloseConn(id string) error {
+	return defaultStack.CloseConn(id)
+}
+
+func (conn *tcpConn) info() ConnInfo {
+	conn.Lock()
+	state := conn.state
+	conn.Unlock()
+	info := ConnInfo{
+		ID:         tcpConnID(conn.connKey),
+		Network:    "tcp",
+		LocalAddr:  addrString(conn.localAddr),
+		RemoteAddr: addrString(conn.remoteAddr),
+		State:      state.String(),
+		Handler:    fmt.Sprintf("%T", conn.handler),
+	}
+	conn.stats.fill(&info)
+	return info
+}
+
+func (conn *tcpConnEx) info() ConnInfo {
+	conn.Lock()
+	state := conn.state
+	conn.Unlock()
+	info := ConnInfo{
+		ID:         tcpConnID(conn.connKey),
+		Network:    "tcp",
+		LocalAddr:  addrString(conn.localAddr),
+		RemoteAddr: addrString(conn.remoteAddr),
+		State:      state.String(),
+		Handler:    fmt.Sprintf("%T", conn.handler),
+	}
+	conn.stats.fill(&info)
+	return info
+}
+
+func (conn *udpConn) info() ConnInfo {
+	conn.RLock()
+	state := conn.state
+	conn.RUnlock()
+	info := ConnInfo{
+		ID:         udpConnID(conn.connId),
+		Network:    "udp",
+		LocalAddr:  addrString(conn.localAddr),
+		RemoteAddr: addrString(conn.remoteAddr),
+		State:      state.String(),
+		Handler:    fmt.Sprintf("%T", conn.handler),
+	}
+	conn.stats.fill(&info)
+	return info
+}
+
+func (conn *udpConnex) info() ConnInfo {
+	state := udpConnected
+	if conn.closed.Load() {
+		state = udpClosed
+	}
+	info := ConnInfo{
+		ID:         udpConnID(conn.connId),
+		Network:    "udp",
+		LocalAddr:  addrString(conn.localAddr),
+		RemoteAddr: addrString(conn.remoteAddr),
+		State:      state.String(),
+		Handler:    fmt.Sprintf("%T", conn.handler),
+	}
+	conn.stats.fill(&info)
+	return info
+}
@@ -2,16 +2,29 @@ package core
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
+	"io"
 	"net"
+	"os"
+	"strconv"
 	"testing"
+	"time"
 
-	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/eycorsican/go-tun2socks/common/metrics"
+	"github.com/eycorsican/go-tun2socks/common/packet"
+	"github.com/eycorsican/go-tun2socks/tun/vtun"
 )
 
 const (
 	ipv4Header = 20 // Length of the IPv4 header in bytes.
+	ipv6Header = 40 // Length of the IPv6 header in bytes.
 	udpHeader  = 8  // Length of the UDP header in bytes.
+	tcpHeader  = 20 // Length of the TCP header in bytes, without options.
+	// A TCP SYN from 10.0.0.1:12345 to 1.2.3.4:80.
+	synHex = "4500002800000000400600000a0000010102030430390050000003e8000000005002ffff00000000"
 	// A small NTP query packet (UDP)
 	ntpHex = "45b8004c72e94000401125a2646a4100d8ef2304007b007b0038a1a7230209e8000003620000072ed8ef230ce10ff888c730e992e10ffbdbc742a583e10ffbdbcaa4151ae10ffde6c3cf01e3"
 	// Two fragments of a large UDP packet.
@@ -53,12 +66,8 @@ func setupUDP(t *testing.T) (LWIPStack, *fakeUDPHandler) {
 	fragPayload = append([]byte(nil), frag1[ipv4Header+udpHeader:]...)
 	fragPayload = append(fragPayload, frag2[ipv4Header:]...)
 
-	// Reset the set of known UDP connections to empty before each test.  Otherwise, the
-	// tests will interfere with each other.
-	udpConns, _ = lru.NewWithEvict(128, func(key string, value UDPConn) {
-		value.Close()
-	})
-
+	// Each new stack starts with an empty set of known UDP connections, so the
+	// tests will not interfere with each other.
 	s := NewLWIPStack()
 	// This channel is buffered because the first Write->ReceiveTo can either be synchronous or
 	// asynchronous, depending on the results of a race during "connection".
@@ -135,3 +144,1375 @@ func TestUDPFragmentationMemoryAndReordering(t *testing.T) {
 
 	assertEqual(<-h.packets, fragPayload, t)
 }
+
+// ipv6UDP builds an IPv6 UDP packet carrying payload after the extension
+// headers exts, the next header fields of exts are filled in.
+func ipv6UDP(payload []byte, exts ...[]byte) []byte {
+	src := &net.UDPAddr{IP: net.ParseIP("fd00::1"), Port: 12350}
+	dst := &net.UDPAddr{IP: net.ParseIP("fd00::2"), Port: 123}
+	plain := vtun.UDPPacket(src, dst, payload)
+	pkt := append([]byte(nil), plain[:ipv6Header]...)
+	next := &pkt[6]
+	for _, ext := range exts {
+		ext = append([]byte(nil), ext...)
+		ext[0], *next = *next, ext[0]
+		pkt = append(pkt, ext...)
+		next = &pkt[len(pkt)-len(ext)]
+	}
+	pkt = append(pkt, plain[ipv6Header:]...)
+	binary.BigEndian.PutUint16(pkt[4:6], uint16(len(pkt)-ipv6Header))
+	return pkt
+}
+
+// Extension headers, the first byte holds the type of the header until
+// ipv6UDP chains them.
+var (
+	// Hop-by-Hop and Destination Options headers with a PadN option.
+	hopByHop = []byte{packet.IPv6HopByHop, 0, 1, 4, 0, 0, 0, 0}
+	destOpts = []byte{packet.IPv6DestOpts, 0, 1, 4, 0, 0, 0, 0}
+	routing  = []byte{packet.IPv6Routing, 0, 4, 0, 0, 0, 0, 0}
+)
+
+// fragmentHeader returns a Fragment header at offset bytes.
+func fragmentHeader(offset int, more bool) []byte {
+	h := []byte{packet.IPv6Fragment, 0, 0, 0, 0, 0, 0, 42}
+	binary.BigEndian.PutUint16(h[2:4], uint16(offset))
+	if more {
+		h[3] |= 0x01
+	}
+	return h
+}
+
+func TestPeekIPv6(t *testing.T) {
+	payload := []byte("payload")
+	for _, c := range []struct {
+		name   string
+		pkt    []byte
+		more   bool
+		offset uint16
+	}{
+		{"plain", ipv6UDP(payload), false, 0},
+		{"options", ipv6UDP(payload, hopByHop, routing, destOpts), false, 0},
+		{"first fragment", ipv6UDP(payload, hopByHop, fragmentHeader(0, true)), true, 0},
+		{"last fragment", ipv6UDP(payload, fragmentHeader(64, false), destOpts), false, 8},
+		{"atomic fragment", ipv6UDP(payload, fragmentHeader(0, false)), false, 0},
+	} {
+		next, err := peekNextProto(ipv6, c.pkt)
+		if err != nil || next != proto_udp {
+			t.Errorf("%v: unexpected next protocol %v, %v", c.name, next, err)
+		}
+		if more := moreFrags(ipv6, c.pkt); more != c.more {
+			t.Errorf("%v: unexpected more fragments %v", c.name, more)
+		}
+		if offset := fragOffset(ipv6, c.pkt); offset != c.offset {
+			t.Errorf("%v: unexpected fragment offset %v", c.name, offset)
+		}
+	}
+
+	// Extension headers running past the end of the packet.
+	pkt := ipv6UDP(nil, hopByHop)
+	pkt[ipv6Header+1] = 8
+	if _, err := peekNextProto(ipv6, pkt); err == nil {
+		t.Error("truncated extension header accepted")
+	}
+	if _, err := peekNextProto(ipv6, pkt[:ipv6Header+1]); err == nil {
+		t.Error("truncated extension header accepted")
+	}
+}
+
+// Send an IPv6 UDP packet with extension headers.
+func TestUDPIPv6ExtensionHeaders(t *testing.T) {
+	s, h := setupUDP(t)
+	write(s, ipv6UDP(ntpPayload, hopByHop, destOpts), t)
+	assertEqual(<-h.packets, ntpPayload, t)
+}
+
+// Send a fragmented IPv6 UDP packet, in and out of order.
+func TestUDPIPv6Fragmentation(t *testing.T) {
+	for _, reorder := range []bool{false, true} {
+		s, h := setupUDP(t)
+		// The first fragment holds the UDP header and the first 504 bytes
+		// of the payload. lwIP doesn't reassemble fragments after a
+		// Hop-by-Hop header, they follow a Destination Options header.
+		udp := ipv6UDP(fragPayload)[ipv6Header:]
+		frags := [][]byte{
+			append(ipv6UDP(nil, destOpts, fragmentHeader(0, true))[:ipv6Header+16], udp[:512]...),
+			append(ipv6UDP(nil, destOpts, fragmentHeader(512, false))[:ipv6Header+16], udp[512:]...),
+		}
+		if reorder {
+			frags[0], frags[1] = frags[1], frags[0]
+		}
+		for _, frag := range frags {
+			binary.BigEndian.PutUint16(frag[4:6], uint16(len(frag)-ipv6Header))
+			write(s, frag, t)
+		}
+		assertEqual(<-h.packets, fragPayload, t)
+	}
+}
+
+// This UDP handler echoes each received packet back to TUN.
+type echoUDPHandler struct {
+	UDPConnHandler
+}
+
+func (h *echoUDPHandler) Connect(conn UDPConn, target *net.UDPAddr) error {
+	return nil
+}
+
+func (h *echoUDPHandler) ReceiveTo(conn UDPConn, data []byte, addr *net.UDPAddr) error {
+	_, err := conn.WriteFrom(data, addr)
+	return err
+}
+
+// Packets written to isolated stacks reach their own handlers and replies
+// come out of their own output functions.
+func TestIsolatedStacks(t *testing.T) {
+	ntp = decode(ntpHex)
+	ntpPayload = ntp[ipv4Header+udpHeader:]
+
+	s1 := NewIsolatedLWIPStack()
+	defer s1.Close()
+	h1 := &fakeUDPHandler{packets: make(chan []byte, 1)}
+	s1.RegisterUDPConnHandler(h1)
+
+	s2 := NewIsolatedLWIPStack()
+	defer s2.Close()
+	s2.RegisterUDPConnHandler(&echoUDPHandler{})
+	out1 := make(chan []byte, 1)
+	s1.RegisterOutputFn(func(data []byte) (int, error) {
+		out1 <- append([]byte(nil), data...)
+		return len(data), nil
+	})
+	out2 := make(chan []byte, 1)
+	s2.RegisterOutputFn(func(data []byte) (int, error) {
+		out2 <- append([]byte(nil), data...)
+		return len(data), nil
+	})
+
+	write(s1, append([]byte(nil), ntp...), t)
+	assertEqual(<-h1.packets, ntpPayload, t)
+
+	write(s2, append([]byte(nil), ntp...), t)
+	reply := <-out2
+	if len(reply) != len(ntp) {
+		t.Fatalf("unexpected reply length %d", len(reply))
+	}
+	assertEqual(reply[ipv4Header+udpHeader:], ntpPayload, t)
+	// Source and destination addresses are swapped in the reply.
+	assertEqual(reply[12:16], ntp[16:20], t)
+	assertEqual(reply[16:20], ntp[12:16], t)
+	select {
+	case <-out1:
+		t.Error("reply leaked to another stack")
+	default:
+	}
+}
+
+// This TCP handler writes a greeting to accepted conns.
+type greetingTCPHandler struct{}
+
+func (h *greetingTCPHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
+	_, err := conn.Write([]byte("hello"))
+	return err
+}
+
+func TestIsolatedStacksTCP(t *testing.T) {
+	var stacks []LWIPStack
+	var outs []chan []byte
+	for i := 0; i < 2; i++ {
+		s := NewIsolatedLWIPStack()
+		defer s.Close()
+		s.RegisterTCPConnHandler(&greetingTCPHandler{})
+		out := make(chan []byte, 2)
+		s.RegisterOutputFn(func(data []byte) (int, error) {
+			out <- append([]byte(nil), data...)
+			return len(data), nil
+		})
+		stacks, outs = append(stacks, s), append(outs, out)
+	}
+
+	// Segments sent by a handler, outside of input, are output by the stack
+	// of the conn.
+	for i, s := range stacks {
+		write(s, decode(synHex), t)
+		synAck := <-outs[i]
+		ack := decode(synHex)
+		binary.BigEndian.PutUint32(ack[ipv4Header+4:], 1001)
+		binary.BigEndian.PutUint32(ack[ipv4Header+8:], binary.BigEndian.Uint32(synAck[ipv4Header+4:])+1)
+		ack[ipv4Header+13] = 0x10
+		write(s, ack, t)
+		select {
+		case data := <-outs[i]:
+			assertEqual(data[ipv4Header+tcpHeader:], []byte("hello"), t)
+		case <-time.After(time.Second):
+			t.Fatalf("no data from stack %d", i)
+		}
+		select {
+		case <-outs[1-i]:
+			t.Error("data leaked to another stack")
+		default:
+		}
+	}
+}
+
+// This ICMP handler replies to each echo request with the same payload.
+type echoICMPHandler struct{}
+
+func (h *echoICMPHandler) HandleEcho(req *ICMPEchoRequest, w ICMPEchoWriter) bool {
+	w.WriteEchoReply(req, req.Payload)
+	return true
+}
+
+func icmpEchoRequest(src, dst net.IP, id, seq uint16, payload []byte) []byte {
+	pkt := make([]byte, ipv4Header+8+len(payload))
+	pkt[0] = 0x45
+	pkt[2], pkt[3] = byte(len(pkt)>>8), byte(len(pkt))
+	pkt[8] = 64
+	pkt[9] = proto_icmp
+	copy(pkt[12:16], src.To4())
+	copy(pkt[16:20], dst.To4())
+	icmp := pkt[ipv4Header:]
+	icmp[0] = icmpv4EchoRequest
+	icmp[4], icmp[5] = byte(id>>8), byte(id)
+	icmp[6], icmp[7] = byte(seq>>8), byte(seq)
+	copy(icmp[8:], payload)
+	sum := checksum(icmp, 0)
+	icmp[2], icmp[3] = byte(sum>>8), byte(sum)
+	return pkt
+}
+
+func TestICMPEchoHandler(t *testing.T) {
+	s := NewIsolatedLWIPStack()
+	defer s.Close()
+	out := make(chan []byte, 1)
+	s.RegisterOutputFn(func(data []byte) (int, error) {
+		out <- append([]byte(nil), data...)
+		return len(data), nil
+	})
+	src, dst := net.IPv4(10, 0, 0, 2), net.IPv4(1, 2, 3, 4)
+	payload := []byte("ping payload")
+
+	s.RegisterICMPHandler(&echoICMPHandler{})
+	write(s, icmpEchoRequest(src, dst, 7, 1, payload), t)
+	reply := <-out
+	if checksum(reply[:ipv4Header], 0) != 0 || checksum(reply[ipv4Header:], 0) != 0 {
+		t.Error("bad checksum")
+	}
+	if reply[ipv4Header] != icmpv4EchoReply {
+		t.Errorf("unexpected ICMP type %d", reply[ipv4Header])
+	}
+	assertEqual(reply[12:16], dst.To4(), t)
+	assertEqual(reply[16:20], src.To4(), t)
+	assertEqual(reply[ipv4Header+4:ipv4Header+8], []byte{0, 7, 0, 1}, t)
+	assertEqual(reply[ipv4Header+8:], payload, t)
+
+	s.RegisterICMPHandler(NewDropICMPHandler())
+	write(s, icmpEchoRequest(src, dst, 7, 2, payload), t)
+	select {
+	case <-out:
+		t.Error("dropped echo request got a reply")
+	default:
+	}
+
+	// lwIP replies locally.
+	s.RegisterICMPHandler(NewLocalICMPHandler())
+	write(s, icmpEchoRequest(src, dst, 7, 3, payload), t)
+	reply = <-out
+	if reply[ipv4Header] != icmpv4EchoReply {
+		t.Errorf("unexpected ICMP type %d", reply[ipv4Header])
+	}
+	assertEqual(reply[ipv4Header+8:], payload, t)
+}
+
+// This ICMP handler passes echo requests to the test.
+type chanICMPHandler chan *ICMPEchoRequest
+
+func (h chanICMPHandler) HandleEcho(req *ICMPEchoRequest, w ICMPEchoWriter) bool {
+	h <- req
+	return true
+}
+
+// Echo requests behind IPv6 extension headers reach the ICMP handler.
+func TestICMPv6ExtensionHeaders(t *testing.T) {
+	s := NewIsolatedLWIPStack()
+	defer s.Close()
+	h := make(chanICMPHandler, 1)
+	s.RegisterICMPHandler(h)
+	s.RegisterOutputFn(func(data []byte) (int, error) {
+		return len(data), nil
+	})
+
+	src, dst := net.ParseIP("fd00::1"), net.ParseIP("fd00::2")
+	payload := []byte("ping payload")
+	for _, exts := range [][][]byte{nil, {hopByHop}, {hopByHop, destOpts}} {
+		pkt := make([]byte, ipv6Header)
+		pkt[0] = 0x60
+		pkt[6] = proto_icmpv6
+		pkt[7] = 64
+		copy(pkt[8:24], src)
+		copy(pkt[24:40], dst)
+		next := &pkt[6]
+		for _, ext := range exts {
+			ext = append([]byte(nil), ext...)
+			ext[0], *next = *next, ext[0]
+			pkt = append(pkt, ext...)
+			next = &pkt[len(pkt)-len(ext)]
+		}
+		pkt = append(pkt, icmpv6EchoRequest, 0, 0, 0, 0, 7, 0, 1)
+		pkt = append(pkt, payload...)
+		binary.BigEndian.PutUint16(pkt[4:6], uint16(len(pkt)-ipv6Header))
+
+		write(s, pkt, t)
+		select {
+		case req := <-h:
+			if req.ID != 7 || req.Seq != 1 || !req.Src.Equal(src) || !req.Dst.Equal(dst) {
+				t.Errorf("unexpected request %+v", req)
+			}
+			assertEqual(req.Payload, payload, t)
+		default:
+			t.Errorf("request with %d extension headers not handled", len(exts))
+		}
+	}
+}
+
+// This UDP handler records the target of each new session.
+type targetUDPHandler struct {
+	UDPConnHandler
+	targets chan *net.UDPAddr
+}
+
+func (h *targetUDPHandler) Connect(conn UDPConn, target *net.UDPAddr) error {
+	h.targets <- target
+	return nil
+}
+
+func (h *targetUDPHandler) ReceiveTo(conn UDPConn, data []byte, addr *net.UDPAddr) error {
+	return nil
+}
+
+func TestUDPSessionMode(t *testing.T) {
+	ntp = decode(ntpHex)
+	other := append([]byte(nil), ntp...)
+	copy(other[16:20], []byte{1, 2, 3, 4})
+
+	for _, mode := range []UDPSessionMode{UDPSessionFullCone, UDPSessionSymmetric} {
+		s := NewIsolatedLWIPStack(WithUDPSessionMode(mode))
+		h := &targetUDPHandler{targets: make(chan *net.UDPAddr, 2)}
+		s.RegisterUDPConnHandler(h)
+
+		write(s, append([]byte(nil), ntp...), t)
+		write(s, append([]byte(nil), other...), t)
+
+		// Handlers are connected asynchronously, sessions may come in any order.
+		targets := map[string]bool{}
+		targets[(<-h.targets).IP.String()] = true
+		select {
+		case target := <-h.targets:
+			targets[target.IP.String()] = true
+		case <-time.After(100 * time.Millisecond):
+		}
+		if mode == UDPSessionFullCone && len(targets) != 1 {
+			t.Errorf("full cone mode created sessions to %v", targets)
+		}
+		if mode == UDPSessionSymmetric && (!targets["216.239.35.4"] || !targets["1.2.3.4"]) {
+			t.Errorf("symmetric mode created sessions to %v", targets)
+		}
+		s.Close()
+	}
+}
+
+// This fake DNS answers every query with the reversed query.
+type reverseFakeDns struct{}
+
+func (d *reverseFakeDns) GenerateFakeResponse(request []byte) ([]byte, error) {
+	resp := make([]byte, len(request))
+	for i, b := range request {
+		resp[len(request)-1-i] = b
+	}
+	return resp, nil
+}
+
+func (d *reverseFakeDns) QueryDomain(ip net.IP) string {
+	return ""
+}
+
+func (d *reverseFakeDns) IsFakeIP(ip net.IP) bool {
+	return false
+}
+
+func TestFakeDns(t *testing.T) {
+	ntp = decode(ntpHex)
+	ntpPayload = ntp[ipv4Header+udpHeader:]
+	query := append([]byte(nil), ntp...)
+	query[ipv4Header+2], query[ipv4Header+3] = 0, 53 // Destination port.
+
+	s := NewIsolatedLWIPStack()
+	defer s.Close()
+	h := &fakeUDPHandler{packets: make(chan []byte, 1)}
+	s.RegisterUDPConnHandler(h)
+	s.RegisterFakeDns(&reverseFakeDns{})
+	out := make(chan []byte, 1)
+	s.RegisterOutputFn(func(data []byte) (int, error) {
+		out <- append([]byte(nil), data...)
+		return len(data), nil
+	})
+
+	write(s, query, t)
+	reply := <-out
+	if len(reply) != len(ntp) {
+		t.Fatalf("unexpected reply length %d", len(reply))
+	}
+	expected, _ := (&reverseFakeDns{}).GenerateFakeResponse(ntpPayload)
+	assertEqual(reply[ipv4Header+udpHeader:], expected, t)
+	// The reply comes from the queried address and port.
+	assertEqual(reply[12:16], ntp[16:20], t)
+	assertEqual(reply[ipv4Header:ipv4Header+2], []byte{0, 53}, t)
+
+	// Other UDP packets still go to the handler.
+	write(s, append([]byte(nil), ntp...), t)
+	assertEqual(<-h.packets, ntpPayload, t)
+}
+
+// tcpSegment builds an IPv4 TCP segment, checksums are left empty since
+// lwIP is built without checksum checks.
+func tcpSegment(src, dst *net.TCPAddr, seq, ack uint32, flags byte, payload []byte) []byte {
+	pkt := make([]byte, ipv4Header+tcpHeader+len(payload))
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+	pkt[8] = 64
+	pkt[9] = 6
+	copy(pkt[12:16], src.IP.To4())
+	copy(pkt[16:20], dst.IP.To4())
+
+	tcp := pkt[ipv4Header:]
+	binary.BigEndian.PutUint16(tcp[0:2], uint16(src.Port))
+	binary.BigEndian.PutUint16(tcp[2:4], uint16(dst.Port))
+	binary.BigEndian.PutUint32(tcp[4:8], seq)
+	binary.BigEndian.PutUint32(tcp[8:12], ack)
+	tcp[12] = (tcpHeader / 4) << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:16], 65535)
+	copy(tcp[tcpHeader:], payload)
+	return pkt
+}
+
+const (
+	tcpFlagSyn = 0x02
+	tcpFlagAck = 0x10
+	tcpFlagPsh = 0x08
+)
+
+// This TCP handler passes accepted conns to the test.
+type chanTCPHandler struct {
+	conns chan net.Conn
+}
+
+func (h *chanTCPHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
+	h.conns <- conn
+	return nil
+}
+
+// connectTCP completes a handshake from clientPort with a new isolated stack
+// and returns the stack, the conn passed to the handler and a function
+// sending data from the client. The client never acknowledges data sent by
+// the stack.
+func connectTCP(t *testing.T, clientPort int) (LWIPStack, net.Conn, func(payload []byte)) {
+	s := NewIsolatedLWIPStack()
+	h := &chanTCPHandler{conns: make(chan net.Conn, 1)}
+	s.RegisterTCPConnHandler(h)
+	out := make(chan []byte, 1024)
+	s.RegisterOutputFn(func(data []byte) (int, error) {
+		select {
+		case out <- append([]byte(nil), data...):
+		default:
+		}
+		return len(data), nil
+	})
+
+	client := &net.TCPAddr{IP: net.IP{10, 0, 0, 1}, Port: clientPort}
+	server := &net.TCPAddr{IP: net.IP{1, 2, 3, 4}, Port: 80}
+	seq := uint32(1000)
+	write(s, tcpSegment(client, server, seq, 0, tcpFlagSyn, nil), t)
+	synAck := <-out
+	if synAck[ipv4Header+13]&(tcpFlagSyn|tcpFlagAck) != tcpFlagSyn|tcpFlagAck {
+		t.Fatalf("unexpected reply to SYN: %x", synAck)
+	}
+	ack := binary.BigEndian.Uint32(synAck[ipv4Header+4:ipv4Header+8]) + 1
+	seq++
+	write(s, tcpSegment(client, server, seq, ack, tcpFlagAck, nil), t)
+
+	send := func(payload []byte) {
+		write(s, tcpSegment(client, server, seq, ack, tcpFlagAck|tcpFlagPsh, payload), t)
+		seq += uint32(len(payload))
+	}
+
+	select {
+	case conn := <-h.conns:
+		return s, conn, send
+	case <-time.After(time.Second):
+		t.Fatal("connection not accepted")
+	}
+	return nil, nil, nil
+}
+
+func TestTCPReadDeadline(t *testing.T) {
+	s, conn, send := connectTCP(t, 12345)
+	defer s.Close()
+
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	buf := make([]byte, 16)
+	start := time.Now()
+	if _, err := conn.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("unexpected read error: %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("read returned too late")
+	}
+
+	// Reads work again once the deadline is cleared.
+	conn.SetReadDeadline(time.Time{})
+	go send([]byte("hello"))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(buf[:n], []byte("hello"), t)
+}
+
+func TestTCPWriteDeadline(t *testing.T) {
+	s, conn, _ := connectTCP(t, 12346)
+	defer s.Close()
+
+	// Nothing is acknowledged, the write blocks once the send buffer of
+	// lwIP is full.
+	conn.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	data := make([]byte, 1<<20)
+	start := time.Now()
+	n, err := conn.Write(data)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("unexpected write error: %v", err)
+	}
+	if n == 0 || n == len(data) {
+		t.Errorf("unexpected written length %d", n)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("write returned too late")
+	}
+
+	// Writes fail immediately once the deadline is exceeded.
+	if _, err := conn.Write(data[:1]); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("unexpected write error: %v", err)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	ntp = decode(ntpHex)
+
+	s := NewIsolatedLWIPStack()
+	defer s.Close()
+	s.RegisterUDPConnHandler(&echoUDPHandler{})
+	out := make(chan []byte, 1)
+	s.RegisterOutputFn(func(data []byte) (int, error) {
+		out <- data
+		return len(data), nil
+	})
+
+	in, sessions, outPackets := packetsIn.Value(), udpSessions.Value(), packetsOut.Value()
+	write(s, append([]byte(nil), ntp...), t)
+	<-out
+	if packetsIn.Value() != in+1 || udpSessions.Value() != sessions+1 || packetsOut.Value() != outPackets+1 {
+		t.Errorf("unexpected counters: in %d, sessions %d, out %d", packetsIn.Value()-in, udpSessions.Value()-sessions, packetsOut.Value()-outPackets)
+	}
+
+	var buf bytes.Buffer
+	metrics.DefaultRegistry.Write(&buf)
+	for _, line := range []string{
+		"# TYPE tun2socks_sessions_total counter\n",
+		"tun2socks_sessions_active{proto=\"udp\"} ",
+		"tun2socks_handler_dial_seconds_bucket{proto=\"udp\",le=\"+Inf\"} ",
+	} {
+		if !bytes.Contains(buf.Bytes(), []byte(line)) {
+			t.Errorf("missing %q in metrics:\n%s", line, buf.String())
+		}
+	}
+}
+
+// Malformed packets are dropped without error and the stack keeps handling
+// packets written after them.
+func TestWriteMalformed(t *testing.T) {
+	ntp = decode(ntpHex)
+
+	s := NewIsolatedLWIPStack()
+	defer s.Close()
+	s.RegisterUDPConnHandler(&echoUDPHandler{})
+	out := make(chan []byte, 1)
+	s.RegisterOutputFn(func(data []byte) (int, error) {
+		out <- data
+		return len(data), nil
+	})
+
+	// An IPv6 header announcing a hop-by-hop options header it lacks.
+	ipv6 := make([]byte, 40)
+	ipv6[0] = 0x60
+	pkts := [][]byte{
+		{0x45, 0, 0},
+		{0x70, 0, 0, 0},
+		ipv6,
+	}
+	dropped := packetsDropped.Value()
+	for _, pkt := range pkts {
+		if n, err := s.Write(pkt); n != len(pkt) || err != nil {
+			t.Errorf("Write(%x) = %d, %v, want %d", pkt, n, err, len(pkt))
+		}
+	}
+	if n, err := s.WriteBatch(pkts); n != len(pkts) || err != nil {
+		t.Errorf("WriteBatch() = %d, %v, want %d", n, err, len(pkts))
+	}
+	if packetsDropped.Value() != dropped+6 {
+		t.Errorf("%d packets dropped, want 6", packetsDropped.Value()-dropped)
+	}
+
+	write(s, append([]byte(nil), ntp...), t)
+	select {
+	case <-out:
+	case <-time.After(time.Second):
+		t.Fatal("no reply after malformed packets")
+	}
+}
+
+func TestConns(t *testing.T) {
+	s, conn, send := connectTCP(t, 12347)
+	defer s.Close()
+	s.RegisterUDPConnHandler(&echoUDPHandler{})
+
+	go send([]byte("hello"))
+	buf := make([]byte, 16)
+	if _, err := conn.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	ntp = decode(ntpHex)
+	write(s, append([]byte(nil), ntp...), t)
+
+	conns := s.Conns()
+	if len(conns) != 2 {
+		t.Fatalf("unexpected conns %+v", conns)
+	}
+	tcp, udp := conns[0], conns[1]
+	if tcp.Network != "tcp" || tcp.LocalAddr != "10.0.0.1:12347" || tcp.RemoteAddr != "1.2.3.4:80" || tcp.UplinkBytes != 5 {
+		t.Errorf("unexpected TCP conn %+v", tcp)
+	}
+	if udp.Network != "udp" || udp.RemoteAddr != "216.239.35.4:123" || udp.Handler != "*core.echoUDPHandler" {
+		t.Errorf("unexpected UDP conn %+v", udp)
+	}
+
+	for _, c := range conns {
+		if err := s.CloseConn(c.ID); err != nil {
+			t.Errorf("failed to close %v: %v", c.ID, err)
+		}
+	}
+	if conns := s.Conns(); len(conns) != 0 {
+		t.Errorf("conns not closed %+v", conns)
+	}
+	if err := s.CloseConn("tcp-0"); err == nil {
+		t.Error("closed an unknown conn")
+	}
+}
+
+type tappedPacket struct {
+	data []byte
+	dir  PacketDirection
+}
+
+// This packet tap records copies of tapped packets.
+type chanPacketTap chan tappedPacket
+
+func (t chanPacketTap) TapPacket(pkt []byte, dir PacketDirection) {
+	t <- tappedPacket{append([]byte(nil), pkt...), dir}
+}
+
+func TestPacketTap(t *testing.T) {
+	s := NewIsolatedLWIPStack()
+	defer s.Close()
+	s.RegisterOutputFn(func(data []byte) (int, error) {
+		return len(data), nil
+	})
+	s.RegisterICMPHandler(&echoICMPHandler{})
+	tap := make(chanPacketTap, 2)
+	s.RegisterPacketTap(tap)
+
+	req := icmpEchoRequest(net.IPv4(10, 0, 0, 2), net.IPv4(1, 2, 3, 4), 7, 1, []byte("ping payload"))
+	write(s, append([]byte(nil), req...), t)
+	in, out := <-tap, <-tap
+	if in.dir != PacketInbound || out.dir != PacketOutbound {
+		t.Errorf("unexpected directions %v, %v", in.dir, out.dir)
+	}
+	assertEqual(in.data, req, t)
+	if out.data[ipv4Header] != icmpv4EchoReply {
+		t.Errorf("unexpected ICMP type %d", out.data[ipv4Header])
+	}
+}
+
+// Swapping the UDP handler of a running stack keeps existing sessions on
+// the old handler.
+func TestSwapUDPHandler(t *testing.T) {
+	ntp = decode(ntpHex)
+	ntpPayload = ntp[ipv4Header+udpHeader:]
+	otherSource := append([]byte(nil), ntp...)
+	otherSource[ipv4Header+1]++
+
+	s := NewIsolatedLWIPStack()
+	defer s.Close()
+	h1 := &fakeUDPHandler{packets: make(chan []byte, 2)}
+	s.RegisterUDPConnHandler(h1)
+	write(s, append([]byte(nil), ntp...), t)
+	assertEqual(<-h1.packets, ntpPayload, t)
+
+	h2 := &fakeUDPHandler{packets: make(chan []byte, 1)}
+	s.RegisterUDPConnHandler(h2)
+	write(s, append([]byte(nil), ntp...), t)
+	assertEqual(<-h1.packets, ntpPayload, t)
+	write(s, otherSource, t)
+	assertEqual(<-h2.packets, ntpPayload, t)
+}
+
+// Handlers, the tap and the output function can be registered while the
+// stack is handling packets, run with -race.
+func TestRegisterWhileRunning(t *testing.T) {
+	ping := icmpEchoRequest(net.IP{10, 0, 0, 1}, net.IP{1, 2, 3, 4}, 1, 1, []byte("ping"))
+
+	s := NewIsolatedLWIPStack()
+	defer s.Close()
+	output := func(data []byte) (int, error) { return len(data), nil }
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			s.RegisterOutputFn(output)
+			s.RegisterICMPHandler(&echoICMPHandler{})
+			s.RegisterPacketTap(make(chanPacketTap, 1000))
+			s.RegisterFakeDns(nil)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		write(s, decode(synHex), t)
+		write(s, append([]byte(nil), ping...), t)
+	}
+	<-done
+}
+
+// evictedTCPConn and evictedUDPConn count the conns evicted from the
+// connection tables.
+type evictedTCPConn struct {
+	TCPConn
+	evicted chan struct{}
+}
+
+func (c *evictedTCPConn) Abort() { c.evicted <- struct{}{} }
+
+type evictedUDPConn struct {
+	UDPConn
+	evicted chan struct{}
+}
+
+func (c *evictedUDPConn) Close() error {
+	c.evicted <- struct{}{}
+	return nil
+}
+
+// Connection table sizes set before NewLWIPStack apply to the new stack.
+func TestConnParamsCarriedOver(t *testing.T) {
+	SetTCPParams(2)
+	SetUDPParams(3)
+	s := NewLWIPStack().(*lwipStack)
+	defer func() {
+		SetTCPParams(defaultMaxConnSize)
+		SetUDPParams(defaultMaxConnSize)
+		s.Close()
+	}()
+
+	evicted := make(chan struct{}, 8)
+	for i := 0; i < 3; i++ {
+		s.tcpConns.Add(uint32(i), &evictedTCPConn{evicted: evicted})
+	}
+	for i := 0; i < 4; i++ {
+		s.udpConns.Add(strconv.Itoa(i), &evictedUDPConn{evicted: evicted})
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-evicted:
+		case <-time.After(time.Second):
+			t.Fatal("no conn evicted")
+		}
+	}
+	if s.tcpConns.Len() != 2 || s.udpConns.Len() != 3 {
+		t.Errorf("%d TCP and %d UDP conns, want 2 and 3", s.tcpConns.Len(), s.udpConns.Len())
+	}
+	s.tcpConns.Purge()
+	s.udpConns.Purge()
+}
+
+// This UDP handler records whether it has been shut down.
+type shutdownUDPHandler struct {
+	echoUDPHandler
+	shutdown bool
+}
+
+func (h *shutdownUDPHandler) Shutdown() error {
+	h.shutdown = true
+	return nil
+}
+
+func TestShutdown(t *testing.T) {
+	s, conn, _ := connectTCP(t, 12348)
+	defer s.Close()
+	h := &shutdownUDPHandler{}
+	s.RegisterUDPConnHandler(h)
+	write(s, decode(ntpHex), t)
+
+	// The client never answers the FIN, so the connection is reset.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	stats, err := s.Shutdown(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *stats != (ShutdownStats{TCPAborted: 1, UDPClosed: 1}) {
+		t.Errorf("unexpected stats: %v", stats)
+	}
+	if !h.shutdown {
+		t.Error("UDP handler not shut down")
+	}
+	if _, err := conn.Read(make([]byte, 16)); err == nil {
+		t.Error("read from a closed connection succeeded")
+	}
+	if _, err := s.Write(decode(ntpHex)); err == nil {
+		t.Error("write to a shut down stack succeeded")
+	}
+}
+
+// Connections are reset at once if ctx is done before Shutdown.
+func TestShutdownCancelled(t *testing.T) {
+	s, _, _ := connectTCP(t, 12349)
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	done := make(chan *ShutdownStats, 1)
+	go func() {
+		stats, err := s.Shutdown(ctx)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- stats
+	}()
+	select {
+	case stats := <-done:
+		if *stats != (ShutdownStats{TCPAborted: 1}) {
+			t.Errorf("unexpected stats: %v", stats)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Shutdown did not return")
+	}
+}
+
+// sliceHandler is not comparable, using it as a map key panics.
+type sliceHandler struct {
+	calls *int
+	_     []byte
+}
+
+func (h sliceHandler) Shutdown() error {
+	*h.calls++
+	return nil
+}
+
+type errorHandler struct {
+	calls int
+	err   error
+}
+
+func (h *errorHandler) Shutdown() error {
+	h.calls++
+	return h.err
+}
+
+func TestShutdownHandlers(t *testing.T) {
+	var sliceCalls int
+	sh := sliceHandler{calls: &sliceCalls}
+	h1 := &errorHandler{err: errors.New("first")}
+	h2 := &errorHandler{err: errors.New("second")}
+	err := ShutdownHandlers(h1, sh, nil, &echoUDPHandler{}, h1, h2, sh)
+	if err != h1.err {
+		t.Errorf("got error %v, want %v", err, h1.err)
+	}
+	if h1.calls != 1 || h2.calls != 1 {
+		t.Errorf("handlers shut down %d and %d times, want once", h1.calls, h2.calls)
+	}
+	// Uncomparable handlers can not be told apart.
+	if sliceCalls != 2 {
+		t.Errorf("uncomparable handler shut down %d times, want 2", sliceCalls)
+	}
+}
+
+// vtunStack wires a new isolated stack to an in-memory TUN device and
+// returns it with a client on the other end of the device.
+func vtunStack(t *testing.T) (LWIPStack, *vtun.Client) {
+	s := NewIsolatedLWIPStack()
+	dev, clientDev := vtun.Pipe()
+	s.RegisterOutputFn(dev.Write)
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, err := dev.Read(buf)
+			if err != nil {
+				return
+			}
+			s.Write(buf[:n])
+		}
+	}()
+	t.Cleanup(func() {
+		dev.Close()
+		s.Close()
+	})
+	return s, vtun.NewClient(clientDev, net.IP{10, 0, 0, 1})
+}
+
+// This TCP handler echoes data and closes the writing side on EOF. Reads
+// and writes are done by different goroutines, as lwIP blocks on delivering
+// data while writes wait for lwIP.
+type echoTCPHandler struct{}
+
+func (h *echoTCPHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
+	chunks := make(chan []byte, 1024)
+	go func() {
+		defer close(chunks)
+		for {
+			buf := make([]byte, 4096)
+			n, err := conn.Read(buf)
+			if n > 0 {
+				chunks <- buf[:n]
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		for chunk := range chunks {
+			if _, err := conn.Write(chunk); err != nil {
+				return
+			}
+		}
+		conn.(TCPConn).CloseWrite()
+	}()
+	return nil
+}
+
+func TestTCPEcho(t *testing.T) {
+	s, client := vtunStack(t)
+	s.RegisterTCPConnHandler(&echoTCPHandler{})
+
+	conn, err := client.DialTCP(&net.TCPAddr{IP: net.IP{1, 2, 3, 4}, Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	data := make([]byte, 256<<10)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	go func() {
+		if _, err := conn.Write(data); err != nil {
+			t.Error(err)
+		}
+		// The FIN is echoed as EOF by the handler.
+		conn.CloseWrite()
+	}()
+	echoed, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(echoed, data, t)
+}
+
+func TestTCPHandlerAbort(t *testing.T) {
+	s, client := vtunStack(t)
+	h := &chanTCPHandler{conns: make(chan net.Conn, 1)}
+	s.RegisterTCPConnHandler(h)
+
+	conn, err := client.DialTCP(&net.TCPAddr{IP: net.IP{1, 2, 3, 4}, Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	var hc net.Conn
+	select {
+	case hc = <-h.conns:
+	case <-time.After(time.Second):
+		t.Fatal("connection not accepted")
+	}
+	buf := make([]byte, 16)
+	n, err := hc.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(buf[:n], []byte("hello"), t)
+
+	hc.(TCPConn).Abort()
+	if _, err := conn.Read(buf); err != vtun.ErrReset {
+		t.Errorf("unexpected read error: %v", err)
+	}
+}
+
+func TestTCPClientAbort(t *testing.T) {
+	s, client := vtunStack(t)
+	h := &chanTCPHandler{conns: make(chan net.Conn, 1)}
+	s.RegisterTCPConnHandler(h)
+
+	conn, err := client.DialTCP(&net.TCPAddr{IP: net.IP{1, 2, 3, 4}, Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	var hc net.Conn
+	select {
+	case hc = <-h.conns:
+	case <-time.After(time.Second):
+		t.Fatal("connection not accepted")
+	}
+	hc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 16)
+	if _, err := io.ReadFull(hc, buf[:5]); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.Abort()
+	if _, err := hc.Read(buf); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("unexpected read error: %v", err)
+	}
+}
+
+// This TCP handler refuses all conns.
+type refusingTCPHandler struct{}
+
+func (h *refusingTCPHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
+	return errors.New("refused")
+}
+
+func TestTCPRefused(t *testing.T) {
+	s, client := vtunStack(t)
+	s.RegisterTCPConnHandler(&refusingTCPHandler{})
+
+	// Conns are passed to the handler once the handshake is complete.
+	conn, err := client.DialTCP(&net.TCPAddr{IP: net.IP{1, 2, 3, 4}, Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 16)); err != vtun.ErrReset {
+		t.Errorf("unexpected read error: %v", err)
+	}
+}
+
+func TestUDPEcho(t *testing.T) {
+	s, client := vtunStack(t)
+	s.RegisterUDPConnHandler(&echoUDPHandler{})
+
+	server := &net.UDPAddr{IP: net.IP{1, 2, 3, 4}, Port: 7}
+	conn, err := client.DialUDP(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, msg := range []string{"first", "second"} {
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 16)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(buf[:n], []byte(msg), t)
+		if addr.String() != server.String() {
+			t.Errorf("unexpected source address %v", addr)
+		}
+	}
+}
+
+// FuzzWrite writes arbitrary packets to a stack with handlers accepting
+// everything, it must never crash.
+func FuzzWrite(f *testing.F) {
+	f.Add(decode(ntpHex))
+	f.Add(decode(frag1Hex))
+	f.Add(decode(frag2Hex))
+	f.Add(icmpEchoRequest(net.IPv4(10, 0, 0, 2), net.IPv4(1, 2, 3, 4), 7, 1, []byte("ping")))
+	client4 := &net.TCPAddr{IP: net.IP{10, 0, 0, 1}, Port: 12349}
+	server4 := &net.TCPAddr{IP: net.IP{1, 2, 3, 4}, Port: 80}
+	f.Add(tcpSegment(client4, server4, 1000, 0, tcpFlagSyn, nil))
+	f.Add(tcpSegment(client4, server4, 1001, 1, tcpFlagAck|tcpFlagPsh, []byte("data")))
+	client6 := &net.TCPAddr{IP: net.ParseIP("fd00::1"), Port: 12349}
+	server6 := &net.TCPAddr{IP: net.ParseIP("fd00::2"), Port: 80}
+	f.Add(vtun.TCPPacket(client6, server6, 1000, 0, vtun.FlagSyn, nil))
+	f.Add(vtun.UDPPacket((*net.UDPAddr)(client6), (*net.UDPAddr)(server6), []byte("data")))
+	// ipaddr_ntoa() formats the destination address of this packet as
+	// "0:1FD:FC:0:F2:FFFF:FF00:".
+	f.Add(decode("60000000000c1140fd000000000000000000000000000000000001fd00fc000000f2ffffff000000000002303d0050000c008164677461"))
+
+	s := NewIsolatedLWIPStack()
+	f.Cleanup(func() { s.Close() })
+	s.RegisterTCPConnHandler(&echoTCPHandler{})
+	s.RegisterUDPConnHandler(&echoUDPHandler{})
+	s.RegisterICMPHandler(&echoICMPHandler{})
+	s.RegisterOutputFn(func(data []byte) (int, error) {
+		return len(data), nil
+	})
+	f.Fuzz(func(t *testing.T, pkt []byte) {
+		s.Write(pkt)
+	})
+}
+
+// udpBatch returns n UDP packets from distinct source ports.
+func udpBatch(n int, payload []byte) [][]byte {
+	dst := &net.UDPAddr{IP: net.IP{1, 2, 3, 4}, Port: 7}
+	pkts := make([][]byte, n)
+	for i := range pkts {
+		src := &net.UDPAddr{IP: net.IP{10, 0, 0, 1}, Port: 20000 + i}
+		pkts[i] = vtun.UDPPacket(src, dst, payload)
+	}
+	return pkts
+}
+
+// echoStack returns a stack echoing UDP packets with the conns of pkts
+// connected, so that further packets are echoed synchronously.
+func echoStack(tb testing.TB, pkts [][]byte) LWIPStack {
+	s := NewIsolatedLWIPStack()
+	tb.Cleanup(func() { s.Close() })
+	s.RegisterUDPConnHandler(&echoUDPHandler{})
+	out := make(chan []byte, len(pkts))
+	s.RegisterOutputFn(func(data []byte) (int, error) {
+		out <- nil
+		return len(data), nil
+	})
+	for _, pkt := range pkts {
+		if _, err := s.Write(pkt); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	for range pkts {
+		<-out
+	}
+	return s
+}
+
+// Replies to packets written in a batch come out of the batch output
+// function at once, packets failing to be written are dropped.
+func TestWriteBatch(t *testing.T) {
+	pkts := udpBatch(8, []byte("batch"))
+	s := echoStack(t, pkts)
+	s.RegisterOutputFn(func(data []byte) (int, error) {
+		t.Error("unexpected output out of batch")
+		return len(data), nil
+	})
+	out := make(chan [][]byte, 1)
+	s.RegisterBatchOutputFn(func(pkts [][]byte) (int, error) {
+		batch := make([][]byte, len(pkts))
+		for i, pkt := range pkts {
+			batch[i] = append([]byte(nil), pkt...)
+		}
+		out <- batch
+		return len(pkts), nil
+	})
+
+	dropped := packetsDropped.Value()
+	n, err := s.WriteBatch(append(append(pkts[:4:4], []byte{0x45}), pkts[4:]...))
+	if n != 9 || err != nil {
+		t.Fatalf("WriteBatch() = %d, %v, want 9", n, err)
+	}
+	if packetsDropped.Value() != dropped+1 {
+		t.Errorf("%d packets dropped, want 1", packetsDropped.Value()-dropped)
+	}
+	replies := <-out
+	if len(replies) != 8 {
+		t.Fatalf("got %d replies, want 8", len(replies))
+	}
+	for i, reply := range replies {
+		p, err := vtun.ParsePacket(reply)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.DstPort != 20000+i || string(p.Payload) != "batch" {
+			t.Errorf("unexpected reply %v", p)
+		}
+	}
+
+	// Packets written one by one still go to the output function.
+	s.RegisterOutputFn(func(data []byte) (int, error) {
+		out <- [][]byte{append([]byte(nil), data...)}
+		return len(data), nil
+	})
+	write(s, pkts[0], t)
+	if replies := <-out; len(replies) != 1 {
+		t.Fatalf("got %d replies, want 1", len(replies))
+	}
+}
+
+// benchmarkWrite writes batches of UDP packets to a stack echoing them, with
+// write either writing the packets one by one or in a batch.
+func benchmarkWrite(b *testing.B, write func(s LWIPStack, pkts [][]byte)) {
+	pkts := udpBatch(64, make([]byte, 1400))
+	s := echoStack(b, pkts)
+	s.RegisterOutputFn(func(data []byte) (int, error) {
+		return len(data), nil
+	})
+	s.RegisterBatchOutputFn(func(pkts [][]byte) (int, error) {
+		return len(pkts), nil
+	})
+
+	b.SetBytes(int64(len(pkts) * len(pkts[0])))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		write(s, pkts)
+	}
+}
+
+func BenchmarkWrite(b *testing.B) {
+	benchmarkWrite(b, func(s LWIPStack, pkts [][]byte) {
+		for _, pkt := range pkts {
+			s.Write(pkt)
+		}
+	})
+}
+
+func BenchmarkWriteBatch(b *testing.B) {
+	benchmarkWrite(b, func(s LWIPStack, pkts [][]byte) {
+		s.WriteBatch(pkts)
+	})
+}
+
+// tcpOptions returns the options of a TCP segment by kind.
+func tcpOptions(pkt []byte) map[byte][]byte {
+	tcp := pkt[ipv4Header:]
+	opts := tcp[tcpHeader : int(tcp[12]>>4)*4]
+	m := make(map[byte][]byte)
+	for len(opts) > 0 {
+		switch opts[0] {
+		case 0: // End of options.
+			return m
+		case 1: // No-operation.
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || int(opts[1]) < 2 || int(opts[1]) > len(opts) {
+			return m
+		}
+		m[opts[0]] = opts[2:opts[1]]
+		opts = opts[opts[1]:]
+	}
+	return m
+}
+
+func TestTCPOptionLimits(t *testing.T) {
+	s := &lwipStack{}
+	for _, opt := range []StackOption{WithTCPWindow(1), WithTCPSendBuffer(1)} {
+		opt(s)
+	}
+	if s.tcpWindow != MinTCPWindow || s.tcpSendBuffer != MinTCPSendBuffer {
+		t.Errorf("window %d, send buffer %d, want %d and %d", s.tcpWindow, s.tcpSendBuffer, MinTCPWindow, MinTCPSendBuffer)
+	}
+	for _, opt := range []StackOption{WithTCPWindow(1 << 30), WithTCPSendBuffer(1 << 30)} {
+		opt(s)
+	}
+	if s.tcpWindow != MaxTCPWindow || s.tcpSendBuffer != MaxTCPSendBuffer {
+		t.Errorf("window %d, send buffer %d, want %d and %d", s.tcpWindow, s.tcpSendBuffer, MaxTCPWindow, MaxTCPSendBuffer)
+	}
+}
+
+func TestTCPOptions(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		opts    []StackOption
+		synOpts []byte // Options of the SYN sent by the client.
+
+		mss, segment int    // Advertised MSS and length of data segments.
+		scale        []byte // Window scale option of the SYN-ACK.
+		window       uint16 // Window of data segments.
+	}{
+		{
+			name:    "defaults",
+			mss:     1460,
+			segment: 536, // The client sends no MSS.
+			window:  DefaultTCPWindow,
+		},
+		{
+			name:    "mtu and mss",
+			opts:    []StackOption{WithMTU(1280), WithMSS(500), WithTCPWindow(16384)},
+			synOpts: []byte{2, 4, 0x05, 0xb4}, // MSS 1460.
+			mss:     1240,
+			segment: 500,
+			window:  16384,
+		},
+		{
+			name:    "window scaling",
+			opts:    []StackOption{WithTCPWindow(1 << 20), WithTCPSendBuffer(1 << 20)},
+			synOpts: []byte{2, 4, 0x05, 0xb4, 1, 3, 3, 3}, // MSS 1460, window scale 3.
+			mss:     1460,
+			segment: 1460,
+			scale:   []byte{7},
+			window:  (1 << 20) >> 7,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := NewIsolatedLWIPStack(tc.opts...)
+			defer s.Close()
+			h := &chanTCPHandler{conns: make(chan net.Conn, 1)}
+			s.RegisterTCPConnHandler(h)
+			out := make(chan []byte, 1024)
+			s.RegisterOutputFn(func(data []byte) (int, error) {
+				out <- append([]byte(nil), data...)
+				return len(data), nil
+			})
+
+			client := &net.TCPAddr{IP: net.IP{10, 0, 0, 1}, Port: 12350}
+			server := &net.TCPAddr{IP: net.IP{1, 2, 3, 4}, Port: 80}
+			syn := tcpSegment(client, server, 1000, 0, tcpFlagSyn, tc.synOpts)
+			syn[ipv4Header+12] = byte((tcpHeader+len(tc.synOpts))/4) << 4
+			write(s, syn, t)
+
+			synAck := <-out
+			opts := tcpOptions(synAck)
+			if mss := opts[2]; len(mss) != 2 || int(binary.BigEndian.Uint16(mss)) != tc.mss {
+				t.Errorf("advertised MSS %x, want %d", mss, tc.mss)
+			}
+			if scale := opts[3]; !bytes.Equal(scale, tc.scale) {
+				t.Errorf("window scale %x, want %x", scale, tc.scale)
+			}
+			ack := binary.BigEndian.Uint32(synAck[ipv4Header+4:ipv4Header+8]) + 1
+			write(s, tcpSegment(client, server, 1001, ack, tcpFlagAck, nil), t)
+
+			var conn net.Conn
+			select {
+			case conn = <-h.conns:
+			case <-time.After(time.Second):
+				t.Fatal("connection not accepted")
+			}
+			if _, err := conn.Write(make([]byte, 4000)); err != nil {
+				t.Fatal(err)
+			}
+			seg := <-out
+			if n := len(seg) - ipv4Header - tcpHeader; n != tc.segment {
+				t.Errorf("segment of %d bytes, want %d", n, tc.segment)
+			}
+			if window := binary.BigEndian.Uint16(seg[ipv4Header+14:]); window != tc.window {
+				t.Errorf("window %d, want %d", window, tc.window)
+			}
+		})
+	}
+}
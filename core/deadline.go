@@ -0,0 +1,46 @@
+package core
+
+import (
+	"sync"
+	"time"
+)
+
+// deadlineTimer tracks a deadline and calls expired once it passes, so that
+// goroutines blocked waiting on a condition can be woken up to check it.
+type deadlineTimer struct {
+	sync.Mutex
+
+	deadline time.Time
+	timer    *time.Timer
+	expired  func()
+}
+
+func newDeadlineTimer(expired func()) *deadlineTimer {
+	return &deadlineTimer{expired: expired}
+}
+
+// set sets the deadline, a zero value means no deadline.
+func (d *deadlineTimer) set(t time.Time) {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	d.deadline = t
+	if t.IsZero() {
+		return
+	}
+	// A timer of a previous deadline may still fire, which is harmless as
+	// waiters check exceeded after being woken up.
+	d.timer = time.AfterFunc(time.Until(t), d.expired)
+}
+
+// exceeded reports whether the deadline has passed.
+func (d *deadlineTimer) exceeded() bool {
+	d.Lock()
+	defer d.Unlock()
+
+	return !d.deadline.IsZero() && !time.Now().Before(d.deadline)
+}
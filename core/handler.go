@@ -2,6 +2,8 @@ package core
 
 import (
 	"net"
+
+	"github.com/eycorsican/go-tun2socks/common/dns"
 )
 
 // TCPConnHandler handles TCP connections comming from TUN.
@@ -28,13 +30,39 @@ type UDPConnHandlerEx interface {
 	ReceiveToBuffer(conn UDPConnEx, reader BytesReader, addr *net.UDPAddr) error
 }
 
-var tcpConnHandler TCPConnHandler
-var udpConnHandler UDPConnHandler
-
+// RegisterTCPConnHandler sets the TCP connection handler of the default stack.
 func RegisterTCPConnHandler(h TCPConnHandler) {
-	tcpConnHandler = h
+	defaultStack.RegisterTCPConnHandler(h)
 }
 
+// RegisterUDPConnHandler sets the UDP connection handler of the default stack.
 func RegisterUDPConnHandler(h UDPConnHandler) {
-	udpConnHandler = h
+	defaultStack.RegisterUDPConnHandler(h)
+}
+
+// RegisterConnHandlers sets the TCP and UDP connection handlers of the
+// default stack at once.
+func RegisterConnHandlers(tcp TCPConnHandler, udp UDPConnHandler) {
+	defaultStack.RegisterConnHandlers(tcp, udp)
+}
+
+// RegisterFakeDns sets the fake DNS of the default stack.
+func RegisterFakeDns(d dns.FakeDns) {
+	defaultStack.RegisterFakeDns(d)
+}
+
+// RegisteredTCPConnHandler returns the TCP connection handler of the default
+// stack, e.g. for handlers wrapping it.
+func RegisteredTCPConnHandler() TCPConnHandler {
+	lwipMutex.Lock()
+	defer lwipMutex.Unlock()
+	return defaultStack.tcpHandler
+}
+
+// RegisteredUDPConnHandler returns the UDP connection handler of the default
+// stack, e.g. for handlers wrapping it.
+func RegisteredUDPConnHandler() UDPConnHandler {
+	lwipMutex.Lock()
+	defer lwipMutex.Unlock()
+	return defaultStack.udpHandler
 }
@@ -0,0 +1,244 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+const (
+	proto_icmpv6 = 58
+
+	icmpv4EchoRequest = 8
+	icmpv4EchoReply   = 0
+	icmpv6EchoRequest = 128
+	icmpv6EchoReply   = 129
+
+	ipv4HeaderLen = 20
+	ipv6HeaderLen = 40
+	icmpEchoLen   = 8 // type, code, checksum, identifier and sequence number
+	icmpReplyTTL  = 64
+)
+
+// ICMPEchoRequest is an ICMP or ICMPv6 echo request coming from TUN.
+type ICMPEchoRequest struct {
+	// Src is the address of the local client sending the request.
+	Src net.IP
+
+	// Dst is the address being pinged.
+	Dst net.IP
+
+	ID      uint16
+	Seq     uint16
+	Payload []byte
+}
+
+// ICMPEchoWriter writes echo replies to TUN.
+type ICMPEchoWriter interface {
+	// WriteEchoReply synthesizes an echo reply to req carrying payload,
+	// as if it was sent by req.Dst, and writes it to TUN.
+	WriteEchoReply(req *ICMPEchoRequest, payload []byte) error
+}
+
+// ICMPHandler handles ICMP and ICMPv6 echo requests coming from TUN.
+type ICMPHandler interface {
+	// HandleEcho is called for every unfragmented echo request written to
+	// the stack, it must not block. Returning false lets lwIP reply to the
+	// request locally, returning true means the request is consumed by the
+	// handler, which may reply later through w.
+	HandleEcho(req *ICMPEchoRequest, w ICMPEchoWriter) bool
+}
+
+// RegisterICMPHandler sets the ICMP handler of the default stack.
+func RegisterICMPHandler(h ICMPHandler) {
+	defaultStack.RegisterICMPHandler(h)
+}
+
+type localICMPHandler struct{}
+
+// NewLocalICMPHandler returns a handler letting the stack reply to every
+// echo request itself, whatever the destination is. This is the behaviour
+// when no ICMP handler is registered.
+func NewLocalICMPHandler() ICMPHandler {
+	return &localICMPHandler{}
+}
+
+func (h *localICMPHandler) HandleEcho(req *ICMPEchoRequest, w ICMPEchoWriter) bool {
+	return false
+}
+
+type dropICMPHandler struct{}
+
+// NewDropICMPHandler returns a handler silently dropping echo requests.
+func NewDropICMPHandler() ICMPHandler {
+	return &dropICMPHandler{}
+}
+
+func (h *dropICMPHandler) HandleEcho(req *ICMPEchoRequest, w ICMPEchoWriter) bool {
+	return true
+}
+
+// parseICMPEchoRequest parses an unfragmented IPv4 or IPv6 packet carrying an
+// echo request, it returns nil for any other packet.
+func parseICMPEchoRequest(ipv ipver, pkt []byte) *ICMPEchoRequest {
+	var src, dst net.IP
+	var icmp []byte
+	switch ipv {
+	case ipv4:
+		if len(pkt) < ipv4HeaderLen {
+			return nil
+		}
+		ihl := int(pkt[0]&0x0f) * 4
+		totlen := int(binary.BigEndian.Uint16(pkt[2:4]))
+		if pkt[9] != proto_icmp || ihl < ipv4HeaderLen || totlen < ihl+icmpEchoLen || totlen > len(pkt) {
+			return nil
+		}
+		if moreFrags(ipv, pkt) || fragOffset(ipv, pkt) > 0 {
+			return nil
+		}
+		src, dst = net.IP(pkt[12:16]), net.IP(pkt[16:20])
+		icmp = pkt[ihl:totlen]
+		if icmp[0] != icmpv4EchoRequest || icmp[1] != 0 {
+			return nil
+		}
+	case ipv6:
+		if len(pkt) < ipv6HeaderLen {
+			return nil
+		}
+		totlen := ipv6HeaderLen + int(binary.BigEndian.Uint16(pkt[4:6]))
+		if totlen > len(pkt) {
+			return nil
+		}
+		next, off, frag, err := walkIPv6(pkt[:totlen])
+		if err != nil || next != proto_icmpv6 || frag != nil || totlen < off+icmpEchoLen {
+			return nil
+		}
+		src, dst = net.IP(pkt[8:24]), net.IP(pkt[24:40])
+		icmp = pkt[off:totlen]
+		if icmp[0] != icmpv6EchoRequest || icmp[1] != 0 {
+			return nil
+		}
+	default:
+		return nil
+	}
+
+	// Copy everything out, pkt belongs to the caller.
+	return &ICMPEchoRequest{
+		Src:     append(net.IP(nil), src...),
+		Dst:     append(net.IP(nil), dst...),
+		ID:      binary.BigEndian.Uint16(icmp[4:6]),
+		Seq:     binary.BigEndian.Uint16(icmp[6:8]),
+		Payload: append([]byte(nil), icmp[icmpEchoLen:]...),
+	}
+}
+
+// buildICMPEchoReply builds the IP packet answering req.
+func buildICMPEchoReply(req *ICMPEchoRequest, payload []byte) ([]byte, error) {
+	if src4, dst4 := req.Dst.To4(), req.Src.To4(); src4 != nil && dst4 != nil {
+		totlen := ipv4HeaderLen + icmpEchoLen + len(payload)
+		if totlen > 0xffff {
+			return nil, errors.New("ICMP payload too large")
+		}
+		pkt := make([]byte, totlen)
+		pkt[0] = 0x45
+		binary.BigEndian.PutUint16(pkt[2:4], uint16(totlen))
+		pkt[8] = icmpReplyTTL
+		pkt[9] = proto_icmp
+		copy(pkt[12:16], src4)
+		copy(pkt[16:20], dst4)
+		binary.BigEndian.PutUint16(pkt[10:12], checksum(pkt[:ipv4HeaderLen], 0))
+
+		icmp := pkt[ipv4HeaderLen:]
+		icmp[0] = icmpv4EchoReply
+		binary.BigEndian.PutUint16(icmp[4:6], req.ID)
+		binary.BigEndian.PutUint16(icmp[6:8], req.Seq)
+		copy(icmp[icmpEchoLen:], payload)
+		binary.BigEndian.PutUint16(icmp[2:4], checksum(icmp, 0))
+		return pkt, nil
+	}
+
+	src6, dst6 := req.Dst.To16(), req.Src.To16()
+	if src6 == nil || dst6 == nil {
+		return nil, errors.New("invalid ICMP echo request address")
+	}
+	plen := icmpEchoLen + len(payload)
+	if plen > 0xffff {
+		return nil, errors.New("ICMP payload too large")
+	}
+	pkt := make([]byte, ipv6HeaderLen+plen)
+	pkt[0] = 0x60
+	binary.BigEndian.PutUint16(pkt[4:6], uint16(plen))
+	pkt[6] = proto_icmpv6
+	pkt[7] = icmpReplyTTL
+	copy(pkt[8:24], src6)
+	copy(pkt[24:40], dst6)
+
+	icmp := pkt[ipv6HeaderLen:]
+	icmp[0] = icmpv6EchoReply
+	binary.BigEndian.PutUint16(icmp[4:6], req.ID)
+	binary.BigEndian.PutUint16(icmp[6:8], req.Seq)
+	copy(icmp[icmpEchoLen:], payload)
+	// ICMPv6 checksum covers the IPv6 pseudo header.
+	sum := pseudoHeaderSum(pkt[8:24], pkt[24:40], proto_icmpv6, plen)
+	binary.BigEndian.PutUint16(icmp[2:4], checksum(icmp, sum))
+	return pkt, nil
+}
+
+func pseudoHeaderSum(src, dst []byte, proto byte, length int) uint32 {
+	var sum uint32
+	for _, b := range [][]byte{src, dst} {
+		for i := 0; i+1 < len(b); i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(b[i : i+2]))
+		}
+	}
+	sum += uint32(length>>16) + uint32(length&0xffff)
+	sum += uint32(proto)
+	return sum
+}
+
+// checksum computes the Internet checksum of b, starting from sum.
+func checksum(b []byte, sum uint32) uint16 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i : i+2]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
+
+// WriteEchoReply implements ICMPEchoWriter, replies are written through the
+// output function of the stack.
+func (s *lwipStack) WriteEchoReply(req *ICMPEchoRequest, payload []byte) error {
+	pkt, err := buildICMPEchoReply(req, payload)
+	if err != nil {
+		return err
+	}
+	countOutput(len(pkt))
+	lwipMutex.Lock()
+	s.tapPacket(pkt, PacketOutbound)
+	outputFn := s.outputFn
+	lwipMutex.Unlock()
+	_, err = outputFn(pkt)
+	return err
+}
+
+// handleICMP passes echo requests to the ICMP handler h, it returns true if
+// the packet has been consumed.
+func (s *lwipStack) handleICMP(h ICMPHandler, pkt []byte) bool {
+	if h == nil {
+		return false
+	}
+	ipv, err := peekIPVer(pkt)
+	if err != nil {
+		return false
+	}
+	req := parseICMPEchoRequest(ipv, pkt)
+	if req == nil {
+		return false
+	}
+	return h.HandleEcho(req, s)
+}
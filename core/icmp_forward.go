@@ -0,0 +1,87 @@
+package core
+
+import (
+	"net"
+	"time"
+
+	"golang.org/x/net/icmp"
+	netipv4 "golang.org/x/net/ipv4"
+	netipv6 "golang.org/x/net/ipv6"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+)
+
+type forwardICMPHandler struct {
+	timeout time.Duration
+}
+
+// NewForwardICMPHandler returns a handler forwarding echo requests to their
+// real destination through an unprivileged ICMP socket, replies received
+// within timeout are written back to TUN.
+//
+// Unprivileged ICMP sockets are only available on Linux (subject to the
+// net.ipv4.ping_group_range sysctl) and macOS, requests are dropped if the
+// socket can not be opened.
+func NewForwardICMPHandler(timeout time.Duration) ICMPHandler {
+	return &forwardICMPHandler{timeout: timeout}
+}
+
+func (h *forwardICMPHandler) HandleEcho(req *ICMPEchoRequest, w ICMPEchoWriter) bool {
+	go h.forward(req, w)
+	return true
+}
+
+func (h *forwardICMPHandler) forward(req *ICMPEchoRequest, w ICMPEchoWriter) {
+	network, laddr := "udp4", "0.0.0.0"
+	var echoType, replyType icmp.Type = netipv4.ICMPTypeEcho, netipv4.ICMPTypeEchoReply
+	proto := proto_icmp
+	if req.Dst.To4() == nil {
+		network, laddr = "udp6", "::"
+		echoType, replyType = netipv6.ICMPTypeEchoRequest, netipv6.ICMPTypeEchoReply
+		proto = proto_icmpv6
+	}
+
+	c, err := icmp.ListenPacket(network, laddr)
+	if err != nil {
+		log.Warnf("failed to open ICMP socket: %v", err)
+		return
+	}
+	defer c.Close()
+
+	// The kernel rewrites the identifier with the socket's own one, the
+	// original identifier is restored when writing the reply.
+	msg := icmp.Message{
+		Type: echoType,
+		Body: &icmp.Echo{ID: int(req.ID), Seq: int(req.Seq), Data: req.Payload},
+	}
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return
+	}
+	if _, err := c.WriteTo(b, &net.UDPAddr{IP: req.Dst}); err != nil {
+		log.Debugf("failed to forward ICMP echo request to %v: %v", req.Dst, err)
+		return
+	}
+
+	buf := NewBytes(BufSize)
+	defer FreeBytes(buf)
+	c.SetReadDeadline(time.Now().Add(h.timeout))
+	for {
+		n, _, err := c.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		reply, err := icmp.ParseMessage(proto, buf[:n])
+		if err != nil || reply.Type != replyType {
+			continue
+		}
+		echo, ok := reply.Body.(*icmp.Echo)
+		if !ok || echo.Seq != int(req.Seq) {
+			continue
+		}
+		if err := w.WriteEchoReply(req, echo.Data); err != nil {
+			log.Warnf("failed to write ICMP echo reply: %v", err)
+		}
+		return
+	}
+}
@@ -6,9 +6,9 @@ package core
 #include "lwip/tcp.h"
 
 err_t
-input(struct pbuf *p)
+input(struct pbuf *p, struct netif *netif)
 {
-	return (*netif_list).input(p, netif_list);
+	return netif->input(p, netif);
 }
 */
 import "C"
@@ -16,6 +16,8 @@ import (
 	"encoding/binary"
 	"errors"
 	"unsafe"
+
+	"github.com/eycorsican/go-tun2socks/common/packet"
 )
 
 type ipver byte
@@ -40,16 +42,29 @@ func peekIPVer(p []byte) (ipver, error) {
 	return ipver((p[0] & 0xf0) >> 4), nil
 }
 
+// walkIPv6 walks the extension headers of an IPv6 packet, see
+// packet.WalkIPv6.
+func walkIPv6(p []byte) (proto, int, []byte, error) {
+	next, off, frag, err := packet.WalkIPv6(p)
+	return proto(next), off, frag, err
+}
+
 func moreFrags(ipv ipver, p []byte) bool {
 	switch ipv {
 	case ipv4:
+		if len(p) < ipv4HeaderLen {
+			return false
+		}
 		if (p[6] & 0x20) > 0 /* has MF (More Fragments) bit set */ {
 			return true
 		}
 	case ipv6:
-		// FIXME Just too lazy to implement this for IPv6, for now
-		// returning true simply indicate do the copy anyway.
-		return true
+		_, _, frag, err := walkIPv6(p)
+		if err != nil {
+			// Copy malformed packets anyway.
+			return true
+		}
+		return frag != nil && (frag[3]&0x01) > 0 /* has M (More Fragments) flag set */
 	}
 	return false
 }
@@ -57,12 +72,16 @@ func moreFrags(ipv ipver, p []byte) bool {
 func fragOffset(ipv ipver, p []byte) uint16 {
 	switch ipv {
 	case ipv4:
+		if len(p) < ipv4HeaderLen {
+			return 0
+		}
 		return binary.BigEndian.Uint16(p[6:8]) & 0x1fff
 	case ipv6:
-		// FIXME Just too lazy to implement this for IPv6, for now
-		// returning a value greater than 0 simply indicate do the
-		// copy anyway.
-		return 1
+		_, _, frag, err := walkIPv6(p)
+		if err != nil || frag == nil {
+			return 0
+		}
+		return binary.BigEndian.Uint16(frag[2:4]) >> 3
 	}
 	return 0
 }
@@ -70,21 +89,26 @@ func fragOffset(ipv ipver, p []byte) uint16 {
 func peekNextProto(ipv ipver, p []byte) (proto, error) {
 	switch ipv {
 	case ipv4:
-		if len(p) < 9 {
+		if len(p) < ipv4HeaderLen {
 			return 0, errors.New("short IPv4 packet")
 		}
 		return proto(p[9]), nil
 	case ipv6:
-		if len(p) < 6 {
-			return 0, errors.New("short IPv6 packet")
-		}
-		return proto(p[6]), nil
+		next, _, _, err := walkIPv6(p)
+		return next, err
 	default:
 		return 0, errors.New("unknown IP version")
 	}
 }
 
-func input(pkt []byte) (int, error) {
+func input(netif *C.struct_netif, pkt []byte) (int, error) {
+	lwipMutex.Lock()
+	defer lwipMutex.Unlock()
+	return inputLocked(netif, pkt)
+}
+
+// inputLocked passes pkt to lwIP, the caller is required to lock lwipMutex.
+func inputLocked(netif *C.struct_netif, pkt []byte) (int, error) {
 	if len(pkt) == 0 {
 		return 0, nil
 	}
@@ -99,9 +123,6 @@ func input(pkt []byte) (int, error) {
 		return 0, err
 	}
 
-	lwipMutex.Lock()
-	defer lwipMutex.Unlock()
-
 	var buf *C.struct_pbuf
 
 	if nextProto == proto_udp && !(moreFrags(ipv, pkt) || fragOffset(ipv, pkt) > 0) {
@@ -118,7 +139,7 @@ func input(pkt []byte) (int, error) {
 		C.pbuf_take(buf, unsafe.Pointer(&pkt[0]), C.u16_t(len(pkt)))
 	}
 
-	ierr := C.input(buf)
+	ierr := C.input(buf, netif)
 	if ierr != C.ERR_OK {
 		C.pbuf_free(buf)
 		return 0, errors.New("packet not handled")
@@ -13,6 +13,10 @@ import (
 	"sync"
 	"time"
 	"unsafe"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+
+	"github.com/eycorsican/go-tun2socks/common/dns"
 )
 
 const CHECK_TIMEOUTS_INTERVAL = 250 // in millisecond
@@ -20,24 +24,200 @@ const TCP_POLL_INTERVAL = 8         // poll every 4 seconds
 
 type LWIPStack interface {
 	Write([]byte) (int, error)
+
+	// WriteBatch writes IP packets to the stack, locking lwIP once for the
+	// whole batch, see lwipStack.WriteBatch.
+	WriteBatch(pkts [][]byte) (int, error)
+
 	Close() error
 	RestartTimeouts()
+
+	// RegisterTCPConnHandler sets the handler for TCP connections accepted
+	// by this stack.
+	RegisterTCPConnHandler(h TCPConnHandler)
+
+	// RegisterUDPConnHandler sets the handler for UDP connections accepted
+	// by this stack.
+	RegisterUDPConnHandler(h UDPConnHandler)
+
+	// RegisterConnHandlers sets both the TCP and the UDP handler, no
+	// connection is accepted between the two.
+	RegisterConnHandlers(tcp TCPConnHandler, udp UDPConnHandler)
+
+	// RegisterICMPHandler sets the handler for ICMP echo requests written
+	// to this stack, lwIP replies to them locally if it's not set.
+	RegisterICMPHandler(h ICMPHandler)
+
+	// RegisterFakeDns sets the fake DNS answering A/AAAA queries sent to
+	// UDP port 53 through this stack, queries are passed to the UDP
+	// handler if it's not set.
+	RegisterFakeDns(d dns.FakeDns)
+
+	// RegisterOutputFn sets the function receiving IP packets output from
+	// this stack.
+	RegisterOutputFn(fn func([]byte) (int, error))
+
+	// RegisterBatchOutputFn sets the function receiving the IP packets
+	// output while processing a WriteBatch, in one batch.
+	RegisterBatchOutputFn(fn func([][]byte) (int, error))
+
+	// RegisterPacketTap sets the tap observing packets written to and
+	// output by this stack.
+	RegisterPacketTap(t PacketTap)
+
+	// Conns returns the TCP and UDP sessions of this stack.
+	Conns() []ConnInfo
+
+	// CloseConn aborts the TCP session or closes the UDP session with the
+	// given ID, see ConnInfo.
+	CloseConn(id string) error
+
+	// Shutdown drains all sessions and closes the stack, see
+	// lwipStack.Shutdown.
+	Shutdown(ctx context.Context) (*ShutdownStats, error)
 }
 
 // lwIP runs in a single thread, locking is needed in Go runtime.
 var lwipMutex = &sync.Mutex{}
 
+// stacks holds all running stacks by key, lwIP callbacks use it to find the
+// stack a pcb or netif belongs to. Protected by lwipMutex.
+var stacks = make(map[uint32]*lwipStack)
+
+var stackKeyCounter uint32 = 1
+
+// defaultStack is the stack bound to the loop interface, package level
+// functions such as RegisterTCPConnHandler and RegisterOutputFn operate
+// on it.
+var defaultStack *lwipStack
+
 type lwipStack struct {
-	tpcb *C.struct_tcp_pcb
-	upcb *C.struct_udp_pcb
+	key   uint32
+	arg   unsafe.Pointer // C allocated arg passed to lwIP callbacks, holds key.
+	netif *C.struct_netif
+	tpcb  *C.struct_tcp_pcb
+	upcb  *C.struct_udp_pcb
+
+	// isolated indicates the netif was allocated for this stack and must be
+	// removed when the stack is closed.
+	isolated bool
+
+	tcpConns    *lru.Cache[uint32, TCPConn]
+	udpConns    *lru.Cache[string, UDPConn]
+	maxTCPConns int
+	maxUDPConns int
+	tcpHandler  TCPConnHandler
+	udpHandler  UDPConnHandler
+	icmpHandler ICMPHandler
+	fakeDns     dns.FakeDns
+	tap         PacketTap
+	outputFn    func([]byte) (int, error)
+
+	// batchOutputFn receives the packets queued in outBatch while batching
+	// is set by WriteBatch. Both are protected by lwipMutex.
+	batchOutputFn func([][]byte) (int, error)
+	batching      bool
+	outBatch      [][]byte
+
+	udpSessionMode UDPSessionMode
+
+	// MTU of the netif and TCP options applied to accepted pcbs, see
+	// options.go.
+	mtu           int
+	tcpMSS        int
+	tcpWindow     int
+	tcpSendBuffer int
+
+	// draining is set by Shutdown to refuse new sessions. Protected by
+	// lwipMutex.
+	draining bool
 
 	ctx    context.Context
 	cancel context.CancelFunc
 }
 
+// newLWIPStackState returns the state of a stack on netif with connection
+// tables of maxTCPConns and maxUDPConns entries.
+func newLWIPStackState(netif *C.struct_netif, maxTCPConns, maxUDPConns int) *lwipStack {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &lwipStack{
+		netif:       netif,
+		tcpConns:    newTCPConnMap(maxTCPConns),
+		udpConns:    newUDPConnMap(maxUDPConns),
+		maxTCPConns: maxTCPConns,
+		maxUDPConns: maxUDPConns,
+		outputFn: func(data []byte) (int, error) {
+			return 0, errors.New("output function not set")
+		},
+		mtu:           DefaultMTU,
+		tcpWindow:     DefaultTCPWindow,
+		tcpSendBuffer: DefaultTCPSendBuffer,
+		ctx:           ctx,
+		cancel:        cancel,
+	}
+}
+
 // NewLWIPStack listens for any incoming connections/packets and registers
 // corresponding accept/recv callback functions.
-func NewLWIPStack() LWIPStack {
+//
+// The returned stack is bound to the loop interface and becomes the default
+// stack, handlers, output function and connection table sizes set with the
+// package level functions are carried over.
+func NewLWIPStack(opts ...StackOption) LWIPStack {
+	lwipMutex.Lock()
+	defer lwipMutex.Unlock()
+
+	s := newLWIPStackState(C.netif_default, defaultStack.maxTCPConns, defaultStack.maxUDPConns)
+	s.tcpHandler = defaultStack.tcpHandler
+	s.udpHandler = defaultStack.udpHandler
+	s.icmpHandler = defaultStack.icmpHandler
+	s.fakeDns = defaultStack.fakeDns
+	s.tap = defaultStack.tap
+	s.outputFn = defaultStack.outputFn
+	s.batchOutputFn = defaultStack.batchOutputFn
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.start()
+	// The replaced state is not closed: the initial one never started
+	// listening and holds no connections, a stack returned by an earlier
+	// call is owned by its caller, who closes it.
+	defaultStack = s
+	return s
+}
+
+// NewIsolatedLWIPStack creates a stack owning its own network interface,
+// connection tables, handlers and output function, so that several
+// independent tunnels can run in one process. Handlers and output function
+// must be registered on the returned stack before writing packets to it.
+func NewIsolatedLWIPStack(opts ...StackOption) LWIPStack {
+	lwipMutex.Lock()
+	defer lwipMutex.Unlock()
+
+	netif := newNetif()
+	if netif == nil {
+		panic("could not allocate netif")
+	}
+	s := newLWIPStackState(netif, defaultMaxConnSize, defaultMaxConnSize)
+	s.isolated = true
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.start()
+	return s
+}
+
+// start creates the listening pcbs on the stack netif. The caller is
+// required to lock lwipMutex.
+func (s *lwipStack) start() {
+	s.key = stackKeyCounter
+	stackKeyCounter += 1
+	s.arg = newConnKeyArg()
+	setConnStackVal(s.arg, s.key)
+
+	s.netif.mtu = C.u16_t(s.mtu)
+	s.netif.mtu6 = C.u16_t(s.mtu)
+
 	tcpPCB := C.tcp_new()
 	if tcpPCB == nil {
 		panic("tcp_new return nil")
@@ -56,11 +236,16 @@ func NewLWIPStack() LWIPStack {
 		panic("unknown tcp_bind return value")
 	}
 
+	setTCPPassiveOpenCallback(tcpPCB)
 	tcpPCB = C.tcp_listen_with_backlog(tcpPCB, C.TCP_DEFAULT_LISTEN_BACKLOG)
 	if tcpPCB == nil {
 		panic("can not allocate tcp pcb")
 	}
+	// tcp_listen resets the netif of the pcb, accepted pcbs inherit the
+	// netif of the listening pcb.
+	C.tcp_bind_netif(tcpPCB, s.netif)
 
+	C.tcp_arg(tcpPCB, s.arg)
 	setTCPAcceptCallback(tcpPCB)
 
 	udpPCB := C.udp_new()
@@ -72,42 +257,97 @@ func NewLWIPStack() LWIPStack {
 	if err != C.ERR_OK {
 		panic("address already in use")
 	}
+	C.udp_bind_netif(udpPCB, s.netif)
 
-	setUDPRecvCallback(udpPCB, nil)
+	setUDPRecvCallback(udpPCB, s.arg)
 
-	ctx, cancel := context.WithCancel(context.Background())
+	s.tpcb = tcpPCB
+	s.upcb = udpPCB
 
-	go func() {
-		for {
-			select {
-			case <-time.After(CHECK_TIMEOUTS_INTERVAL * time.Millisecond):
-				lwipMutex.Lock()
-				C.sys_check_timeouts()
-				lwipMutex.Unlock()
-			case <-ctx.Done():
-				return
-			}
-		}
-	}()
+	// Packets output through the netif are dispatched to the stack by the
+	// arg saved in netif state.
+	s.netif.state = s.arg
+	setNetifOutput(s.netif)
 
-	return &lwipStack{
-		tpcb:   tcpPCB,
-		upcb:   udpPCB,
-		ctx:    ctx,
-		cancel: cancel,
-	}
+	stacks[s.key] = s
+	startTimeouts()
 }
 
-// Write writes IP packets to the stack.
+// Write writes IP packets to the stack. Malformed packets and packets lwIP
+// fails to handle are dropped and counted, so that a bad packet from TUN does
+// not stop the stack; an error is only returned if the stack is closed.
 func (s *lwipStack) Write(data []byte) (int, error) {
 	select {
 	case <-s.ctx.Done():
 		return 0, errors.New("stack closed")
 	default:
-		return input(data)
+		packetsIn.Inc()
+		bytesIn.Add(uint64(len(data)))
+		lwipMutex.Lock()
+		s.tapPacket(data, PacketInbound)
+		icmpHandler := s.icmpHandler
+		lwipMutex.Unlock()
+		if s.handleICMP(icmpHandler, data) {
+			return len(data), nil
+		}
+		if _, err := input(s.netif, data); err != nil {
+			packetsDropped.Inc()
+		}
+		return len(data), nil
 	}
 }
 
+// WriteBatch writes IP packets to the stack as Write does, but lwipMutex is
+// locked once for all packets and the packets output meanwhile are passed
+// to the batch output function at once, if it's set.
+//
+// Packets the stack fails to handle are dropped as in Write, all packets are
+// written unless the stack is closed.
+func (s *lwipStack) WriteBatch(pkts [][]byte) (int, error) {
+	select {
+	case <-s.ctx.Done():
+		return 0, errors.New("stack closed")
+	default:
+	}
+
+	lwipMutex.Lock()
+	for _, pkt := range pkts {
+		packetsIn.Inc()
+		bytesIn.Add(uint64(len(pkt)))
+		s.tapPacket(pkt, PacketInbound)
+	}
+	icmpHandler := s.icmpHandler
+	lwipMutex.Unlock()
+
+	// ICMP echo requests are handled without locking lwIP, as in Write.
+	in := make([][]byte, 0, len(pkts))
+	for _, pkt := range pkts {
+		if !s.handleICMP(icmpHandler, pkt) {
+			in = append(in, pkt)
+		}
+	}
+
+	lwipMutex.Lock()
+	s.batching = s.batchOutputFn != nil
+	for _, pkt := range in {
+		if _, err := inputLocked(s.netif, pkt); err != nil {
+			packetsDropped.Inc()
+		}
+	}
+	s.batching = false
+	out, outputFn := s.outBatch, s.batchOutputFn
+	s.outBatch = nil
+	lwipMutex.Unlock()
+
+	if len(out) > 0 {
+		outputFn(out)
+		for _, buf := range out {
+			FreeBytes(buf[:cap(buf)])
+		}
+	}
+	return len(pkts), nil
+}
+
 // RestartTimeouts rebases the timeout times to the current time.
 //
 // This is necessary if sys_check_timeouts() hasn't been called for a long
@@ -119,37 +359,160 @@ func (s *lwipStack) RestartTimeouts() {
 	lwipMutex.Unlock()
 }
 
+// RegisterTCPConnHandler can be called while the stack is running to swap
+// the handler, existing connections keep the handler they were accepted by.
+func (s *lwipStack) RegisterTCPConnHandler(h TCPConnHandler) {
+	lwipMutex.Lock()
+	s.tcpHandler = h
+	lwipMutex.Unlock()
+}
+
+// RegisterUDPConnHandler can be called while the stack is running to swap
+// the handler, existing connections keep the handler they were created by.
+func (s *lwipStack) RegisterUDPConnHandler(h UDPConnHandler) {
+	lwipMutex.Lock()
+	s.udpHandler = h
+	lwipMutex.Unlock()
+}
+
+// RegisterConnHandlers swaps both handlers at once, so that no connection is
+// accepted by the new TCP handler while UDP is still served by the old one.
+func (s *lwipStack) RegisterConnHandlers(tcp TCPConnHandler, udp UDPConnHandler) {
+	lwipMutex.Lock()
+	s.tcpHandler = tcp
+	s.udpHandler = udp
+	lwipMutex.Unlock()
+}
+
+func (s *lwipStack) RegisterICMPHandler(h ICMPHandler) {
+	lwipMutex.Lock()
+	s.icmpHandler = h
+	lwipMutex.Unlock()
+}
+
+func (s *lwipStack) RegisterFakeDns(d dns.FakeDns) {
+	lwipMutex.Lock()
+	s.fakeDns = d
+	lwipMutex.Unlock()
+}
+
+func (s *lwipStack) RegisterOutputFn(fn func([]byte) (int, error)) {
+	lwipMutex.Lock()
+	s.outputFn = fn
+	lwipMutex.Unlock()
+}
+
+// RegisterBatchOutputFn sets the function receiving the packets output
+// while processing a WriteBatch, packets output otherwise are passed to the
+// output function.
+func (s *lwipStack) RegisterBatchOutputFn(fn func([][]byte) (int, error)) {
+	lwipMutex.Lock()
+	s.batchOutputFn = fn
+	lwipMutex.Unlock()
+}
+
 // Close closes the stack.
 //
 // Timer events will be canceled and existing connections will be closed.
 // Note this function will not free objects allocated in lwIP initialization
 // stage, e.g. the loop interface.
 func (s *lwipStack) Close() error {
-	// Stop firing timer events.
+	select {
+	case <-s.ctx.Done():
+		return nil
+	default:
+	}
 	s.cancel()
 
+	// Remove callbacks and close listening pcbs.
 	lwipMutex.Lock()
+	C.tcp_accept(s.tpcb, nil)
+	C.udp_recv(s.upcb, nil, nil)
 	C.tcp_close(s.tpcb)
 	C.udp_remove(s.upcb)
 	lwipMutex.Unlock()
 
-	// Abort and close all TCP and UDP connections.
-	tcpConns.Purge()
+	// Abort and close all TCP and UDP connections. TCP connections are
+	// aborted before purging since evicted ones are aborted asynchronously.
+	for _, conn := range s.tcpConns.Values() {
+		conn.Abort()
+	}
+	s.tcpConns.Purge()
 
 	// This only closes UDP connections in the core,
 	// UDP connections in the handler will wait till
 	// timeout, they are not closed immediately for
 	// now.
-	udpConns.Purge()
-	// Remove callbacks and close listening pcbs.
+	s.udpConns.Purge()
+
 	lwipMutex.Lock()
-	C.tcp_accept(s.tpcb, nil)
-	C.udp_recv(s.upcb, nil, nil)
+	delete(stacks, s.key)
+	if s.netif.state == s.arg {
+		s.netif.state = nil
+	}
+	if s.isolated {
+		freeNetif(s.netif)
+	}
+	freeConnKeyArg(s.arg)
 	lwipMutex.Unlock()
 
+	stopTimeouts()
+
 	return nil
 }
 
+var timeoutsMutex sync.Mutex
+var timeoutsRefs int
+var timeoutsCancel context.CancelFunc
+
+// startTimeouts starts firing lwIP timer events, timers are shared by all
+// stacks so they are started along with the first stack.
+func startTimeouts() {
+	timeoutsMutex.Lock()
+	defer timeoutsMutex.Unlock()
+
+	timeoutsRefs += 1
+	if timeoutsRefs > 1 {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	timeoutsCancel = cancel
+	go func() {
+		for {
+			select {
+			case <-time.After(CHECK_TIMEOUTS_INTERVAL * time.Millisecond):
+				lwipMutex.Lock()
+				C.sys_check_timeouts()
+				lwipMutex.Unlock()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// stopTimeouts stops firing lwIP timer events once the last stack is closed.
+func stopTimeouts() {
+	timeoutsMutex.Lock()
+	defer timeoutsMutex.Unlock()
+
+	timeoutsRefs -= 1
+	if timeoutsRefs == 0 {
+		timeoutsCancel()
+	}
+}
+
+// stackFromArg returns the stack whose key is stored in a callback arg, the
+// caller is required to lock lwipMutex.
+func stackFromArg(arg unsafe.Pointer) (*lwipStack, bool) {
+	if arg == nil {
+		return nil, false
+	}
+	s, ok := stacks[getConnStackVal(arg)]
+	return s, ok
+}
+
 func init() {
 	// Initialize lwIP.
 	//
@@ -158,10 +521,16 @@ func init() {
 	// `#define LWIP_HAVE_LOOPIF 1` in `lwipopts.h`, so we need
 	// not create our own interface.
 	//
-	// Now the loop interface is just the first element in
-	// `C.netif_list`, i.e. `*C.netif_list`.
+	// The loop interface is the first element in `C.netif_list`
+	// right after initialization, it's made the default netif
+	// since isolated stacks add their interfaces in front of it.
 	lwipInit()
+	C.netif_set_default(C.netif_list)
 
 	// Set MTU.
-	C.netif_list.mtu = 1500
+	C.netif_default.mtu = 1500
+
+	// The default stack is not listening until NewLWIPStack is called,
+	// it only holds handlers registered before that.
+	defaultStack = newLWIPStackState(C.netif_default, defaultMaxConnSize, defaultMaxConnSize)
 }
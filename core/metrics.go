@@ -0,0 +1,71 @@
+package core
+
+import (
+	"github.com/eycorsican/go-tun2socks/common/metrics"
+)
+
+// Metrics of all stacks, registered to metrics.DefaultRegistry.
+var (
+	packetsIn  metrics.Counter
+	bytesIn    metrics.Counter
+	packetsOut metrics.Counter
+	bytesOut   metrics.Counter
+
+	packetsDropped metrics.Counter
+
+	tcpSessions  metrics.Counter
+	udpSessions  metrics.Counter
+	tcpEvictions metrics.Counter
+	udpEvictions metrics.Counter
+
+	tcpDialFailures metrics.Counter
+	udpDialFailures metrics.Counter
+	tcpDialLatency  = metrics.NewHistogram(metrics.DefaultDurationBuckets)
+	udpDialLatency  = metrics.NewHistogram(metrics.DefaultDurationBuckets)
+)
+
+// countOutput counts a packet output to TUN.
+func countOutput(n int) {
+	packetsOut.Inc()
+	bytesOut.Add(uint64(n))
+}
+
+// activeSessions returns the number of TCP and UDP conns of all stacks.
+func activeSessions() (int, int) {
+	lwipMutex.Lock()
+	defer lwipMutex.Unlock()
+
+	var tcp, udp int
+	for _, s := range stacks {
+		tcp += s.tcpConns.Len()
+		udp += s.udpConns.Len()
+	}
+	return tcp, udp
+}
+
+func init() {
+	r := metrics.DefaultRegistry
+	r.RegisterCounter("tun2socks_packets_in_total", "IP packets written to the stack.", &packetsIn)
+	r.RegisterCounter("tun2socks_bytes_in_total", "Bytes of IP packets written to the stack.", &bytesIn)
+	r.RegisterCounter("tun2socks_packets_dropped_total", "IP packets written to the stack and dropped as malformed or not handled.", &packetsDropped)
+	r.RegisterCounter("tun2socks_packets_out_total", "IP packets output by the stack.", &packetsOut)
+	r.RegisterCounter("tun2socks_bytes_out_total", "Bytes of IP packets output by the stack.", &bytesOut)
+
+	r.RegisterCounter(`tun2socks_sessions_total{proto="tcp"}`, "Sessions accepted by the stack.", &tcpSessions)
+	r.RegisterCounter(`tun2socks_sessions_total{proto="udp"}`, "", &udpSessions)
+	r.RegisterGauge(`tun2socks_sessions_active{proto="tcp"}`, "Sessions currently tracked by the stack.", func() float64 {
+		tcp, _ := activeSessions()
+		return float64(tcp)
+	})
+	r.RegisterGauge(`tun2socks_sessions_active{proto="udp"}`, "", func() float64 {
+		_, udp := activeSessions()
+		return float64(udp)
+	})
+	r.RegisterCounter(`tun2socks_session_evictions_total{proto="tcp"}`, "Sessions evicted because the connection table is full.", &tcpEvictions)
+	r.RegisterCounter(`tun2socks_session_evictions_total{proto="udp"}`, "", &udpEvictions)
+
+	r.RegisterCounter(`tun2socks_handler_dial_failures_total{proto="tcp"}`, "Sessions the handler failed to connect.", &tcpDialFailures)
+	r.RegisterCounter(`tun2socks_handler_dial_failures_total{proto="udp"}`, "", &udpDialFailures)
+	r.RegisterHistogram(`tun2socks_handler_dial_seconds{proto="tcp"}`, "Time taken by the handler to connect a session.", tcpDialLatency)
+	r.RegisterHistogram(`tun2socks_handler_dial_seconds{proto="udp"}`, "", udpDialLatency)
+}
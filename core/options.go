@@ -0,0 +1,93 @@
+package core
+
+// StackOption configures a stack created by NewLWIPStack or
+// NewIsolatedLWIPStack.
+type StackOption func(*lwipStack)
+
+// UDPSessionMode determines how UDP packets coming from TUN are grouped into
+// UDPConn sessions.
+type UDPSessionMode int
+
+const (
+	// UDPSessionFullCone keys sessions by source address, a client socket
+	// talking to several destinations shares one UDPConn. This is the
+	// default.
+	UDPSessionFullCone UDPSessionMode = iota
+
+	// UDPSessionSymmetric keys sessions by source and destination address,
+	// every destination of a client socket gets its own UDPConn and the
+	// handler Connect sees the real target.
+	UDPSessionSymmetric
+)
+
+// WithUDPSessionMode sets how UDP sessions are keyed.
+func WithUDPSessionMode(mode UDPSessionMode) StackOption {
+	return func(s *lwipStack) {
+		s.udpSessionMode = mode
+	}
+}
+
+// Limits and defaults of the MTU and TCP options.
+const (
+	DefaultMTU = 1500
+	MinMTU     = 576
+	MaxMTU     = 65535
+
+	// MaxMSS is the largest MSS of TCP connections, MTUs above 9000 do
+	// not give larger segments.
+	MaxMSS = 8960
+
+	DefaultTCPWindow = 32 * 1024
+	MinTCPWindow     = MaxMSS
+	MaxTCPWindow     = 4 * 1024 * 1024
+
+	DefaultTCPSendBuffer = 32 * 1024
+	MinTCPSendBuffer     = 2 * MaxMSS
+	MaxTCPSendBuffer     = 4 * 1024 * 1024
+)
+
+// WithMTU sets the MTU of the stack, clamped to [MinMTU, MaxMTU]. Packets
+// output by the stack fit in it and the MSS advertised to TCP clients is
+// derived from it. The default is DefaultMTU.
+func WithMTU(mtu int) StackOption {
+	return func(s *lwipStack) {
+		s.mtu = clamp(mtu, MinMTU, MaxMTU)
+	}
+}
+
+// WithMSS clamps the MSS of the segments sent on TCP connections, it's only
+// derived from the MTU and the MSS of the client by default. The MSS
+// advertised to clients is not clamped, set the MTU to lower it.
+func WithMSS(mss int) StackOption {
+	return func(s *lwipStack) {
+		s.tcpMSS = clamp(mss, 0, MaxMSS)
+	}
+}
+
+// WithTCPWindow sets the receive window of TCP connections, clamped to
+// [MinTCPWindow, MaxTCPWindow]. Windows above 64KB are only used with clients
+// supporting window scaling (RFC 7323). The default is DefaultTCPWindow.
+func WithTCPWindow(size int) StackOption {
+	return func(s *lwipStack) {
+		s.tcpWindow = clamp(size, MinTCPWindow, MaxTCPWindow)
+	}
+}
+
+// WithTCPSendBuffer sets the send buffer of TCP connections, clamped to
+// [MinTCPSendBuffer, MaxTCPSendBuffer]. Writes to a connection block while its
+// buffer is full. The default is DefaultTCPSendBuffer.
+func WithTCPSendBuffer(size int) StackOption {
+	return func(s *lwipStack) {
+		s.tcpSendBuffer = clamp(size, MinTCPSendBuffer, MaxTCPSendBuffer)
+	}
+}
+
+func clamp(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
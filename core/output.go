@@ -3,28 +3,63 @@ package core
 /*
 #cgo CFLAGS: -I./c/include
 #include "lwip/tcp.h"
+#include "lwip/ip.h"
+#include <stdlib.h>
+#include <string.h>
 
-extern err_t output(struct pbuf *p);
+extern err_t output(struct netif *netif, struct pbuf *p);
 
 err_t
 output_ip4(struct netif *netif, struct pbuf *p, const ip4_addr_t *ipaddr)
 {
-	return output(p);
+	return output(netif, p);
 }
 
 err_t
 output_ip6(struct netif *netif, struct pbuf *p, const ip6_addr_t *ipaddr)
 {
-	return output(p);
+	return output(netif, p);
 }
 
 void
-set_output()
+set_netif_output(struct netif *netif)
 {
-	if (netif_list != NULL) {
-		(*netif_list).output = output_ip4;
-		(*netif_list).output_ip6 = output_ip6;
+	netif->output = output_ip4;
+	netif->output_ip6 = output_ip6;
+}
+
+static err_t
+stack_netif_init(struct netif *netif)
+{
+	netif->name[0] = 't';
+	netif->name[1] = 'n';
+	netif->mtu = 1500;
+	set_netif_output(netif);
+	return ERR_OK;
+}
+
+struct netif*
+new_netif()
+{
+	struct netif *netif = malloc(sizeof(struct netif));
+	if (netif == NULL) {
+		return NULL;
+	}
+	memset(netif, 0, sizeof(struct netif));
+	if (netif_add(netif, NULL, NULL, NULL, NULL, stack_netif_init, ip_input) == NULL) {
+		free(netif);
+		return NULL;
 	}
+	netif_set_link_up(netif);
+	netif_set_up(netif);
+	return netif;
+}
+
+void
+free_netif(struct netif *netif)
+{
+	netif_remove(netif);
+	free(netif);
 }
 */
 import "C"
@@ -32,11 +67,35 @@ import (
 	"errors"
 )
 
+// OutputFn is the output function of the default stack.
 var OutputFn func([]byte) (int, error)
 
+// RegisterOutputFn sets the output function of the default stack.
 func RegisterOutputFn(fn func([]byte) (int, error)) {
 	OutputFn = fn
-	C.set_output()
+	defaultStack.RegisterOutputFn(fn)
+}
+
+// RegisterBatchOutputFn sets the batch output function of the default
+// stack, see LWIPStack.RegisterBatchOutputFn.
+func RegisterBatchOutputFn(fn func([][]byte) (int, error)) {
+	defaultStack.RegisterBatchOutputFn(fn)
+}
+
+func setNetifOutput(netif *C.struct_netif) {
+	C.set_netif_output(netif)
+}
+
+// newNetif adds a network interface for an isolated stack, the caller is
+// required to lock lwipMutex.
+func newNetif() *C.struct_netif {
+	return C.new_netif()
+}
+
+// freeNetif removes a network interface added by newNetif, the caller is
+// required to lock lwipMutex.
+func freeNetif(netif *C.struct_netif) {
+	C.free_netif(netif)
 }
 
 func init() {
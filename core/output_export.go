@@ -10,18 +10,35 @@ import (
 )
 
 //export output
-func output(p *C.struct_pbuf) C.err_t {
+func output(netif *C.struct_netif, p *C.struct_pbuf) C.err_t {
+	// Packets are dispatched to the stack owning the netif, drop them
+	// if the stack has been closed.
+	s, ok := stackFromArg(netif.state)
+	if !ok {
+		return C.ERR_OK
+	}
+
 	// In most case, all data are in the same pbuf struct, data copying can be avoid by
 	// backing Go slice with C array. Buf if there are multiple pbuf structs holding the
 	// data, we must copy data for sending them in one pass.
 	totlen := int(p.tot_len)
-	if p.tot_len == p.len {
+	countOutput(totlen)
+	if s.batching {
+		// The pbuf is freed once we return, queued packets are copied to
+		// be written after WriteBatch unlocks lwIP.
+		buf := NewBytes(totlen)[:totlen]
+		C.pbuf_copy_partial(p, unsafe.Pointer(&buf[0]), p.tot_len, 0)
+		s.tapPacket(buf, PacketOutbound)
+		s.outBatch = append(s.outBatch, buf)
+	} else if p.tot_len == p.len {
 		buf := (*[1 << 30]byte)(unsafe.Pointer(p.payload))[:totlen:totlen]
-		OutputFn(buf[:totlen])
+		s.tapPacket(buf[:totlen], PacketOutbound)
+		s.outputFn(buf[:totlen])
 	} else {
 		buf := NewBytes(totlen)
 		C.pbuf_copy_partial(p, unsafe.Pointer(&buf[0]), p.tot_len, 0) // data copy here!
-		OutputFn(buf[:totlen])
+		s.tapPacket(buf[:totlen], PacketOutbound)
+		s.outputFn(buf[:totlen])
 		FreeBytes(buf)
 	}
 	return C.ERR_OK
@@ -0,0 +1,134 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// ShutdownHandler is optionally implemented by TCP and UDP handlers holding
+// resources of connections, e.g. UDP sockets kept until a timeout. Shutdown
+// is called when the stack shuts down and should release all of them.
+type ShutdownHandler interface {
+	Shutdown() error
+}
+
+// ShutdownStats summarises the sessions drained by Shutdown.
+type ShutdownStats struct {
+	// TCPClosed is the number of TCP connections closed with FIN.
+	TCPClosed int
+
+	// TCPAborted is the number of TCP connections reset because they
+	// were still open after the grace period.
+	TCPAborted int
+
+	// UDPClosed is the number of UDP sessions closed.
+	UDPClosed int
+}
+
+func (st *ShutdownStats) String() string {
+	return fmt.Sprintf("%d TCP connections closed, %d reset, %d UDP sessions closed", st.TCPClosed, st.TCPAborted, st.UDPClosed)
+}
+
+// ShutdownHandlers shuts down the handlers implementing ShutdownHandler and
+// returns the first error. Handlers given several times are shut down once,
+// unless their values are not comparable, e.g. structs holding a slice.
+func ShutdownHandlers(handlers ...interface{}) error {
+	var err error
+	var done []ShutdownHandler
+	for _, h := range handlers {
+		sh, ok := h.(ShutdownHandler)
+		if !ok || containsHandler(done, sh) {
+			continue
+		}
+		done = append(done, sh)
+		if herr := sh.Shutdown(); herr != nil && err == nil {
+			err = herr
+		}
+	}
+	return err
+}
+
+// containsHandler reports whether h is in hs, comparing only comparable
+// values as == panics otherwise.
+func containsHandler(hs []ShutdownHandler, h ShutdownHandler) bool {
+	if !reflect.ValueOf(h).Comparable() {
+		return false
+	}
+	for _, x := range hs {
+		if reflect.ValueOf(x).Comparable() && x == h {
+			return true
+		}
+	}
+	return false
+}
+
+const shutdownPollInterval = 50 * time.Millisecond
+
+// Shutdown gracefully shuts down the default stack.
+func Shutdown(ctx context.Context) (*ShutdownStats, error) {
+	return defaultStack.Shutdown(ctx)
+}
+
+// Shutdown refuses new sessions, sends FIN on all TCP connections, closes
+// all UDP sessions along with the resources handlers hold for them, and
+// closes the stack once all TCP connections are closed, connections still
+// open when ctx is done are reset.
+//
+// Packets of existing connections are still processed until Shutdown
+// returns, keep writing packets to the stack meanwhile so that the closing
+// handshakes can complete.
+func (s *lwipStack) Shutdown(ctx context.Context) (*ShutdownStats, error) {
+	lwipMutex.Lock()
+	s.draining = true
+	handlers := []interface{}{s.tcpHandler, s.udpHandler}
+	lwipMutex.Unlock()
+
+	tcpConns := s.tcpConns.Values()
+	for _, conn := range tcpConns {
+		conn.Close()
+	}
+
+	// Handlers of existing sessions may have been replaced.
+	udpConns := s.udpConns.Values()
+	for _, conn := range udpConns {
+		switch c := conn.(type) {
+		case *udpConn:
+			handlers = append(handlers, c.handler)
+		case *udpConnex:
+			handlers = append(handlers, c.handler)
+		}
+	}
+	err := ShutdownHandlers(handlers...)
+	for _, conn := range udpConns {
+		conn.Close()
+	}
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	aborted := 0
+Wait:
+	for s.tcpConns.Len() > 0 {
+		select {
+		case <-ctx.Done():
+			// Connections removed meanwhile are not aborted.
+			for _, conn := range s.tcpConns.Values() {
+				conn.Abort()
+				aborted++
+			}
+			break Wait
+		case <-ticker.C:
+		}
+	}
+
+	stats := &ShutdownStats{
+		TCPClosed:  len(tcpConns) - aborted,
+		TCPAborted: aborted,
+		UDPClosed:  len(udpConns),
+	}
+	if cerr := s.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	return stats, err
+}
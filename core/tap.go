@@ -0,0 +1,42 @@
+package core
+
+import "github.com/eycorsican/go-tun2socks/common/packet"
+
+// PacketDirection is the direction of a packet crossing the TUN boundary,
+// packet taps can use packet.Direction without importing core.
+type PacketDirection = packet.Direction
+
+const (
+	// PacketInbound packets are read from TUN and written to the stack.
+	PacketInbound = packet.Inbound
+
+	// PacketOutbound packets are output by the stack to TUN.
+	PacketOutbound = packet.Outbound
+)
+
+// PacketTap observes IP packets crossing the TUN boundary, e.g. to capture
+// them for debugging.
+type PacketTap interface {
+	// TapPacket is called for every packet written to or output by the
+	// stack, it must not block and must not retain pkt after returning.
+	TapPacket(pkt []byte, dir PacketDirection)
+}
+
+// RegisterPacketTap sets the packet tap of the default stack.
+func RegisterPacketTap(t PacketTap) {
+	defaultStack.RegisterPacketTap(t)
+}
+
+func (s *lwipStack) RegisterPacketTap(t PacketTap) {
+	lwipMutex.Lock()
+	s.tap = t
+	lwipMutex.Unlock()
+}
+
+// tapPacket passes pkt to the packet tap of the stack if any, the caller is
+// required to lock lwipMutex.
+func (s *lwipStack) tapPacket(pkt []byte, dir PacketDirection) {
+	if t := s.tap; t != nil {
+		t.TapPacket(pkt, dir)
+	}
+}
@@ -38,6 +38,40 @@ void
 set_tcp_poll_callback(struct tcp_pcb *pcb, u8_t interval) {
 	tcp_poll(pcb, tcpPollFn, interval);
 }
+
+extern err_t tcpPassiveOpenFn(void *arg, struct tcp_pcb *newpcb);
+
+static err_t
+tcp_passive_open(u8_t id, struct tcp_pcb_listen *lpcb, struct tcp_pcb *newpcb) {
+	return tcpPassiveOpenFn(newpcb->callback_arg, newpcb);
+}
+
+static const struct tcp_ext_arg_callbacks tcp_ext_arg_callbacks = {
+	NULL,
+	tcp_passive_open,
+};
+
+static u8_t tcp_ext_arg_id = LWIP_TCP_PCB_NUM_EXT_ARGS;
+
+// The callbacks must be set before listening, tcp_listen copies them to the
+// listening pcb.
+void
+set_tcp_passive_open_callback(struct tcp_pcb *pcb) {
+	if (tcp_ext_arg_id == LWIP_TCP_PCB_NUM_EXT_ARGS) {
+		tcp_ext_arg_id = tcp_ext_arg_alloc_id();
+	}
+	tcp_ext_arg_set_callbacks(pcb, tcp_ext_arg_id, &tcp_ext_arg_callbacks);
+}
+
+void
+tune_tcp_pcb(struct tcp_pcb *pcb, u16_t mss, tcpwnd_size_t wnd, tcpwnd_size_t snd_buf) {
+	if (mss > 0 && pcb->mss > mss) {
+		pcb->mss = mss;
+	}
+	pcb->rcv_wnd_max = wnd;
+	pcb->rcv_wnd = pcb->rcv_ann_wnd = TCP_WND_MAX(pcb);
+	pcb->snd_buf = snd_buf;
+}
 */
 import "C"
 
@@ -60,3 +94,14 @@ func setTCPErrCallback(pcb *C.struct_tcp_pcb) {
 func setTCPPollCallback(pcb *C.struct_tcp_pcb, interval C.u8_t) {
 	C.set_tcp_poll_callback(pcb, interval)
 }
+
+func setTCPPassiveOpenCallback(pcb *C.struct_tcp_pcb) {
+	C.set_tcp_passive_open_callback(pcb)
+}
+
+// tuneTCP applies the TCP options of the stack to a pcb created by its
+// listening pcb, before the SYN-ACK is sent. The caller is required to lock
+// lwipMutex.
+func (s *lwipStack) tuneTCP(pcb *C.struct_tcp_pcb) {
+	C.tune_tcp_pcb(pcb, C.u16_t(s.tcpMSS), C.tcpwnd_size_t(s.tcpWindow), C.tcpwnd_size_t(s.tcpSendBuffer))
+}
@@ -23,14 +23,21 @@ func tcpAcceptFn(arg unsafe.Pointer, newpcb *C.struct_tcp_pcb, err C.err_t) C.er
 		return err
 	}
 
-	if tcpConnHandler == nil {
+	s, ok := stackFromArg(arg)
+	if !ok || s.draining {
+		// The stack has been closed or is shutting down.
+		C.tcp_abort(newpcb)
+		return C.ERR_ABRT
+	}
+
+	if s.tcpHandler == nil {
 		panic("must register a TCP connection handler")
 	}
 
-	if handler, ok := tcpConnHandler.(TCPConnHandlerEx); ok {
-		newTCPConnEx(newpcb, handler)
+	if handler, ok := s.tcpHandler.(TCPConnHandlerEx); ok {
+		newTCPConnEx(s, newpcb, handler)
 		return C.ERR_OK
-	} else if _, nerr := newTCPConn(newpcb, tcpConnHandler); nerr != nil {
+	} else if _, nerr := newTCPConn(s, newpcb, s.tcpHandler); nerr != nil {
 		switch nerr.(*lwipError).Code {
 		case LWIP_ERR_ABRT:
 			return C.ERR_ABRT
@@ -44,6 +51,14 @@ func tcpAcceptFn(arg unsafe.Pointer, newpcb *C.struct_tcp_pcb, err C.err_t) C.er
 	return C.ERR_OK
 }
 
+//export tcpPassiveOpenFn
+func tcpPassiveOpenFn(arg unsafe.Pointer, newpcb *C.struct_tcp_pcb) C.err_t {
+	if s, ok := stackFromArg(arg); ok {
+		s.tuneTCP(newpcb)
+	}
+	return C.ERR_OK
+}
+
 //export tcpRecvFn
 func tcpRecvFn(arg unsafe.Pointer, tpcb *C.struct_tcp_pcb, p *C.struct_pbuf, err C.err_t) C.err_t {
 	if err != C.ERR_OK && err != C.ERR_ABRT {
@@ -59,7 +74,7 @@ func tcpRecvFn(arg unsafe.Pointer, tpcb *C.struct_tcp_pcb, p *C.struct_pbuf, err
 		}
 	}()
 
-	conn, ok := tcpConns.Get(getConnKeyVal(arg))
+	conn, ok := getTCPConn(arg)
 	if !ok {
 		// The connection does not exists.
 		C.tcp_abort(tpcb)
@@ -122,7 +137,7 @@ func tcpRecvFn(arg unsafe.Pointer, tpcb *C.struct_tcp_pcb, p *C.struct_pbuf, err
 
 //export tcpSentFn
 func tcpSentFn(arg unsafe.Pointer, tpcb *C.struct_tcp_pcb, len C.u16_t) C.err_t {
-	if conn, ok := tcpConns.Get(getConnKeyVal(arg)); ok {
+	if conn, ok := getTCPConn(arg); ok {
 		err := conn.(TCPConn).Sent(uint16(len))
 		switch err.(*lwipError).Code {
 		case LWIP_ERR_ABRT:
@@ -140,7 +155,7 @@ func tcpSentFn(arg unsafe.Pointer, tpcb *C.struct_tcp_pcb, len C.u16_t) C.err_t
 
 //export tcpErrFn
 func tcpErrFn(arg unsafe.Pointer, err C.err_t) {
-	if conn, ok := tcpConns.Get(getConnKeyVal(arg)); ok {
+	if conn, ok := getTCPConn(arg); ok {
 		switch err {
 		case C.ERR_ABRT:
 			// Aborted through tcp_abort or by a TCP timer
@@ -156,7 +171,7 @@ func tcpErrFn(arg unsafe.Pointer, err C.err_t) {
 
 //export tcpPollFn
 func tcpPollFn(arg unsafe.Pointer, tpcb *C.struct_tcp_pcb) C.err_t {
-	if conn, ok := tcpConns.Get(getConnKeyVal(arg)); ok {
+	if conn, ok := getTCPConn(arg); ok {
 		err := conn.(TCPConn).Poll()
 		switch err.(*lwipError).Code {
 		case LWIP_ERR_ABRT:
@@ -9,7 +9,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
+	"os"
 	"sync"
 	"time"
 	"unsafe"
@@ -57,6 +59,7 @@ const (
 type tcpConn struct {
 	sync.Mutex
 
+	stack         *lwipStack
 	pcb           *C.struct_tcp_pcb
 	handler       TCPConnHandler
 	remoteAddr    *net.TCPAddr
@@ -64,17 +67,20 @@ type tcpConn struct {
 	connKeyArg    unsafe.Pointer
 	connKey       uint32
 	canWrite      *sync.Cond // Condition variable to implement TCP backpressure.
+	writeDeadline *deadlineTimer
 	state         tcpConnState
-	sndPipeReader *io.PipeReader
-	sndPipeWriter *io.PipeWriter
+	sndPipeReader net.Conn // Read deadlines are implemented by the pipe.
+	sndPipeWriter net.Conn
 	closeOnce     sync.Once
 	closeErr      error
+	stats         connStats
 }
 
-func newTCPConn(pcb *C.struct_tcp_pcb, handler TCPConnHandler) (TCPConn, error) {
+func newTCPConn(s *lwipStack, pcb *C.struct_tcp_pcb, handler TCPConnHandler) (TCPConn, error) {
 	connKeyArg := newConnKeyArg()
 	connKey := getNextConnKeyVal()
 	setConnKeyVal(connKeyArg, connKey)
+	setConnStackVal(connKeyArg, s.key)
 
 	// Pass the key as arg for subsequent tcp callbacks.
 	C.tcp_arg(pcb, unsafe.Pointer(connKeyArg))
@@ -85,22 +91,28 @@ func newTCPConn(pcb *C.struct_tcp_pcb, handler TCPConnHandler) (TCPConn, error)
 	setTCPErrCallback(pcb)
 	setTCPPollCallback(pcb, C.u8_t(TCP_POLL_INTERVAL))
 
-	pipeReader, pipeWriter := io.Pipe()
+	pipeReader, pipeWriter := net.Pipe()
 	conn := &tcpConn{
+		stack:         s,
 		pcb:           pcb,
 		handler:       handler,
-		localAddr:     ParseTCPAddr(ipAddrNTOA(pcb.remote_ip), uint16(pcb.remote_port)),
-		remoteAddr:    ParseTCPAddr(ipAddrNTOA(pcb.local_ip), uint16(pcb.local_port)),
+		localAddr:     &net.TCPAddr{IP: ipAddrToIP(&pcb.remote_ip), Port: int(pcb.remote_port)},
+		remoteAddr:    &net.TCPAddr{IP: ipAddrToIP(&pcb.local_ip), Port: int(pcb.local_port)},
 		connKeyArg:    connKeyArg,
 		connKey:       connKey,
 		canWrite:      sync.NewCond(&sync.Mutex{}),
 		state:         tcpNewConn,
 		sndPipeReader: pipeReader,
 		sndPipeWriter: pipeWriter,
+		stats:         newConnStats(),
 	}
+	conn.writeDeadline = newDeadlineTimer(conn.wakeWriter)
 
-	// Associate conn with key and save to the global map.
-	tcpConns.Add(connKey, conn)
+	// Associate conn with key and save to the map of the stack.
+	if s.tcpConns.Add(connKey, conn) {
+		tcpEvictions.Inc()
+	}
+	tcpSessions.Inc()
 
 	// Connecting remote host could take some time, do it in another goroutine
 	// to prevent blocking the lwip thread.
@@ -108,8 +120,11 @@ func newTCPConn(pcb *C.struct_tcp_pcb, handler TCPConnHandler) (TCPConn, error)
 	conn.state = tcpConnecting
 	conn.Unlock()
 	go func() {
+		start := time.Now()
 		err := handler.Handle(TCPConn(conn), conn.remoteAddr)
+		tcpDialLatency.ObserveDuration(start)
 		if err != nil {
+			tcpDialFailures.Inc()
 			conn.Abort()
 		} else {
 			conn.Lock()
@@ -140,15 +155,27 @@ func (conn *tcpConn) LocalAddr() net.Addr {
 }
 
 func (conn *tcpConn) SetDeadline(t time.Time) error {
-	return nil
+	conn.SetReadDeadline(t)
+	return conn.SetWriteDeadline(t)
 }
+
 func (conn *tcpConn) SetReadDeadline(t time.Time) error {
-	return nil
+	return conn.sndPipeReader.SetReadDeadline(t)
 }
+
 func (conn *tcpConn) SetWriteDeadline(t time.Time) error {
+	conn.writeDeadline.set(t)
 	return nil
 }
 
+// wakeWriter wakes up the writer waiting for the send buffer, it's called
+// when the write deadline passes.
+func (conn *tcpConn) wakeWriter() {
+	conn.canWrite.L.Lock()
+	conn.canWrite.Broadcast()
+	conn.canWrite.L.Unlock()
+}
+
 func (conn *tcpConn) receiveCheck() error {
 	conn.Lock()
 	defer conn.Unlock()
@@ -186,6 +213,7 @@ func (conn *tcpConn) Receive(data []byte) error {
 	if err != nil {
 		return NewLWIPError(LWIP_ERR_CLSD)
 	}
+	conn.stats.uplink.Add(uint64(n))
 	C.tcp_recved(conn.pcb, C.u16_t(n))
 	return NewLWIPError(LWIP_ERR_OK)
 }
@@ -261,6 +289,9 @@ func (conn *tcpConn) Write(data []byte) (int, error) {
 		if err := conn.writeCheck(); err != nil {
 			return totalWritten, err
 		}
+		if conn.writeDeadline.exceeded() {
+			return totalWritten, os.ErrDeadlineExceeded
+		}
 
 		lwipMutex.Lock()
 		toWrite := len(data)
@@ -268,9 +299,14 @@ func (conn *tcpConn) Write(data []byte) (int, error) {
 			// Write at most the size of the LWIP buffer.
 			toWrite = int(conn.pcb.snd_buf)
 		}
+		if toWrite > math.MaxUint16 {
+			// The length of tcp_write is a u16_t.
+			toWrite = math.MaxUint16
+		}
 		if toWrite > 0 {
 			written, err := conn.writeInternal(data[0:toWrite])
 			totalWritten += written
+			conn.stats.downlink.Add(uint64(written))
 			if err != nil {
 				lwipMutex.Unlock()
 				return totalWritten, err
@@ -457,7 +493,7 @@ func (conn *tcpConn) LocalClosed() error {
 }
 
 func (conn *tcpConn) release() {
-	tcpConns.Remove(conn.connKey)
+	conn.stack.tcpConns.Remove(conn.connKey)
 	if conn.connKeyArg != nil {
 		setConnKeyVal(conn.connKeyArg, 0)
 		freeConnKeyArg(conn.connKeyArg)
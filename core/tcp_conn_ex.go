@@ -9,7 +9,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
+	"os"
 	"sync"
 	"time"
 	"unsafe"
@@ -18,23 +20,27 @@ import (
 type tcpConnEx struct {
 	sync.Mutex
 
-	pcb        *C.struct_tcp_pcb
-	handler    TCPConnHandler
-	remoteAddr *net.TCPAddr
-	localAddr  *net.TCPAddr
-	connKeyArg unsafe.Pointer
-	connKey    uint32
-	canWrite   *sync.Cond // Condition variable to implement TCP backpressure.
-	state      tcpConnState
-	closeOnce  sync.Once
-	closeErr   error
-	patch      TCPConnPatch
-}
-
-func newTCPConnEx(pcb *C.struct_tcp_pcb, handler TCPConnHandlerEx) (TCPConnEx, error) {
+	stack         *lwipStack
+	pcb           *C.struct_tcp_pcb
+	handler       TCPConnHandler
+	remoteAddr    *net.TCPAddr
+	localAddr     *net.TCPAddr
+	connKeyArg    unsafe.Pointer
+	connKey       uint32
+	canWrite      *sync.Cond // Condition variable to implement TCP backpressure.
+	writeDeadline *deadlineTimer
+	state         tcpConnState
+	closeOnce     sync.Once
+	closeErr      error
+	patch         TCPConnPatch
+	stats         connStats
+}
+
+func newTCPConnEx(s *lwipStack, pcb *C.struct_tcp_pcb, handler TCPConnHandlerEx) (TCPConnEx, error) {
 	connKeyArg := newConnKeyArg()
 	connKey := getNextConnKeyVal()
 	setConnKeyVal(connKeyArg, connKey)
+	setConnStackVal(connKeyArg, s.key)
 
 	// Pass the key as arg for subsequent tcp callbacks.
 	C.tcp_arg(pcb, unsafe.Pointer(connKeyArg))
@@ -46,20 +52,28 @@ func newTCPConnEx(pcb *C.struct_tcp_pcb, handler TCPConnHandlerEx) (TCPConnEx, e
 	setTCPPollCallback(pcb, C.u8_t(TCP_POLL_INTERVAL))
 
 	conn := &tcpConnEx{
+		stack:      s,
 		pcb:        pcb,
 		handler:    handler,
-		localAddr:  ParseTCPAddr(ipAddrNTOA(pcb.remote_ip), uint16(pcb.remote_port)),
-		remoteAddr: ParseTCPAddr(ipAddrNTOA(pcb.local_ip), uint16(pcb.local_port)),
+		localAddr:  &net.TCPAddr{IP: ipAddrToIP(&pcb.remote_ip), Port: int(pcb.remote_port)},
+		remoteAddr: &net.TCPAddr{IP: ipAddrToIP(&pcb.local_ip), Port: int(pcb.local_port)},
 		connKeyArg: connKeyArg,
 		connKey:    connKey,
 		canWrite:   sync.NewCond(&sync.Mutex{}),
 		state:      tcpNewConn,
+		stats:      newConnStats(),
 	}
+	conn.writeDeadline = newDeadlineTimer(conn.wakeWriter)
 
-	// Associate conn with key and save to the global map.
-	tcpConns.Add(connKey, conn)
+	// Associate conn with key and save to the map of the stack.
+	if s.tcpConns.Add(connKey, conn) {
+		tcpEvictions.Inc()
+	}
+	tcpSessions.Inc()
 	conn.state = tcpConnecting
+	start := time.Now()
 	conn.patch = handler.HandleEx(conn, conn.remoteAddr)
+	tcpDialLatency.ObserveDuration(start)
 	conn.state = tcpConnected
 	if pcb.refused_data != nil {
 		C.tcp_process_refused_data(pcb)
@@ -84,15 +98,29 @@ func (conn *tcpConnEx) LocalAddr() net.Addr {
 }
 
 func (conn *tcpConnEx) SetDeadline(t time.Time) error {
-	return nil
+	conn.SetReadDeadline(t)
+	return conn.SetWriteDeadline(t)
 }
+
+// SetReadDeadline does nothing, data is pushed to the patch by
+// ReceiveBuffer rather than read from the conn.
 func (conn *tcpConnEx) SetReadDeadline(t time.Time) error {
 	return nil
 }
+
 func (conn *tcpConnEx) SetWriteDeadline(t time.Time) error {
+	conn.writeDeadline.set(t)
 	return nil
 }
 
+// wakeWriter wakes up the writer waiting for the send buffer, it's called
+// when the write deadline passes.
+func (conn *tcpConnEx) wakeWriter() {
+	conn.canWrite.L.Lock()
+	conn.canWrite.Broadcast()
+	conn.canWrite.L.Unlock()
+}
+
 func (conn *tcpConnEx) receiveCheck() error {
 	conn.Lock()
 	defer conn.Unlock()
@@ -134,6 +162,7 @@ func (conn *tcpConnEx) ReceiveBuffer(reader BytesReader) error {
 	if err != nil {
 		return NewLWIPError(LWIP_ERR_CLSD)
 	}
+	conn.stats.uplink.Add(uint64(n))
 	C.tcp_recved(conn.pcb, C.u16_t(n))
 	return NewLWIPError(LWIP_ERR_OK)
 }
@@ -193,6 +222,9 @@ func (conn *tcpConnEx) Write(data []byte) (int, error) {
 		if err := conn.writeCheck(); err != nil {
 			return totalWritten, err
 		}
+		if conn.writeDeadline.exceeded() {
+			return totalWritten, os.ErrDeadlineExceeded
+		}
 
 		lwipMutex.Lock()
 		toWrite := len(data)
@@ -200,9 +232,14 @@ func (conn *tcpConnEx) Write(data []byte) (int, error) {
 			// Write at most the size of the LWIP buffer.
 			toWrite = int(conn.pcb.snd_buf)
 		}
+		if toWrite > math.MaxUint16 {
+			// The length of tcp_write is a u16_t.
+			toWrite = math.MaxUint16
+		}
 		if toWrite > 0 {
 			written, err := conn.writeInternal(data[0:toWrite])
 			totalWritten += written
+			conn.stats.downlink.Add(uint64(written))
 			if err != nil {
 				lwipMutex.Unlock()
 				return totalWritten, err
@@ -394,7 +431,7 @@ func (conn *tcpConnEx) LocalClosed() error {
 }
 
 func (conn *tcpConnEx) release() {
-	tcpConns.Remove(conn.connKey)
+	conn.stack.tcpConns.Remove(conn.connKey)
 	if conn.connKeyArg != nil {
 		setConnKeyVal(conn.connKeyArg, 0)
 		freeConnKeyArg(conn.connKeyArg)
@@ -5,10 +5,12 @@ package core
 #include "lwip/tcp.h"
 #include <stdlib.h>
 
+// The first slot holds the connection key, the second one holds the
+// key of the stack owning the connection.
 void*
 new_conn_key_arg()
 {
-	return malloc(sizeof(uint32_t));
+	return calloc(2, sizeof(uint32_t));
 }
 
 void
@@ -28,6 +30,18 @@ get_conn_key_val(void *arg)
 {
 	return *((uint32_t*)arg);
 }
+
+void
+set_conn_stack_val(void *arg, uint32_t val)
+{
+	*((uint32_t*)arg + 1) = val;
+}
+
+uint32_t
+get_conn_stack_val(void *arg)
+{
+	return *((uint32_t*)arg + 1);
+}
 */
 import "C"
 import (
@@ -38,22 +52,45 @@ import (
 	lru "github.com/hashicorp/golang-lru/v2"
 )
 
-var tcpConns *lru.Cache[uint32, TCPConn]
+const defaultMaxConnSize = 1024
 
 var connKeyArgCounter uint32 = 1
 
+// SetTCPParams sets TCP parameters of the default stack.
 func SetTCPParams(maxConnSize int) {
+	defaultStack.setTCPParams(maxConnSize)
+}
+
+// WriteTCPConnStats writes TCP connections of the default stack to w.
+func WriteTCPConnStats(w io.Writer) {
+	defaultStack.writeTCPConnStats(w)
+}
+
+// setTCPParams resizes the TCP connection table, the size is kept for the
+// stack replacing the default one. Evicted connections are aborted.
+func (s *lwipStack) setTCPParams(maxConnSize int) {
 	if maxConnSize > 0 {
-		tcpConns.Resize(maxConnSize)
+		lwipMutex.Lock()
+		s.maxTCPConns = maxConnSize
+		lwipMutex.Unlock()
+		s.tcpConns.Resize(maxConnSize)
 	}
 }
-func WriteTCPConnStats(w io.Writer) {
-	fmt.Fprintf(w, "tcp connection count: %d, list:\n", tcpConns.Len())
-	for k, conn := range tcpConns.Values() {
+
+func (s *lwipStack) writeTCPConnStats(w io.Writer) {
+	fmt.Fprintf(w, "tcp connection count: %d, list:\n", s.tcpConns.Len())
+	for k, conn := range s.tcpConns.Values() {
 		fmt.Fprintln(w, fmt.Sprintf("conn %d: ", k), conn.LocalAddr().String(), " -> ", conn.RemoteAddr().String())
 	}
 }
 
+func newTCPConnMap(size int) *lru.Cache[uint32, TCPConn] {
+	conns, _ := lru.NewWithEvict(size, func(key uint32, value TCPConn) {
+		go value.Abort()
+	})
+	return conns
+}
+
 // We need such a key-value mechanism because when passing a Go pointer
 // to C, the Go pointer will only be valid during the call.
 // If we pass a Go pointer to tcp_arg(), this pointer will not be usable
@@ -81,15 +118,26 @@ func getConnKeyVal(p unsafe.Pointer) uint32 {
 	return uint32(C.get_conn_key_val(p))
 }
 
+func setConnStackVal(p unsafe.Pointer, val uint32) {
+	C.set_conn_stack_val(p, C.uint32_t(val))
+}
+
+func getConnStackVal(p unsafe.Pointer) uint32 {
+	return uint32(C.get_conn_stack_val(p))
+}
+
+// getTCPConn finds the connection a callback arg refers to, the caller is
+// required to lock lwipMutex.
+func getTCPConn(p unsafe.Pointer) (TCPConn, bool) {
+	s, ok := stacks[getConnStackVal(p)]
+	if !ok {
+		return nil, false
+	}
+	return s.tcpConns.Get(getConnKeyVal(p))
+}
+
 func getNextConnKeyVal() uint32 {
 	connKey := connKeyArgCounter
 	connKeyArgCounter += 1
 	return connKey
 }
-
-func init() {
-	maxConnSize := 1024
-	tcpConns, _ = lru.NewWithEvict(maxConnSize, func(key uint32, value TCPConn) {
-		go value.Abort()
-	})
-}
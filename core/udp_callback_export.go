@@ -8,8 +8,9 @@ import "C"
 import (
 	"io"
 	"net"
-	"strconv"
 	"unsafe"
+
+	"github.com/eycorsican/go-tun2socks/common/dns"
 )
 
 //export udpRecvFn
@@ -24,23 +25,36 @@ func udpRecvFn(arg unsafe.Pointer, pcb *C.struct_udp_pcb, p *C.struct_pbuf, addr
 		return
 	}
 
-	srcIP := ipAddrNTOA(*addr)
-	destIP := ipAddrNTOA(*destAddr)
-	if srcIP == "" || destIP == "" {
-		panic("invalid UDP address")
+	s, ok := stackFromArg(arg)
+	if !ok {
+		return
 	}
-	dstAddr := ParseUDPAddr(net.JoinHostPort(destIP, strconv.Itoa(int(destPort))))
 
-	connId := net.JoinHostPort(srcIP, strconv.Itoa(int(port))) // + "-" + ipAddrNTOA(*destAddr) + ":" + strconv.Itoa(int(uint16(destPort)))
-	conn, ok := udpConns.Get(connId)
+	srcAddr := &net.UDPAddr{IP: ipAddrToIP(addr), Port: int(port)}
+	dstAddr := &net.UDPAddr{IP: ipAddrToIP(destAddr), Port: int(destPort)}
+
+	if s.fakeDns != nil && int(destPort) == dns.COMMON_DNS_PORT {
+		if s.handleFakeDns(pcb, p, addr, port, destAddr, destPort) {
+			return
+		}
+	}
+
+	connId := srcAddr.String()
+	if s.udpSessionMode == UDPSessionSymmetric {
+		connId += "-" + dstAddr.String()
+	}
+	conn, ok := s.udpConns.Get(connId)
 	if !ok {
-		if udpConnHandler == nil {
+		if s.draining {
+			return
+		}
+		udpSessions.Inc()
+		if s.udpHandler == nil {
 			panic("must register a UDP connection handler")
 		}
-		srcAddr := ParseUDPAddr(connId)
 		var err error
-		if h2, ok := udpConnHandler.(UDPConnHandlerEx); ok {
-			conn, err = newUDPConnEx(connId, pcb,
+		if h2, ok := s.udpHandler.(UDPConnHandlerEx); ok {
+			conn, err = newUDPConnEx(s, connId, pcb,
 				h2,
 				*addr,
 				port,
@@ -49,10 +63,12 @@ func udpRecvFn(arg unsafe.Pointer, pcb *C.struct_udp_pcb, p *C.struct_pbuf, addr
 			if err != nil {
 				return
 			}
-			udpConns.Add(connId, conn)
+			if s.udpConns.Add(connId, conn) {
+				udpEvictions.Inc()
+			}
 		} else {
-			conn, err = newUDPConn(connId, pcb,
-				udpConnHandler,
+			conn, err = newUDPConn(s, connId, pcb,
+				s.udpHandler,
 				*addr,
 				port,
 				srcAddr,
@@ -60,7 +76,9 @@ func udpRecvFn(arg unsafe.Pointer, pcb *C.struct_udp_pcb, p *C.struct_pbuf, addr
 			if err != nil {
 				return
 			}
-			udpConns.Add(connId, conn)
+			if s.udpConns.Add(connId, conn) {
+				udpEvictions.Inc()
+			}
 		}
 	}
 	var totlen = int(p.tot_len)
@@ -81,6 +99,30 @@ func udpRecvFn(arg unsafe.Pointer, pcb *C.struct_udp_pcb, p *C.struct_pbuf, addr
 
 }
 
+// handleFakeDns answers a DNS query with the fake DNS of the stack, it
+// returns false if the query should be handled as usual.
+func (s *lwipStack) handleFakeDns(pcb *C.struct_udp_pcb, p *C.struct_pbuf, addr *C.ip_addr_t, port C.u16_t, destAddr *C.ip_addr_t, destPort C.u16_t) bool {
+	totlen := int(p.tot_len)
+	if totlen == 0 {
+		return false
+	}
+	buf := NewBytes(totlen)
+	defer FreeBytes(buf)
+	C.pbuf_copy_partial(p, unsafe.Pointer(&buf[0]), p.tot_len, 0)
+
+	resp, err := s.fakeDns.GenerateFakeResponse(buf[:totlen])
+	if err != nil || len(resp) == 0 {
+		return false
+	}
+
+	// The response is sent from the queried address to the client, lwIP
+	// is already locked in the callback.
+	rp := C.pbuf_alloc_reference(unsafe.Pointer(&resp[0]), C.u16_t(len(resp)), C.PBUF_ROM)
+	defer C.pbuf_free(rp)
+	C.udp_sendto(pcb, rp, addr, port, destAddr, destPort)
+	return true
+}
+
 type pbbufReader struct {
 	p      *C.struct_pbuf
 	offset int
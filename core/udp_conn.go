@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"net"
 	"sync"
+	"time"
 	"unsafe"
 )
 
@@ -29,34 +30,48 @@ type udpPacket struct {
 type udpConn struct {
 	sync.RWMutex
 
-	connId    string
-	pcb       *C.struct_udp_pcb
-	handler   UDPConnHandler
-	localAddr *net.UDPAddr
-	localIP   C.ip_addr_t
-	localPort C.u16_t
-	state     udpConnState
-	pending   chan *udpPacket
+	stack      *lwipStack
+	connId     string
+	pcb        *C.struct_udp_pcb
+	handler    UDPConnHandler
+	localAddr  *net.UDPAddr
+	remoteAddr *net.UDPAddr
+	localIP    C.ip_addr_t
+	localPort  C.u16_t
+	state      udpConnState
+	pending    chan *udpPacket
+	stats      connStats
 }
 
-func newUDPConn(connId string, pcb *C.struct_udp_pcb, handler UDPConnHandler, localIP C.ip_addr_t, localPort C.u16_t, localAddr, remoteAddr *net.UDPAddr) (UDPConn, error) {
+func newUDPConn(s *lwipStack, connId string, pcb *C.struct_udp_pcb, handler UDPConnHandler, localIP C.ip_addr_t, localPort C.u16_t, localAddr, remoteAddr *net.UDPAddr) (UDPConn, error) {
 	conn := &udpConn{
-		connId:    connId,
-		handler:   handler,
-		pcb:       pcb,
-		localAddr: localAddr,
-		localIP:   localIP,
-		localPort: localPort,
-		state:     udpConnecting,
-		pending:   make(chan *udpPacket, 64), // To hold the early packets on the connection
+		stack:      s,
+		connId:     connId,
+		handler:    handler,
+		pcb:        pcb,
+		localAddr:  localAddr,
+		remoteAddr: remoteAddr,
+		stats:      newConnStats(),
+		localIP:    localIP,
+		localPort:  localPort,
+		state:      udpConnecting,
+		pending:    make(chan *udpPacket, 64), // To hold the early packets on the connection
 	}
 
 	go func() {
+		start := time.Now()
 		err := handler.Connect(conn, remoteAddr)
+		udpDialLatency.ObserveDuration(start)
 		if err != nil {
+			udpDialFailures.Inc()
 			conn.Close()
 		} else {
 			conn.Lock()
+			if conn.state != udpConnecting {
+				// Closed while connecting.
+				conn.Unlock()
+				return
+			}
 			conn.state = udpConnected
 			conn.Unlock()
 			// Once connected, send all pending data.
@@ -117,6 +132,7 @@ func (conn *udpConn) enqueueEarlyPacket(data []byte, addr *net.UDPAddr) bool {
 }
 
 func (conn *udpConn) ReceiveTo(data []byte, addr *net.UDPAddr) error {
+	conn.stats.uplink.Add(uint64(len(data)))
 	if conn.enqueueEarlyPacket(data, addr) {
 		return nil
 	}
@@ -143,16 +159,20 @@ func (conn *udpConn) WriteFrom(data []byte, addr *net.UDPAddr) (int, error) {
 	buf := C.pbuf_alloc_reference(unsafe.Pointer(&data[0]), C.u16_t(len(data)), C.PBUF_ROM)
 	defer C.pbuf_free(buf)
 	C.udp_sendto(conn.pcb, buf, &conn.localIP, conn.localPort, &cremoteIP, C.u16_t(addr.Port))
+	conn.stats.downlink.Add(uint64(len(data)))
 	return len(data), nil
 }
 
 func (conn *udpConn) Close() error {
-	if err := conn.checkState(); err != nil {
-		return err
-	}
+	// Connecting conns can be closed as well, e.g. if the handler failed
+	// to connect.
 	conn.Lock()
+	if conn.state == udpClosed {
+		conn.Unlock()
+		return errors.New("connection closed")
+	}
 	conn.state = udpClosed
 	conn.Unlock()
-	udpConns.Remove(conn.connId)
+	conn.stack.udpConns.Remove(conn.connId)
 	return nil
 }
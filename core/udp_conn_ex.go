@@ -11,32 +11,42 @@ import (
 	"io"
 	"net"
 	"sync/atomic"
+	"time"
 	"unsafe"
 )
 
 type udpConnex struct {
-	connId    string
-	pcb       *C.struct_udp_pcb
-	handler   UDPConnHandlerEx
-	localAddr *net.UDPAddr
-	localIP   C.ip_addr_t
-	localPort C.u16_t
-	closed    atomic.Bool
-	data      interface{}
+	stack      *lwipStack
+	connId     string
+	pcb        *C.struct_udp_pcb
+	handler    UDPConnHandlerEx
+	localAddr  *net.UDPAddr
+	remoteAddr *net.UDPAddr
+	localIP    C.ip_addr_t
+	localPort  C.u16_t
+	closed     atomic.Bool
+	data       interface{}
+	stats      connStats
 }
 
-func newUDPConnEx(connId string, pcb *C.struct_udp_pcb, handler UDPConnHandlerEx, localIP C.ip_addr_t, localPort C.u16_t, localAddr, remoteAddr *net.UDPAddr) (UDPConn, error) {
+func newUDPConnEx(s *lwipStack, connId string, pcb *C.struct_udp_pcb, handler UDPConnHandlerEx, localIP C.ip_addr_t, localPort C.u16_t, localAddr, remoteAddr *net.UDPAddr) (UDPConn, error) {
 	conn := &udpConnex{
-		connId:    connId,
-		handler:   handler,
-		pcb:       pcb,
-		localAddr: localAddr,
-		localIP:   localIP,
-		localPort: localPort,
+		stack:      s,
+		connId:     connId,
+		handler:    handler,
+		pcb:        pcb,
+		localAddr:  localAddr,
+		remoteAddr: remoteAddr,
+		stats:      newConnStats(),
+		localIP:    localIP,
+		localPort:  localPort,
 	}
 
+	start := time.Now()
 	err := handler.Connect(conn, remoteAddr)
+	udpDialLatency.ObserveDuration(start)
 	if err != nil {
+		udpDialFailures.Inc()
 		conn.Close()
 		return nil, err
 	}
@@ -59,6 +69,7 @@ func (conn *udpConnex) ReceiveTo(data []byte, addr *net.UDPAddr) error {
 }
 
 func (conn *udpConnex) ReceiveToBuffer(reader BytesReader, addr *net.UDPAddr) error {
+	conn.stats.uplink.Add(uint64(reader.Len()))
 	return conn.handler.ReceiveToBuffer(conn, reader, addr)
 }
 
@@ -75,12 +86,13 @@ func (conn *udpConnex) WriteFrom(data []byte, addr *net.UDPAddr) (int, error) {
 	buf := C.pbuf_alloc_reference(unsafe.Pointer(&data[0]), C.u16_t(len(data)), C.PBUF_ROM)
 	defer C.pbuf_free(buf)
 	C.udp_sendto(conn.pcb, buf, &conn.localIP, conn.localPort, &cremoteIP, C.u16_t(addr.Port))
+	conn.stats.downlink.Add(uint64(len(data)))
 	return len(data), nil
 }
 
 func (conn *udpConnex) Close() error {
 	if conn.closed.CompareAndSwap(false, true) {
-		udpConns.Remove(conn.connId)
+		conn.stack.udpConns.Remove(conn.connId)
 		if o, ok := conn.data.(io.Closer); ok {
 			o.Close()
 		}
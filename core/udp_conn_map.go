@@ -7,23 +7,37 @@ import (
 	lru "github.com/hashicorp/golang-lru/v2"
 )
 
-var udpConns *lru.Cache[string, UDPConn]
-
+// SetUDPParams sets UDP parameters of the default stack.
 func SetUDPParams(maxConnSize int) {
+	defaultStack.setUDPParams(maxConnSize)
+}
+
+// WriteUDPConnStats writes UDP connections of the default stack to w.
+func WriteUDPConnStats(w io.Writer) {
+	defaultStack.writeUDPConnStats(w)
+}
+
+// setUDPParams resizes the UDP connection table, the size is kept for the
+// stack replacing the default one. Evicted connections are closed.
+func (s *lwipStack) setUDPParams(maxConnSize int) {
 	if maxConnSize > 0 {
-		udpConns.Resize(maxConnSize)
+		lwipMutex.Lock()
+		s.maxUDPConns = maxConnSize
+		lwipMutex.Unlock()
+		s.udpConns.Resize(maxConnSize)
 	}
 }
-func WriteUDPConnStats(w io.Writer) {
-	fmt.Fprintf(w, "udp connection count: %d, list:\n", udpConns.Len())
-	for k, conn := range udpConns.Values() {
+
+func (s *lwipStack) writeUDPConnStats(w io.Writer) {
+	fmt.Fprintf(w, "udp connection count: %d, list:\n", s.udpConns.Len())
+	for k, conn := range s.udpConns.Values() {
 		fmt.Fprintln(w, fmt.Sprintf("conn %d: ", k), conn.LocalAddr().String())
 	}
 }
 
-func init() {
-	maxConnSize := 1024
-	udpConns, _ = lru.NewWithEvict(maxConnSize, func(key string, value UDPConn) {
+func newUDPConnMap(size int) *lru.Cache[string, UDPConn] {
+	conns, _ := lru.NewWithEvict(size, func(key string, value UDPConn) {
 		value.Close()
 	})
+	return conns
 }
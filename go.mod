@@ -3,8 +3,18 @@ module github.com/eycorsican/go-tun2socks
 go 1.23
 
 require (
+	github.com/BurntSushi/toml v1.4.0
 	github.com/hashicorp/golang-lru/v2 v2.0.7
 	github.com/songgao/water v0.0.0-20200317203138-2b4b6d7c09d8
-	golang.org/x/net v0.1.0
+	github.com/vishvananda/netlink v1.3.1
+	golang.org/x/crypto v0.28.0
+	golang.org/x/net v0.21.0
 	golang.org/x/sys v0.26.0
+	gopkg.in/yaml.v3 v3.0.1
+	lukechampine.com/blake3 v1.4.1
+)
+
+require (
+	github.com/klauspost/cpuid/v2 v2.0.12 // indirect
+	github.com/vishvananda/netns v0.0.5 // indirect
 )
@@ -0,0 +1,67 @@
+package direct
+
+import (
+	"context"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// Options controls how connections to the original destinations are made,
+// they are needed to keep the dialed traffic from being routed back into the
+// TUN interface.
+type Options struct {
+	// Interface is the name of the outbound interface to bind sockets to
+	// (SO_BINDTODEVICE on Linux, IP_BOUND_IF on macOS).
+	Interface string
+
+	// SourceAddr is the local address to bind sockets to.
+	SourceAddr net.IP
+
+	// Mark is the fwmark set on sockets (SO_MARK, Linux only), policy
+	// routing rules can match on it. Zero means no mark.
+	Mark int
+}
+
+func (o *Options) control(network, address string, c syscall.RawConn) error {
+	if o.Interface == "" && o.Mark == 0 {
+		return nil
+	}
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		err = setSocketOptions(fd, network, o)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// DialContext connects to address on network ("tcp" or "udp" and their
+// variants) with sockets set up by the options, so that other components,
+// e.g. DNS upstreams, can reach servers off the TUN interface too.
+func (o *Options) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d := &net.Dialer{Control: o.control}
+	if o.SourceAddr != nil {
+		if strings.HasPrefix(network, "udp") {
+			d.LocalAddr = &net.UDPAddr{IP: o.SourceAddr}
+		} else {
+			d.LocalAddr = &net.TCPAddr{IP: o.SourceAddr}
+		}
+	}
+	return d.DialContext(ctx, network, address)
+}
+
+func (o *Options) dialTCP(target *net.TCPAddr) (net.Conn, error) {
+	return o.DialContext(context.Background(), "tcp", target.String())
+}
+
+func (o *Options) listenUDP() (*net.UDPConn, error) {
+	lc := &net.ListenConfig{Control: o.control}
+	laddr := &net.UDPAddr{IP: o.SourceAddr}
+	pc, err := lc.ListenPacket(context.Background(), "udp", laddr.String())
+	if err != nil {
+		return nil, err
+	}
+	return pc.(*net.UDPConn), nil
+}
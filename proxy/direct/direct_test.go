@@ -0,0 +1,144 @@
+package direct
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// fakeUDPConn passes the packets written to TUN to the test.
+type fakeUDPConn struct {
+	packets chan []byte
+	from    chan *net.UDPAddr
+}
+
+func (c *fakeUDPConn) LocalAddr() *net.UDPAddr {
+	return &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 12345}
+}
+
+func (c *fakeUDPConn) ReceiveTo(data []byte, addr *net.UDPAddr) error { return nil }
+
+func (c *fakeUDPConn) WriteFrom(data []byte, addr *net.UDPAddr) (int, error) {
+	c.packets <- append([]byte(nil), data...)
+	c.from <- addr
+	return len(data), nil
+}
+
+func (c *fakeUDPConn) Close() error { return nil }
+
+func TestTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	remotes := make(chan net.Addr, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		remotes <- c.RemoteAddr()
+		io.Copy(c, c)
+		c.Close()
+	}()
+
+	h := NewTCPHandler(&Options{SourceAddr: net.IPv4(127, 0, 0, 1)})
+	conn, tun := net.Pipe()
+	defer tun.Close()
+	if err := h.Handle(conn, l.Addr().(*net.TCPAddr)); err != nil {
+		t.Fatal(err)
+	}
+	go tun.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(tun, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Errorf("unexpected reply %q", buf)
+	}
+	if remote := <-remotes; !remote.(*net.TCPAddr).IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("unexpected source address %v", remote)
+	}
+}
+
+func TestUDP(t *testing.T) {
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteToUDP(buf[:n], addr)
+		}
+	}()
+
+	opts := &Options{}
+	if runtime.GOOS == "linux" && os.Geteuid() == 0 {
+		// Binding to an interface and marking sockets require
+		// CAP_NET_RAW and CAP_NET_ADMIN.
+		opts.Interface, opts.Mark = "lo", 1
+	}
+	h := NewUDPHandler(opts, time.Second)
+	conn := &fakeUDPConn{packets: make(chan []byte, 1), from: make(chan *net.UDPAddr, 1)}
+	target := pc.LocalAddr().(*net.UDPAddr)
+	if err := h.Connect(conn, target); err != nil {
+		t.Fatal(err)
+	}
+	defer h.(*udpHandler).Close(conn)
+	if err := h.ReceiveTo(conn, []byte("query"), target); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case data := <-conn.packets:
+		if string(data) != "query" {
+			t.Errorf("unexpected reply %q", data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no reply")
+	}
+	// IPv4 sources are not IPv4-mapped IPv6 addresses.
+	if from := <-conn.from; len(from.IP) != net.IPv4len || from.Port != target.Port {
+		t.Errorf("unexpected reply source %#v", from)
+	}
+}
+
+func TestDialContext(t *testing.T) {
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	opts := &Options{SourceAddr: net.IPv4(127, 0, 0, 1)}
+	if runtime.GOOS == "linux" && os.Geteuid() == 0 {
+		opts.Interface, opts.Mark = "lo", 1
+	}
+	c, err := opts.DialContext(context.Background(), "udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte("query")); err != nil {
+		t.Fatal(err)
+	}
+	pc.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 5)
+	_, from, err := pc.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "query" || from.String() != c.LocalAddr().String() {
+		t.Errorf("unexpected datagram %q from %v", buf, from)
+	}
+}
@@ -0,0 +1,26 @@
+package direct
+
+import (
+	"errors"
+	"net"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+func setSocketOptions(fd uintptr, network string, o *Options) error {
+	if o.Mark != 0 {
+		return errors.New("fwmark is not supported on this platform")
+	}
+	if o.Interface != "" {
+		iface, err := net.InterfaceByName(o.Interface)
+		if err != nil {
+			return err
+		}
+		if strings.HasSuffix(network, "6") {
+			return unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_BOUND_IF, iface.Index)
+		}
+		return unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_BOUND_IF, iface.Index)
+	}
+	return nil
+}
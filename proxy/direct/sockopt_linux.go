@@ -0,0 +1,19 @@
+package direct
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+func setSocketOptions(fd uintptr, network string, o *Options) error {
+	if o.Interface != "" {
+		if err := unix.BindToDevice(int(fd), o.Interface); err != nil {
+			return err
+		}
+	}
+	if o.Mark != 0 {
+		if err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, o.Mark); err != nil {
+			return err
+		}
+	}
+	return nil
+}
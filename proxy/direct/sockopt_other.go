@@ -0,0 +1,11 @@
+// +build !linux,!darwin
+
+package direct
+
+import (
+	"errors"
+)
+
+func setSocketOptions(fd uintptr, network string, o *Options) error {
+	return errors.New("binding to an interface or fwmark is not supported on this platform")
+}
@@ -0,0 +1,33 @@
+package direct
+
+import (
+	"net"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+	"github.com/eycorsican/go-tun2socks/common/relay"
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+type tcpHandler struct {
+	opts Options
+}
+
+// NewTCPHandler creates a TCP handler connecting to the original
+// destinations, opts can be nil.
+func NewTCPHandler(opts *Options) core.TCPConnHandler {
+	h := &tcpHandler{}
+	if opts != nil {
+		h.opts = *opts
+	}
+	return h
+}
+
+func (h *tcpHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
+	c, err := h.opts.dialTCP(target)
+	if err != nil {
+		return err
+	}
+	go relay.Copy(conn, c)
+	log.Infof("new direct connection to %v", target)
+	return nil
+}
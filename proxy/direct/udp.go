@@ -0,0 +1,109 @@
+package direct
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+type udpHandler struct {
+	sync.Mutex
+
+	opts     Options
+	timeout  time.Duration
+	udpConns map[core.UDPConn]*net.UDPConn
+}
+
+// NewUDPHandler creates a UDP handler sending packets to their original
+// destinations from a local socket per connection, opts can be nil.
+func NewUDPHandler(opts *Options, timeout time.Duration) core.UDPConnHandler {
+	h := &udpHandler{
+		timeout:  timeout,
+		udpConns: make(map[core.UDPConn]*net.UDPConn, 8),
+	}
+	if opts != nil {
+		h.opts = *opts
+	}
+	return h
+}
+
+func (h *udpHandler) fetchUDPInput(conn core.UDPConn, pc *net.UDPConn) {
+	buf := core.NewBytes(core.BufSize)
+
+	defer func() {
+		h.Close(conn)
+		core.FreeBytes(buf)
+	}()
+
+	for {
+		pc.SetDeadline(time.Now().Add(h.timeout))
+		n, addr, err := pc.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		// Unmap IPv4 addresses received on a dual-stack socket.
+		if ip4 := addr.IP.To4(); ip4 != nil {
+			addr.IP = ip4
+		}
+		if _, err := conn.WriteFrom(buf[:n], addr); err != nil {
+			log.Warnf("failed to write UDP data to TUN")
+			return
+		}
+	}
+}
+
+func (h *udpHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
+	pc, err := h.opts.listenUDP()
+	if err != nil {
+		log.Errorf("failed to bind udp address: %v", err)
+		return err
+	}
+	h.Lock()
+	h.udpConns[conn] = pc
+	h.Unlock()
+	go h.fetchUDPInput(conn, pc)
+	log.Infof("new direct connection for target: %v", target)
+	return nil
+}
+
+func (h *udpHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr) error {
+	h.Lock()
+	pc, ok := h.udpConns[conn]
+	h.Unlock()
+	if !ok {
+		return errors.New("direct connection does not exist")
+	}
+	_, err := pc.WriteToUDP(data, addr)
+	return err
+}
+
+func (h *udpHandler) Close(conn core.UDPConn) {
+	conn.Close()
+
+	h.Lock()
+	defer h.Unlock()
+
+	if pc, ok := h.udpConns[conn]; ok {
+		pc.Close()
+		delete(h.udpConns, conn)
+	}
+}
+
+// Shutdown closes all connections and their sockets.
+func (h *udpHandler) Shutdown() error {
+	h.Lock()
+	conns := make([]core.UDPConn, 0, len(h.udpConns))
+	for conn := range h.udpConns {
+		conns = append(conns, conn)
+	}
+	h.Unlock()
+
+	for _, conn := range conns {
+		h.Close(conn)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package dns
+
+import (
+	"strings"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+type cacheEntry struct {
+	msg     dnsmessage.Message
+	stored  time.Time
+	expires time.Time
+}
+
+// cache holds responses until the lowest TTL of their records expires,
+// negative responses are held for the TTL of their SOA record (RFC 2308).
+type cache struct {
+	entries *lru.Cache[string, *cacheEntry]
+}
+
+func newCache(size int) *cache {
+	entries, _ := lru.New[string, *cacheEntry](size)
+	return &cache{entries: entries}
+}
+
+func cacheKey(q dnsmessage.Question) string {
+	return strings.ToLower(q.Name.String()) + "/" + q.Type.String() + "/" + q.Class.String()
+}
+
+// get returns the packed cached response to q with ID id, or nil if q is
+// not cached. TTLs are decreased by the time spent in the cache.
+func (c *cache) get(q dnsmessage.Question, id uint16) []byte {
+	key := cacheKey(q)
+	e, ok := c.entries.Get(key)
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	if !now.Before(e.expires) {
+		c.entries.Remove(key)
+		return nil
+	}
+
+	elapsed := uint32(now.Sub(e.stored) / time.Second)
+	msg := e.msg
+	msg.Header.ID = id
+	msg.Answers = decreaseTTL(e.msg.Answers, elapsed)
+	msg.Authorities = decreaseTTL(e.msg.Authorities, elapsed)
+	msg.Additionals = decreaseTTL(e.msg.Additionals, elapsed)
+	b, err := msg.Pack()
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// put caches msg if it's a cacheable response.
+func (c *cache) put(msg *dnsmessage.Message) {
+	if len(msg.Questions) != 1 || msg.Truncated {
+		return
+	}
+	if msg.RCode != dnsmessage.RCodeSuccess && msg.RCode != dnsmessage.RCodeNameError {
+		return
+	}
+
+	var ttl uint32
+	found := false
+	minTTL := func(t uint32) {
+		if !found || t < ttl {
+			ttl, found = t, true
+		}
+	}
+	for _, r := range msg.Answers {
+		minTTL(r.Header.TTL)
+	}
+	if len(msg.Answers) == 0 {
+		// Negative response.
+		for _, r := range msg.Authorities {
+			if soa, ok := r.Body.(*dnsmessage.SOAResource); ok {
+				minTTL(r.Header.TTL)
+				minTTL(soa.MinTTL)
+			}
+		}
+	}
+	if !found || ttl == 0 {
+		return
+	}
+
+	now := time.Now()
+	c.entries.Add(cacheKey(msg.Questions[0]), &cacheEntry{
+		msg:     *msg,
+		stored:  now,
+		expires: now.Add(time.Duration(ttl) * time.Second),
+	})
+}
+
+// decreaseTTL returns a copy of rs with TTLs decreased by elapsed seconds,
+// OPT pseudo-records are kept as their TTL field holds flags.
+func decreaseTTL(rs []dnsmessage.Resource, elapsed uint32) []dnsmessage.Resource {
+	if len(rs) == 0 {
+		return rs
+	}
+	out := make([]dnsmessage.Resource, len(rs))
+	copy(out, rs)
+	for i := range out {
+		if out[i].Header.Type == dnsmessage.TypeOPT {
+			continue
+		}
+		if out[i].Header.TTL > elapsed {
+			out[i].Header.TTL -= elapsed
+		} else {
+			out[i].Header.TTL = 0
+		}
+	}
+	return out
+}
@@ -0,0 +1,161 @@
+package dns
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func question(name string) dnsmessage.Question {
+	return dnsmessage.Question{
+		Name:  dnsmessage.MustNewName(name),
+		Type:  dnsmessage.TypeA,
+		Class: dnsmessage.ClassINET,
+	}
+}
+
+// response returns a response to a query of name with an A record of ttl
+// for each of ips.
+func response(name string, ttl uint32, ips ...[4]byte) *dnsmessage.Message {
+	msg := &dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 1, Response: true},
+		Questions: []dnsmessage.Question{question(name)},
+	}
+	for _, ip := range ips {
+		msg.Answers = append(msg.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{
+				Name:  dnsmessage.MustNewName(name),
+				Type:  dnsmessage.TypeA,
+				Class: dnsmessage.ClassINET,
+				TTL:   ttl,
+			},
+			Body: &dnsmessage.AResource{A: ip},
+		})
+	}
+	return msg
+}
+
+// negativeResponse returns a NXDOMAIN response to a query of name with a SOA
+// record of ttl and minTTL.
+func negativeResponse(name string, ttl, minTTL uint32) *dnsmessage.Message {
+	msg := response(name, 0)
+	msg.RCode = dnsmessage.RCodeNameError
+	msg.Authorities = []dnsmessage.Resource{{
+		Header: dnsmessage.ResourceHeader{
+			Name:  dnsmessage.MustNewName("example."),
+			Type:  dnsmessage.TypeSOA,
+			Class: dnsmessage.ClassINET,
+			TTL:   ttl,
+		},
+		Body: &dnsmessage.SOAResource{
+			NS:     dnsmessage.MustNewName("ns.example."),
+			MBox:   dnsmessage.MustNewName("admin.example."),
+			MinTTL: minTTL,
+		},
+	}}
+	return msg
+}
+
+// age moves the entry of q back in time by d.
+func age(c *cache, q dnsmessage.Question, d time.Duration) {
+	if e, ok := c.entries.Get(cacheKey(q)); ok {
+		e.stored = e.stored.Add(-d)
+		e.expires = e.expires.Add(-d)
+	}
+}
+
+func unpack(t *testing.T, b []byte) *dnsmessage.Message {
+	t.Helper()
+	var msg dnsmessage.Message
+	if err := msg.Unpack(b); err != nil {
+		t.Fatal(err)
+	}
+	return &msg
+}
+
+func TestCacheTTL(t *testing.T) {
+	c := newCache(8)
+	q := question("a.example.")
+	c.put(response("a.example.", 60, [4]byte{1, 2, 3, 4}))
+
+	msg := unpack(t, c.get(question("A.Example."), 42))
+	if msg.ID != 42 || len(msg.Answers) != 1 || msg.Answers[0].Header.TTL != 60 {
+		t.Errorf("cached response %+v", msg)
+	}
+
+	age(c, q, 10*time.Second)
+	msg = unpack(t, c.get(q, 43))
+	if msg.ID != 43 || msg.Answers[0].Header.TTL != 50 {
+		t.Errorf("response after 10s %+v", msg)
+	}
+
+	age(c, q, 50*time.Second)
+	if c.get(q, 44) != nil {
+		t.Error("expired response returned")
+	}
+	if c.entries.Len() != 0 {
+		t.Error("expired response kept")
+	}
+}
+
+func TestCacheLowestTTL(t *testing.T) {
+	c := newCache(8)
+	q := question("a.example.")
+	msg := response("a.example.", 60, [4]byte{1, 2, 3, 4}, [4]byte{1, 2, 3, 5})
+	msg.Answers[1].Header.TTL = 20
+	c.put(msg)
+
+	age(c, q, 19*time.Second)
+	if c.get(q, 1) == nil {
+		t.Fatal("response expired before its lowest TTL")
+	}
+	age(c, q, time.Second)
+	if c.get(q, 1) != nil {
+		t.Error("response not expired after its lowest TTL")
+	}
+}
+
+func TestCacheNegative(t *testing.T) {
+	c := newCache(8)
+	q := question("nx.example.")
+
+	// The SOA minimum is lower than its TTL.
+	c.put(negativeResponse("nx.example.", 300, 30))
+	msg := unpack(t, c.get(q, 1))
+	if msg.RCode != dnsmessage.RCodeNameError || len(msg.Authorities) != 1 {
+		t.Errorf("cached negative response %+v", msg)
+	}
+	age(c, q, 30*time.Second)
+	if c.get(q, 1) != nil {
+		t.Error("negative response held longer than the SOA minimum")
+	}
+
+	// Without SOA record, the TTL of negative responses is unknown.
+	msg = negativeResponse("nx.example.", 300, 30)
+	msg.Authorities = nil
+	c.put(msg)
+	if c.get(q, 1) != nil {
+		t.Error("negative response without SOA cached")
+	}
+}
+
+func TestCacheUncacheable(t *testing.T) {
+	failure := response("a.example.", 60, [4]byte{1, 2, 3, 4})
+	failure.RCode = dnsmessage.RCodeServerFailure
+	truncated := response("a.example.", 60, [4]byte{1, 2, 3, 4})
+	truncated.Truncated = true
+
+	for _, msg := range []*dnsmessage.Message{
+		failure,
+		truncated,
+		response("a.example.", 0, [4]byte{1, 2, 3, 4}),
+		response("a.example.", 60),
+	} {
+		c := newCache(8)
+		c.put(msg)
+		if c.entries.Len() != 0 {
+			t.Errorf("cached %+v", msg)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+// Package dns implements a UDP handler answering DNS queries from a cache
+// and forwarding cache misses to an upstream DNS server, over UDP, TCP, TLS
+// or HTTPS.
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	cdns "github.com/eycorsican/go-tun2socks/common/dns"
+	"github.com/eycorsican/go-tun2socks/common/log"
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+const (
+	// exchangeTimeout is the timeout of queries to the upstream, clients
+	// get a SERVFAIL response once it's reached.
+	exchangeTimeout = 5 * time.Second
+
+	// defaultUDPSize is the maximum size of responses to clients not
+	// advertising a larger size with EDNS (RFC 1035 section 4.2.1).
+	defaultUDPSize = 512
+)
+
+// udpHandler intercepts DNS queries and passes other UDP conns to the next
+// handler.
+type udpHandler struct {
+	sync.Mutex
+
+	next     core.UDPConnHandler
+	upstream Upstream
+	cache    *cache
+
+	// Pending queries of conns connected to a DNS server, conns are closed
+	// once all their queries are answered.
+	pending map[core.UDPConn]int
+}
+
+// NewUDPHandler creates a UDP handler answering queries to port 53 with
+// responses from a cache of cacheSize entries, or from upstream. Other UDP
+// conns are handled by next, they are refused if next is nil.
+func NewUDPHandler(next core.UDPConnHandler, upstream Upstream, cacheSize int) core.UDPConnHandler {
+	h := &udpHandler{
+		next:     next,
+		upstream: upstream,
+		pending:  make(map[core.UDPConn]int, 8),
+	}
+	if cacheSize > 0 {
+		h.cache = newCache(cacheSize)
+	}
+	return h
+}
+
+func (h *udpHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
+	if target != nil && target.Port == cdns.COMMON_DNS_PORT {
+		h.Lock()
+		h.pending[conn] = 0
+		h.Unlock()
+		return nil
+	}
+	if h.next == nil {
+		return errors.New("only DNS is handled")
+	}
+	return h.next.Connect(conn, target)
+}
+
+func (h *udpHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr) error {
+	if addr.Port != cdns.COMMON_DNS_PORT {
+		h.Lock()
+		_, intercepted := h.pending[conn]
+		h.Unlock()
+		if intercepted || h.next == nil {
+			h.closeIdle(conn)
+			return errors.New("only DNS is handled")
+		}
+		return h.next.ReceiveTo(conn, data, addr)
+	}
+
+	var query dnsmessage.Message
+	if err := query.Unpack(data); err != nil {
+		h.closeIdle(conn)
+		return err
+	}
+	if query.Response || len(query.Questions) != 1 {
+		h.closeIdle(conn)
+		return errors.New("unsupported DNS query")
+	}
+
+	h.Lock()
+	if n, ok := h.pending[conn]; ok {
+		h.pending[conn] = n + 1
+	}
+	h.Unlock()
+
+	if h.cache != nil {
+		if resp := h.cache.get(query.Questions[0], query.ID); resp != nil {
+			log.Debugf("dns cache hit for %v", query.Questions[0].Name)
+			return h.reply(conn, &query, resp, addr)
+		}
+	}
+
+	// The buffer of data is not ours once returned.
+	data = append([]byte{}, data...)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), exchangeTimeout)
+		defer cancel()
+		resp, err := h.exchange(ctx, data)
+		if err != nil {
+			log.Warnf("dns query for %v failed: %v", query.Questions[0].Name, err)
+			resp = serverFailure(&query)
+		}
+		h.reply(conn, &query, resp, addr)
+	}()
+	return nil
+}
+
+// exchange forwards query to the upstream and caches the response.
+func (h *udpHandler) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	resp, err := h.upstream.Exchange(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		return nil, err
+	}
+	if !msg.Response {
+		return nil, errors.New("upstream response is not a response")
+	}
+	if h.cache != nil {
+		h.cache.put(&msg)
+	}
+	return resp, nil
+}
+
+// reply writes resp to the query, truncated to the size the client accepts,
+// and closes conn if it has no more pending queries.
+func (h *udpHandler) reply(conn core.UDPConn, query *dnsmessage.Message, resp []byte, addr *net.UDPAddr) error {
+	_, err := conn.WriteFrom(truncate(resp, udpSize(query)), addr)
+
+	h.Lock()
+	n, ok := h.pending[conn]
+	if ok && n <= 1 {
+		delete(h.pending, conn)
+	} else if ok {
+		h.pending[conn] = n - 1
+	}
+	h.Unlock()
+	if ok && n <= 1 {
+		conn.Close()
+	}
+	return err
+}
+
+// closeIdle closes conn if it's connected to a DNS server and has no pending
+// queries, as no reply will close it.
+func (h *udpHandler) closeIdle(conn core.UDPConn) {
+	h.Lock()
+	n, ok := h.pending[conn]
+	if ok && n == 0 {
+		delete(h.pending, conn)
+	}
+	h.Unlock()
+	if ok && n == 0 {
+		conn.Close()
+	}
+}
+
+// Shutdown closes conns connected to DNS servers and shuts down the next
+// handler if it implements core.ShutdownHandler.
+func (h *udpHandler) Shutdown() error {
+	h.Lock()
+	conns := make([]core.UDPConn, 0, len(h.pending))
+	for conn := range h.pending {
+		conns = append(conns, conn)
+	}
+	h.pending = make(map[core.UDPConn]int, 8)
+	h.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+	if sh, ok := h.next.(core.ShutdownHandler); ok {
+		return sh.Shutdown()
+	}
+	return nil
+}
+
+// udpSize returns the maximum size of UDP responses to query.
+func udpSize(query *dnsmessage.Message) int {
+	for _, r := range query.Additionals {
+		if r.Header.Type == dnsmessage.TypeOPT && int(r.Header.Class) > defaultUDPSize {
+			return int(r.Header.Class)
+		}
+	}
+	return defaultUDPSize
+}
+
+// truncate returns resp, or a copy of its header and question with the TC
+// bit set if it's larger than size, so that the client retries over TCP.
+func truncate(resp []byte, size int) []byte {
+	if len(resp) <= size {
+		return resp
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		return resp
+	}
+	msg.Truncated = true
+	msg.Answers, msg.Authorities, msg.Additionals = nil, nil, nil
+	b, err := msg.Pack()
+	if err != nil {
+		return resp
+	}
+	return b
+}
+
+// serverFailure returns a SERVFAIL response to query.
+func serverFailure(query *dnsmessage.Message) []byte {
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 query.ID,
+			Response:           true,
+			OpCode:             query.OpCode,
+			RecursionDesired:   query.RecursionDesired,
+			RecursionAvailable: true,
+			RCode:              dnsmessage.RCodeServerFailure,
+		},
+		Questions: query.Questions,
+	}
+	b, _ := msg.Pack()
+	return b
+}
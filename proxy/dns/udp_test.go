@@ -0,0 +1,207 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeUDPConn passes the packets written to TUN to the test.
+type fakeUDPConn struct {
+	packets chan []byte
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newFakeUDPConn() *fakeUDPConn {
+	return &fakeUDPConn{packets: make(chan []byte, 4), closed: make(chan struct{})}
+}
+
+func (c *fakeUDPConn) LocalAddr() *net.UDPAddr {
+	return &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 12345}
+}
+
+func (c *fakeUDPConn) ReceiveTo(data []byte, addr *net.UDPAddr) error { return nil }
+
+func (c *fakeUDPConn) WriteFrom(data []byte, addr *net.UDPAddr) (int, error) {
+	c.packets <- append([]byte(nil), data...)
+	return len(data), nil
+}
+
+func (c *fakeUDPConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *fakeUDPConn) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// upstreamFunc is an Upstream calling the function itself.
+type upstreamFunc func(ctx context.Context, query []byte) ([]byte, error)
+
+func (f upstreamFunc) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	return f(ctx, query)
+}
+
+var dnsServer = &net.UDPAddr{IP: net.IPv4(8, 8, 8, 8), Port: 53}
+
+func packQuery(t *testing.T, id uint16, name string) []byte {
+	t.Helper()
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{question(name)},
+	}
+	b, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// query sends a query of name to h on a new conn and returns the response.
+func query(t *testing.T, h *udpHandler, id uint16, name string) *dnsmessage.Message {
+	t.Helper()
+	conn := newFakeUDPConn()
+	if err := h.Connect(conn, dnsServer); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.ReceiveTo(conn, packQuery(t, id, name), dnsServer); err != nil {
+		t.Fatal(err)
+	}
+	var resp []byte
+	select {
+	case resp = <-conn.packets:
+	case <-time.After(time.Second):
+		t.Fatal("no response")
+	}
+	select {
+	case <-conn.closed:
+	case <-time.After(time.Second):
+		t.Error("conn not closed after the response")
+	}
+	return unpack(t, resp)
+}
+
+func TestUDPCache(t *testing.T) {
+	var exchanges int
+	upstream := upstreamFunc(func(ctx context.Context, query []byte) ([]byte, error) {
+		exchanges++
+		var q dnsmessage.Message
+		if err := q.Unpack(query); err != nil {
+			return nil, err
+		}
+		msg := response("a.example.", 60, [4]byte{1, 2, 3, 4})
+		msg.ID = q.ID
+		return msg.Pack()
+	})
+	h := NewUDPHandler(nil, upstream, 8).(*udpHandler)
+
+	for _, id := range []uint16{1, 2} {
+		resp := query(t, h, id, "a.example.")
+		if resp.ID != id || len(resp.Answers) != 1 {
+			t.Errorf("response %+v", resp)
+		}
+	}
+	if exchanges != 1 {
+		t.Errorf("%v queries sent upstream", exchanges)
+	}
+}
+
+func TestUDPServerFailure(t *testing.T) {
+	upstream := upstreamFunc(func(ctx context.Context, query []byte) ([]byte, error) {
+		return nil, errors.New("fake failure")
+	})
+	h := NewUDPHandler(nil, upstream, 8).(*udpHandler)
+
+	resp := query(t, h, 7, "a.example.")
+	if resp.ID != 7 || !resp.Response || resp.RCode != dnsmessage.RCodeServerFailure {
+		t.Errorf("response %+v", resp)
+	}
+	if len(resp.Questions) != 1 || resp.Questions[0].Name.String() != "a.example." {
+		t.Errorf("response questions %v", resp.Questions)
+	}
+	if h.cache.entries.Len() != 0 {
+		t.Error("failure cached")
+	}
+}
+
+func TestUDPBadQuery(t *testing.T) {
+	upstream := upstreamFunc(func(ctx context.Context, query []byte) ([]byte, error) {
+		t.Error("bad query sent upstream")
+		return nil, errors.New("bad query")
+	})
+	h := NewUDPHandler(nil, upstream, 8).(*udpHandler)
+
+	resp, err := response("a.example.", 60).Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range [][]byte{[]byte("garbage"), resp} {
+		conn := newFakeUDPConn()
+		if err := h.Connect(conn, dnsServer); err != nil {
+			t.Fatal(err)
+		}
+		if err := h.ReceiveTo(conn, data, dnsServer); err == nil {
+			t.Errorf("no error receiving %q", data)
+		}
+		if !conn.isClosed() {
+			t.Errorf("conn not closed after receiving %q", data)
+		}
+	}
+	if len(h.pending) != 0 {
+		t.Errorf("pending conns %v", h.pending)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	msg := response("a.example.", 60)
+	for i := 0; i < 40; i++ {
+		msg.Answers = append(response("a.example.", 60, [4]byte{1, 2, 3, byte(i)}).Answers, msg.Answers...)
+	}
+	resp, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp) <= defaultUDPSize {
+		t.Fatalf("response of %v bytes", len(resp))
+	}
+
+	if b := truncate(resp, len(resp)); len(b) != len(resp) {
+		t.Errorf("response of %v bytes truncated to its size", len(resp))
+	}
+	b := truncate(resp, defaultUDPSize)
+	if len(b) > defaultUDPSize {
+		t.Errorf("truncated to %v bytes", len(b))
+	}
+	truncated := unpack(t, b)
+	if !truncated.Truncated || len(truncated.Answers) != 0 || truncated.ID != msg.ID || len(truncated.Questions) != 1 {
+		t.Errorf("truncated response %+v", truncated)
+	}
+}
+
+func TestUDPSize(t *testing.T) {
+	msg := dnsmessage.Message{}
+	if size := udpSize(&msg); size != defaultUDPSize {
+		t.Errorf("size %v without EDNS", size)
+	}
+	var opt dnsmessage.ResourceHeader
+	if err := opt.SetEDNS0(1232, dnsmessage.RCodeSuccess, false); err != nil {
+		t.Fatal(err)
+	}
+	msg.Additionals = []dnsmessage.Resource{{Header: opt, Body: &dnsmessage.OPTResource{}}}
+	if size := udpSize(&msg); size != 1232 {
+		t.Errorf("size %v with EDNS", size)
+	}
+}
@@ -0,0 +1,227 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+// maxMessageSize is the maximum size of DNS messages over TCP.
+const maxMessageSize = 65535
+
+// Upstream exchanges DNS messages with a DNS server.
+type Upstream interface {
+	// Exchange sends query and returns the response.
+	Exchange(ctx context.Context, query []byte) ([]byte, error)
+}
+
+// Dialer connects to addr (host:port) over TCP.
+type Dialer func(ctx context.Context, addr string) (net.Conn, error)
+
+// NetDialer connects to address on network, e.g. (*net.Dialer).DialContext.
+type NetDialer func(ctx context.Context, network, address string) (net.Conn, error)
+
+// HandlerDialer returns a dialer connecting through the TCP handler h. Host
+// names are resolved with r, or the system resolver if r is nil, whose
+// queries must not be routed into the TUN interface, where they could end up
+// waiting for the upstream being dialed.
+func HandlerDialer(h core.TCPConnHandler, r *net.Resolver) Dialer {
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	return func(ctx context.Context, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		p, err := r.LookupPort(ctx, "tcp", port)
+		if err != nil {
+			return nil, err
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			ips, err := r.LookupIP(ctx, "ip", host)
+			if err != nil {
+				return nil, err
+			}
+			// Prefer IPv4 as net.ResolveTCPAddr does.
+			ip = ips[0]
+			for _, a := range ips {
+				if a.To4() != nil {
+					ip = a
+					break
+				}
+			}
+		}
+		local, remote := net.Pipe()
+		if err := h.Handle(remote, &net.TCPAddr{IP: ip, Port: p}); err != nil {
+			local.Close()
+			remote.Close()
+			return nil, err
+		}
+		return local, nil
+	}
+}
+
+type udpUpstream struct {
+	addr string
+	dial NetDialer
+}
+
+// NewUDPUpstream creates an upstream sending queries to addr (host:port)
+// over UDP from a socket of its own made by dial, bypassing the handlers.
+// The socket must not be routed into the TUN interface, dial can bind it to
+// the outbound interface, see direct.Options.DialContext. A nil dial uses a
+// plain net.Dialer.
+func NewUDPUpstream(addr string, dial NetDialer) Upstream {
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	return &udpUpstream{addr: addr, dial: dial}
+}
+
+func (u *udpUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	if len(query) < 2 {
+		return nil, errors.New("query too short")
+	}
+	c, err := u.dial(ctx, "udp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+
+	if _, err := c.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Ignore stray responses to other queries.
+		if n >= 2 && bytes.Equal(buf[:2], query[:2]) {
+			return buf[:n], nil
+		}
+	}
+}
+
+type streamUpstream struct {
+	addr      string
+	dial      Dialer
+	tlsConfig *tls.Config
+}
+
+// NewTCPUpstream creates an upstream sending queries to addr (host:port)
+// over TCP connections made by dial.
+func NewTCPUpstream(addr string, dial Dialer) Upstream {
+	return &streamUpstream{addr: addr, dial: dial}
+}
+
+// NewTLSUpstream creates an upstream sending queries to addr (host:port)
+// over TLS (RFC 7858) on TCP connections made by dial.
+func NewTLSUpstream(addr string, dial Dialer, tlsConfig *tls.Config) Upstream {
+	return &streamUpstream{addr: addr, dial: dial, tlsConfig: tlsConfig}
+}
+
+func (u *streamUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	if len(query) > maxMessageSize {
+		return nil, errors.New("query too large")
+	}
+	c, err := u.dial(ctx, u.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+	if u.tlsConfig != nil {
+		tc := tls.Client(c, u.tlsConfig)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			return nil, err
+		}
+		c = tc
+	}
+
+	// Messages are prefixed with their length (RFC 1035 section 4.2.2).
+	req := make([]byte, 0, 2+len(query))
+	req = binary.BigEndian.AppendUint16(req, uint16(len(query)))
+	req = append(req, query...)
+	if _, err := c.Write(req); err != nil {
+		return nil, err
+	}
+	var size [2]byte
+	if _, err := io.ReadFull(c, size[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(c, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+type httpsUpstream struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTPSUpstream creates an upstream sending queries to url over HTTPS
+// (RFC 8484) on TCP connections made by dial, connections are kept alive
+// between queries.
+func NewHTTPSUpstream(url string, dial Dialer, tlsConfig *tls.Config) Upstream {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dial(ctx, addr)
+		},
+		TLSClientConfig:   tlsConfig,
+		ForceAttemptHTTP2: true,
+		IdleConnTimeout:   90 * time.Second,
+	}
+	return &httpsUpstream{url: url, client: &http.Client{Transport: transport}}
+}
+
+func (u *httpsUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	if len(query) < 2 {
+		return nil, errors.New("query too short")
+	}
+	// The ID should be 0 for HTTP caches (RFC 8484 section 4.1).
+	body := append([]byte{0, 0}, query[2:]...)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %v", resp.Status)
+	}
+	msg, err := io.ReadAll(io.LimitReader(resp.Body, maxMessageSize))
+	if err != nil {
+		return nil, err
+	}
+	if len(msg) < 2 {
+		return nil, errors.New("response too short")
+	}
+	copy(msg[:2], query[:2])
+	return msg, nil
+}
@@ -0,0 +1,128 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// serveDNS answers queries sent to a UDP socket with an A record of
+// 1.2.3.4 for A queries of name and empty responses to others.
+func serveDNS(t *testing.T, name string) *net.UDPConn {
+	t.Helper()
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			var query dnsmessage.Message
+			if err := query.Unpack(buf[:n]); err != nil || len(query.Questions) != 1 {
+				continue
+			}
+			resp := response(name, 60)
+			q := query.Questions[0]
+			if q.Type == dnsmessage.TypeA && q.Name.String() == name {
+				resp = response(name, 60, [4]byte{1, 2, 3, 4})
+			}
+			resp.ID = query.ID
+			resp.RecursionAvailable = true
+			resp.Questions = query.Questions
+			b, err := resp.Pack()
+			if err != nil {
+				continue
+			}
+			pc.WriteToUDP(b, addr)
+		}
+	}()
+	return pc
+}
+
+func TestUDPUpstreamDial(t *testing.T) {
+	server := serveDNS(t, "a.example.")
+	var dialed int32
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		atomic.AddInt32(&dialed, 1)
+		if network != "udp" {
+			t.Errorf("dialed network %v", network)
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, network, address)
+	}
+	u := NewUDPUpstream(server.LocalAddr().String(), dial)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	resp, err := u.Exchange(ctx, packQuery(t, 7, "a.example."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := unpack(t, resp); msg.ID != 7 || len(msg.Answers) != 1 {
+		t.Errorf("unexpected response %+v", msg)
+	}
+	if atomic.LoadInt32(&dialed) != 1 {
+		t.Errorf("socket not made by dial")
+	}
+}
+
+type tcpHandlerFunc func(conn net.Conn, target *net.TCPAddr) error
+
+func (f tcpHandlerFunc) Handle(conn net.Conn, target *net.TCPAddr) error {
+	return f(conn, target)
+}
+
+func TestHandlerDialerResolver(t *testing.T) {
+	server := serveDNS(t, "dns.example.")
+	var lookups int32
+	r := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			atomic.AddInt32(&lookups, 1)
+			var d net.Dialer
+			return d.DialContext(ctx, "udp", server.LocalAddr().String())
+		},
+	}
+	targets := make(chan *net.TCPAddr, 1)
+	h := tcpHandlerFunc(func(conn net.Conn, target *net.TCPAddr) error {
+		targets <- target
+		conn.Close()
+		return nil
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	tests := []struct {
+		addr, target string
+		lookup       bool
+	}{
+		{"dns.example:853", "1.2.3.4:853", true},
+		{"9.9.9.9:853", "9.9.9.9:853", false},
+	}
+	for _, tt := range tests {
+		atomic.StoreInt32(&lookups, 0)
+		c, err := HandlerDialer(h, r)(ctx, tt.addr)
+		if err != nil {
+			t.Errorf("%v: %v", tt.addr, err)
+			continue
+		}
+		c.Close()
+		if target := <-targets; target.String() != tt.target {
+			t.Errorf("%v: dialed %v, want %v", tt.addr, target, tt.target)
+		}
+		if looked := atomic.LoadInt32(&lookups) > 0; looked != tt.lookup {
+			t.Errorf("%v: resolver used %v, want %v", tt.addr, looked, tt.lookup)
+		}
+	}
+	if _, err := HandlerDialer(h, r)(ctx, "other.example:853"); err == nil {
+		t.Errorf("unknown name resolved")
+	}
+}
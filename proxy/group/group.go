@@ -0,0 +1,341 @@
+// Package group implements a handler spreading connections over several
+// upstream proxies with health checking and failover.
+package group
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+// Policies selecting the upstream of a new connection among healthy ones.
+const (
+	// PolicyPriority selects the upstream with the lowest priority value.
+	PolicyPriority = "priority"
+
+	// PolicyRoundRobin selects upstreams in turn.
+	PolicyRoundRobin = "round-robin"
+
+	// PolicyLeastLatency selects the upstream with the lowest latency
+	// measured by the last probe.
+	PolicyLeastLatency = "least-latency"
+
+	// PolicyConsistentHash selects the upstream by a hash of the
+	// destination address, so that connections to a destination keep
+	// going through the same upstream while it is healthy.
+	PolicyConsistentHash = "consistent-hash"
+)
+
+const (
+	defaultProbeInterval = 30 * time.Second
+	defaultProbeTimeout  = 5 * time.Second
+)
+
+// Member is an upstream of a group.
+type Member struct {
+	// Name identifies the upstream in logs.
+	Name string
+
+	// Priority orders upstreams for PolicyPriority, lower values first.
+	Priority int
+
+	// TCPHandler handles TCP connections through the upstream.
+	TCPHandler core.TCPConnHandler
+
+	// UDPHandler handles UDP connections through the upstream, UDP
+	// connections never go through the upstream if nil.
+	UDPHandler core.UDPConnHandler
+
+	// Probe checks the health of the upstream, the upstream is always
+	// considered healthy if nil.
+	Probe Probe
+
+	mu      sync.Mutex
+	up      bool
+	latency time.Duration
+	probing bool
+}
+
+func (m *Member) isUp() (bool, time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.up, m.latency
+}
+
+// Options configures a group.
+type Options struct {
+	// Policy is one of the Policy constants, PolicyPriority if empty.
+	Policy string
+
+	// ProbeInterval is the interval between health checks.
+	ProbeInterval time.Duration
+
+	// ProbeTimeout is the timeout of a health check.
+	ProbeTimeout time.Duration
+}
+
+// Group is both a TCP and a UDP connection handler, it passes every new
+// connection to a healthy member selected by its policy and fails over to
+// the next member if the handler of the member fails. Members failing to
+// handle a connection are probed right away.
+//
+// If no member is healthy, members are tried by priority anyway.
+type Group struct {
+	sync.Mutex
+
+	members  []*Member
+	opts     Options
+	next     uint32
+	udpConns map[core.UDPConn]*memberUDPConn
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewGroup creates a group of members and starts probing them.
+func NewGroup(members []*Member, opts *Options) (*Group, error) {
+	if len(members) == 0 {
+		return nil, errors.New("no members in group")
+	}
+	g := &Group{
+		members:  members,
+		udpConns: make(map[core.UDPConn]*memberUDPConn, 8),
+		done:     make(chan struct{}),
+	}
+	if opts != nil {
+		g.opts = *opts
+	}
+	switch g.opts.Policy {
+	case "":
+		g.opts.Policy = PolicyPriority
+	case PolicyPriority, PolicyRoundRobin, PolicyLeastLatency, PolicyConsistentHash:
+	default:
+		return nil, fmt.Errorf("unsupported group policy %v", g.opts.Policy)
+	}
+	if g.opts.ProbeInterval <= 0 {
+		g.opts.ProbeInterval = defaultProbeInterval
+	}
+	if g.opts.ProbeTimeout <= 0 {
+		g.opts.ProbeTimeout = defaultProbeTimeout
+	}
+	for _, m := range members {
+		if m.TCPHandler == nil {
+			return nil, fmt.Errorf("missing TCP handler for member %v", m.Name)
+		}
+		m.up = true
+	}
+
+	go g.probeLoop()
+	return g, nil
+}
+
+// Stop stops probing members, connections are still handled by members in
+// the state of their last probe.
+func (g *Group) Stop() {
+	g.stopOnce.Do(func() {
+		close(g.done)
+	})
+}
+
+// Shutdown stops probing members and shuts down their handlers implementing
+// core.ShutdownHandler.
+func (g *Group) Shutdown() error {
+	g.Stop()
+
+	handlers := make([]interface{}, 0, 2*len(g.members))
+	for _, m := range g.members {
+		handlers = append(handlers, m.TCPHandler, m.UDPHandler)
+	}
+	return core.ShutdownHandlers(handlers...)
+}
+
+func (g *Group) probeLoop() {
+	ticker := time.NewTicker(g.opts.ProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		for _, m := range g.members {
+			g.probe(m)
+		}
+		select {
+		case <-g.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe probes m in the background unless it's being probed already.
+func (g *Group) probe(m *Member) {
+	if m.Probe == nil {
+		return
+	}
+	m.mu.Lock()
+	if m.probing {
+		m.mu.Unlock()
+		return
+	}
+	m.probing = true
+	m.mu.Unlock()
+
+	go func() {
+		latency, err := m.Probe(g.opts.ProbeTimeout)
+
+		m.mu.Lock()
+		wasUp := m.up
+		m.up = err == nil
+		if err == nil {
+			m.latency = latency
+		}
+		m.probing = false
+		m.mu.Unlock()
+
+		if wasUp && err != nil {
+			log.Warnf("upstream %v is down: %v", m.Name, err)
+		} else if !wasUp && err == nil {
+			log.Infof("upstream %v is up", m.Name)
+		}
+	}()
+}
+
+// candidates returns members in the order they should be tried for a
+// connection to dest, healthy members come first in the order of the
+// policy, followed by other members by priority.
+func (g *Group) candidates(dest string, udp bool) []*Member {
+	var up, down []*Member
+	latencies := make(map[*Member]time.Duration, len(g.members))
+	for _, m := range g.members {
+		if udp && m.UDPHandler == nil {
+			continue
+		}
+		if ok, latency := m.isUp(); ok {
+			up = append(up, m)
+			latencies[m] = latency
+		} else {
+			down = append(down, m)
+		}
+	}
+	byPriority := func(ms []*Member) {
+		sort.SliceStable(ms, func(i, j int) bool { return ms[i].Priority < ms[j].Priority })
+	}
+
+	switch g.opts.Policy {
+	case PolicyPriority:
+		byPriority(up)
+	case PolicyRoundRobin:
+		if len(up) > 0 {
+			n := int(atomic.AddUint32(&g.next, 1)-1) % len(up)
+			rotated := make([]*Member, 0, len(up))
+			rotated = append(rotated, up[n:]...)
+			up = append(rotated, up[:n]...)
+		}
+	case PolicyLeastLatency:
+		// Members not probed yet have no latency and come last.
+		sort.SliceStable(up, func(i, j int) bool {
+			li, lj := latencies[up[i]], latencies[up[j]]
+			return li != 0 && (lj == 0 || li < lj)
+		})
+	case PolicyConsistentHash:
+		// Rendezvous hashing, only connections to destinations of a
+		// member going down move to other members.
+		scores := make(map[*Member]uint64, len(up))
+		for _, m := range up {
+			scores[m] = score(m.Name, dest)
+		}
+		sort.SliceStable(up, func(i, j int) bool { return scores[up[i]] > scores[up[j]] })
+	}
+	byPriority(down)
+	return append(up, down...)
+}
+
+// score hashes a member name and a destination for rendezvous hashing.
+func score(name, dest string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	h.Write([]byte{0})
+	h.Write([]byte(dest))
+
+	// FNV mixes the last bytes poorly into the high bits, finalize it like
+	// MurmurHash3 for an even spread.
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+func (g *Group) Handle(conn net.Conn, target *net.TCPAddr) error {
+	err := errors.New("no member in group")
+	for _, m := range g.candidates(target.IP.String(), false) {
+		if err = m.TCPHandler.Handle(conn, target); err == nil {
+			log.Debugf("group tcp %v via %v", target, m.Name)
+			return nil
+		}
+		log.Warnf("upstream %v failed to handle connection to %v: %v", m.Name, target, err)
+		g.probe(m)
+	}
+	return err
+}
+
+func (g *Group) Connect(conn core.UDPConn, target *net.UDPAddr) error {
+	var dest string
+	if target != nil {
+		dest = target.IP.String()
+	}
+	err := errors.New("no member in group handles UDP")
+	for _, m := range g.candidates(dest, true) {
+		mc := &memberUDPConn{UDPConn: conn, group: g, member: m}
+		g.Lock()
+		g.udpConns[conn] = mc
+		g.Unlock()
+		if err = m.UDPHandler.Connect(mc, target); err == nil {
+			log.Debugf("group udp %v via %v", target, m.Name)
+			return nil
+		}
+		g.Lock()
+		if g.udpConns[conn] == mc {
+			delete(g.udpConns, conn)
+		}
+		g.Unlock()
+		log.Warnf("upstream %v failed to handle connection to %v: %v", m.Name, target, err)
+		g.probe(m)
+	}
+	return err
+}
+
+func (g *Group) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr) error {
+	g.Lock()
+	mc, ok := g.udpConns[conn]
+	g.Unlock()
+	if !ok {
+		return errors.New("UDP connection not connected")
+	}
+	return mc.member.UDPHandler.ReceiveTo(mc, data, addr)
+}
+
+// memberUDPConn is passed to member handlers in place of the core conn, it
+// forgets the member when the member handler closes the conn.
+type memberUDPConn struct {
+	core.UDPConn
+
+	group  *Group
+	member *Member
+}
+
+func (c *memberUDPConn) Close() error {
+	c.group.Lock()
+	if c.group.udpConns[c.UDPConn] == c {
+		delete(c.group.udpConns, c.UDPConn)
+	}
+	c.group.Unlock()
+	return c.UDPConn.Close()
+}
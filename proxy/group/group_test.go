@@ -0,0 +1,314 @@
+package group
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+// fakeHandler records the connections passed to it, failing them if fail is
+// set.
+type fakeHandler struct {
+	sync.Mutex
+
+	fail     bool
+	tcp      int
+	udpConns []core.UDPConn
+	received []core.UDPConn
+}
+
+func (h *fakeHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
+	h.Lock()
+	defer h.Unlock()
+	if h.fail {
+		return errors.New("fake failure")
+	}
+	h.tcp++
+	return nil
+}
+
+func (h *fakeHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
+	h.Lock()
+	defer h.Unlock()
+	if h.fail {
+		return errors.New("fake failure")
+	}
+	h.udpConns = append(h.udpConns, conn)
+	return nil
+}
+
+func (h *fakeHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr) error {
+	h.Lock()
+	defer h.Unlock()
+	h.received = append(h.received, conn)
+	return nil
+}
+
+type fakeUDPConn struct{}
+
+func (c *fakeUDPConn) LocalAddr() *net.UDPAddr {
+	return &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 12345}
+}
+
+func (c *fakeUDPConn) ReceiveTo(data []byte, addr *net.UDPAddr) error { return nil }
+
+func (c *fakeUDPConn) WriteFrom(data []byte, addr *net.UDPAddr) (int, error) {
+	return len(data), nil
+}
+
+func (c *fakeUDPConn) Close() error { return nil }
+
+// newMember returns a member with fake handlers, without UDP handler if udp
+// is false.
+func newMember(name string, priority int, udp bool) *Member {
+	h := &fakeHandler{}
+	m := &Member{Name: name, Priority: priority, TCPHandler: h}
+	if udp {
+		m.UDPHandler = h
+	}
+	return m
+}
+
+func newTestGroup(t *testing.T, policy string, members ...*Member) *Group {
+	t.Helper()
+	g, err := NewGroup(members, &Options{Policy: policy})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(g.Stop)
+	return g
+}
+
+func setState(m *Member, up bool, latency time.Duration) {
+	m.mu.Lock()
+	m.up, m.latency = up, latency
+	m.mu.Unlock()
+}
+
+func names(ms []*Member) string {
+	s := make([]string, len(ms))
+	for i, m := range ms {
+		s[i] = m.Name
+	}
+	return strings.Join(s, " ")
+}
+
+func TestNewGroup(t *testing.T) {
+	if _, err := NewGroup(nil, nil); err == nil {
+		t.Error("no error creating an empty group")
+	}
+	if _, err := NewGroup([]*Member{newMember("a", 0, true)}, &Options{Policy: "random"}); err == nil {
+		t.Error("no error creating a group with an unsupported policy")
+	}
+	if _, err := NewGroup([]*Member{{Name: "a"}}, nil); err == nil {
+		t.Error("no error creating a group with a member without TCP handler")
+	}
+	g := newTestGroup(t, "", newMember("a", 0, true))
+	if g.opts.Policy != PolicyPriority || g.opts.ProbeInterval != defaultProbeInterval || g.opts.ProbeTimeout != defaultProbeTimeout {
+		t.Errorf("default options %+v", g.opts)
+	}
+}
+
+func TestCandidates(t *testing.T) {
+	type state struct {
+		up      bool
+		latency time.Duration
+	}
+	up := func(latency time.Duration) state { return state{true, latency} }
+	down := state{}
+
+	// d has no UDP handler.
+	tests := []struct {
+		policy   string
+		states   map[string]state
+		tcp, udp string
+	}{
+		{PolicyPriority, nil, "b c a d", "b c a"},
+		{PolicyPriority, map[string]state{"b": down}, "c a d b", "c a b"},
+		{PolicyPriority, map[string]state{"b": down, "c": down}, "a d b c", "a b c"},
+		{PolicyPriority, map[string]state{"a": down, "b": down, "c": down, "d": down}, "b c a d", "b c a"},
+		{PolicyLeastLatency, map[string]state{"a": up(30), "c": up(10), "d": up(20)}, "c d a b", "c a b"},
+		{PolicyLeastLatency, map[string]state{"a": up(30), "b": up(40), "c": down, "d": up(20)}, "d a b c", "a b c"},
+		{PolicyLeastLatency, map[string]state{"a": down, "b": down, "c": down, "d": down}, "b c a d", "b c a"},
+		// TCP and UDP connections share the turn.
+		{PolicyRoundRobin, nil, "a b c d", "b c a"},
+		{PolicyRoundRobin, map[string]state{"a": down}, "b c d a", "c b a"},
+	}
+	for _, tt := range tests {
+		a, b, c, d := newMember("a", 2, true), newMember("b", 0, true), newMember("c", 1, true), newMember("d", 3, false)
+		g := newTestGroup(t, tt.policy, a, b, c, d)
+		for _, m := range g.members {
+			if s, ok := tt.states[m.Name]; ok {
+				setState(m, s.up, s.latency)
+			}
+		}
+		if got := names(g.candidates("1.2.3.4", false)); got != tt.tcp {
+			t.Errorf("%v %v: TCP candidates %v, want %v", tt.policy, tt.states, got, tt.tcp)
+		}
+		if got := names(g.candidates("1.2.3.4", true)); got != tt.udp {
+			t.Errorf("%v %v: UDP candidates %v, want %v", tt.policy, tt.states, got, tt.udp)
+		}
+	}
+}
+
+func TestCandidatesRoundRobin(t *testing.T) {
+	g := newTestGroup(t, PolicyRoundRobin, newMember("a", 0, true), newMember("b", 1, true), newMember("c", 2, true), newMember("d", 3, true))
+	setState(g.members[1], false, 0)
+	for _, want := range []string{"a c d b", "c d a b", "d a c b", "a c d b"} {
+		if got := names(g.candidates("1.2.3.4", false)); got != want {
+			t.Errorf("candidates %v, want %v", got, want)
+		}
+	}
+}
+
+func TestCandidatesConsistentHash(t *testing.T) {
+	g := newTestGroup(t, PolicyConsistentHash, newMember("a", 0, true), newMember("b", 1, true), newMember("c", 2, true))
+
+	first := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		dest := fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+		all := g.candidates(dest, false)
+		if again := g.candidates(dest, false); names(again) != names(all) {
+			t.Fatalf("%v: candidates %v, then %v", dest, names(all), names(again))
+		}
+		first[all[0].Name]++
+
+		// Only destinations of the member going down move, the others
+		// keep their order.
+		setState(all[0], false, 0)
+		want := names(append(append([]*Member(nil), all[1:]...), all[0]))
+		if got := names(g.candidates(dest, false)); got != want {
+			t.Fatalf("%v: candidates %v with %v down, want %v", dest, got, all[0].Name, want)
+		}
+		setState(all[0], true, 0)
+	}
+	for name, n := range first {
+		if n < 800 || n > 1200 {
+			t.Errorf("%v is the first candidate of %v destinations out of 3000", name, n)
+		}
+	}
+	if len(first) != 3 {
+		t.Errorf("first candidates %v", first)
+	}
+}
+
+func TestScore(t *testing.T) {
+	if score("a", "1.2.3.4") != score("a", "1.2.3.4") {
+		t.Error("score is not deterministic")
+	}
+	// The separator keeps names and destinations apart.
+	if score("a", "b1.2.3.4") == score("ab", "1.2.3.4") {
+		t.Error("score ignores the boundary between name and destination")
+	}
+	// Destinations differing in the last byte spread over the high bits.
+	var high [2]int
+	for i := 0; i < 1000; i++ {
+		high[score("a", fmt.Sprintf("1.2.3.%d", i))>>63]++
+	}
+	if high[0] < 400 || high[1] < 400 {
+		t.Errorf("high bit of scores %v", high)
+	}
+}
+
+func TestHandleFailover(t *testing.T) {
+	a, b, c := newMember("a", 0, true), newMember("b", 1, true), newMember("c", 2, true)
+	a.TCPHandler.(*fakeHandler).fail = true
+	// a is probed on failure.
+	probed := make(chan struct{}, 1)
+	a.Probe = func(timeout time.Duration) (time.Duration, error) {
+		probed <- struct{}{}
+		return 0, errors.New("fake probe failure")
+	}
+	g := newTestGroup(t, PolicyPriority, a, b, c)
+	<-probed
+	for ok, _ := a.isUp(); ok; ok, _ = a.isUp() {
+		time.Sleep(time.Millisecond)
+	}
+	setState(a, true, 0)
+
+	target := &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 80}
+	if err := g.Handle(nil, target); err != nil {
+		t.Fatal(err)
+	}
+	if n := b.TCPHandler.(*fakeHandler).tcp; n != 1 {
+		t.Errorf("b handled %v connections", n)
+	}
+	if n := c.TCPHandler.(*fakeHandler).tcp; n != 0 {
+		t.Errorf("c handled %v connections", n)
+	}
+	select {
+	case <-probed:
+	case <-time.After(time.Second):
+		t.Error("a not probed after failing")
+	}
+
+	for _, m := range g.members {
+		m.TCPHandler.(*fakeHandler).fail = true
+	}
+	if err := g.Handle(nil, target); err == nil || err.Error() != "fake failure" {
+		t.Errorf("got error %v when all members fail", err)
+	}
+}
+
+func TestConnectFailover(t *testing.T) {
+	// c has no UDP handler though it comes first.
+	a, b, c := newMember("a", 1, true), newMember("b", 2, true), newMember("c", 0, false)
+	a.UDPHandler.(*fakeHandler).fail = true
+	g := newTestGroup(t, PolicyPriority, a, b, c)
+
+	conn := &fakeUDPConn{}
+	target := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 53}
+	if err := g.Connect(conn, target); err != nil {
+		t.Fatal(err)
+	}
+	bh := b.UDPHandler.(*fakeHandler)
+	if len(bh.udpConns) != 1 {
+		t.Fatalf("b connected %v connections", len(bh.udpConns))
+	}
+	mc := bh.udpConns[0].(*memberUDPConn)
+	if mc.UDPConn != conn || mc.member != b {
+		t.Errorf("b connected %+v", mc)
+	}
+	if len(g.udpConns) != 1 || g.udpConns[conn] != mc {
+		t.Errorf("tracked connections %v", g.udpConns)
+	}
+
+	// Packets go to the member the connection was connected by.
+	if err := g.ReceiveTo(conn, []byte("data"), target); err != nil {
+		t.Fatal(err)
+	}
+	if len(bh.received) != 1 || bh.received[0] != mc {
+		t.Errorf("b received on %v", bh.received)
+	}
+	if len(a.UDPHandler.(*fakeHandler).received) != 0 {
+		t.Error("a received data")
+	}
+
+	// The member closing the connection untracks it.
+	mc.Close()
+	if len(g.udpConns) != 0 {
+		t.Errorf("tracked connections %v after close", g.udpConns)
+	}
+	if err := g.ReceiveTo(conn, []byte("data"), target); err == nil {
+		t.Error("no error receiving on a closed connection")
+	}
+
+	bh.fail = true
+	if err := g.Connect(conn, target); err == nil {
+		t.Error("no error when all members fail")
+	}
+	if len(g.udpConns) != 0 {
+		t.Errorf("tracked connections %v after failure", g.udpConns)
+	}
+
+	g = newTestGroup(t, PolicyPriority, newMember("d", 0, false))
+	if err := g.Connect(conn, nil); err == nil || err.Error() != "no member in group handles UDP" {
+		t.Errorf("got error %v without UDP members", err)
+	}
+}
@@ -0,0 +1,52 @@
+package group
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Probe checks whether an upstream is usable and returns the time taken.
+type Probe func(timeout time.Duration) (time.Duration, error)
+
+// TCPProbe probes an upstream by connecting to addr.
+func TCPProbe(addr string) Probe {
+	return func(timeout time.Duration) (time.Duration, error) {
+		start := time.Now()
+		c, err := net.DialTimeout("tcp", addr, timeout)
+		if err != nil {
+			return 0, err
+		}
+		c.Close()
+		return time.Since(start), nil
+	}
+}
+
+// HTTPProbe probes an upstream by fetching url through transport, which
+// should send requests through the upstream. Responses with a status code
+// below 500 are considered successful, proxies report failures to reach
+// url with 5xx status codes.
+func HTTPProbe(transport http.RoundTripper, url string) Probe {
+	return func(timeout time.Duration) (time.Duration, error) {
+		client := &http.Client{
+			Transport: transport,
+			Timeout:   timeout,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+		start := time.Now()
+		resp, err := client.Get(url)
+		if err != nil {
+			return 0, err
+		}
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		if resp.StatusCode >= 500 {
+			return 0, fmt.Errorf("unexpected status %v", resp.Status)
+		}
+		return time.Since(start), nil
+	}
+}
@@ -0,0 +1,117 @@
+package http
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"golang.org/x/net/proxy"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+	"github.com/eycorsican/go-tun2socks/common/relay"
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+// tcpHandler tunnels each TCP connection through an HTTP proxy server with
+// the HTTP/1.1 CONNECT method.
+type tcpHandler struct {
+	proxyServer string
+	auth        *proxy.Auth
+	tlsConfig   *tls.Config
+}
+
+// NewTCPHandler creates a TCP handler connecting through the HTTP proxy at
+// proxyServer (host:port). Basic authentication is used if auth is not nil,
+// and the connection to the proxy is secured with TLS if tlsConfig is not
+// nil.
+func NewTCPHandler(proxyServer string, auth *proxy.Auth, tlsConfig *tls.Config) core.TCPConnHandler {
+	return &tcpHandler{
+		proxyServer: proxyServer,
+		auth:        auth,
+		tlsConfig:   tlsConfig,
+	}
+}
+
+func (h *tcpHandler) dial(target string) (net.Conn, error) {
+	c, err := net.Dial("tcp", h.proxyServer)
+	if err != nil {
+		return nil, err
+	}
+	if h.tlsConfig != nil {
+		tlsConn := tls.Client(c, h.tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			c.Close()
+			return nil, err
+		}
+		c = tlsConn
+	}
+
+	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", target, target)
+	if h.auth != nil {
+		cred := base64.StdEncoding.EncodeToString([]byte(h.auth.User + ":" + h.auth.Password))
+		req += "Proxy-Authorization: Basic " + cred + "\r\n"
+	}
+	req += "\r\n"
+	if _, err := io.WriteString(c, req); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		c.Close()
+		return nil, fmt.Errorf("HTTP proxy CONNECT failed: %v", resp.Status)
+	}
+
+	// The server may have sent some data right after the response.
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: c, r: br}, nil
+	}
+	return c, nil
+}
+
+func (h *tcpHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
+	c, err := h.dial(target.String())
+	if err != nil {
+		return err
+	}
+
+	go relay.Copy(conn, c)
+
+	log.Infof("new proxy connection to %v", target)
+
+	return nil
+}
+
+// bufferedConn reads from r before reading from the underlying conn.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *bufferedConn) CloseRead() error {
+	if dc, ok := c.Conn.(relay.DuplexConn); ok {
+		return dc.CloseRead()
+	}
+	return c.Conn.Close()
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	if dc, ok := c.Conn.(relay.DuplexConn); ok {
+		return dc.CloseWrite()
+	}
+	return c.Conn.Close()
+}
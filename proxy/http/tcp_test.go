@@ -0,0 +1,137 @@
+package http
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/proxy"
+)
+
+// connectProxy is an HTTP proxy handling CONNECT requests, it requires
+// Basic authentication with user:password if user is not empty.
+type connectProxy struct {
+	user, password string
+}
+
+func (p *connectProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+		return
+	}
+	if p.user != "" {
+		cred := base64.StdEncoding.EncodeToString([]byte(p.user + ":" + p.password))
+		if r.Header.Get("Proxy-Authorization") != "Basic "+cred {
+			http.Error(w, "", http.StatusProxyAuthRequired)
+			return
+		}
+	}
+	target, err := net.Dial("tcp", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	c, rw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		target.Close()
+		return
+	}
+	rw.WriteString("HTTP/1.1 200 Connection established\r\n\r\n")
+	rw.Flush()
+	go func() {
+		io.Copy(target, rw)
+		target.Close()
+	}()
+	io.Copy(c, target)
+	c.Close()
+}
+
+// echoServer returns the address of a TCP server echoing lines.
+func echoServer(t *testing.T) *net.TCPAddr {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return l.Addr().(*net.TCPAddr)
+}
+
+// echo sends a message through a conn handled by h and checks the reply.
+func echo(t *testing.T, h *tcpHandler, target *net.TCPAddr) error {
+	conn, tun := net.Pipe()
+	defer tun.Close()
+	if err := h.Handle(conn, target); err != nil {
+		conn.Close()
+		return err
+	}
+	go tun.Write([]byte("hello\n"))
+	buf := make([]byte, 6)
+	if _, err := io.ReadFull(tun, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello\n" {
+		t.Errorf("unexpected reply %q", buf)
+	}
+	return nil
+}
+
+func TestConnect(t *testing.T) {
+	target := echoServer(t)
+	for _, tc := range []struct {
+		name  string
+		proxy *connectProxy
+		auth  *proxy.Auth
+		err   string
+	}{
+		{"no auth", &connectProxy{}, nil, ""},
+		{"auth", &connectProxy{user: "u", password: "p"}, &proxy.Auth{User: "u", Password: "p"}, ""},
+		{"missing auth", &connectProxy{user: "u", password: "p"}, nil, "407"},
+		{"wrong auth", &connectProxy{user: "u", password: "p"}, &proxy.Auth{User: "u", Password: "x"}, "407"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := httptest.NewServer(tc.proxy)
+			defer s.Close()
+			h := NewTCPHandler(s.Listener.Addr().String(), tc.auth, nil).(*tcpHandler)
+			err := echo(t, h, target)
+			if tc.err == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+				t.Fatalf("unexpected error %v, want %v", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestConnectTLS(t *testing.T) {
+	s := httptest.NewTLSServer(&connectProxy{})
+	defer s.Close()
+	roots := s.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	h := NewTCPHandler(s.Listener.Addr().String(), nil, &tls.Config{RootCAs: roots, ServerName: "127.0.0.1"}).(*tcpHandler)
+	if err := echo(t, h, echoServer(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The certificate of the proxy is verified.
+	h = NewTCPHandler(s.Listener.Addr().String(), nil, &tls.Config{ServerName: "127.0.0.1"}).(*tcpHandler)
+	if err := echo(t, h, echoServer(t)); err == nil {
+		t.Error("untrusted proxy certificate accepted")
+	}
+}
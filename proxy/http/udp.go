@@ -0,0 +1,26 @@
+package http
+
+import (
+	"errors"
+	"net"
+
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+// udpHandler rejects UDP sessions, HTTP proxies are only able to tunnel
+// TCP connections.
+type udpHandler struct{}
+
+// NewUDPHandler creates a UDP handler refusing every session, use it when
+// no other UDP handler (e.g. DNS fallback) is available.
+func NewUDPHandler() core.UDPConnHandler {
+	return &udpHandler{}
+}
+
+func (h *udpHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
+	return errors.New("UDP is not supported by HTTP proxies")
+}
+
+func (h *udpHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr) error {
+	return errors.New("UDP is not supported by HTTP proxies")
+}
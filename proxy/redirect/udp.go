@@ -17,7 +17,9 @@ type udpHandler struct {
 	timeout        time.Duration
 	udpConns       map[core.UDPConn]*net.UDPConn
 	udpTargetAddrs map[core.UDPConn]*net.UDPAddr
+	udpOrigAddrs   map[core.UDPConn]*net.UDPAddr // Original destinations seen from TUN, in symmetric mode.
 	target         string
+	symmetric      bool
 }
 
 func NewUDPHandler(target string, timeout time.Duration) core.UDPConnHandler {
@@ -25,10 +27,21 @@ func NewUDPHandler(target string, timeout time.Duration) core.UDPConnHandler {
 		timeout:        timeout,
 		udpConns:       make(map[core.UDPConn]*net.UDPConn, 8),
 		udpTargetAddrs: make(map[core.UDPConn]*net.UDPAddr, 8),
+		udpOrigAddrs:   make(map[core.UDPConn]*net.UDPAddr, 8),
 		target:         target,
 	}
 }
 
+// NewSymmetricUDPHandler returns a handler for stacks in UDPSessionSymmetric
+// mode, replies appear to come from the original destination of each
+// session rather than from target, so that connected client sockets accept
+// them.
+func NewSymmetricUDPHandler(target string, timeout time.Duration) core.UDPConnHandler {
+	h := NewUDPHandler(target, timeout).(*udpHandler)
+	h.symmetric = true
+	return h
+}
+
 func (h *udpHandler) fetchUDPInput(conn core.UDPConn, pc *net.UDPConn) {
 	buf := core.NewBytes(core.BufSize)
 
@@ -45,6 +58,14 @@ func (h *udpHandler) fetchUDPInput(conn core.UDPConn, pc *net.UDPConn) {
 			return
 		}
 
+		// In symmetric UDP session mode each conn has exactly one
+		// destination, replies appear to come from it.
+		h.Lock()
+		if origAddr, ok := h.udpOrigAddrs[conn]; ok {
+			addr = origAddr
+		}
+		h.Unlock()
+
 		_, err = conn.WriteFrom(buf[:n], addr)
 		if err != nil {
 			log.Warnf("failed to write UDP data to TUN")
@@ -63,6 +84,9 @@ func (h *udpHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
 	tgtAddr, _ := net.ResolveUDPAddr("udp", h.target)
 	h.Lock()
 	h.udpTargetAddrs[conn] = tgtAddr
+	if h.symmetric && target != nil {
+		h.udpOrigAddrs[conn] = target
+	}
 	h.udpConns[conn] = pc
 	h.Unlock()
 	go h.fetchUDPInput(conn, pc)
@@ -74,6 +98,9 @@ func (h *udpHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr
 	h.Lock()
 	pc, ok1 := h.udpConns[conn]
 	tgtAddr, ok2 := h.udpTargetAddrs[conn]
+	if ok2 && h.symmetric && addr != nil {
+		h.udpOrigAddrs[conn] = addr
+	}
 	h.Unlock()
 
 	if ok1 && ok2 {
@@ -97,8 +124,24 @@ func (h *udpHandler) Close(conn core.UDPConn) {
 	if _, ok := h.udpTargetAddrs[conn]; ok {
 		delete(h.udpTargetAddrs, conn)
 	}
+	delete(h.udpOrigAddrs, conn)
 	if pc, ok := h.udpConns[conn]; ok {
 		pc.Close()
 		delete(h.udpConns, conn)
 	}
 }
+
+// Shutdown closes all connections and their sockets to the target.
+func (h *udpHandler) Shutdown() error {
+	h.Lock()
+	conns := make([]core.UDPConn, 0, len(h.udpConns))
+	for conn := range h.udpConns {
+		conns = append(conns, conn)
+	}
+	h.Unlock()
+
+	for _, conn := range conns {
+		h.Close(conn)
+	}
+	return nil
+}
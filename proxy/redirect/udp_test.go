@@ -0,0 +1,74 @@
+package redirect
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeUDPConn passes the source address of written packets to the test.
+type fakeUDPConn struct {
+	from chan *net.UDPAddr
+}
+
+func (c *fakeUDPConn) LocalAddr() *net.UDPAddr {
+	return &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 12345}
+}
+
+func (c *fakeUDPConn) ReceiveTo(data []byte, addr *net.UDPAddr) error { return nil }
+
+func (c *fakeUDPConn) WriteFrom(data []byte, addr *net.UDPAddr) (int, error) {
+	c.from <- addr
+	return len(data), nil
+}
+
+func (c *fakeUDPConn) Close() error { return nil }
+
+// Replies come from the target in full-cone mode and from the original
+// destination in symmetric mode.
+func TestUDPReplySource(t *testing.T) {
+	target, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := target.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			target.WriteToUDP(buf[:n], addr)
+		}
+	}()
+
+	orig := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 53}
+	for _, tc := range []struct {
+		name string
+		h    *udpHandler
+		want *net.UDPAddr
+	}{
+		{"fullcone", NewUDPHandler(target.LocalAddr().String(), time.Second).(*udpHandler), target.LocalAddr().(*net.UDPAddr)},
+		{"symmetric", NewSymmetricUDPHandler(target.LocalAddr().String(), time.Second).(*udpHandler), orig},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			conn := &fakeUDPConn{from: make(chan *net.UDPAddr, 1)}
+			if err := tc.h.Connect(conn, orig); err != nil {
+				t.Fatal(err)
+			}
+			defer tc.h.Close(conn)
+			if err := tc.h.ReceiveTo(conn, []byte("query"), orig); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case from := <-conn.from:
+				if from.String() != tc.want.String() {
+					t.Errorf("reply from %v, want %v", from, tc.want)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("no reply")
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+	"github.com/eycorsican/go-tun2socks/core"
+	"github.com/eycorsican/go-tun2socks/proxy/direct"
+)
+
+// DomainLookup returns the domain name a destination address was resolved
+// from, if known.
+type DomainLookup func(ip net.IP) (string, bool)
+
+// Router is both a TCP and a UDP connection handler, it dispatches every new
+// connection to the handler of the first matching rule.
+//
+// UDP connections are routed once by the target given to Connect, packets
+// sent to other destinations on the same connection go through the same
+// handler.
+type Router struct {
+	sync.Mutex
+
+	rules         []*Rule
+	defaultAction string
+	tcpHandlers   map[string]core.TCPConnHandler
+	udpHandlers   map[string]core.UDPConnHandler
+	lookup        DomainLookup
+	udpConns      map[core.UDPConn]*routedUDPConn
+}
+
+// NewRouter creates a router for cfg, tcpHandlers and udpHandlers hold
+// handlers of the upstreams declared in cfg by name. The "direct" action is
+// served by proxy/direct handlers with default options unless given in the
+// maps, their UDP sessions expire after timeout.
+func NewRouter(cfg *Config, tcpHandlers map[string]core.TCPConnHandler, udpHandlers map[string]core.UDPConnHandler, timeout time.Duration) (*Router, error) {
+	r := &Router{
+		rules:         cfg.Rules,
+		defaultAction: cfg.Default,
+		tcpHandlers:   make(map[string]core.TCPConnHandler, len(tcpHandlers)+1),
+		udpHandlers:   make(map[string]core.UDPConnHandler, len(udpHandlers)+1),
+		udpConns:      make(map[core.UDPConn]*routedUDPConn, 8),
+	}
+	r.tcpHandlers[ActionDirect] = direct.NewTCPHandler(nil)
+	r.udpHandlers[ActionDirect] = direct.NewUDPHandler(nil, timeout)
+	for name, h := range tcpHandlers {
+		r.tcpHandlers[name] = h
+	}
+	for name, h := range udpHandlers {
+		r.udpHandlers[name] = h
+	}
+	for _, u := range cfg.Upstreams {
+		if _, ok := r.tcpHandlers[u.Name]; !ok {
+			return nil, fmt.Errorf("missing TCP handler for upstream %v", u.Name)
+		}
+		if _, ok := r.udpHandlers[u.Name]; !ok {
+			return nil, fmt.Errorf("missing UDP handler for upstream %v", u.Name)
+		}
+	}
+	return r, nil
+}
+
+// SetDomainLookup sets the function used to find the domain of destination
+// addresses for domain rules, domain rules never match if it's not set.
+func (r *Router) SetDomainLookup(lookup DomainLookup) {
+	r.Lock()
+	r.lookup = lookup
+	r.Unlock()
+}
+
+// route returns the action for a connection to ip:port over proto.
+func (r *Router) route(proto string, ip net.IP, port uint16) string {
+	r.Lock()
+	lookup := r.lookup
+	r.Unlock()
+
+	var domain string
+	if lookup != nil {
+		if d, ok := lookup(ip); ok {
+			domain = d
+		}
+	}
+	for _, rule := range r.rules {
+		if rule.Match(proto, ip, port, domain) {
+			return rule.Action
+		}
+	}
+	return r.defaultAction
+}
+
+func (r *Router) Handle(conn net.Conn, target *net.TCPAddr) error {
+	action := r.route("tcp", target.IP, uint16(target.Port))
+	log.Debugf("route tcp %v to %v", target, action)
+	if action == ActionReject {
+		return fmt.Errorf("connection to %v rejected", target)
+	}
+	h, ok := r.tcpHandlers[action]
+	if !ok {
+		return fmt.Errorf("no TCP handler for %v", action)
+	}
+	return h.Handle(conn, target)
+}
+
+func (r *Router) Connect(conn core.UDPConn, target *net.UDPAddr) error {
+	action := r.defaultAction
+	if target != nil {
+		action = r.route("udp", target.IP, uint16(target.Port))
+	}
+	log.Debugf("route udp %v to %v", target, action)
+	if action == ActionReject {
+		return fmt.Errorf("connection to %v rejected", target)
+	}
+	h, ok := r.udpHandlers[action]
+	if !ok {
+		return fmt.Errorf("no UDP handler for %v", action)
+	}
+
+	rc := &routedUDPConn{UDPConn: conn, router: r, handler: h}
+	r.Lock()
+	r.udpConns[conn] = rc
+	r.Unlock()
+	if err := h.Connect(rc, target); err != nil {
+		r.Lock()
+		delete(r.udpConns, conn)
+		r.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (r *Router) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr) error {
+	r.Lock()
+	rc, ok := r.udpConns[conn]
+	r.Unlock()
+	if !ok {
+		return errors.New("UDP connection not routed")
+	}
+	return rc.handler.ReceiveTo(rc, data, addr)
+}
+
+// routedUDPConn is passed to sub-handlers in place of the core conn, it
+// forgets the route when the sub-handler closes the conn.
+type routedUDPConn struct {
+	core.UDPConn
+
+	router  *Router
+	handler core.UDPConnHandler
+}
+
+func (c *routedUDPConn) Close() error {
+	c.router.Lock()
+	if c.router.udpConns[c.UDPConn] == c {
+		delete(c.router.udpConns, c.UDPConn)
+	}
+	c.router.Unlock()
+	return c.UDPConn.Close()
+}
+
+// Shutdown shuts down the upstream handlers implementing
+// core.ShutdownHandler.
+func (r *Router) Shutdown() error {
+	var handlers []interface{}
+	for _, h := range r.tcpHandlers {
+		handlers = append(handlers, h)
+	}
+	for _, h := range r.udpHandlers {
+		handlers = append(handlers, h)
+	}
+	return core.ShutdownHandlers(handlers...)
+}
@@ -0,0 +1,256 @@
+package router
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Built-in actions, any other action names an upstream.
+const (
+	ActionDirect = "direct"
+	ActionReject = "reject"
+)
+
+// Config holds upstreams and rules loaded from a rules file.
+//
+// A rules file has one directive per line, blank lines and lines starting
+// with '#' are ignored:
+//
+//	upstream <name> <type> <address> [<user> [<password>]]
+//	rule <action> [cidr=<list>] [port=<list>] [proto=tcp|udp] [domain=<list>]
+//	default <action>
+//
+// Lists are comma separated, ports can be given as ranges (e.g. 8000-8080).
+// Rules are evaluated in order and the first matching rule wins, the default
+// action applies if no rule matches, it's "direct" if not given.
+type Config struct {
+	Upstreams []*Upstream
+	Rules     []*Rule
+	Default   string
+}
+
+// Upstream is a named proxy handler declared in a rules file, the router
+// itself does not know how to build it, see NewRouter.
+type Upstream struct {
+	Name     string
+	Type     string
+	Address  string
+	User     string
+	Password string
+}
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	Start uint16
+	End   uint16
+}
+
+// Rule matches connections on destination and protocol, conditions left
+// empty match anything.
+type Rule struct {
+	Action   string
+	Networks []*net.IPNet
+	Ports    []PortRange
+	Proto    string
+	Domains  []string
+}
+
+// Match reports whether a connection to ip:port over proto ("tcp" or "udp")
+// matches the rule, domain is the destination domain or "" if unknown. A
+// rule with domain conditions never matches an unknown domain.
+func (r *Rule) Match(proto string, ip net.IP, port uint16, domain string) bool {
+	if r.Proto != "" && r.Proto != proto {
+		return false
+	}
+	if len(r.Networks) > 0 {
+		found := false
+		for _, n := range r.Networks {
+			if n.Contains(ip) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(r.Ports) > 0 {
+		found := false
+		for _, pr := range r.Ports {
+			if port >= pr.Start && port <= pr.End {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(r.Domains) > 0 {
+		if domain == "" {
+			return false
+		}
+		domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+		found := false
+		for _, d := range r.Domains {
+			// A domain matches itself and all its subdomains.
+			if domain == d || strings.HasSuffix(domain, "."+d) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// LoadConfig reads and parses the rules file at path.
+func LoadConfig(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseConfig(f)
+}
+
+// ParseConfig parses a rules file.
+func ParseConfig(r io.Reader) (*Config, error) {
+	cfg := &Config{Default: ActionDirect}
+	upstreams := make(map[string]bool)
+	scanner := bufio.NewScanner(r)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		switch fields[0] {
+		case "upstream":
+			if len(fields) < 4 || len(fields) > 6 {
+				return nil, fmt.Errorf("line %d: invalid upstream", lineno)
+			}
+			u := &Upstream{Name: fields[1], Type: fields[2], Address: fields[3]}
+			if len(fields) > 4 {
+				u.User = fields[4]
+			}
+			if len(fields) > 5 {
+				u.Password = fields[5]
+			}
+			if u.Name == ActionDirect || u.Name == ActionReject || upstreams[u.Name] {
+				return nil, fmt.Errorf("line %d: invalid upstream name %v", lineno, u.Name)
+			}
+			upstreams[u.Name] = true
+			cfg.Upstreams = append(cfg.Upstreams, u)
+		case "rule":
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("line %d: missing rule action", lineno)
+			}
+			rule, err := parseRule(fields[1], fields[2:])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineno, err)
+			}
+			cfg.Rules = append(cfg.Rules, rule)
+		case "default":
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("line %d: invalid default action", lineno)
+			}
+			cfg.Default = fields[1]
+		default:
+			return nil, fmt.Errorf("line %d: unknown directive %v", lineno, fields[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// Actions may refer to upstreams declared later in the file.
+	validAction := func(a string) bool {
+		return a == ActionDirect || a == ActionReject || upstreams[a]
+	}
+	for _, rule := range cfg.Rules {
+		if !validAction(rule.Action) {
+			return nil, fmt.Errorf("unknown rule action %v", rule.Action)
+		}
+	}
+	if !validAction(cfg.Default) {
+		return nil, fmt.Errorf("unknown default action %v", cfg.Default)
+	}
+	return cfg, nil
+}
+
+func parseRule(action string, conds []string) (*Rule, error) {
+	rule := &Rule{Action: action}
+	for _, cond := range conds {
+		kv := strings.SplitN(cond, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, fmt.Errorf("invalid condition %v", cond)
+		}
+		values := strings.Split(kv[1], ",")
+		switch kv[0] {
+		case "cidr":
+			for _, v := range values {
+				_, n, err := net.ParseCIDR(v)
+				if err != nil {
+					// A single address is accepted as well.
+					ip := net.ParseIP(v)
+					if ip == nil {
+						return nil, fmt.Errorf("invalid cidr %v", v)
+					}
+					bits := 8 * net.IPv6len
+					if ip4 := ip.To4(); ip4 != nil {
+						ip = ip4
+						bits = 8 * net.IPv4len
+					}
+					n = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+				}
+				rule.Networks = append(rule.Networks, n)
+			}
+		case "port":
+			for _, v := range values {
+				pr, err := parsePortRange(v)
+				if err != nil {
+					return nil, err
+				}
+				rule.Ports = append(rule.Ports, pr)
+			}
+		case "proto":
+			if kv[1] != "tcp" && kv[1] != "udp" {
+				return nil, fmt.Errorf("invalid proto %v", kv[1])
+			}
+			rule.Proto = kv[1]
+		case "domain":
+			for _, v := range values {
+				rule.Domains = append(rule.Domains, strings.ToLower(strings.Trim(v, ".")))
+			}
+		default:
+			return nil, fmt.Errorf("unknown condition %v", kv[0])
+		}
+	}
+	return rule, nil
+}
+
+func parsePortRange(s string) (PortRange, error) {
+	bounds := strings.SplitN(s, "-", 2)
+	start, err := strconv.ParseUint(bounds[0], 10, 16)
+	if err != nil {
+		return PortRange{}, fmt.Errorf("invalid port %v", s)
+	}
+	end := start
+	if len(bounds) == 2 {
+		end, err = strconv.ParseUint(bounds[1], 10, 16)
+		if err != nil || end < start {
+			return PortRange{}, fmt.Errorf("invalid port range %v", s)
+		}
+	}
+	return PortRange{Start: uint16(start), End: uint16(end)}, nil
+}
@@ -0,0 +1,134 @@
+package router
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+const rules = `
+# Upstreams may be declared after the rules using them.
+rule reject port=25
+rule proxy cidr=10.0.0.0/8,192.168.1.1 port=80,8000-8080 proto=tcp
+rule reject domain=Example.COM.
+rule proxy cidr=fd00::/8 proto=udp
+
+upstream proxy socks 127.0.0.1:1080 user secret
+default direct
+`
+
+func TestParseConfig(t *testing.T) {
+	cfg, err := ParseConfig(strings.NewReader(rules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Upstreams) != 1 || *cfg.Upstreams[0] != (Upstream{"proxy", "socks", "127.0.0.1:1080", "user", "secret"}) {
+		t.Errorf("unexpected upstreams %+v", cfg.Upstreams)
+	}
+	if len(cfg.Rules) != 4 || cfg.Default != ActionDirect {
+		t.Fatalf("unexpected config %+v", cfg)
+	}
+	r := cfg.Rules[1]
+	if len(r.Networks) != 2 || r.Networks[1].String() != "192.168.1.1/32" {
+		t.Errorf("unexpected networks %v", r.Networks)
+	}
+	if len(r.Ports) != 2 || r.Ports[1] != (PortRange{8000, 8080}) || r.Proto != "tcp" {
+		t.Errorf("unexpected rule %+v", r)
+	}
+	if d := cfg.Rules[2].Domains; len(d) != 1 || d[0] != "example.com" {
+		t.Errorf("unexpected domains %v", d)
+	}
+
+	cfg, err = ParseConfig(strings.NewReader("rule reject port=53\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Default != ActionDirect {
+		t.Errorf("unexpected default action %v", cfg.Default)
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	for _, line := range []string{
+		"upstream proxy socks",
+		"upstream direct socks 127.0.0.1:1080",
+		"upstream p socks 127.0.0.1:1080\nupstream p http 127.0.0.1:8080",
+		"rule",
+		"rule nowhere port=80",
+		"rule direct port=http",
+		"rule direct port=8080-8000",
+		"rule direct port=70000",
+		"rule direct cidr=10.0.0.0/33",
+		"rule direct proto=icmp",
+		"rule direct port=",
+		"rule direct color=red",
+		"default",
+		"default nowhere",
+		"forward all",
+	} {
+		if _, err := ParseConfig(strings.NewReader(line)); err == nil {
+			t.Errorf("%q: no error", line)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	cfg, err := ParseConfig(strings.NewReader(rules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &Router{rules: cfg.Rules, defaultAction: cfg.Default}
+	domains := map[string]string{"1.2.3.4": "www.example.com", "1.2.3.5": "notexample.com"}
+	r.SetDomainLookup(func(ip net.IP) (string, bool) {
+		d, ok := domains[ip.String()]
+		return d, ok
+	})
+	for _, tc := range []struct {
+		proto  string
+		ip     string
+		port   uint16
+		action string
+	}{
+		{"tcp", "8.8.8.8", 25, ActionReject},
+		{"tcp", "10.1.2.3", 80, "proxy"},
+		{"tcp", "10.1.2.3", 8080, "proxy"},
+		{"tcp", "192.168.1.1", 8000, "proxy"},
+		{"tcp", "10.1.2.3", 8081, ActionDirect},
+		{"udp", "192.168.1.1", 8000, ActionDirect},
+		{"tcp", "192.168.1.2", 8000, ActionDirect},
+		{"tcp", "1.2.3.4", 443, ActionReject},
+		{"udp", "1.2.3.5", 443, ActionDirect},
+		{"udp", "fd00::1", 443, "proxy"},
+		{"tcp", "fd00::1", 443, ActionDirect},
+	} {
+		if action := r.route(tc.proto, net.ParseIP(tc.ip), tc.port); action != tc.action {
+			t.Errorf("%v %v:%v routed to %v, want %v", tc.proto, tc.ip, tc.port, action, tc.action)
+		}
+	}
+}
+
+func TestRuleMatch(t *testing.T) {
+	rule, err := parseRule("direct", []string{"cidr=10.0.0.0/8", "port=1000-2000", "domain=example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		ip     string
+		port   uint16
+		domain string
+		match  bool
+	}{
+		{"10.0.0.1", 1500, "example.com", true},
+		{"10.0.0.1", 1000, "a.b.example.com.", true},
+		{"10.0.0.1", 2000, "EXAMPLE.com", true},
+		{"10.0.0.1", 1500, "", false},
+		{"10.0.0.1", 1500, "example.org", false},
+		{"10.0.0.1", 999, "example.com", false},
+		{"10.0.0.1", 2001, "example.com", false},
+		{"11.0.0.1", 1500, "example.com", false},
+	} {
+		if match := rule.Match("tcp", net.ParseIP(tc.ip), tc.port, tc.domain); match != tc.match {
+			t.Errorf("%v:%v %q: match %v, want %v", tc.ip, tc.port, tc.domain, match, tc.match)
+		}
+	}
+}
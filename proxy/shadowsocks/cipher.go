@@ -0,0 +1,157 @@
+// Package shadowsocks implements TCP and UDP handlers relaying connections
+// through Shadowsocks servers with AEAD ciphers, including the Shadowsocks
+// 2022 (SIP022) ones.
+package shadowsocks
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"lukechampine.com/blake3"
+)
+
+// Supported methods.
+const (
+	MethodChacha20Poly1305     = "chacha20-ietf-poly1305"
+	MethodAES128GCM            = "aes-128-gcm"
+	MethodAES256GCM            = "aes-256-gcm"
+	Method2022AES128GCM        = "2022-blake3-aes-128-gcm"
+	Method2022AES256GCM        = "2022-blake3-aes-256-gcm"
+	Method2022Chacha20Poly1305 = "2022-blake3-chacha20-poly1305"
+)
+
+// Cipher holds the method and the key shared with a Shadowsocks server.
+type Cipher struct {
+	method  string
+	key     []byte
+	newAEAD func(key []byte) (cipher.AEAD, error)
+	is2022  bool
+
+	// Ciphers of UDP packets of 2022 methods, the AES methods encrypt
+	// packet headers with block while the ChaCha20 method seals whole
+	// packets with udpAEAD.
+	block   cipher.Block
+	udpAEAD cipher.AEAD
+}
+
+// NewCipher creates a cipher for method. The key of legacy AEAD methods is
+// derived from password, while 2022 methods take the base64 encoded key as
+// password.
+func NewCipher(method, password string) (*Cipher, error) {
+	method = strings.ToLower(method)
+	c := &Cipher{method: method, is2022: strings.HasPrefix(method, "2022-")}
+
+	var keySize int
+	switch method {
+	case MethodChacha20Poly1305, Method2022Chacha20Poly1305:
+		keySize = chacha20poly1305.KeySize
+		c.newAEAD = chacha20poly1305.New
+	case MethodAES128GCM, Method2022AES128GCM:
+		keySize = 16
+		c.newAEAD = newGCM
+	case MethodAES256GCM, Method2022AES256GCM:
+		keySize = 32
+		c.newAEAD = newGCM
+	default:
+		return nil, fmt.Errorf("unsupported shadowsocks method %v", method)
+	}
+
+	if !c.is2022 {
+		c.key = kdf(password, keySize)
+		return c, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(password)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %v key: %v", method, err)
+	}
+	if len(key) != keySize {
+		return nil, fmt.Errorf("%v requires a base64 encoded %d-byte key", method, keySize)
+	}
+	c.key = key
+	if method == Method2022Chacha20Poly1305 {
+		c.udpAEAD, err = chacha20poly1305.NewX(key)
+	} else {
+		c.block, err = aes.NewCipher(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Method returns the method of the cipher.
+func (c *Cipher) Method() string {
+	return c.method
+}
+
+// saltSize returns the size of salts, which is the key size for all
+// supported methods.
+func (c *Cipher) saltSize() int {
+	return len(c.key)
+}
+
+// maxPayloadSize returns the maximum payload size of stream chunks.
+func (c *Cipher) maxPayloadSize() int {
+	if c.is2022 {
+		return 0xffff
+	}
+	return 0x3fff
+}
+
+// aead returns the AEAD of the session identified by salt.
+func (c *Cipher) aead(salt []byte) (cipher.AEAD, error) {
+	subkey := make([]byte, len(c.key))
+	if c.is2022 {
+		material := make([]byte, 0, len(c.key)+len(salt))
+		material = append(material, c.key...)
+		material = append(material, salt...)
+		blake3.DeriveKey(subkey, "shadowsocks 2022 session subkey", material)
+	} else {
+		r := hkdf.New(sha1.New, c.key, salt, []byte("ss-subkey"))
+		if _, err := io.ReadFull(r, subkey); err != nil {
+			return nil, err
+		}
+	}
+	return c.newAEAD(subkey)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// kdf derives a key from password like EVP_BytesToKey of OpenSSL with MD5.
+func kdf(password string, keySize int) []byte {
+	var b, prev []byte
+	h := md5.New()
+	for len(b) < keySize {
+		h.Reset()
+		h.Write(prev)
+		h.Write([]byte(password))
+		b = h.Sum(b)
+		prev = b[len(b)-h.Size():]
+	}
+	return b[:keySize]
+}
+
+// increment increments a little-endian nonce.
+func increment(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
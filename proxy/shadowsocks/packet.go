@@ -0,0 +1,186 @@
+package shadowsocks
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/proxy/socks"
+)
+
+// packetSession seals and opens the UDP packets of a session. Sessions of
+// legacy methods are stateless, each packet has its own salt, while 2022
+// sessions have an ID and number their packets.
+//
+// A session is either the client or the server side, servers reply to the
+// client session of the last packet opened.
+type packetSession struct {
+	cipher   *Cipher
+	server   bool
+	id       [8]byte
+	packetID uint64
+	aead     cipher.AEAD // Session AEAD of 2022 AES methods.
+
+	// Session of the peer, only accessed by the reader.
+	remoteID   [8]byte
+	remoteAEAD cipher.AEAD
+}
+
+func newPacketSession(c *Cipher, server bool) (*packetSession, error) {
+	s := &packetSession{cipher: c, server: server}
+	if !c.is2022 {
+		return s, nil
+	}
+	if _, err := rand.Read(s.id[:]); err != nil {
+		return nil, err
+	}
+	if c.block != nil {
+		var err error
+		if s.aead, err = c.aead(s.id[:]); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// pack seals payload to addr into a packet.
+func (s *packetSession) pack(addr socks.Addr, payload []byte) ([]byte, error) {
+	c := s.cipher
+	if !c.is2022 {
+		salt := make([]byte, c.saltSize())
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		aead, err := c.aead(salt)
+		if err != nil {
+			return nil, err
+		}
+		plaintext := make([]byte, 0, len(addr)+len(payload))
+		plaintext = append(plaintext, addr...)
+		plaintext = append(plaintext, payload...)
+		return aead.Seal(salt, make([]byte, aead.NonceSize()), plaintext, nil), nil
+	}
+
+	// Session ID, packet ID and the header of the main packet, without
+	// padding.
+	header := make([]byte, 0, 16+1+8+8+2+len(addr)+len(payload))
+	header = append(header, s.id[:]...)
+	header = binary.BigEndian.AppendUint64(header, atomic.AddUint64(&s.packetID, 1)-1)
+	if s.server {
+		header = append(header, headerTypeServer)
+		header = binary.BigEndian.AppendUint64(header, uint64(time.Now().Unix()))
+		header = append(header, s.remoteID[:]...)
+	} else {
+		header = append(header, headerTypeClient)
+		header = binary.BigEndian.AppendUint64(header, uint64(time.Now().Unix()))
+	}
+	header = binary.BigEndian.AppendUint16(header, 0)
+	header = append(header, addr...)
+	header = append(header, payload...)
+
+	if c.udpAEAD != nil {
+		nonce := make([]byte, c.udpAEAD.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+		return c.udpAEAD.Seal(nonce, nonce, header, nil), nil
+	}
+	pkt := make([]byte, 16, 16+len(header)-16+s.aead.Overhead())
+	copy(pkt, header[:16])
+	pkt = s.aead.Seal(pkt, pkt[4:16], header[16:], nil)
+	c.block.Encrypt(pkt[:16], pkt[:16])
+	return pkt, nil
+}
+
+// unpack opens a packet and returns its address and payload.
+func (s *packetSession) unpack(pkt []byte) (socks.Addr, []byte, error) {
+	c := s.cipher
+	if !c.is2022 {
+		if len(pkt) < c.saltSize() {
+			return nil, nil, errors.New("packet too short")
+		}
+		aead, err := c.aead(pkt[:c.saltSize()])
+		if err != nil {
+			return nil, nil, err
+		}
+		b, err := aead.Open(nil, make([]byte, aead.NonceSize()), pkt[c.saltSize():], nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		addr := socks.SplitAddr(b)
+		if addr == nil {
+			return nil, nil, errors.New("invalid address")
+		}
+		return addr, b[len(addr):], nil
+	}
+
+	var b []byte
+	if c.udpAEAD != nil {
+		size := c.udpAEAD.NonceSize()
+		if len(pkt) < size {
+			return nil, nil, errors.New("packet too short")
+		}
+		var err error
+		if b, err = c.udpAEAD.Open(nil, pkt[:size], pkt[size:], nil); err != nil {
+			return nil, nil, err
+		}
+		if len(b) < 16 {
+			return nil, nil, errors.New("packet too short")
+		}
+		copy(s.remoteID[:], b[:8])
+	} else {
+		if len(pkt) < 16 {
+			return nil, nil, errors.New("packet too short")
+		}
+		header := make([]byte, 16)
+		c.block.Decrypt(header, pkt[:16])
+		if s.remoteAEAD == nil || string(header[:8]) != string(s.remoteID[:]) {
+			aead, err := c.aead(header[:8])
+			if err != nil {
+				return nil, nil, err
+			}
+			copy(s.remoteID[:], header[:8])
+			s.remoteAEAD = aead
+		}
+		body, err := s.remoteAEAD.Open(nil, header[4:16], pkt[16:], nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		b = append(header, body...)
+	}
+
+	// Skip the session ID and the packet ID.
+	b = b[16:]
+	headerType := byte(headerTypeServer)
+	size := 1 + 8 + 8 + 2
+	if s.server {
+		headerType = headerTypeClient
+		size = 1 + 8 + 2
+	}
+	if len(b) < size {
+		return nil, nil, errors.New("packet too short")
+	}
+	if b[0] != headerType {
+		return nil, nil, fmt.Errorf("unexpected header type %v", b[0])
+	}
+	if err := checkTimestamp(b[1:9]); err != nil {
+		return nil, nil, err
+	}
+	if !s.server && string(b[9:17]) != string(s.id[:]) {
+		return nil, nil, errors.New("packet of another session")
+	}
+	paddingSize := int(binary.BigEndian.Uint16(b[size-2:]))
+	if len(b) < size+paddingSize {
+		return nil, nil, errors.New("packet too short")
+	}
+	b = b[size+paddingSize:]
+	addr := socks.SplitAddr(b)
+	if addr == nil {
+		return nil, nil, errors.New("invalid address")
+	}
+	return addr, b[len(addr):], nil
+}
@@ -0,0 +1,475 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/proxy/socks"
+)
+
+func testCiphers(t *testing.T) []*Cipher {
+	var ciphers []*Cipher
+	for method, keySize := range map[string]int{
+		MethodChacha20Poly1305:     0,
+		MethodAES128GCM:            0,
+		MethodAES256GCM:            0,
+		Method2022AES128GCM:        16,
+		Method2022AES256GCM:        32,
+		Method2022Chacha20Poly1305: 32,
+	} {
+		password := "password"
+		if keySize != 0 {
+			key := make([]byte, keySize)
+			rand.Read(key)
+			password = base64.StdEncoding.EncodeToString(key)
+		}
+		c, err := NewCipher(method, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ciphers = append(ciphers, c)
+	}
+	return ciphers
+}
+
+// serveStream runs a Shadowsocks server relaying TCP connections on l.
+func serveStream(l net.Listener, c *Cipher) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			if err := serveStreamConn(conn, c); err != nil {
+				panic(err)
+			}
+		}()
+	}
+}
+
+func serveStreamConn(conn net.Conn, c *Cipher) error {
+	reqSalt := make([]byte, c.saltSize())
+	if _, err := io.ReadFull(conn, reqSalt); err != nil {
+		return err
+	}
+	aead, err := c.aead(reqSalt)
+	if err != nil {
+		return err
+	}
+	r := newAEADReader(conn, aead, c.maxPayloadSize())
+
+	var target socks.Addr
+	if !c.is2022 {
+		buf := make([]byte, socks.MaxAddrLen)
+		n, err := r.Read(buf)
+		if err != nil {
+			return err
+		}
+		target = socks.SplitAddr(buf[:n])
+	} else {
+		fixed, err := r.open(1 + 8 + 2)
+		if err != nil {
+			return err
+		}
+		if fixed[0] != headerTypeClient {
+			return io.ErrUnexpectedEOF
+		}
+		header, err := r.open(int(binary.BigEndian.Uint16(fixed[9:])))
+		if err != nil {
+			return err
+		}
+		target = append(socks.Addr{}, socks.SplitAddr(header)...)
+		if paddingSize := binary.BigEndian.Uint16(header[len(target):]); paddingSize == 0 {
+			return io.ErrUnexpectedEOF
+		}
+	}
+	rc, err := net.Dial("tcp", target.String())
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	respSalt := make([]byte, c.saltSize())
+	rand.Read(respSalt)
+	if aead, err = c.aead(respSalt); err != nil {
+		return err
+	}
+	w := newAEADWriter(conn, aead, c.maxPayloadSize())
+	buf := append([]byte{}, respSalt...)
+	if c.is2022 {
+		fixed := []byte{headerTypeServer}
+		fixed = binary.BigEndian.AppendUint64(fixed, uint64(time.Now().Unix()))
+		fixed = append(fixed, reqSalt...)
+		fixed = binary.BigEndian.AppendUint16(fixed, 0)
+		buf = w.seal(buf, fixed)
+		buf = w.seal(buf, nil)
+	}
+	if _, err := conn.Write(buf); err != nil {
+		return err
+	}
+
+	go io.Copy(w, rc)
+	io.Copy(rc, r)
+	return nil
+}
+
+func echoTCP(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return l
+}
+
+func TestTCP(t *testing.T) {
+	echo := echoTCP(t)
+	defer echo.Close()
+	target := echo.Addr().(*net.TCPAddr)
+
+	for _, c := range testCiphers(t) {
+		t.Run(c.Method(), func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			go serveStream(l, c)
+
+			local, remote := net.Pipe()
+			defer local.Close()
+			if err := NewTCPHandler(l.Addr().String(), c).Handle(remote, target); err != nil {
+				t.Fatal(err)
+			}
+
+			// Larger than a chunk of legacy methods.
+			data := make([]byte, 0x3fff*2+1)
+			rand.Read(data)
+			go local.Write(data)
+			local.SetDeadline(time.Now().Add(5 * time.Second))
+			got := make([]byte, len(data))
+			if _, err := io.ReadFull(local, got); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Error("echoed data differs")
+			}
+		})
+	}
+}
+
+// servePacket runs a Shadowsocks server on pc echoing UDP packets as if they
+// were replies from their destination.
+func servePacket(pc net.PacketConn, c *Cipher) {
+	sessions := make(map[string]*packetSession)
+	buf := make([]byte, maxUdpPacketSize)
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		s, ok := sessions[from.String()]
+		if !ok {
+			if s, err = newPacketSession(c, true); err != nil {
+				panic(err)
+			}
+			sessions[from.String()] = s
+		}
+		addr, payload, err := s.unpack(buf[:n])
+		if err != nil {
+			panic(err)
+		}
+		pkt, err := s.pack(addr, payload)
+		if err != nil {
+			panic(err)
+		}
+		pc.WriteTo(pkt, from)
+	}
+}
+
+type udpPacket struct {
+	data []byte
+	addr *net.UDPAddr
+}
+
+type chanUDPConn chan udpPacket
+
+func (c chanUDPConn) LocalAddr() *net.UDPAddr {
+	return &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 5353}
+}
+
+func (c chanUDPConn) ReceiveTo(data []byte, addr *net.UDPAddr) error {
+	return nil
+}
+
+func (c chanUDPConn) WriteFrom(data []byte, addr *net.UDPAddr) (int, error) {
+	c <- udpPacket{append([]byte{}, data...), addr}
+	return len(data), nil
+}
+
+func (c chanUDPConn) Close() error {
+	return nil
+}
+
+func TestUDP(t *testing.T) {
+	target := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 53}
+
+	for _, c := range testCiphers(t) {
+		t.Run(c.Method(), func(t *testing.T) {
+			pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer pc.Close()
+			go servePacket(pc, c)
+
+			h := NewUDPHandler(pc.LocalAddr().String(), c, time.Minute)
+			conn := make(chanUDPConn, 1)
+			if err := h.Connect(conn, target); err != nil {
+				t.Fatal(err)
+			}
+			defer h.(*udpHandler).Close(conn)
+
+			for i := 0; i < 3; i++ {
+				data := []byte{byte(i), 1, 2, 3}
+				if err := h.ReceiveTo(conn, data, target); err != nil {
+					t.Fatal(err)
+				}
+				select {
+				case p := <-conn:
+					if !bytes.Equal(p.data, data) || p.addr.String() != target.String() {
+						t.Errorf("got %x from %v, want %x from %v", p.data, p.addr, data, target)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("no reply")
+				}
+			}
+		})
+	}
+}
+
+func TestNewCipher(t *testing.T) {
+	if _, err := NewCipher("rc4-md5", "password"); err == nil {
+		t.Error("stream cipher accepted")
+	}
+	if _, err := NewCipher(Method2022AES256GCM, base64.StdEncoding.EncodeToString(make([]byte, 16))); err == nil {
+		t.Error("short 2022 key accepted")
+	}
+
+	// Key of "password" from EVP_BytesToKey of OpenSSL.
+	want := "5f4dcc3b5aa765d61d8327deb882cf992b95990a9151374abd8ff8c5a7a0fe08"
+	c, err := NewCipher(MethodAES256GCM, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hex.EncodeToString(c.key); got != want {
+		t.Errorf("derived key %v, want %v", got, want)
+	}
+}
+
+// Known answers of legacy methods were generated with go-shadowsocks2
+// v0.1.5 with the key of "password", salts count up from 0x00 (requests),
+// 0x20 (responses) and 0x40 (packets).
+var legacyVectors = []struct {
+	method, key, request, response, packet string
+}{
+	{
+		MethodChacha20Poly1305,
+		"5f4dcc3b5aa765d61d8327deb882cf992b95990a9151374abd8ff8c5a7a0fe08",
+		"000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1fad47ac9c0937f236912a6ebec32771677b5083c3ce5d825d5be9428b2bc98d01ee98e2b54eb61697fa4594661ba787afdfef8167005fa9be276d462af523006735b976e0dc0eae1be297535576d25114d5d17a6593c14bcb0c08bbd90f267354f67b29369b",
+		"202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f149138045614ade58ee42f2aac9e801154c40e90c3b6763a65c28bd5105b14154a3b75e4595e96bc01063025156c9748dc68c63d85",
+		"404142434445464748494a4b4c4d4e4f505152535455565758595a5b5c5d5e5f560961fc5e043af2e98e2cae536907205f554a33ca3577d69d97fbba",
+	},
+	{
+		MethodAES128GCM,
+		"5f4dcc3b5aa765d61d8327deb882cf99",
+		"000102030405060708090a0b0c0d0e0f5c21e5188ce46ebad51558e9c4d808a3ba03ff1a7ea18456ee41050a92f7f435fa78d7bea4ccee4dd6b42c19efbc19a0f2f7c5c7a2ee88bcb4b6d09f09fe72f8982c6dd1967126cd16323c7bb65847d31555efcce65c531a5d9dfc62d2d9632eec1f4325c5",
+		"202122232425262728292a2b2c2d2e2f77580d0362d6332fab07f86178ad187e194ba3faa4fa2de3273d24d049b0dedf60330d2b2d84c64f66dc236d197953576d0dc3ad21",
+		"404142434445464748494a4b4c4d4e4fd3aff9990f2d96848d9f9791b4b36097996bd5f0faae84db59b43dc2",
+	},
+	{
+		MethodAES256GCM,
+		"5f4dcc3b5aa765d61d8327deb882cf992b95990a9151374abd8ff8c5a7a0fe08",
+		"000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f7eaadaf7882df11c47f841d64ec3be97d9f0f62bba0d4b25261b49e432d754aa720ec3266a58b37161a363b48c93242fa78e82739c18f03de23f2ef80cf5368d079d0258b228d7ea050166baf2023a2785a5777804d3a0ae44b9a6c588fcb6660a52c6ed78",
+		"202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f64fee17075185e517dfe7c04a1303ead7bd5bb2ec70935062ae41bfabb2d5138ae4b1e5978d9377c2efc3fa6659d76ea5980763900",
+		"404142434445464748494a4b4c4d4e4f505152535455565758595a5b5c5d5e5fa1934dbc2a99e8b6af2bbca200c3be997f11cac30ad7abaa0289dc92",
+	},
+}
+
+// Known answers of 2022 methods were computed from the SIP022 specification
+// with github.com/zeebo/blake3, keys count up from 0x80. The request has 16
+// bytes of padding, both headers have the timestamp 1700000000.
+var vectors2022 = []struct {
+	method, key, request, response string
+}{
+	{
+		Method2022AES128GCM,
+		"gIGCg4SFhoeIiYqLjI2Ojw==",
+		"000102030405060708090a0b0c0d0e0f6c0980110d7060cdc5ac587d2b21d38cee6fc114b7f65e627ea9bcc08899a17fc2db68898c18c2dba66e5182c329673e61614ecaf07091568c91ae6024d232df3a32819a50cb331b49e1b19b",
+		"202122232425262728292a2b2c2d2e2ffc19f0e33d58da56a072b497dfdab81117eabcecdc3b0ff7ebba12375155618101f8ce3743dc4c1069366a9d0554358895983e00ea7a2320f548fe16876e247555cc0e742390b34b1269c3876f96",
+	},
+	{
+		Method2022AES256GCM,
+		"gIGCg4SFhoeIiYqLjI2Oj5CRkpOUlZaXmJmam5ydnp8=",
+		"000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1fd1ee7ef54314214853841d501870d932c08d4ab3ef17145ab3880ba5b9cbcd49ef6157a5cf51d9a0b1ec4f0f697c675cdd1f2e983fb69c3b5b4966b54a788f8d6a3fed765e69cd8bd739be11",
+		"202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f8a3da73ed4769fecacff357d97ab31df9cfbdb87c7785898cccba6679b0bbfb6942da710d385dc1b853c56788f423c9a80a6c562e738cba8860b1ad1c91e0b87c8657ec1b1f1fde4a3163f14ef8ee8f35a0a9ef448ff90a129acbc1901d0",
+	},
+	{
+		Method2022Chacha20Poly1305,
+		"gIGCg4SFhoeIiYqLjI2Oj5CRkpOUlZaXmJmam5ydnp8=",
+		"000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f40cbbcf1a4a8e6fc08b4f84c692f913dd871eaed87f95f3377556a9f1a0a3764d71009dfb056cc9f72e6d7ec191ae92bed3eeb0114815a4440c4b5dc959b52d8469c204981426cb740f329a1",
+		"202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3ff6996982f1fbd10ab0eb43101dae3b6bb536d655ea19277e4028935b76c083cbb2569ca7009ef7bcd11cb630d2dc34321968bf017c25ecc0a45731c635c175a70b67d992f778b8b2b2479a4849dd1709747057933e9bfb99eee1aeb7f561",
+	},
+}
+
+var (
+	vectorTarget   = socks.ParseAddr("example.com:80")
+	vectorRequest  = []byte("GET / HTTP/1.1\r\n\r\n")
+	vectorResponse = []byte("HTTP/1.1 200 OK\r\n\r\n")
+)
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// readStream reads n bytes from a stream conn whose peer sends data.
+func readStream(t *testing.T, c *Cipher, data []byte, n int) []byte {
+	t.Helper()
+	local, remote := net.Pipe()
+	defer local.Close()
+	go func() {
+		remote.Write(data)
+		remote.Close()
+	}()
+	sc := &streamConn{Conn: local, cipher: c}
+	got := make([]byte, n)
+	if _, err := io.ReadFull(sc, got); err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestLegacyVectors(t *testing.T) {
+	for _, v := range legacyVectors {
+		t.Run(v.method, func(t *testing.T) {
+			c, err := NewCipher(v.method, "password")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := hex.EncodeToString(c.key); got != v.key {
+				t.Errorf("derived key %v, want %v", got, v.key)
+			}
+
+			// The request carries the target and the payload in
+			// separate chunks.
+			want := mustDecodeHex(t, v.request)
+			salt := want[:c.saltSize()]
+			aead, err := c.aead(salt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var req bytes.Buffer
+			req.Write(salt)
+			w := newAEADWriter(&req, aead, c.maxPayloadSize())
+			req.Write(w.sealChunk(nil, vectorTarget))
+			w.Write(vectorRequest)
+			if !bytes.Equal(req.Bytes(), want) {
+				t.Errorf("request %x, want %x", req.Bytes(), want)
+			}
+
+			if got := readStream(t, c, mustDecodeHex(t, v.response), len(vectorResponse)); !bytes.Equal(got, vectorResponse) {
+				t.Errorf("response %q, want %q", got, vectorResponse)
+			}
+
+			s, err := newPacketSession(c, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			addr, payload, err := s.unpack(mustDecodeHex(t, v.packet))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if addr.String() != "8.8.8.8:53" || string(payload) != "query" {
+				t.Errorf("packet to %v carries %q", addr, payload)
+			}
+		})
+	}
+}
+
+func TestVectors2022(t *testing.T) {
+	const timestamp = 1700000000
+
+	for _, v := range vectors2022 {
+		t.Run(v.method, func(t *testing.T) {
+			c, err := NewCipher(v.method, v.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := mustDecodeHex(t, v.request)
+			reqSalt := want[:c.saltSize()]
+			aead, err := c.aead(reqSalt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			header := append(append(socks.Addr{}, vectorTarget...), 0, 16)
+			header = append(header, make([]byte, 16)...)
+			fixed := []byte{headerTypeClient}
+			fixed = binary.BigEndian.AppendUint64(fixed, timestamp)
+			fixed = binary.BigEndian.AppendUint16(fixed, uint16(len(header)))
+			w := newAEADWriter(nil, aead, c.maxPayloadSize())
+			req := append([]byte{}, reqSalt...)
+			req = w.seal(req, fixed)
+			req = w.seal(req, header)
+			if !bytes.Equal(req, want) {
+				t.Errorf("request %x, want %x", req, want)
+			}
+
+			// Responses are checked against the local time by
+			// streamConn, open them by hand.
+			resp := mustDecodeHex(t, v.response)
+			if aead, err = c.aead(resp[:c.saltSize()]); err != nil {
+				t.Fatal(err)
+			}
+			r := newAEADReader(bytes.NewReader(resp[c.saltSize():]), aead, c.maxPayloadSize())
+			fixed, err = r.open(1 + 8 + len(reqSalt) + 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fixed[0] != headerTypeServer || binary.BigEndian.Uint64(fixed[1:9]) != timestamp || !bytes.Equal(fixed[9:9+len(reqSalt)], reqSalt) {
+				t.Errorf("response header %x", fixed)
+			}
+			payload, err := r.open(int(binary.BigEndian.Uint16(fixed[9+len(reqSalt):])))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(payload, vectorResponse) {
+				t.Errorf("response %q, want %q", payload, vectorResponse)
+			}
+		})
+	}
+}
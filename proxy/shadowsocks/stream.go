@@ -0,0 +1,266 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/proxy/socks"
+)
+
+// Header types of Shadowsocks 2022 streams and packets.
+const (
+	headerTypeClient = 0
+	headerTypeServer = 1
+)
+
+const (
+	// maxTimeDiff is the maximum difference between the timestamp of a
+	// 2022 header and the local time.
+	maxTimeDiff = 30 * time.Second
+
+	// maxPaddingSize is the maximum size of the padding of 2022 requests.
+	maxPaddingSize = 900
+)
+
+// aeadWriter seals data into chunks of a length block followed by a payload
+// block, each sealed with the next nonce.
+type aeadWriter struct {
+	w          io.Writer
+	aead       cipher.AEAD
+	nonce      []byte
+	buf        []byte
+	maxPayload int
+}
+
+func newAEADWriter(w io.Writer, aead cipher.AEAD, maxPayload int) *aeadWriter {
+	return &aeadWriter{
+		w:          w,
+		aead:       aead,
+		nonce:      make([]byte, aead.NonceSize()),
+		buf:        make([]byte, 0, 2+maxPayload+2*aead.Overhead()),
+		maxPayload: maxPayload,
+	}
+}
+
+// seal appends p sealed with the next nonce to dst.
+func (w *aeadWriter) seal(dst, p []byte) []byte {
+	dst = w.aead.Seal(dst, w.nonce, p, nil)
+	increment(w.nonce)
+	return dst
+}
+
+// sealChunk appends the chunk of p to dst, p must not be larger than
+// maxPayload.
+func (w *aeadWriter) sealChunk(dst, p []byte) []byte {
+	dst = w.seal(dst, []byte{byte(len(p) >> 8), byte(len(p))})
+	return w.seal(dst, p)
+}
+
+func (w *aeadWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		size := len(p)
+		if size > w.maxPayload {
+			size = w.maxPayload
+		}
+		if _, err := w.w.Write(w.sealChunk(w.buf[:0], p[:size])); err != nil {
+			return n, err
+		}
+		n += size
+		p = p[size:]
+	}
+	return n, nil
+}
+
+// aeadReader opens chunks written by aeadWriter.
+type aeadReader struct {
+	r          io.Reader
+	aead       cipher.AEAD
+	nonce      []byte
+	buf        []byte
+	leftover   []byte
+	maxPayload int
+}
+
+func newAEADReader(r io.Reader, aead cipher.AEAD, maxPayload int) *aeadReader {
+	return &aeadReader{
+		r:          r,
+		aead:       aead,
+		nonce:      make([]byte, aead.NonceSize()),
+		buf:        make([]byte, maxPayload+aead.Overhead()),
+		maxPayload: maxPayload,
+	}
+}
+
+// open reads and opens a block of n bytes of plaintext, the returned slice
+// is valid until the next call.
+func (r *aeadReader) open(n int) ([]byte, error) {
+	if n > r.maxPayload {
+		return nil, fmt.Errorf("block of %d bytes is too large", n)
+	}
+	buf := r.buf[:n+r.aead.Overhead()]
+	if _, err := io.ReadFull(r.r, buf); err != nil {
+		return nil, err
+	}
+	p, err := r.aead.Open(buf[:0], r.nonce, buf, nil)
+	increment(r.nonce)
+	return p, err
+}
+
+func (r *aeadReader) Read(p []byte) (int, error) {
+	if len(r.leftover) == 0 {
+		b, err := r.open(2)
+		if err != nil {
+			return 0, err
+		}
+		if r.leftover, err = r.open(int(binary.BigEndian.Uint16(b))); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.leftover)
+	r.leftover = r.leftover[n:]
+	return n, nil
+}
+
+// streamConn is a connection to a Shadowsocks server relaying a TCP
+// connection, the response header is read on the first Read.
+type streamConn struct {
+	net.Conn
+
+	cipher *Cipher
+	salt   []byte
+	w      *aeadWriter
+	r      *aeadReader
+}
+
+// dialStream connects to server and requests a connection to target.
+func dialStream(server string, c *Cipher, target socks.Addr) (*streamConn, error) {
+	conn, err := net.DialTimeout("tcp", server, 4*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	sc := &streamConn{Conn: conn, cipher: c}
+	if err := sc.writeRequest(target); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return sc, nil
+}
+
+// writeRequest writes the salt and the request header, which carries no
+// payload so that protocols where the server speaks first work.
+func (c *streamConn) writeRequest(target socks.Addr) error {
+	c.salt = make([]byte, c.cipher.saltSize())
+	if _, err := rand.Read(c.salt); err != nil {
+		return err
+	}
+	aead, err := c.cipher.aead(c.salt)
+	if err != nil {
+		return err
+	}
+	c.w = newAEADWriter(c.Conn, aead, c.cipher.maxPayloadSize())
+
+	buf := append([]byte{}, c.salt...)
+	if !c.cipher.is2022 {
+		buf = c.w.sealChunk(buf, target)
+	} else {
+		// Requests without initial payload must be padded.
+		padding, err := rand.Int(rand.Reader, big.NewInt(maxPaddingSize))
+		if err != nil {
+			return err
+		}
+		paddingSize := int(padding.Int64()) + 1
+		header := make([]byte, 0, len(target)+2+paddingSize)
+		header = append(header, target...)
+		header = binary.BigEndian.AppendUint16(header, uint16(paddingSize))
+		header = append(header, make([]byte, paddingSize)...)
+
+		fixed := []byte{headerTypeClient}
+		fixed = binary.BigEndian.AppendUint64(fixed, uint64(time.Now().Unix()))
+		fixed = binary.BigEndian.AppendUint16(fixed, uint16(len(header)))
+		buf = c.w.seal(buf, fixed)
+		buf = c.w.seal(buf, header)
+	}
+	_, err = c.Conn.Write(buf)
+	return err
+}
+
+// readResponse reads the salt and the response header.
+func (c *streamConn) readResponse() error {
+	salt := make([]byte, c.cipher.saltSize())
+	if _, err := io.ReadFull(c.Conn, salt); err != nil {
+		return err
+	}
+	aead, err := c.cipher.aead(salt)
+	if err != nil {
+		return err
+	}
+	r := newAEADReader(c.Conn, aead, c.cipher.maxPayloadSize())
+
+	if c.cipher.is2022 {
+		header, err := r.open(1 + 8 + len(c.salt) + 2)
+		if err != nil {
+			return err
+		}
+		if header[0] != headerTypeServer {
+			return fmt.Errorf("unexpected header type %v", header[0])
+		}
+		if err := checkTimestamp(header[1:9]); err != nil {
+			return err
+		}
+		if !bytes.Equal(header[9:9+len(c.salt)], c.salt) {
+			return errors.New("response to another request")
+		}
+		size := int(binary.BigEndian.Uint16(header[9+len(c.salt):]))
+		if r.leftover, err = r.open(size); err != nil {
+			return err
+		}
+	}
+	c.r = r
+	return nil
+}
+
+func (c *streamConn) Read(p []byte) (int, error) {
+	if c.r == nil {
+		if err := c.readResponse(); err != nil {
+			return 0, err
+		}
+	}
+	return c.r.Read(p)
+}
+
+func (c *streamConn) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+func (c *streamConn) CloseRead() error {
+	if conn, ok := c.Conn.(*net.TCPConn); ok {
+		return conn.CloseRead()
+	}
+	return c.Conn.Close()
+}
+
+func (c *streamConn) CloseWrite() error {
+	if conn, ok := c.Conn.(*net.TCPConn); ok {
+		return conn.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// checkTimestamp checks that the 2022 header timestamp ts is close to the
+// local time.
+func checkTimestamp(ts []byte) error {
+	diff := time.Since(time.Unix(int64(binary.BigEndian.Uint64(ts)), 0))
+	if diff > maxTimeDiff || diff < -maxTimeDiff {
+		return fmt.Errorf("timestamp off by %v", diff)
+	}
+	return nil
+}
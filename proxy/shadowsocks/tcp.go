@@ -0,0 +1,44 @@
+package shadowsocks
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+	"github.com/eycorsican/go-tun2socks/common/relay"
+	"github.com/eycorsican/go-tun2socks/core"
+	"github.com/eycorsican/go-tun2socks/proxy/socks"
+)
+
+// tcpHandler relays each TCP connection through a Shadowsocks server.
+type tcpHandler struct {
+	server string
+	cipher *Cipher
+}
+
+// NewTCPHandler creates a TCP handler connecting through the Shadowsocks
+// server at server (host:port) encrypting with c.
+func NewTCPHandler(server string, c *Cipher) core.TCPConnHandler {
+	return &tcpHandler{
+		server: server,
+		cipher: c,
+	}
+}
+
+func (h *tcpHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
+	addr := socks.ParseAddr(target.String())
+	if addr == nil {
+		return fmt.Errorf("invalid target address %v", target)
+	}
+
+	c, err := dialStream(h.server, h.cipher, addr)
+	if err != nil {
+		return err
+	}
+
+	go relay.Copy(conn, c)
+
+	log.Infof("new proxy connection to %v", target)
+
+	return nil
+}
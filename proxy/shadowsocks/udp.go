@@ -0,0 +1,154 @@
+package shadowsocks
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+	"github.com/eycorsican/go-tun2socks/core"
+	"github.com/eycorsican/go-tun2socks/proxy/socks"
+)
+
+// max IP packet size - min IP header size - min UDP header size
+const maxUdpPacketSize = 65535 - 20 - 8
+
+// udpSession is the socket and the packet session of a UDP conn.
+type udpSession struct {
+	pc      *net.UDPConn
+	session *packetSession
+}
+
+// udpHandler relays each UDP conn through a Shadowsocks server with a
+// socket of its own.
+type udpHandler struct {
+	sync.Mutex
+
+	server   string
+	cipher   *Cipher
+	timeout  time.Duration
+	sessions map[core.UDPConn]*udpSession
+}
+
+// NewUDPHandler creates a UDP handler relaying through the Shadowsocks
+// server at server (host:port) encrypting with c, sessions expire after
+// timeout without packets from the server.
+func NewUDPHandler(server string, c *Cipher, timeout time.Duration) core.UDPConnHandler {
+	return &udpHandler{
+		server:   server,
+		cipher:   c,
+		timeout:  timeout,
+		sessions: make(map[core.UDPConn]*udpSession, 8),
+	}
+}
+
+func (h *udpHandler) fetchUDPInput(conn core.UDPConn, s *udpSession) {
+	buf := core.NewBytes(maxUdpPacketSize)
+
+	defer func() {
+		h.Close(conn)
+		core.FreeBytes(buf)
+	}()
+
+	for {
+		s.pc.SetDeadline(time.Now().Add(h.timeout))
+		n, err := s.pc.Read(buf)
+		if err != nil {
+			return
+		}
+		addr, payload, err := s.session.unpack(buf[:n])
+		if err != nil {
+			log.Debugf("dropped packet from shadowsocks server: %v", err)
+			continue
+		}
+		resolvedAddr, err := net.ResolveUDPAddr("udp", addr.String())
+		if err != nil {
+			continue
+		}
+		_, err = conn.WriteFrom(payload, resolvedAddr)
+		if err != nil {
+			log.Warnf("write local failed: %v", err)
+			return
+		}
+	}
+}
+
+func (h *udpHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
+	remoteAddr, err := net.ResolveUDPAddr("udp", h.server)
+	if err != nil {
+		return err
+	}
+	session, err := newPacketSession(h.cipher, false)
+	if err != nil {
+		return err
+	}
+	pc, err := net.DialUDP("udp", nil, remoteAddr)
+	if err != nil {
+		return err
+	}
+
+	s := &udpSession{pc: pc, session: session}
+	h.Lock()
+	h.sessions[conn] = s
+	h.Unlock()
+
+	go h.fetchUDPInput(conn, s)
+
+	log.Infof("new proxy connection to %v", target)
+
+	return nil
+}
+
+func (h *udpHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr) error {
+	h.Lock()
+	s, ok := h.sessions[conn]
+	h.Unlock()
+
+	if !ok {
+		h.Close(conn)
+		return fmt.Errorf("proxy connection %v->%v does not exists", conn.LocalAddr(), addr)
+	}
+
+	dest := socks.ParseAddr(addr.String())
+	if dest == nil {
+		return errors.New("invalid destination address")
+	}
+	pkt, err := s.session.pack(dest, data)
+	if err != nil {
+		return err
+	}
+	if _, err := s.pc.Write(pkt); err != nil {
+		h.Close(conn)
+		return fmt.Errorf("write remote failed: %v", err)
+	}
+	return nil
+}
+
+func (h *udpHandler) Close(conn core.UDPConn) {
+	conn.Close()
+
+	h.Lock()
+	defer h.Unlock()
+
+	if s, ok := h.sessions[conn]; ok {
+		s.pc.Close()
+		delete(h.sessions, conn)
+	}
+}
+
+// Shutdown closes all connections and their sockets to the server.
+func (h *udpHandler) Shutdown() error {
+	h.Lock()
+	conns := make([]core.UDPConn, 0, len(h.sessions))
+	for conn := range h.sessions {
+		conns = append(conns, conn)
+	}
+	h.Unlock()
+
+	for _, conn := range conns {
+		h.Close(conn)
+	}
+	return nil
+}
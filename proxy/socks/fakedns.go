@@ -0,0 +1,45 @@
+package socks
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/eycorsican/go-tun2socks/common/dns"
+)
+
+// targetAddr returns the address to request from the proxy server for
+// ip:port, it's the domain if ip is a fake IP of fakeDns.
+func targetAddr(fakeDns dns.FakeDns, ip net.IP, port int) (string, error) {
+	if fakeDns != nil && fakeDns.IsFakeIP(ip) {
+		domain := fakeDns.QueryDomain(ip)
+		if domain == "" {
+			return "", fmt.Errorf("fake IP %v is not mapped to any domain", ip)
+		}
+		return net.JoinHostPort(domain, strconv.Itoa(port)), nil
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(port)), nil
+}
+
+// fakeDests records the fake addresses a UDP conn sent packets to, so that
+// replies can be written from the addresses the client expects.
+type fakeDests struct {
+	addrs map[string]*net.UDPAddr // Requested domain address to fake address.
+	real  bool                    // Packets were also sent to real addresses.
+}
+
+// replyAddr returns the fake address a reply from the proxy server should
+// come from, or nil if it's not a reply from a fake address.
+func (d *fakeDests) replyAddr(from string) *net.UDPAddr {
+	if addr, ok := d.addrs[from]; ok {
+		return addr
+	}
+	// Proxy servers may reply with the resolved address of the domain,
+	// it's unambiguous if the conn talks to a single fake address.
+	if !d.real && len(d.addrs) == 1 {
+		for _, addr := range d.addrs {
+			return addr
+		}
+	}
+	return nil
+}
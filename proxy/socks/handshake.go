@@ -0,0 +1,146 @@
+package socks
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// SOCKS authentication methods as defined in RFC 1928 section 3.
+const (
+	socks5AuthNone     = 0
+	socks5AuthPassword = 2
+	socks5AuthNoAccept = 0xff
+)
+
+// Version of the username/password sub-negotiation defined in RFC 1929.
+const socks5AuthPasswordVersion = 1
+
+// handshake negotiates the authentication method with the SOCKS5 server on c
+// and performs the username/password sub-negotiation if the server asks for
+// it. Only the no-auth method is offered if auth is nil.
+func handshake(c net.Conn, auth *proxy.Auth) error {
+	// send VER, NMETHODS, METHODS
+	greeting := []byte{5, 1, socks5AuthNone}
+	if auth != nil {
+		greeting = []byte{5, 2, socks5AuthNone, socks5AuthPassword}
+	}
+	if _, err := c.Write(greeting); err != nil {
+		return err
+	}
+
+	// read VER METHOD
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		return err
+	}
+	if buf[0] != 5 {
+		return errors.New("unexpected SOCKS version")
+	}
+
+	switch buf[1] {
+	case socks5AuthNone:
+		return nil
+	case socks5AuthPassword:
+		if auth == nil {
+			return errors.New("SOCKS server requires authentication")
+		}
+		return authenticate(c, auth)
+	case socks5AuthNoAccept:
+		return errors.New("no acceptable SOCKS authentication methods")
+	default:
+		return errors.New("unsupported SOCKS authentication method")
+	}
+}
+
+// authenticate performs the username/password sub-negotiation (RFC 1929).
+func authenticate(c net.Conn, auth *proxy.Auth) error {
+	if len(auth.User) == 0 || len(auth.User) > 255 || len(auth.Password) > 255 {
+		return errors.New("invalid SOCKS username or password length")
+	}
+
+	// send VER ULEN UNAME PLEN PASSWD
+	req := make([]byte, 0, 3+len(auth.User)+len(auth.Password))
+	req = append(req, socks5AuthPasswordVersion, byte(len(auth.User)))
+	req = append(req, auth.User...)
+	req = append(req, byte(len(auth.Password)))
+	req = append(req, auth.Password...)
+	if _, err := c.Write(req); err != nil {
+		return err
+	}
+
+	// read VER STATUS
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		return err
+	}
+	if buf[0] != socks5AuthPasswordVersion {
+		return errors.New("unexpected SOCKS username/password authentication version")
+	}
+	if buf[1] != 0 {
+		return errors.New("SOCKS username/password authentication failed")
+	}
+	return nil
+}
+
+// Probe connects to the SOCKS5 server at addr and negotiates the
+// authentication method, it returns the time taken.
+func Probe(addr string, auth *proxy.Auth, timeout time.Duration) (time.Duration, error) {
+	start := time.Now()
+	c, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+
+	c.SetDeadline(start.Add(timeout))
+	if err := handshake(c, auth); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// Connect connects to the SOCKS5 server at addr and requests a connection to
+// target with the CONNECT command. Unlike the dialer of golang.org/x/net/proxy,
+// it accepts any target including port 0, which some servers use for
+// special destinations.
+func Connect(addr string, auth *proxy.Auth, target Addr) (net.Conn, error) {
+	c, err := net.DialTimeout("tcp", addr, 4*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if err := handshake(c, auth); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	// send VER CMD RSV ATYP DST.ADDR DST.PORT
+	req := append([]byte{5, socks5Connect, 0}, target...)
+	if _, err := c.Write(req); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	// read VER REP RSV ATYP BND.ADDR BND.PORT
+	buf := make([]byte, MaxAddrLen)
+	if _, err := io.ReadFull(c, buf[:3]); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if rep := buf[1]; rep != 0 {
+		c.Close()
+		if int(rep) < len(socks5Errors) {
+			return nil, fmt.Errorf("SOCKS connect failed: %v", socks5Errors[rep])
+		}
+		return nil, errors.New("SOCKS connect failed")
+	}
+	if _, err := readAddr(c, buf); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
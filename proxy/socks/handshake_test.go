@@ -0,0 +1,259 @@
+package socks
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// testServer is a SOCKS5 server echoing the data of CONNECT streams and the
+// datagrams of UDP ASSOCIATE sessions.
+type testServer struct {
+	// Credentials required by the server, none if user is empty.
+	user, password string
+	// Version of the username/password replies, 1 if zero.
+	authVersion byte
+
+	l   net.Listener
+	udp *net.UDPConn
+}
+
+func newTestServer(t *testing.T, user, password string) *testServer {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		l.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		l.Close()
+		udp.Close()
+	})
+	s := &testServer{user: user, password: password, l: l, udp: udp}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	go func() {
+		// Datagrams are echoed with their header, the destination
+		// becomes the source.
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := udp.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			udp.WriteToUDP(buf[:n], addr)
+		}
+	}()
+	return s
+}
+
+func (s *testServer) addr() *net.TCPAddr {
+	return s.l.Addr().(*net.TCPAddr)
+}
+
+func (s *testServer) serve(c net.Conn) {
+	defer c.Close()
+
+	// VER NMETHODS METHODS
+	buf := make([]byte, 256)
+	if _, err := io.ReadFull(c, buf[:2]); err != nil {
+		return
+	}
+	methods := buf[2 : 2+int(buf[1])]
+	if _, err := io.ReadFull(c, methods); err != nil {
+		return
+	}
+	if s.user == "" {
+		c.Write([]byte{5, socks5AuthNone})
+	} else {
+		if bytes.IndexByte(methods, socks5AuthPassword) < 0 {
+			c.Write([]byte{5, socks5AuthNoAccept})
+			return
+		}
+		c.Write([]byte{5, socks5AuthPassword})
+
+		// VER ULEN UNAME PLEN PASSWD
+		var fields [2]string
+		if _, err := io.ReadFull(c, buf[:1]); err != nil {
+			return
+		}
+		for i := range fields {
+			if _, err := io.ReadFull(c, buf[:1]); err != nil {
+				return
+			}
+			field := make([]byte, buf[0])
+			if _, err := io.ReadFull(c, field); err != nil {
+				return
+			}
+			fields[i] = string(field)
+		}
+		version := s.authVersion
+		if version == 0 {
+			version = socks5AuthPasswordVersion
+		}
+		if fields[0] != s.user || fields[1] != s.password {
+			c.Write([]byte{version, 1})
+			return
+		}
+		c.Write([]byte{version, 0})
+	}
+
+	// VER CMD RSV DST.ADDR DST.PORT
+	if _, err := io.ReadFull(c, buf[:3]); err != nil {
+		return
+	}
+	cmd := buf[1]
+	if _, err := ReadAddr(c); err != nil {
+		return
+	}
+	switch cmd {
+	case socks5Connect:
+		c.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+		io.Copy(c, c)
+	case socks5UDPAssociate:
+		c.Write(append([]byte{5, 0, 0}, ParseAddr(s.udp.LocalAddr().String())...))
+		io.Copy(io.Discard, c)
+	default:
+		c.Write([]byte{5, 7, 0, 1, 0, 0, 0, 0, 0, 0})
+	}
+}
+
+var authTests = []struct {
+	name           string
+	user, password string // Credentials required by the server.
+	auth           *proxy.Auth
+	authVersion    byte
+	ok             bool
+}{
+	{"auth", "user", "pass", &proxy.Auth{User: "user", Password: "pass"}, 0, true},
+	{"rejected", "user", "pass", &proxy.Auth{User: "user", Password: "wrong"}, 0, false},
+	{"no credentials", "user", "pass", nil, 0, false},
+	{"no auth required", "", "", &proxy.Auth{User: "user", Password: "pass"}, 0, true},
+	{"bad auth version", "user", "pass", &proxy.Auth{User: "user", Password: "pass"}, 5, false},
+}
+
+// assertEcho writes data to c and checks it's echoed.
+func assertEcho(t *testing.T, c net.Conn) {
+	t.Helper()
+	c.SetDeadline(time.Now().Add(time.Second))
+	go c.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Errorf("unexpected reply %q", buf)
+	}
+}
+
+func TestConnect(t *testing.T) {
+	for _, tt := range authTests {
+		s := newTestServer(t, tt.user, tt.password)
+		s.authVersion = tt.authVersion
+		c, err := Connect(s.addr().String(), tt.auth, ParseAddr("1.2.3.4:80"))
+		if (err == nil) != tt.ok {
+			t.Errorf("%v: got error %v", tt.name, err)
+		}
+		if err == nil {
+			assertEcho(t, c)
+			c.Close()
+		}
+	}
+}
+
+func TestHandshakeErrors(t *testing.T) {
+	s := newTestServer(t, "user", "pass")
+	for _, auth := range []*proxy.Auth{
+		{User: "", Password: "pass"},
+		{User: strings.Repeat("u", 256), Password: "pass"},
+	} {
+		if _, err := Connect(s.addr().String(), auth, ParseAddr("1.2.3.4:80")); err == nil || !strings.Contains(err.Error(), "length") {
+			t.Errorf("user of %d bytes: got error %v", len(auth.User), err)
+		}
+	}
+}
+
+func TestTCPHandlerAuth(t *testing.T) {
+	for _, tt := range authTests {
+		s := newTestServer(t, tt.user, tt.password)
+		s.authVersion = tt.authVersion
+		h := NewTCPHandlerWithAuth("127.0.0.1", uint16(s.addr().Port), tt.auth)
+		conn, tun := net.Pipe()
+		err := h.Handle(conn, &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 80})
+		if (err == nil) != tt.ok {
+			t.Errorf("%v: got error %v", tt.name, err)
+		}
+		if err == nil {
+			assertEcho(t, tun)
+		}
+		tun.Close()
+	}
+}
+
+// fakeUDPConn passes the packets written to TUN to the test.
+type fakeUDPConn struct {
+	packets chan []byte
+	from    chan *net.UDPAddr
+}
+
+func (c *fakeUDPConn) LocalAddr() *net.UDPAddr {
+	return &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 12345}
+}
+
+func (c *fakeUDPConn) ReceiveTo(data []byte, addr *net.UDPAddr) error { return nil }
+
+func (c *fakeUDPConn) WriteFrom(data []byte, addr *net.UDPAddr) (int, error) {
+	c.packets <- append([]byte(nil), data...)
+	c.from <- addr
+	return len(data), nil
+}
+
+func (c *fakeUDPConn) Close() error { return nil }
+
+func TestUDPHandlerAuth(t *testing.T) {
+	target := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 53}
+	for _, tt := range authTests {
+		s := newTestServer(t, tt.user, tt.password)
+		s.authVersion = tt.authVersion
+		h := NewUDPHandlerWithAuth("127.0.0.1", uint16(s.addr().Port), time.Second, tt.auth)
+		conn := &fakeUDPConn{packets: make(chan []byte, 1), from: make(chan *net.UDPAddr, 1)}
+		err := h.Connect(conn, target)
+		if (err == nil) != tt.ok {
+			t.Errorf("%v: got error %v", tt.name, err)
+		}
+		if err != nil {
+			continue
+		}
+		if err := h.ReceiveTo(conn, []byte("query"), target); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case data := <-conn.packets:
+			if string(data) != "query" {
+				t.Errorf("unexpected reply %q", data)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%v: no reply", tt.name)
+		}
+		if from := <-conn.from; !from.IP.Equal(target.IP) || from.Port != target.Port {
+			t.Errorf("reply from %v, want %v", from, target)
+		}
+		h.(*udpHandler).Shutdown()
+	}
+}
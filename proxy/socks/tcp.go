@@ -1,13 +1,14 @@
 package socks
 
 import (
-	"io"
 	"net"
 	"sync"
 
 	"golang.org/x/net/proxy"
 
+	"github.com/eycorsican/go-tun2socks/common/dns"
 	"github.com/eycorsican/go-tun2socks/common/log"
+	"github.com/eycorsican/go-tun2socks/common/relay"
 	"github.com/eycorsican/go-tun2socks/core"
 )
 
@@ -16,89 +17,52 @@ type tcpHandler struct {
 
 	proxyHost string
 	proxyPort uint16
+	auth      *proxy.Auth
+	fakeDns   dns.FakeDns
 }
 
 func NewTCPHandler(proxyHost string, proxyPort uint16) core.TCPConnHandler {
-	return &tcpHandler{
-		proxyHost: proxyHost,
-		proxyPort: proxyPort,
-	}
+	return NewTCPHandlerWithAuth(proxyHost, proxyPort, nil)
 }
 
-type direction byte
-
-const (
-	dirUplink direction = iota
-	dirDownlink
-)
-
-type duplexConn interface {
-	net.Conn
-	CloseRead() error
-	CloseWrite() error
+// NewTCPHandlerWithAuth creates a TCP handler authenticating with the proxy
+// server using username/password (RFC 1929), auth can be nil if the server
+// requires no authentication.
+func NewTCPHandlerWithAuth(proxyHost string, proxyPort uint16, auth *proxy.Auth) core.TCPConnHandler {
+	return NewTCPHandlerWithFakeDns(proxyHost, proxyPort, auth, nil)
 }
 
-func (h *tcpHandler) relay(lhs, rhs net.Conn) {
-	upCh := make(chan struct{})
-
-	cls := func(dir direction, interrupt bool) {
-		lhsDConn, lhsOk := lhs.(duplexConn)
-		rhsDConn, rhsOk := rhs.(duplexConn)
-		if !interrupt && lhsOk && rhsOk {
-			switch dir {
-			case dirUplink:
-				lhsDConn.CloseRead()
-				rhsDConn.CloseWrite()
-			case dirDownlink:
-				lhsDConn.CloseWrite()
-				rhsDConn.CloseRead()
-			default:
-				panic("unexpected direction")
-			}
-		} else {
-			lhs.Close()
-			rhs.Close()
-		}
+// NewTCPHandlerWithFakeDns creates a TCP handler sending the domain instead
+// of the address to the proxy server if the target is a fake IP of fakeDns,
+// fakeDns can be nil.
+func NewTCPHandlerWithFakeDns(proxyHost string, proxyPort uint16, auth *proxy.Auth, fakeDns dns.FakeDns) core.TCPConnHandler {
+	return &tcpHandler{
+		proxyHost: proxyHost,
+		proxyPort: proxyPort,
+		auth:      auth,
+		fakeDns:   fakeDns,
 	}
+}
 
-	// Uplink
-	go func() {
-		var err error
-		_, err = io.Copy(rhs, lhs)
-		if err != nil {
-			cls(dirUplink, true) // interrupt the conn if the error is not nil (not EOF)
-		} else {
-			cls(dirUplink, false) // half close uplink direction of the TCP conn if possible
-		}
-		upCh <- struct{}{}
-	}()
-
-	// Downlink
-	var err error
-	_, err = io.Copy(lhs, rhs)
+func (h *tcpHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
+	dialer, err := proxy.SOCKS5("tcp", core.ParseTCPAddr(h.proxyHost, h.proxyPort).String(), h.auth, nil)
 	if err != nil {
-		cls(dirDownlink, true)
-	} else {
-		cls(dirDownlink, false)
+		return err
 	}
 
-	<-upCh // Wait for uplink done.
-}
-
-func (h *tcpHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
-	dialer, err := proxy.SOCKS5("tcp", core.ParseTCPAddr(h.proxyHost, h.proxyPort).String(), nil, nil)
+	dest, err := targetAddr(h.fakeDns, target.IP, target.Port)
 	if err != nil {
 		return err
 	}
 
-	c, err := dialer.Dial(target.Network(), target.String())
+	c, err := dialer.Dial(target.Network(), dest)
 	if err != nil {
 		return err
 	}
 
-	go h.relay(conn, c)
+	go relay.Copy(conn, c)
 
-	log.Infof("new proxy connection to %v", target)
+	log.Infof("new proxy connection to %v", dest)
 
 	return nil
 }
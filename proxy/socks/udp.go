@@ -8,6 +8,9 @@ import (
 	"sync"
 	"time"
 
+	"golang.org/x/net/proxy"
+
+	"github.com/eycorsican/go-tun2socks/common/dns"
 	"github.com/eycorsican/go-tun2socks/common/log"
 	"github.com/eycorsican/go-tun2socks/core"
 )
@@ -20,19 +23,39 @@ type udpHandler struct {
 
 	proxyHost   string
 	proxyPort   uint16
+	auth        *proxy.Auth
 	udpConns    map[core.UDPConn]net.PacketConn
 	tcpConns    map[core.UDPConn]net.Conn
 	remoteAddrs map[core.UDPConn]*net.UDPAddr // UDP relay server addresses
+	fakeDests   map[core.UDPConn]*fakeDests
+	fakeDns     dns.FakeDns
 	timeout     time.Duration
 }
 
 func NewUDPHandler(proxyHost string, proxyPort uint16, timeout time.Duration) core.UDPConnHandler {
+	return NewUDPHandlerWithAuth(proxyHost, proxyPort, timeout, nil)
+}
+
+// NewUDPHandlerWithAuth creates a UDP handler authenticating with the proxy
+// server using username/password (RFC 1929) before UDP ASSOCIATE, auth can be
+// nil if the server requires no authentication.
+func NewUDPHandlerWithAuth(proxyHost string, proxyPort uint16, timeout time.Duration, auth *proxy.Auth) core.UDPConnHandler {
+	return NewUDPHandlerWithFakeDns(proxyHost, proxyPort, timeout, auth, nil)
+}
+
+// NewUDPHandlerWithFakeDns creates a UDP handler sending the domain instead
+// of the address to the proxy server if the destination is a fake IP of
+// fakeDns, fakeDns can be nil.
+func NewUDPHandlerWithFakeDns(proxyHost string, proxyPort uint16, timeout time.Duration, auth *proxy.Auth, fakeDns dns.FakeDns) core.UDPConnHandler {
 	return &udpHandler{
 		proxyHost:   proxyHost,
 		proxyPort:   proxyPort,
+		auth:        auth,
 		udpConns:    make(map[core.UDPConn]net.PacketConn, 8),
 		tcpConns:    make(map[core.UDPConn]net.Conn, 8),
 		remoteAddrs: make(map[core.UDPConn]*net.UDPAddr, 8),
+		fakeDests:   make(map[core.UDPConn]*fakeDests, 8),
+		fakeDns:     fakeDns,
 		timeout:     timeout,
 	}
 }
@@ -74,9 +97,17 @@ func (h *udpHandler) fetchUDPInput(conn core.UDPConn, input net.PacketConn) {
 		if addr == nil {
 			continue
 		}
-		resolvedAddr, err := net.ResolveUDPAddr("udp", addr.String())
-		if err != nil {
-			continue
+		var resolvedAddr *net.UDPAddr
+		h.Lock()
+		if dests, ok := h.fakeDests[conn]; ok {
+			resolvedAddr = dests.replyAddr(addr.String())
+		}
+		h.Unlock()
+		if resolvedAddr == nil {
+			resolvedAddr, err = net.ResolveUDPAddr("udp", addr.String())
+			if err != nil {
+				continue
+			}
 		}
 		_, err = conn.WriteFrom(buf[int(3+len(addr)):n], resolvedAddr)
 		if err != nil {
@@ -99,34 +130,38 @@ func (h *udpHandler) connectInternal(conn core.UDPConn, dest string) error {
 		return err
 	}
 
-	// send VER, NMETHODS, METHODS
-	c.Write([]byte{5, 1, 0})
+	if err := handshake(c, h.auth); err != nil {
+		c.Close()
+		return err
+	}
 
 	buf := make([]byte, MaxAddrLen)
-	// read VER METHOD
-	if _, err := io.ReadFull(c, buf[:2]); err != nil {
+	if _, err := c.Write(append([]byte{5, socks5UDPAssociate, 0}, []byte{1, 0, 0, 0, 0, 0, 0}...)); err != nil {
+		c.Close()
 		return err
 	}
 
-	c.Write(append([]byte{5, socks5UDPAssociate, 0}, []byte{1, 0, 0, 0, 0, 0, 0}...))
-	
 	// read VER REP RSV ATYP BND.ADDR BND.PORT
 	if _, err := io.ReadFull(c, buf[:3]); err != nil {
+		c.Close()
 		return err
 	}
 
 	rep := buf[1]
 	if rep != 0 {
+		c.Close()
 		return errors.New("SOCKS handshake failed")
 	}
 
 	remoteAddr, err := readAddr(c, buf)
 	if err != nil {
+		c.Close()
 		return err
 	}
 
 	resolvedRemoteAddr, err := net.ResolveUDPAddr("udp", remoteAddr.String())
 	if err != nil {
+		c.Close()
 		return errors.New("failed to resolve remote address")
 	}
 
@@ -157,9 +192,16 @@ func (h *udpHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr
 	h.Unlock()
 
 	if ok1 && ok2 {
-		buf := append([]byte{0, 0, 0}, ParseAddr(addr.String())...)
+		dest, err := targetAddr(h.fakeDns, addr.IP, addr.Port)
+		if err != nil {
+			return err
+		}
+		if h.fakeDns != nil {
+			h.recordDest(conn, dest, addr)
+		}
+		buf := append([]byte{0, 0, 0}, ParseAddr(dest)...)
 		buf = append(buf, data[:]...)
-		_, err := pc.WriteTo(buf, remoteAddr)
+		_, err = pc.WriteTo(buf, remoteAddr)
 		if err != nil {
 			h.Close(conn)
 			return errors.New(fmt.Sprintf("write remote failed: %v", err))
@@ -186,4 +228,37 @@ func (h *udpHandler) Close(conn core.UDPConn) {
 		delete(h.udpConns, conn)
 	}
 	delete(h.remoteAddrs, conn)
+	delete(h.fakeDests, conn)
+}
+
+// Shutdown closes all connections and their sockets to the proxy server.
+func (h *udpHandler) Shutdown() error {
+	h.Lock()
+	conns := make([]core.UDPConn, 0, len(h.udpConns))
+	for conn := range h.udpConns {
+		conns = append(conns, conn)
+	}
+	h.Unlock()
+
+	for _, conn := range conns {
+		h.Close(conn)
+	}
+	return nil
+}
+
+// recordDest records that a packet to addr was requested as dest.
+func (h *udpHandler) recordDest(conn core.UDPConn, dest string, addr *net.UDPAddr) {
+	h.Lock()
+	defer h.Unlock()
+
+	dests, ok := h.fakeDests[conn]
+	if !ok {
+		dests = &fakeDests{addrs: make(map[string]*net.UDPAddr, 1)}
+		h.fakeDests[conn] = dests
+	}
+	if h.fakeDns.IsFakeIP(addr.IP) {
+		dests.addrs[dest] = addr
+	} else {
+		dests.real = true
+	}
 }
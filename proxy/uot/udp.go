@@ -0,0 +1,250 @@
+// Package uot implements a UDP handler relaying datagrams in TCP streams
+// through a SOCKS5 proxy server, so that UDP works through proxies only able
+// to relay TCP.
+//
+// Streams follow version 2 of the UDP-over-TCP protocol of sing-box in
+// non-connect mode. Each UDP conn opens a SOCKS5 CONNECT to the relay, which
+// is the magic address sp.v2.udp-over-tcp.arpa for proxies implementing the
+// protocol themselves, sends a request and then a frame per datagram:
+//
+//	request: | IsConnect (1 byte, 0) | Destination (address) |
+//	frame:   | Address | Length (2 bytes) | Data |
+//	address: | Family (1 byte) | IPv4, IPv6 or FQDN | Port (2 bytes) |
+//
+// Frames from the relay have the same format, the address being the source
+// of the datagram. Addresses are encoded like SOCKS addresses except for the
+// family, which is 0x00 for IPv4, 0x01 for IPv6 and 0x02 for FQDNs (a length
+// byte followed by the name). Ports and lengths are big-endian.
+package uot
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/proxy"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+	"github.com/eycorsican/go-tun2socks/core"
+	"github.com/eycorsican/go-tun2socks/proxy/socks"
+)
+
+// MagicRelay is the relay address of proxies implementing the protocol.
+const MagicRelay = "sp.v2.udp-over-tcp.arpa:0"
+
+// Address families of UoT addresses.
+const (
+	familyIPv4 = 0x00
+	familyIPv6 = 0x01
+	familyFQDN = 0x02
+)
+
+// SOCKS address types as defined in RFC 1928 section 5.
+const (
+	atypIPv4   = 0x01
+	atypDomain = 0x03
+	atypIPv6   = 0x04
+)
+
+// parseAddr returns the UoT address of s (host:port), or nil if s is
+// invalid.
+func parseAddr(s string) []byte {
+	addr := socks.ParseAddr(s)
+	if addr == nil {
+		return nil
+	}
+	switch addr[0] {
+	case atypIPv4:
+		addr[0] = familyIPv4
+	case atypIPv6:
+		addr[0] = familyIPv6
+	case atypDomain:
+		addr[0] = familyFQDN
+	}
+	return addr
+}
+
+// readAddr reads a UoT address from r and returns it as a SOCKS address.
+func readAddr(r io.Reader) (socks.Addr, error) {
+	var family [1]byte
+	if _, err := io.ReadFull(r, family[:]); err != nil {
+		return nil, err
+	}
+	var atyp byte
+	switch family[0] {
+	case familyIPv4:
+		atyp = atypIPv4
+	case familyIPv6:
+		atyp = atypIPv6
+	case familyFQDN:
+		atyp = atypDomain
+	default:
+		return nil, fmt.Errorf("unknown address family %v", family[0])
+	}
+	return socks.ReadAddr(io.MultiReader(bytes.NewReader([]byte{atyp}), r))
+}
+
+// max IP packet size - min IP header size - min UDP header size
+const maxUdpPayloadSize = 65535 - 20 - 8
+
+// stream is the TCP stream of a UDP conn, frames are written whole under the
+// lock.
+type stream struct {
+	sync.Mutex
+
+	c net.Conn
+}
+
+type udpHandler struct {
+	sync.Mutex
+
+	proxyServer string
+	auth        *proxy.Auth
+	relay       string
+	timeout     time.Duration
+	streams     map[core.UDPConn]*stream
+}
+
+// NewUDPHandler creates a UDP handler relaying UDP conns in TCP streams to
+// relay (host:port) through the SOCKS5 server at proxyServer, auth can be nil
+// if the server requires no authentication. Streams are closed after timeout
+// without datagrams from the relay.
+func NewUDPHandler(proxyServer string, auth *proxy.Auth, relay string, timeout time.Duration) core.UDPConnHandler {
+	return &udpHandler{
+		proxyServer: proxyServer,
+		auth:        auth,
+		relay:       relay,
+		timeout:     timeout,
+		streams:     make(map[core.UDPConn]*stream, 8),
+	}
+}
+
+func (h *udpHandler) fetchInput(conn core.UDPConn, c net.Conn) {
+	buf := core.NewBytes(maxUdpPayloadSize)
+
+	defer func() {
+		h.Close(conn)
+		core.FreeBytes(buf)
+	}()
+
+	r := bufio.NewReader(c)
+	for {
+		c.SetReadDeadline(time.Now().Add(h.timeout))
+		addr, err := readAddr(r)
+		if err != nil {
+			return
+		}
+		if _, err := io.ReadFull(r, buf[:2]); err != nil {
+			return
+		}
+		n := int(binary.BigEndian.Uint16(buf))
+		if n > len(buf) {
+			log.Warnf("datagram of %d bytes from relay is too large", n)
+			return
+		}
+		if _, err := io.ReadFull(r, buf[:n]); err != nil {
+			return
+		}
+		resolvedAddr, err := net.ResolveUDPAddr("udp", addr.String())
+		if err != nil {
+			continue
+		}
+		if _, err := conn.WriteFrom(buf[:n], resolvedAddr); err != nil {
+			log.Warnf("write local failed: %v", err)
+			return
+		}
+	}
+}
+
+func (h *udpHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
+	relay := socks.ParseAddr(h.relay)
+	if relay == nil {
+		return fmt.Errorf("invalid relay address %v", h.relay)
+	}
+	dest := "0.0.0.0:0"
+	if target != nil {
+		dest = target.String()
+	}
+
+	c, err := socks.Connect(h.proxyServer, h.auth, relay)
+	if err != nil {
+		return err
+	}
+	req := append([]byte{0}, parseAddr(dest)...)
+	if _, err := c.Write(req); err != nil {
+		c.Close()
+		return err
+	}
+
+	h.Lock()
+	h.streams[conn] = &stream{c: c}
+	h.Unlock()
+
+	go h.fetchInput(conn, c)
+
+	log.Infof("new proxy connection to %v over TCP", dest)
+
+	return nil
+}
+
+func (h *udpHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr) error {
+	h.Lock()
+	s, ok := h.streams[conn]
+	h.Unlock()
+
+	if !ok {
+		h.Close(conn)
+		return fmt.Errorf("proxy connection %v->%v does not exists", conn.LocalAddr(), addr)
+	}
+	if len(data) > 0xffff {
+		return errors.New("datagram too large")
+	}
+
+	dest := parseAddr(addr.String())
+	frame := make([]byte, 0, len(dest)+2+len(data))
+	frame = append(frame, dest...)
+	frame = binary.BigEndian.AppendUint16(frame, uint16(len(data)))
+	frame = append(frame, data...)
+
+	s.Lock()
+	_, err := s.c.Write(frame)
+	s.Unlock()
+	if err != nil {
+		h.Close(conn)
+		return fmt.Errorf("write remote failed: %v", err)
+	}
+	return nil
+}
+
+func (h *udpHandler) Close(conn core.UDPConn) {
+	conn.Close()
+
+	h.Lock()
+	defer h.Unlock()
+
+	if s, ok := h.streams[conn]; ok {
+		s.c.Close()
+		delete(h.streams, conn)
+	}
+}
+
+// Shutdown closes all connections and their streams.
+func (h *udpHandler) Shutdown() error {
+	h.Lock()
+	conns := make([]core.UDPConn, 0, len(h.streams))
+	for conn := range h.streams {
+		conns = append(conns, conn)
+	}
+	h.Unlock()
+
+	for _, conn := range conns {
+		h.Close(conn)
+	}
+	return nil
+}
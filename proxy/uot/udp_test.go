@@ -0,0 +1,159 @@
+package uot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/proxy/socks"
+)
+
+func TestAddr(t *testing.T) {
+	tests := []struct {
+		addr, encoded string
+	}{
+		{"1.2.3.4:53", "00010203040035"},
+		{"[2001:db8::1]:443", "0120010db800000000000000000000000101bb"},
+		{"example.com:80", "020b6578616d706c652e636f6d0050"},
+	}
+	for _, tt := range tests {
+		if got := hex.EncodeToString(parseAddr(tt.addr)); got != tt.encoded {
+			t.Errorf("%v encoded as %v, want %v", tt.addr, got, tt.encoded)
+		}
+		b, _ := hex.DecodeString(tt.encoded)
+		addr, err := readAddr(bytes.NewReader(b))
+		if err != nil {
+			t.Errorf("%v: %v", tt.encoded, err)
+			continue
+		}
+		if addr.String() != tt.addr {
+			t.Errorf("%v decoded as %v, want %v", tt.encoded, addr, tt.addr)
+		}
+	}
+	if parseAddr("1.2.3.4") != nil {
+		t.Error("address without port encoded")
+	}
+	if _, err := readAddr(bytes.NewReader([]byte{3, 1, 2, 3, 4, 0, 53})); err == nil {
+		t.Error("no error reading an address of unknown family")
+	}
+}
+
+// fakeUDPConn passes the packets written to TUN to the test.
+type fakeUDPConn struct {
+	packets chan []byte
+	from    chan *net.UDPAddr
+}
+
+func (c *fakeUDPConn) LocalAddr() *net.UDPAddr {
+	return &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 12345}
+}
+
+func (c *fakeUDPConn) ReceiveTo(data []byte, addr *net.UDPAddr) error { return nil }
+
+func (c *fakeUDPConn) WriteFrom(data []byte, addr *net.UDPAddr) (int, error) {
+	c.packets <- append([]byte(nil), data...)
+	c.from <- addr
+	return len(data), nil
+}
+
+func (c *fakeUDPConn) Close() error { return nil }
+
+// serveRelay accepts a SOCKS5 connection to MagicRelay on l and echoes the
+// frames of its UoT stream, it sends the destination of the request to dests.
+func serveRelay(t *testing.T, l net.Listener, dests chan<- string) {
+	c, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer c.Close()
+
+	// VER NMETHODS METHODS, then VER CMD RSV and the target.
+	buf := make([]byte, 6)
+	if _, err := io.ReadFull(c, buf[:3]); err != nil {
+		t.Error(err)
+		return
+	}
+	c.Write([]byte{5, 0})
+	if _, err := io.ReadFull(c, buf[:3]); err != nil {
+		t.Error(err)
+		return
+	}
+	target, err := socks.ReadAddr(c)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if target.String() != MagicRelay {
+		t.Errorf("connected to %v, want %v", target, MagicRelay)
+	}
+	c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+
+	if _, err := io.ReadFull(c, buf[:1]); err != nil || buf[0] != 0 {
+		t.Errorf("request IsConnect %v, error %v", buf[0], err)
+		return
+	}
+	dest, err := readAddr(c)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	dests <- dest.String()
+
+	for {
+		addr, err := readAddr(c)
+		if err != nil {
+			return
+		}
+		if _, err := io.ReadFull(c, buf[:2]); err != nil {
+			return
+		}
+		data := make([]byte, binary.BigEndian.Uint16(buf))
+		if _, err := io.ReadFull(c, data); err != nil {
+			return
+		}
+		frame := append(parseAddr(addr.String()), buf[:2]...)
+		c.Write(append(frame, data...))
+	}
+}
+
+func TestUDP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	dests := make(chan string, 1)
+	go serveRelay(t, l, dests)
+
+	h := NewUDPHandler(l.Addr().String(), nil, MagicRelay, time.Second)
+	defer h.(*udpHandler).Shutdown()
+	conn := &fakeUDPConn{packets: make(chan []byte, 2), from: make(chan *net.UDPAddr, 2)}
+	target := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 53}
+	if err := h.Connect(conn, target); err != nil {
+		t.Fatal(err)
+	}
+	if dest := <-dests; dest != target.String() {
+		t.Errorf("requested destination %v, want %v", dest, target)
+	}
+
+	for _, addr := range []*net.UDPAddr{target, {IP: net.ParseIP("2001:db8::1"), Port: 443}} {
+		if err := h.ReceiveTo(conn, []byte("query"), addr); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case data := <-conn.packets:
+			if string(data) != "query" {
+				t.Errorf("unexpected reply %q", data)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("no reply")
+		}
+		if from := <-conn.from; !from.IP.Equal(addr.IP) || from.Port != addr.Port {
+			t.Errorf("reply from %v, want %v", from, addr)
+		}
+	}
+}
@@ -0,0 +1,14 @@
+package tun
+
+// BatchDevice is implemented by TUN devices moving several packets per call,
+// e.g. the Linux device opened with LinkOptions.Offload.
+type BatchDevice interface {
+	// ReadBatch reads at least one packet, and more if they are available
+	// without blocking, into bufs and sets the size of each in sizes. It
+	// returns the number of packets read.
+	ReadBatch(bufs [][]byte, sizes []int) (int, error)
+
+	// WriteBatch writes the packets pkts, it returns the number of packets
+	// written.
+	WriteBatch(pkts [][]byte) (int, error)
+}
@@ -0,0 +1,47 @@
+package tun
+
+import (
+	"net"
+	"strings"
+)
+
+// LinkOptions holds optional settings applied to the TUN interface after it
+// is created. Platforms that do not support a setting simply ignore it.
+type LinkOptions struct {
+	// MTU of the interface, zero keeps the system default.
+	MTU int
+
+	// Routes are destination networks routed through the interface, e.g.
+	// 0.0.0.0/0 for a default route or 0.0.0.0/1 and 128.0.0.0/1 for a
+	// split default route.
+	Routes []*net.IPNet
+
+	// IPv6Prefixes are additional IPv6 addresses (with prefix length)
+	// assigned to the interface.
+	IPv6Prefixes []*net.IPNet
+
+	// Offload moves packets with a virtio-net header so that TCP segments
+	// are read and written in super-packets of up to 64KB, the returned
+	// device implements BatchDevice. Linux only.
+	Offload bool
+}
+
+// ParseCIDRList parses a comma separated list of networks in CIDR notation.
+// The host part of each CIDR is kept, so "fd00::2/64" yields fd00::2 with a
+// /64 mask rather than fd00::/64.
+func ParseCIDRList(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		ip, ipNet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		ipNet.IP = ip
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
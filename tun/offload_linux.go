@@ -0,0 +1,485 @@
+package tun
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// vnetHdrLen is the length of struct virtio_net_hdr, prepended to each
+	// packet read from or written to a device opened with IFF_VNET_HDR.
+	vnetHdrLen = 10
+
+	// maxSuperPacket is the maximum length of an IP packet, TCP segments
+	// are coalesced up to it.
+	maxSuperPacket = 65535
+)
+
+// TCP flags checked when splitting and coalescing segments.
+const (
+	tcpFin = 0x01
+	tcpPsh = 0x08
+	tcpAck = 0x10
+	tcpCwr = 0x80
+)
+
+var errWouldBlock = errors.New("no packet available")
+
+// vnetHdr is struct virtio_net_hdr, in host byte order since the device
+// is not a virtio 1.0 device.
+type vnetHdr struct {
+	flags      uint8
+	gsoType    uint8
+	hdrLen     uint16
+	gsoSize    uint16
+	csumStart  uint16
+	csumOffset uint16
+}
+
+func (h *vnetHdr) decode(b []byte) {
+	h.flags = b[0]
+	h.gsoType = b[1]
+	h.hdrLen = binary.NativeEndian.Uint16(b[2:4])
+	h.gsoSize = binary.NativeEndian.Uint16(b[4:6])
+	h.csumStart = binary.NativeEndian.Uint16(b[6:8])
+	h.csumOffset = binary.NativeEndian.Uint16(b[8:10])
+}
+
+func (h *vnetHdr) encode(b []byte) {
+	b[0] = h.flags
+	b[1] = h.gsoType
+	binary.NativeEndian.PutUint16(b[2:4], h.hdrLen)
+	binary.NativeEndian.PutUint16(b[4:6], h.gsoSize)
+	binary.NativeEndian.PutUint16(b[6:8], h.csumStart)
+	binary.NativeEndian.PutUint16(b[8:10], h.csumOffset)
+}
+
+// vnetDevice is a TUN device opened with IFF_VNET_HDR and TCP segmentation
+// offload. The kernel passes TCP super-packets of up to 64KB, they are split
+// into MSS sized segments when read, and consecutive segments of a flow are
+// coalesced into super-packets when written.
+//
+// Transport checksums of the packets read are not verified nor completed,
+// packets sent by local sockets carry a partial checksum only. lwIP does not
+// check them.
+type vnetDevice struct {
+	f  *os.File
+	rc syscall.RawConn
+
+	rmu   sync.Mutex
+	rhdr  [vnetHdrLen]byte
+	spill []byte // Receives packets larger than the buffer read into.
+	sbuf  []byte // Holds the super-packet being split.
+	super tcpSegment
+	gso   int
+	next  int // Offset of the payload of the next segment in super.
+
+	wmu  sync.Mutex
+	whdr [vnetHdrLen]byte
+	wbuf []byte // Holds the super-packet being written.
+}
+
+// openVnetDevice creates or attaches to the TUN device name, the kernel
+// picks the name if it's empty. It returns the device and its name.
+func openVnetDevice(name string, persist bool) (*vnetDevice, string, error) {
+	fd, err := unix.Open("/dev/net/tun", unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		unix.Close(fd)
+		return nil, "", err
+	}
+	ifr.SetUint16(unix.IFF_TUN | unix.IFF_NO_PI | unix.IFF_VNET_HDR)
+	if err := unix.IoctlIfreq(fd, unix.TUNSETIFF, ifr); err != nil {
+		unix.Close(fd)
+		return nil, "", err
+	}
+	if persist {
+		if err := unix.IoctlSetInt(fd, unix.TUNSETPERSIST, 1); err != nil {
+			unix.Close(fd)
+			return nil, "", err
+		}
+	}
+	if err := unix.IoctlSetInt(fd, unix.TUNSETOFFLOAD, unix.TUN_F_CSUM|unix.TUN_F_TSO4|unix.TUN_F_TSO6); err != nil {
+		unix.Close(fd)
+		return nil, "", errors.New("failed to enable offload: " + err.Error())
+	}
+	// A non-blocking file is polled by the runtime, so that Close
+	// interrupts blocking reads.
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return nil, "", err
+	}
+
+	f := os.NewFile(uintptr(fd), "/dev/net/tun")
+	rc, err := f.SyscallConn()
+	if err != nil {
+		f.Close()
+		return nil, "", err
+	}
+	return &vnetDevice{
+		f:     f,
+		rc:    rc,
+		spill: make([]byte, maxSuperPacket),
+		sbuf:  make([]byte, maxSuperPacket),
+		wbuf:  make([]byte, maxSuperPacket),
+	}, ifr.Name(), nil
+}
+
+// Read reads a packet, see ReadBatch.
+func (d *vnetDevice) Read(p []byte) (int, error) {
+	var size [1]int
+	if _, err := d.ReadBatch([][]byte{p}, size[:]); err != nil {
+		return 0, err
+	}
+	return size[0], nil
+}
+
+// ReadBatch reads packets into bufs, each buffer must hold a packet of the
+// MTU of the device. Super-packets are split into several buffers, segments
+// left over are returned by the next call.
+func (d *vnetDevice) ReadBatch(bufs [][]byte, sizes []int) (int, error) {
+	d.rmu.Lock()
+	defer d.rmu.Unlock()
+
+	n := 0
+	for n < len(bufs) {
+		if d.super.pkt != nil {
+			k, err := d.split(bufs[n:], sizes[n:])
+			n += k
+			if err != nil || d.super.pkt != nil {
+				return n, err
+			}
+			continue
+		}
+		// Only block until the first packet is read.
+		size, err := d.read(bufs[n], n == 0)
+		if err == errWouldBlock {
+			break
+		} else if err != nil {
+			return n, err
+		}
+		if size > 0 {
+			sizes[n] = size
+			n++
+		}
+	}
+	return n, nil
+}
+
+// read reads a packet into buf and returns its size, or zero if it's a
+// super-packet to be split or it's dropped.
+func (d *vnetDevice) read(buf []byte, block bool) (int, error) {
+	var n int
+	var rerr error
+	err := d.rc.Read(func(fd uintptr) bool {
+		n, rerr = unix.Readv(int(fd), [][]byte{d.rhdr[:], buf, d.spill})
+		return !block || rerr != unix.EAGAIN
+	})
+	if err != nil {
+		return 0, err
+	}
+	if rerr == unix.EAGAIN {
+		return 0, errWouldBlock
+	} else if rerr != nil {
+		return 0, rerr
+	}
+	if n <= vnetHdrLen {
+		return 0, nil
+	}
+	n -= vnetHdrLen
+
+	var hdr vnetHdr
+	hdr.decode(d.rhdr[:])
+	switch hdr.gsoType &^ unix.VIRTIO_NET_HDR_GSO_ECN {
+	case unix.VIRTIO_NET_HDR_GSO_NONE:
+		if n > len(buf) {
+			// Larger than the MTU.
+			return 0, nil
+		}
+		return n, nil
+	case unix.VIRTIO_NET_HDR_GSO_TCPV4, unix.VIRTIO_NET_HDR_GSO_TCPV6:
+		pkt := d.sbuf[:n]
+		copy(pkt[copy(pkt, buf):], d.spill)
+		seg, ok := parseTCPSegment(pkt)
+		if !ok || hdr.gsoSize == 0 {
+			return 0, nil
+		}
+		d.super, d.gso, d.next = seg, int(hdr.gsoSize), seg.hdrLen()
+		return 0, nil
+	default:
+		return 0, nil
+	}
+}
+
+// split splits the super-packet into bufs and returns the number of
+// segments, the super-packet is reset once all its segments are split.
+func (d *vnetDevice) split(bufs [][]byte, sizes []int) (int, error) {
+	p, iphLen, hdrLen := d.super.pkt, d.super.iphLen, d.super.hdrLen()
+	k := 0
+	for ; k < len(bufs) && d.next < len(p); k++ {
+		end := d.next + d.gso
+		if end > len(p) {
+			end = len(p)
+		}
+		size := hdrLen + end - d.next
+		seg := bufs[k]
+		if len(seg) < size {
+			d.super.pkt = nil
+			return k, io.ErrShortBuffer
+		}
+		copy(seg, p[:hdrLen])
+		copy(seg[hdrLen:], p[d.next:end])
+
+		i := (d.next - hdrLen) / d.gso
+		if d.super.ipv4 {
+			binary.BigEndian.PutUint16(seg[2:4], uint16(size))
+			binary.BigEndian.PutUint16(seg[4:6], binary.BigEndian.Uint16(p[4:6])+uint16(i))
+			seg[10], seg[11] = 0, 0
+			binary.BigEndian.PutUint16(seg[10:12], ^fold(sum(0, seg[:iphLen])))
+		} else {
+			binary.BigEndian.PutUint16(seg[4:6], uint16(size-iphLen))
+		}
+		tcp := seg[iphLen:]
+		binary.BigEndian.PutUint32(tcp[4:8], binary.BigEndian.Uint32(tcp[4:8])+uint32(d.next-hdrLen))
+		if end < len(p) {
+			tcp[13] &^= tcpFin | tcpPsh
+		}
+		if i > 0 {
+			tcp[13] &^= tcpCwr
+		}
+
+		sizes[k] = size
+		d.next = end
+	}
+	if d.next >= len(p) {
+		d.super.pkt = nil
+	}
+	return k, nil
+}
+
+// Write writes a packet without offload.
+func (d *vnetDevice) Write(p []byte) (int, error) {
+	var hdr [vnetHdrLen]byte
+	if err := d.writev(hdr[:], p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// WriteBatch writes pkts, consecutive TCP segments of a flow are written in
+// a super-packet.
+func (d *vnetDevice) WriteBatch(pkts [][]byte) (int, error) {
+	d.wmu.Lock()
+	defer d.wmu.Unlock()
+
+	var zero [vnetHdrLen]byte
+	for i := 0; i < len(pkts); {
+		var err error
+		k := d.coalesce(pkts[i:])
+		if k > 1 {
+			err = d.writev(d.whdr[:], d.wbuf)
+		} else {
+			err = d.writev(zero[:], pkts[i])
+		}
+		if err != nil {
+			return i, err
+		}
+		i += k
+	}
+	return len(pkts), nil
+}
+
+func (d *vnetDevice) writev(hdr, pkt []byte) error {
+	var werr error
+	err := d.rc.Write(func(fd uintptr) bool {
+		_, werr = unix.Writev(int(fd), [][]byte{hdr, pkt})
+		return werr != unix.EAGAIN
+	})
+	if err != nil {
+		return err
+	}
+	return werr
+}
+
+// coalesce merges the leading segments of pkts into a super-packet in wbuf,
+// with its header in whdr, and returns the number of segments merged. The
+// segments must be of the same flow, in sequence and all but the last one
+// of the same size. Only the last one may have PSH set.
+func (d *vnetDevice) coalesce(pkts [][]byte) int {
+	first, ok := parseTCPSegment(pkts[0])
+	if !ok || first.flags() != tcpAck {
+		return 1
+	}
+	gso := len(first.payload())
+	if gso == 0 {
+		return 1
+	}
+
+	total, seq := len(first.pkt), first.seq()+uint32(gso)
+	k := 1
+	for ; k < len(pkts); k++ {
+		seg, ok := parseTCPSegment(pkts[k])
+		if !ok || !seg.sameFlow(&first) || seg.seq() != seq ||
+			seg.flags()&^tcpPsh != tcpAck {
+			break
+		}
+		size := len(seg.payload())
+		if size == 0 || size > gso || total+size > maxSuperPacket {
+			break
+		}
+		total += size
+		seq += uint32(size)
+		if size < gso || seg.flags()&tcpPsh != 0 {
+			k++
+			break
+		}
+	}
+	if k == 1 {
+		return 1
+	}
+
+	iphLen, hdrLen := first.iphLen, first.hdrLen()
+	p := append(d.wbuf[:0], first.pkt...)
+	for _, pkt := range pkts[1:k] {
+		seg, _ := parseTCPSegment(pkt)
+		p = append(p, seg.payload()...)
+		p[iphLen+13] |= seg.flags() & tcpPsh
+	}
+	d.wbuf = p
+
+	// The kernel completes the checksum from the pseudo-header checksum.
+	tcpLen := len(p) - iphLen
+	var psum uint32
+	if first.ipv4 {
+		binary.BigEndian.PutUint16(p[2:4], uint16(len(p)))
+		p[10], p[11] = 0, 0
+		binary.BigEndian.PutUint16(p[10:12], ^fold(sum(0, p[:iphLen])))
+		psum = sum(0, p[12:20])
+	} else {
+		binary.BigEndian.PutUint16(p[4:6], uint16(tcpLen))
+		psum = sum(0, p[8:40])
+	}
+	psum += unix.IPPROTO_TCP + uint32(tcpLen)
+	binary.BigEndian.PutUint16(p[iphLen+16:], fold(psum))
+
+	hdr := vnetHdr{
+		flags:      unix.VIRTIO_NET_HDR_F_NEEDS_CSUM,
+		gsoType:    unix.VIRTIO_NET_HDR_GSO_TCPV6,
+		hdrLen:     uint16(hdrLen),
+		gsoSize:    uint16(gso),
+		csumStart:  uint16(iphLen),
+		csumOffset: 16,
+	}
+	if first.ipv4 {
+		hdr.gsoType = unix.VIRTIO_NET_HDR_GSO_TCPV4
+	}
+	hdr.encode(d.whdr[:])
+	return k
+}
+
+func (d *vnetDevice) Close() error {
+	return d.f.Close()
+}
+
+// tcpSegment is a TCP segment in an IPv4 packet without options or in an
+// IPv6 packet without extension headers.
+type tcpSegment struct {
+	pkt     []byte
+	ipv4    bool
+	iphLen  int
+	tcphLen int
+}
+
+func parseTCPSegment(pkt []byte) (tcpSegment, bool) {
+	seg := tcpSegment{pkt: pkt}
+	switch {
+	case len(pkt) >= 20 && pkt[0] == 0x45:
+		if pkt[9] != unix.IPPROTO_TCP || binary.BigEndian.Uint16(pkt[6:8])&0x3fff != 0 ||
+			int(binary.BigEndian.Uint16(pkt[2:4])) != len(pkt) {
+			return seg, false
+		}
+		seg.ipv4, seg.iphLen = true, 20
+	case len(pkt) >= 40 && pkt[0]>>4 == 6:
+		if pkt[6] != unix.IPPROTO_TCP || int(binary.BigEndian.Uint16(pkt[4:6])) != len(pkt)-40 {
+			return seg, false
+		}
+		seg.iphLen = 40
+	default:
+		return seg, false
+	}
+	if len(pkt) < seg.iphLen+20 {
+		return seg, false
+	}
+	seg.tcphLen = int(pkt[seg.iphLen+12]>>4) * 4
+	if seg.tcphLen < 20 || len(pkt) < seg.hdrLen() {
+		return seg, false
+	}
+	return seg, true
+}
+
+func (s *tcpSegment) hdrLen() int {
+	return s.iphLen + s.tcphLen
+}
+
+func (s *tcpSegment) payload() []byte {
+	return s.pkt[s.hdrLen():]
+}
+
+func (s *tcpSegment) seq() uint32 {
+	return binary.BigEndian.Uint32(s.pkt[s.iphLen+4:])
+}
+
+func (s *tcpSegment) flags() byte {
+	return s.pkt[s.iphLen+13]
+}
+
+// sameFlow reports whether s can be coalesced with o, their headers differ
+// only in the fields fixed when coalescing or splitting.
+func (s *tcpSegment) sameFlow(o *tcpSegment) bool {
+	if s.ipv4 != o.ipv4 || s.tcphLen != o.tcphLen {
+		return false
+	}
+	a, b := s.pkt, o.pkt
+	if s.ipv4 {
+		// TOS, flags, TTL, protocol and addresses.
+		if a[1] != b[1] || a[6] != b[6] || a[8] != b[8] || string(a[12:20]) != string(b[12:20]) {
+			return false
+		}
+	} else {
+		// Traffic class, flow label, hop limit and addresses.
+		if string(a[0:4]) != string(b[0:4]) || a[7] != b[7] || string(a[8:40]) != string(b[8:40]) {
+			return false
+		}
+	}
+	ta, tb := a[s.iphLen:s.hdrLen()], b[o.iphLen:o.hdrLen()]
+	// Ports, ack, window and options.
+	return string(ta[0:4]) == string(tb[0:4]) && string(ta[8:12]) == string(tb[8:12]) &&
+		string(ta[14:16]) == string(tb[14:16]) && string(ta[20:]) == string(tb[20:])
+}
+
+// sum adds b to the one's complement sum initial, without folding it.
+func sum(initial uint32, b []byte) uint32 {
+	for ; len(b) >= 2; b = b[2:] {
+		initial += uint32(b[0])<<8 | uint32(b[1])
+	}
+	if len(b) == 1 {
+		initial += uint32(b[0]) << 8
+	}
+	return initial
+}
+
+func fold(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return uint16(sum)
+}
@@ -0,0 +1,82 @@
+package tun
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/eycorsican/go-tun2socks/tun/vtun"
+)
+
+// Segments coalesced into a super-packet are split back into the same
+// segments.
+func TestCoalesceSplit(t *testing.T) {
+	for _, tc := range []struct {
+		src, dst *net.TCPAddr
+		gsoType  uint8
+	}{
+		{&net.TCPAddr{IP: net.IP{1, 2, 3, 4}, Port: 80}, &net.TCPAddr{IP: net.IP{10, 0, 0, 1}, Port: 40000}, unix.VIRTIO_NET_HDR_GSO_TCPV4},
+		{&net.TCPAddr{IP: net.ParseIP("fd00::2"), Port: 80}, &net.TCPAddr{IP: net.ParseIP("fd00::1"), Port: 40000}, unix.VIRTIO_NET_HDR_GSO_TCPV6},
+	} {
+		var segs [][]byte
+		for i := 0; i < 10; i++ {
+			payload := bytes.Repeat([]byte{byte(i)}, 1000)
+			flags := byte(vtun.FlagAck)
+			if i == 9 {
+				payload, flags = payload[:500], vtun.FlagAck|vtun.FlagPsh
+			}
+			segs = append(segs, vtun.TCPPacket(tc.src, tc.dst, uint32(1000+i*1000), 1, flags, payload))
+		}
+		// Segments of other flows are not coalesced.
+		other := &net.TCPAddr{IP: tc.dst.IP, Port: tc.dst.Port + 1}
+		pkts := append(segs, vtun.TCPPacket(tc.src, other, 10500, 1, vtun.FlagAck, []byte("other")))
+
+		d := &vnetDevice{wbuf: make([]byte, maxSuperPacket)}
+		if k := d.coalesce(pkts); k != len(segs) {
+			t.Fatalf("coalesced %d segments, want %d", k, len(segs))
+		}
+		var hdr vnetHdr
+		hdr.decode(d.whdr[:])
+		if hdr.gsoType != tc.gsoType || hdr.gsoSize != 1000 || hdr.flags != unix.VIRTIO_NET_HDR_F_NEEDS_CSUM {
+			t.Fatalf("unexpected header %+v", hdr)
+		}
+		if k := d.coalesce(pkts[len(segs):]); k != 1 {
+			t.Fatalf("coalesced %d segments, want 1", k)
+		}
+
+		super, ok := parseTCPSegment(d.wbuf)
+		if !ok {
+			t.Fatal("invalid super-packet")
+		}
+		d.super, d.gso, d.next = super, int(hdr.gsoSize), super.hdrLen()
+		var split [][]byte
+		for d.super.pkt != nil {
+			bufs, sizes := [][]byte{make([]byte, 1500), make([]byte, 1500), make([]byte, 1500)}, make([]int, 3)
+			n, err := d.split(bufs, sizes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < n; i++ {
+				split = append(split, bufs[i][:sizes[i]])
+			}
+		}
+		if len(split) != len(segs) {
+			t.Fatalf("split %d segments, want %d", len(split), len(segs))
+		}
+		for i := range segs {
+			want, err := vtun.ParsePacket(segs[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := vtun.ParsePacket(split[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Seq != want.Seq || got.Flags != want.Flags || !bytes.Equal(got.Payload, want.Payload) {
+				t.Errorf("segment %d: got %v, want %v", i, got, want)
+			}
+		}
+	}
+}
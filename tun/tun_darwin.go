@@ -65,3 +65,9 @@ func OpenTunDevice(name, addr, gw, mask string, dnsServers []string, persist boo
 	}
 	return tunDev, nil
 }
+
+// OpenTunDeviceWithOptions is the same as OpenTunDevice, link options are
+// not supported on macOS yet and are ignored.
+func OpenTunDeviceWithOptions(name, addr, gw, mask string, dnsServers []string, persist bool, opts LinkOptions) (io.ReadWriteCloser, error) {
+	return OpenTunDevice(name, addr, gw, mask, dnsServers, persist)
+}
@@ -1,12 +1,30 @@
 package tun
 
 import (
+	"errors"
+	"fmt"
 	"io"
+	"net"
+	"strconv"
+	"sync"
 
 	"github.com/songgao/water"
+	"github.com/vishvananda/netlink"
 )
 
 func OpenTunDevice(name, addr, gw, mask string, dnsServers []string, persist bool) (io.ReadWriteCloser, error) {
+	return OpenTunDeviceWithOptions(name, addr, gw, mask, dnsServers, persist, LinkOptions{})
+}
+
+// OpenTunDeviceWithOptions creates the TUN device and configures it through
+// netlink: it assigns addr/mask (and any extra IPv6 prefixes), sets the MTU,
+// brings the link up and installs the requested routes via gw. Everything
+// added here is removed again when the returned device is closed.
+func OpenTunDeviceWithOptions(name, addr, gw, mask string, dnsServers []string, persist bool, opts LinkOptions) (io.ReadWriteCloser, error) {
+	if opts.Offload {
+		return openOffloadTunDevice(name, addr, gw, mask, persist, opts)
+	}
+
 	cfg := water.Config{
 		DeviceType: water.TUN,
 	}
@@ -17,5 +35,154 @@ func OpenTunDevice(name, addr, gw, mask string, dnsServers []string, persist boo
 		return nil, err
 	}
 	name = tunDev.Name()
-	return tunDev, nil
+
+	dev := &linuxTunDev{ReadWriteCloser: tunDev}
+	if err := dev.configure(name, addr, gw, mask, opts); err != nil {
+		dev.Close()
+		return nil, err
+	}
+	return dev, nil
+}
+
+func openOffloadTunDevice(name, addr, gw, mask string, persist bool, opts LinkOptions) (io.ReadWriteCloser, error) {
+	vnet, name, err := openVnetDevice(name, persist)
+	if err != nil {
+		return nil, err
+	}
+
+	dev := &linuxOffloadTunDev{linuxTunDev: &linuxTunDev{ReadWriteCloser: vnet}, vnet: vnet}
+	if err := dev.configure(name, addr, gw, mask, opts); err != nil {
+		dev.Close()
+		return nil, err
+	}
+	return dev, nil
+}
+
+// linuxTunDev wraps the water interface to undo the link configuration
+// on Close.
+type linuxTunDev struct {
+	io.ReadWriteCloser
+
+	link      netlink.Link
+	addrs     []*netlink.Addr
+	routes    []*netlink.Route
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// linuxOffloadTunDev is a linuxTunDev reading and writing packets in
+// batches with offload.
+type linuxOffloadTunDev struct {
+	*linuxTunDev
+	vnet *vnetDevice
+}
+
+func (dev *linuxOffloadTunDev) ReadBatch(bufs [][]byte, sizes []int) (int, error) {
+	return dev.vnet.ReadBatch(bufs, sizes)
+}
+
+func (dev *linuxOffloadTunDev) WriteBatch(pkts [][]byte) (int, error) {
+	return dev.vnet.WriteBatch(pkts)
+}
+
+func (dev *linuxTunDev) configure(name, addr, gw, mask string, opts LinkOptions) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to find link %v: %v", name, err)
+	}
+	dev.link = link
+
+	if opts.MTU > 0 {
+		if err := netlink.LinkSetMTU(link, opts.MTU); err != nil {
+			return fmt.Errorf("failed to set MTU %v: %v", opts.MTU, err)
+		}
+	}
+
+	var ipNets []*net.IPNet
+	if addr != "" {
+		ipNet, err := parseAddrMask(addr, mask)
+		if err != nil {
+			return err
+		}
+		ipNets = append(ipNets, ipNet)
+	}
+	ipNets = append(ipNets, opts.IPv6Prefixes...)
+	for _, ipNet := range ipNets {
+		a := &netlink.Addr{IPNet: ipNet}
+		if err := netlink.AddrAdd(link, a); err != nil {
+			return fmt.Errorf("failed to add address %v: %v", ipNet, err)
+		}
+		dev.addrs = append(dev.addrs, a)
+	}
+
+	if err := netlink.LinkSetUp(link); err != nil {
+		return fmt.Errorf("failed to bring up link %v: %v", name, err)
+	}
+
+	gwIP := net.ParseIP(gw)
+	for _, dst := range opts.Routes {
+		r := &netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Dst:       &net.IPNet{IP: dst.IP.Mask(dst.Mask), Mask: dst.Mask},
+		}
+		// Only IPv4 routes are sent via the gateway, IPv6 routes are
+		// on-link routes through the device.
+		if gwIP != nil && isIPv4(gwIP) && isIPv4(dst.IP) {
+			r.Gw = gwIP
+		}
+		if err := netlink.RouteAdd(r); err != nil {
+			return fmt.Errorf("failed to add route %v: %v", dst, err)
+		}
+		dev.routes = append(dev.routes, r)
+	}
+	return nil
+}
+
+func (dev *linuxTunDev) Close() error {
+	dev.closeOnce.Do(func() {
+		// Remove in reverse order, errors are ignored since the kernel
+		// may have already dropped routes along with the addresses.
+		for i := len(dev.routes) - 1; i >= 0; i-- {
+			netlink.RouteDel(dev.routes[i])
+		}
+		if dev.link != nil {
+			for i := len(dev.addrs) - 1; i >= 0; i-- {
+				netlink.AddrDel(dev.link, dev.addrs[i])
+			}
+			netlink.LinkSetDown(dev.link)
+		}
+		dev.closeErr = dev.ReadWriteCloser.Close()
+	})
+	return dev.closeErr
+}
+
+// parseAddrMask accepts a dotted netmask for IPv4 addresses and a prefix
+// length for IPv6 addresses, mirroring the -tunMask flag.
+func parseAddrMask(addr, mask string) (*net.IPNet, error) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, errors.New("invalid IP address")
+	}
+	if isIPv4(ip) {
+		m := net.ParseIP(mask)
+		if m == nil || m.To4() == nil {
+			return nil, fmt.Errorf("invalid IPv4 netmask: %v", mask)
+		}
+		return &net.IPNet{IP: ip.To4(), Mask: net.IPMask(m.To4())}, nil
+	} else if isIPv6(ip) {
+		prefixlen, err := strconv.Atoi(mask)
+		if err != nil || prefixlen < 0 || prefixlen > 128 {
+			return nil, fmt.Errorf("parse IPv6 prefixlen failed: %v", mask)
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(prefixlen, 128)}, nil
+	}
+	return nil, errors.New("invalid IP address")
+}
+
+func isIPv4(ip net.IP) bool {
+	return ip.To4() != nil
+}
+
+func isIPv6(ip net.IP) bool {
+	return ip.To4() == nil && ip.To16() != nil
 }
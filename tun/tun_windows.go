@@ -389,3 +389,9 @@ func (dev *winTapDev) Close() error {
 	sendStopMarker(dev.addr, dev.gw)
 	return windows.Close(dev.fd)
 }
+
+// OpenTunDeviceWithOptions is the same as OpenTunDevice, link options are
+// not supported on Windows yet and are ignored.
+func OpenTunDeviceWithOptions(name, addr, gw, mask string, dns []string, persist bool, opts LinkOptions) (io.ReadWriteCloser, error) {
+	return OpenTunDevice(name, addr, gw, mask, dns, persist)
+}
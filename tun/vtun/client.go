@@ -0,0 +1,520 @@
+package vtun
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// dialTimeout is the timeout of TCP handshakes.
+	dialTimeout = 5 * time.Second
+
+	// mss is the maximum size of TCP segments sent by the client.
+	mss = 1400
+
+	// rto is the retransmission timeout of TCP segments.
+	rto = 100 * time.Millisecond
+
+	// firstPort is the first local port of conns, ports are not reused.
+	firstPort = 40000
+)
+
+// ErrReset is returned by reads and writes on a TCP conn reset by the peer.
+var ErrReset = errors.New("connection reset by peer")
+
+// Client is a userspace TCP/UDP client sending and receiving packets
+// through a TUN device. Its TCP is minimal: unacknowledged segments are all
+// retransmitted after a fixed timeout, there is no congestion control and
+// out of order segments are dropped.
+type Client struct {
+	sync.Mutex
+
+	dev      io.ReadWriteCloser
+	ip       net.IP
+	nextPort int
+	tcpConns map[int]*TCPConn
+	udpConns map[int]*UDPConn
+}
+
+// NewClient creates a client with address ip on dev, it reads packets from
+// dev until dev is closed.
+func NewClient(dev io.ReadWriteCloser, ip net.IP) *Client {
+	c := &Client{
+		dev:      dev,
+		ip:       ip,
+		nextPort: firstPort,
+		tcpConns: make(map[int]*TCPConn, 8),
+		udpConns: make(map[int]*UDPConn, 8),
+	}
+	go c.readPackets()
+	return c
+}
+
+// Close closes the device of the client.
+func (c *Client) Close() error {
+	return c.dev.Close()
+}
+
+func (c *Client) readPackets() {
+	buf := make([]byte, 65535)
+	for {
+		n, err := c.dev.Read(buf)
+		if err != nil {
+			c.closeConns()
+			return
+		}
+		p, err := ParsePacket(append([]byte(nil), buf[:n]...))
+		if err != nil {
+			continue
+		}
+		c.Lock()
+		tcpConn, udpConn := c.tcpConns[p.DstPort], c.udpConns[p.DstPort]
+		c.Unlock()
+		switch {
+		case p.Proto == ProtoTCP && tcpConn != nil:
+			tcpConn.handle(p)
+		case p.Proto == ProtoUDP && udpConn != nil:
+			udpConn.handle(p)
+		}
+	}
+}
+
+// closeConns fails pending and future operations of all conns.
+func (c *Client) closeConns() {
+	c.Lock()
+	tcpConns, udpConns := c.tcpConns, c.udpConns
+	c.tcpConns = make(map[int]*TCPConn)
+	c.udpConns = make(map[int]*UDPConn)
+	c.Unlock()
+	for _, conn := range tcpConns {
+		conn.closeWithError(net.ErrClosed)
+	}
+	for _, conn := range udpConns {
+		conn.Close()
+	}
+}
+
+func (c *Client) allocPort() int {
+	c.Lock()
+	defer c.Unlock()
+	port := c.nextPort
+	c.nextPort++
+	return port
+}
+
+func (c *Client) send(pkt []byte) error {
+	_, err := c.dev.Write(pkt)
+	return err
+}
+
+// TCPConn is a TCP conn of a Client.
+type TCPConn struct {
+	client        *Client
+	local, remote *net.TCPAddr
+
+	mu          sync.Mutex
+	cond        *sync.Cond
+	established bool
+	sndNxt      uint32
+	sndUna      uint32
+	sndWnd      uint32
+	rcvNxt      uint32
+	unacked     []byte
+	buf         bytes.Buffer
+	finSent     bool
+	finReceived bool
+	err         error
+	deadline    time.Time
+	timer       *time.Timer
+	done        chan struct{}
+	once        sync.Once
+}
+
+// DialTCP connects to dst, which must be of the same IP version as the
+// address of the client.
+func (c *Client) DialTCP(dst *net.TCPAddr) (*TCPConn, error) {
+	conn := &TCPConn{
+		client: c,
+		local:  &net.TCPAddr{IP: c.ip, Port: c.allocPort()},
+		remote: dst,
+		sndNxt: rand.Uint32(),
+		done:   make(chan struct{}),
+	}
+	conn.cond = sync.NewCond(&conn.mu)
+	conn.sndUna = conn.sndNxt
+	c.Lock()
+	c.tcpConns[conn.local.Port] = conn
+	c.Unlock()
+
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	conn.mu.Lock()
+	err := conn.sendSegment(FlagSyn, nil)
+	conn.sndNxt++
+	go conn.retransmit(conn.sndUna)
+	for err == nil && !conn.established {
+		err = conn.wait()
+	}
+	conn.mu.Unlock()
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		conn.remove()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// sendSegment sends a segment at sndNxt acknowledging rcvNxt, conn.mu must
+// be held.
+func (conn *TCPConn) sendSegment(flags byte, payload []byte) error {
+	return conn.sendSegmentAt(conn.sndNxt, flags, payload)
+}
+
+func (conn *TCPConn) sendSegmentAt(seq uint32, flags byte, payload []byte) error {
+	ack := uint32(0)
+	if flags&FlagSyn == 0 {
+		flags |= FlagAck
+		ack = conn.rcvNxt
+	}
+	return conn.client.send(TCPPacket(conn.local, conn.remote, seq, ack, flags, payload))
+}
+
+// retransmit resends the SYN, or everything not acknowledged from sndUna,
+// when sndUna hasn't moved from last for rto, until the conn is removed.
+func (conn *TCPConn) retransmit(last uint32) {
+	ticker := time.NewTicker(rto)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-conn.done:
+			return
+		}
+		conn.mu.Lock()
+		if conn.sndUna != last || conn.sndUna == conn.sndNxt || conn.err != nil {
+			last = conn.sndUna
+			conn.mu.Unlock()
+			continue
+		}
+		if !conn.established {
+			conn.sendSegmentAt(conn.sndUna, FlagSyn, nil)
+			conn.mu.Unlock()
+			continue
+		}
+		seq, data := conn.sndUna, conn.unacked
+		for len(data) > 0 && seq-conn.sndUna < conn.sndWnd {
+			size := len(data)
+			if size > mss {
+				size = mss
+			}
+			conn.sendSegmentAt(seq, FlagPsh, data[:size])
+			seq += uint32(size)
+			data = data[size:]
+		}
+		if conn.finSent && seq+1 == conn.sndNxt {
+			conn.sendSegmentAt(seq, FlagFin, nil)
+		}
+		conn.mu.Unlock()
+	}
+}
+
+// wait waits for a segment or the deadline, conn.mu must be held.
+func (conn *TCPConn) wait() error {
+	if conn.err != nil {
+		return conn.err
+	}
+	if !conn.deadline.IsZero() && !time.Now().Before(conn.deadline) {
+		return os.ErrDeadlineExceeded
+	}
+	conn.cond.Wait()
+	return nil
+}
+
+func (conn *TCPConn) handle(p *Packet) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	defer conn.cond.Broadcast()
+
+	if p.Flags&FlagRst != 0 {
+		conn.err = ErrReset
+		conn.remove()
+		return
+	}
+	if !conn.established {
+		if p.Flags&(FlagSyn|FlagAck) == FlagSyn|FlagAck && p.Ack == conn.sndNxt {
+			conn.established = true
+			conn.rcvNxt = p.Seq + 1
+			conn.sndUna = p.Ack
+			conn.sndWnd = uint32(p.Window)
+			conn.sendSegment(0, nil)
+		}
+		return
+	}
+
+	if p.Flags&FlagAck != 0 && int32(p.Ack-conn.sndUna) > 0 && int32(conn.sndNxt-p.Ack) >= 0 {
+		acked := int(p.Ack - conn.sndUna)
+		if acked > len(conn.unacked) {
+			acked = len(conn.unacked)
+		}
+		conn.unacked = conn.unacked[acked:]
+		conn.sndUna = p.Ack
+	}
+	conn.sndWnd = uint32(p.Window)
+	if p.Seq != conn.rcvNxt {
+		if len(p.Payload) > 0 || p.Flags&FlagFin != 0 {
+			// Out of order or duplicate, acknowledge what we have.
+			conn.sendSegment(0, nil)
+		}
+		return
+	}
+	conn.buf.Write(p.Payload)
+	conn.rcvNxt += uint32(len(p.Payload))
+	if p.Flags&FlagFin != 0 && !conn.finReceived {
+		conn.finReceived = true
+		conn.rcvNxt++
+	}
+	if len(p.Payload) > 0 || p.Flags&FlagFin != 0 {
+		conn.sendSegment(0, nil)
+	}
+	if conn.finReceived && conn.finSent && conn.sndUna == conn.sndNxt {
+		conn.remove()
+	}
+}
+
+// remove stops dispatching segments to conn and retransmitting.
+func (conn *TCPConn) remove() {
+	conn.client.Lock()
+	if conn.client.tcpConns[conn.local.Port] == conn {
+		delete(conn.client.tcpConns, conn.local.Port)
+	}
+	conn.client.Unlock()
+	conn.once.Do(func() {
+		close(conn.done)
+	})
+}
+
+func (conn *TCPConn) closeWithError(err error) {
+	conn.mu.Lock()
+	if conn.err == nil {
+		conn.err = err
+	}
+	conn.mu.Unlock()
+	conn.cond.Broadcast()
+	conn.once.Do(func() {
+		close(conn.done)
+	})
+}
+
+// Read reads data sent by the peer, it returns io.EOF once the peer has
+// sent a FIN and ErrReset if it has sent a RST.
+func (conn *TCPConn) Read(b []byte) (int, error) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	for conn.buf.Len() == 0 {
+		if conn.finReceived {
+			return 0, io.EOF
+		}
+		if err := conn.wait(); err != nil {
+			return 0, err
+		}
+	}
+	return conn.buf.Read(b)
+}
+
+// Write sends b in segments of at most mss bytes, it blocks while the
+// window of the peer is full.
+func (conn *TCPConn) Write(b []byte) (int, error) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	n := 0
+	for n < len(b) {
+		if conn.err != nil {
+			return n, conn.err
+		}
+		if conn.finSent {
+			return n, io.ErrClosedPipe
+		}
+		inFlight := conn.sndNxt - conn.sndUna
+		if inFlight >= conn.sndWnd {
+			if err := conn.wait(); err != nil {
+				return n, err
+			}
+			continue
+		}
+		size := len(b) - n
+		if size > mss {
+			size = mss
+		}
+		if avail := int(conn.sndWnd - inFlight); size > avail {
+			size = avail
+		}
+		if err := conn.sendSegment(FlagPsh, b[n:n+size]); err != nil {
+			return n, err
+		}
+		conn.unacked = append(conn.unacked, b[n:n+size]...)
+		conn.sndNxt += uint32(size)
+		n += size
+	}
+	return n, nil
+}
+
+// CloseWrite sends a FIN.
+func (conn *TCPConn) CloseWrite() error {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.err != nil {
+		return conn.err
+	}
+	if conn.finSent {
+		return nil
+	}
+	conn.finSent = true
+	err := conn.sendSegment(FlagFin, nil)
+	conn.sndNxt++
+	return err
+}
+
+// Close sends a FIN if not sent yet, the conn keeps acknowledging data and
+// the FIN of the peer.
+func (conn *TCPConn) Close() error {
+	return conn.CloseWrite()
+}
+
+// Abort sends a RST and removes the conn.
+func (conn *TCPConn) Abort() error {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	defer conn.cond.Broadcast()
+	conn.remove()
+	if conn.err != nil {
+		return conn.err
+	}
+	conn.err = net.ErrClosed
+	return conn.sendSegment(FlagRst, nil)
+}
+
+func (conn *TCPConn) LocalAddr() net.Addr  { return conn.local }
+func (conn *TCPConn) RemoteAddr() net.Addr { return conn.remote }
+
+// SetDeadline sets the deadline of reads, writes and handshakes.
+func (conn *TCPConn) SetDeadline(t time.Time) error {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	conn.deadline = t
+	if conn.timer != nil {
+		conn.timer.Stop()
+		conn.timer = nil
+	}
+	if !t.IsZero() {
+		conn.timer = time.AfterFunc(time.Until(t), func() {
+			conn.mu.Lock()
+			conn.cond.Broadcast()
+			conn.mu.Unlock()
+		})
+	}
+	return nil
+}
+
+func (conn *TCPConn) SetReadDeadline(t time.Time) error  { return conn.SetDeadline(t) }
+func (conn *TCPConn) SetWriteDeadline(t time.Time) error { return conn.SetDeadline(t) }
+
+// UDPConn is a UDP conn of a Client.
+type UDPConn struct {
+	client        *Client
+	local, remote *net.UDPAddr
+	in            chan *Packet
+	done          chan struct{}
+	once          sync.Once
+
+	mu       sync.Mutex
+	deadline time.Time
+}
+
+// DialUDP creates a UDP conn sending to dst, which must be of the same IP
+// version as the address of the client.
+func (c *Client) DialUDP(dst *net.UDPAddr) (*UDPConn, error) {
+	conn := &UDPConn{
+		client: c,
+		local:  &net.UDPAddr{IP: c.ip, Port: c.allocPort()},
+		remote: dst,
+		in:     make(chan *Packet, queueSize),
+		done:   make(chan struct{}),
+	}
+	c.Lock()
+	c.udpConns[conn.local.Port] = conn
+	c.Unlock()
+	return conn, nil
+}
+
+func (conn *UDPConn) handle(p *Packet) {
+	select {
+	case conn.in <- p:
+	default:
+	}
+}
+
+// Write sends b in a datagram to the address the conn was dialed to.
+func (conn *UDPConn) Write(b []byte) (int, error) {
+	return conn.WriteTo(b, conn.remote)
+}
+
+// WriteTo sends b in a datagram to addr.
+func (conn *UDPConn) WriteTo(b []byte, addr *net.UDPAddr) (int, error) {
+	select {
+	case <-conn.done:
+		return 0, net.ErrClosed
+	default:
+	}
+	if err := conn.client.send(UDPPacket(conn.local, addr, b)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// ReadFrom reads a datagram from any address.
+func (conn *UDPConn) ReadFrom(b []byte) (int, *net.UDPAddr, error) {
+	conn.mu.Lock()
+	deadline := conn.deadline
+	conn.mu.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case p := <-conn.in:
+		return copy(b, p.Payload), &net.UDPAddr{IP: p.Src, Port: p.SrcPort}, nil
+	case <-conn.done:
+		return 0, nil, net.ErrClosed
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+func (conn *UDPConn) Close() error {
+	conn.once.Do(func() {
+		close(conn.done)
+		conn.client.Lock()
+		if conn.client.udpConns[conn.local.Port] == conn {
+			delete(conn.client.udpConns, conn.local.Port)
+		}
+		conn.client.Unlock()
+	})
+	return nil
+}
+
+func (conn *UDPConn) LocalAddr() *net.UDPAddr { return conn.local }
+
+// SetReadDeadline sets the deadline of reads.
+func (conn *UDPConn) SetReadDeadline(t time.Time) error {
+	conn.mu.Lock()
+	conn.deadline = t
+	conn.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,67 @@
+// Package vtun implements an in-memory TUN device and a userspace client
+// speaking TCP and UDP through it, so that the stack can be exercised end to
+// end without a real TUN device or privileges.
+package vtun
+
+import (
+	"io"
+	"sync"
+)
+
+// queueSize is the number of packets buffered in each direction.
+const queueSize = 1024
+
+// Device is one end of an in-memory TUN device, each Write sends a packet
+// to the other end and each Read returns a packet from it.
+type Device struct {
+	in   <-chan []byte
+	out  chan<- []byte
+	done chan struct{}
+	once *sync.Once
+}
+
+// Pipe creates the two ends of an in-memory TUN device, typically the end
+// read and written by the stack and the end of a Client. Closing either end
+// closes both.
+func Pipe() (*Device, *Device) {
+	a, b := make(chan []byte, queueSize), make(chan []byte, queueSize)
+	done := make(chan struct{})
+	once := new(sync.Once)
+	return &Device{in: a, out: b, done: done, once: once},
+		&Device{in: b, out: a, done: done, once: once}
+}
+
+// Read reads a packet, p should be large enough to hold it as the rest of
+// the packet is discarded otherwise.
+func (d *Device) Read(p []byte) (int, error) {
+	select {
+	case pkt := <-d.in:
+		return copy(p, pkt), nil
+	case <-d.done:
+		return 0, io.EOF
+	}
+}
+
+// Write writes a copy of the packet p, it blocks while the other end has
+// queueSize packets not read yet.
+func (d *Device) Write(p []byte) (int, error) {
+	pkt := append([]byte(nil), p...)
+	select {
+	case <-d.done:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	select {
+	case d.out <- pkt:
+		return len(p), nil
+	case <-d.done:
+		return 0, io.ErrClosedPipe
+	}
+}
+
+func (d *Device) Close() error {
+	d.once.Do(func() {
+		close(d.done)
+	})
+	return nil
+}
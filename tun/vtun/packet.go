@@ -0,0 +1,204 @@
+package vtun
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// IP protocol numbers.
+const (
+	ProtoTCP = 6
+	ProtoUDP = 17
+)
+
+// TCP flags.
+const (
+	FlagFin = 0x01
+	FlagSyn = 0x02
+	FlagRst = 0x04
+	FlagPsh = 0x08
+	FlagAck = 0x10
+)
+
+const (
+	ipv4HeaderLen = 20
+	ipv6HeaderLen = 40
+	tcpHeaderLen  = 20
+	udpHeaderLen  = 8
+)
+
+// Packet is a parsed TCP or UDP packet.
+type Packet struct {
+	Src, Dst         net.IP
+	Proto            int
+	SrcPort, DstPort int
+
+	// TCP fields.
+	Seq, Ack uint32
+	Flags    byte
+	Window   uint16
+
+	Payload []byte
+}
+
+func (p *Packet) String() string {
+	src := net.JoinHostPort(p.Src.String(), fmt.Sprint(p.SrcPort))
+	dst := net.JoinHostPort(p.Dst.String(), fmt.Sprint(p.DstPort))
+	if p.Proto == ProtoUDP {
+		return fmt.Sprintf("udp %v > %v len %d", src, dst, len(p.Payload))
+	}
+	return fmt.Sprintf("tcp %v > %v flags %#x seq %d ack %d len %d", src, dst, p.Flags, p.Seq, p.Ack, len(p.Payload))
+}
+
+// TCPPacket builds a TCP segment from src to dst with a full window, src
+// and dst must be of the same IP version.
+func TCPPacket(src, dst *net.TCPAddr, seq, ack uint32, flags byte, payload []byte) []byte {
+	tcp := make([]byte, tcpHeaderLen+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:2], uint16(src.Port))
+	binary.BigEndian.PutUint16(tcp[2:4], uint16(dst.Port))
+	binary.BigEndian.PutUint32(tcp[4:8], seq)
+	binary.BigEndian.PutUint32(tcp[8:12], ack)
+	tcp[12] = (tcpHeaderLen / 4) << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:16], 65535)
+	copy(tcp[tcpHeaderLen:], payload)
+	return ipPacket(src.IP, dst.IP, ProtoTCP, tcp, 16)
+}
+
+// UDPPacket builds a UDP datagram from src to dst, src and dst must be of
+// the same IP version.
+func UDPPacket(src, dst *net.UDPAddr, payload []byte) []byte {
+	udp := make([]byte, udpHeaderLen+len(payload))
+	binary.BigEndian.PutUint16(udp[0:2], uint16(src.Port))
+	binary.BigEndian.PutUint16(udp[2:4], uint16(dst.Port))
+	binary.BigEndian.PutUint16(udp[4:6], uint16(len(udp)))
+	copy(udp[udpHeaderLen:], payload)
+	return ipPacket(src.IP, dst.IP, ProtoUDP, udp, 6)
+}
+
+// ipPacket prepends the IP header to the transport segment and fills the
+// transport checksum at offset csum.
+func ipPacket(src, dst net.IP, proto byte, segment []byte, csum int) []byte {
+	var pkt, pseudo []byte
+	if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+		pkt = make([]byte, ipv4HeaderLen, ipv4HeaderLen+len(segment))
+		pkt[0] = 0x45
+		binary.BigEndian.PutUint16(pkt[2:4], uint16(ipv4HeaderLen+len(segment)))
+		pkt[8] = 64
+		pkt[9] = proto
+		copy(pkt[12:16], src4)
+		copy(pkt[16:20], dst4)
+		binary.BigEndian.PutUint16(pkt[10:12], checksum(0, pkt))
+
+		pseudo = append(append([]byte{}, src4...), dst4...)
+		pseudo = append(pseudo, 0, proto)
+		pseudo = binary.BigEndian.AppendUint16(pseudo, uint16(len(segment)))
+	} else {
+		pkt = make([]byte, ipv6HeaderLen, ipv6HeaderLen+len(segment))
+		pkt[0] = 0x60
+		binary.BigEndian.PutUint16(pkt[4:6], uint16(len(segment)))
+		pkt[6] = proto
+		pkt[7] = 64
+		copy(pkt[8:24], src.To16())
+		copy(pkt[24:40], dst.To16())
+
+		pseudo = append(append([]byte{}, src.To16()...), dst.To16()...)
+		pseudo = binary.BigEndian.AppendUint32(pseudo, uint32(len(segment)))
+		pseudo = append(pseudo, 0, 0, 0, proto)
+	}
+
+	sum := checksum(checksum(0, pseudo)^0xffff, segment)
+	if sum == 0 && proto == ProtoUDP {
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(segment[csum:], sum)
+	return append(pkt, segment...)
+}
+
+// checksum returns the Internet checksum (RFC 1071) of b continuing the
+// one's complement sum initial.
+func checksum(initial uint16, b []byte) uint16 {
+	sum := uint32(initial)
+	for ; len(b) >= 2; b = b[2:] {
+		sum += uint32(b[0])<<8 | uint32(b[1])
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// ParsePacket parses a TCP or UDP packet over IPv4 or IPv6, IPv6 extension
+// headers and IPv4 fragments are not supported.
+func ParsePacket(pkt []byte) (*Packet, error) {
+	if len(pkt) < 1 {
+		return nil, errors.New("empty packet")
+	}
+	p := &Packet{}
+	var segment []byte
+	switch pkt[0] >> 4 {
+	case 4:
+		if len(pkt) < ipv4HeaderLen {
+			return nil, errors.New("short IPv4 header")
+		}
+		headerLen := int(pkt[0]&0xf) * 4
+		totalLen := int(binary.BigEndian.Uint16(pkt[2:4]))
+		if headerLen < ipv4HeaderLen || totalLen < headerLen || totalLen > len(pkt) {
+			return nil, errors.New("invalid IPv4 header")
+		}
+		if binary.BigEndian.Uint16(pkt[6:8])&0x3fff != 0 {
+			return nil, errors.New("IPv4 fragment")
+		}
+		p.Proto = int(pkt[9])
+		p.Src, p.Dst = net.IP(pkt[12:16]), net.IP(pkt[16:20])
+		segment = pkt[headerLen:totalLen]
+	case 6:
+		if len(pkt) < ipv6HeaderLen {
+			return nil, errors.New("short IPv6 header")
+		}
+		payloadLen := int(binary.BigEndian.Uint16(pkt[4:6]))
+		if ipv6HeaderLen+payloadLen > len(pkt) {
+			return nil, errors.New("invalid IPv6 header")
+		}
+		p.Proto = int(pkt[6])
+		p.Src, p.Dst = net.IP(pkt[8:24]), net.IP(pkt[24:40])
+		segment = pkt[ipv6HeaderLen : ipv6HeaderLen+payloadLen]
+	default:
+		return nil, fmt.Errorf("unknown IP version %d", pkt[0]>>4)
+	}
+
+	switch p.Proto {
+	case ProtoTCP:
+		if len(segment) < tcpHeaderLen {
+			return nil, errors.New("short TCP header")
+		}
+		headerLen := int(segment[12]>>4) * 4
+		if headerLen < tcpHeaderLen || headerLen > len(segment) {
+			return nil, errors.New("invalid TCP header")
+		}
+		p.Seq = binary.BigEndian.Uint32(segment[4:8])
+		p.Ack = binary.BigEndian.Uint32(segment[8:12])
+		p.Flags = segment[13]
+		p.Window = binary.BigEndian.Uint16(segment[14:16])
+		p.Payload = segment[headerLen:]
+	case ProtoUDP:
+		if len(segment) < udpHeaderLen {
+			return nil, errors.New("short UDP header")
+		}
+		length := int(binary.BigEndian.Uint16(segment[4:6]))
+		if length < udpHeaderLen || length > len(segment) {
+			return nil, errors.New("invalid UDP header")
+		}
+		p.Payload = segment[udpHeaderLen:length]
+	default:
+		return nil, fmt.Errorf("unsupported protocol %d", p.Proto)
+	}
+	p.SrcPort = int(binary.BigEndian.Uint16(segment[0:2]))
+	p.DstPort = int(binary.BigEndian.Uint16(segment[2:4]))
+	return p, nil
+}